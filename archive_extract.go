@@ -0,0 +1,547 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// 解压状态 - 显示在任务状态中
+type ExtractStatus struct {
+	Status    string  `json:"status"`
+	Progress  float64 `json:"progress"`
+	Current   string  `json:"current"`
+	Extracted int64   `json:"extracted"`
+	Total     int64   `json:"total"`
+	Archives  int     `json:"archives"`
+	Failed    int     `json:"failed"`
+}
+
+// 待解压的压缩包，分卷zip包含多个分卷文件
+type archiveJob struct {
+	Kind  string   // zip, tar, tar.gz
+	Parts []string // 按顺序排列的文件路径，解压前转换为完整路径
+}
+
+// 分卷zip: name.zip.001, name.zip.002 ...
+var splitZipPattern = regexp.MustCompile(`(?i)^(.+\.zip)\.(\d{3})$`)
+
+// 标准分卷zip: name.z01, name.z02 ... name.zip（最后一卷）
+var spannedZipPattern = regexp.MustCompile(`(?i)^(.+)\.z(\d{2,})$`)
+
+// 复制解压状态，避免调用方在锁外读取正在更新的结构
+func (es *ExtractStatus) clone() *ExtractStatus {
+	if es == nil {
+		return nil
+	}
+	copied := *es
+	return &copied
+}
+
+// 从torrent文件列表中找出压缩包
+func findArchives(paths []string) []archiveJob {
+	var jobs []archiveJob
+	splitParts := make(map[string][]string)
+
+	// 先收集.z01等分卷，同名的.zip作为最后一卷
+	spanned := make(map[string][]string)
+	for _, p := range paths {
+		if m := spannedZipPattern.FindStringSubmatch(p); m != nil {
+			base := strings.ToLower(m[1])
+			spanned[base] = append(spanned[base], p)
+		}
+	}
+	spannedLast := make(map[string]string)
+	for _, p := range paths {
+		lower := strings.ToLower(p)
+		if strings.HasSuffix(lower, ".zip") {
+			if _, ok := spanned[lower[:len(lower)-len(".zip")]]; ok {
+				spannedLast[lower[:len(lower)-len(".zip")]] = p
+			}
+		}
+	}
+
+	for _, p := range paths {
+		lower := strings.ToLower(p)
+		switch {
+		case spannedZipPattern.MatchString(p),
+			strings.HasSuffix(lower, ".zip") && spannedLast[lower[:len(lower)-len(".zip")]] != "":
+			// .z01分卷及其最后一卷在下方统一处理
+		case splitZipPattern.MatchString(p):
+			base := splitZipPattern.FindStringSubmatch(p)[1]
+			splitParts[base] = append(splitParts[base], p)
+		case strings.HasSuffix(lower, ".zip"):
+			jobs = append(jobs, archiveJob{Kind: "zip", Parts: []string{p}})
+		case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+			jobs = append(jobs, archiveJob{Kind: "tar.gz", Parts: []string{p}})
+		case strings.HasSuffix(lower, ".tar"):
+			jobs = append(jobs, archiveJob{Kind: "tar", Parts: []string{p}})
+		}
+	}
+
+	bases := make([]string, 0, len(splitParts))
+	for base := range splitParts {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+
+	for _, base := range bases {
+		parts := splitParts[base]
+		sort.Strings(parts) // .001 .002 ... 按字典序即为分卷顺序
+		jobs = append(jobs, archiveJob{Kind: "zip", Parts: parts})
+	}
+
+	// 缺少最后一卷.zip时无法读取中央目录，跳过
+	spannedBases := make([]string, 0, len(spannedLast))
+	for base := range spannedLast {
+		spannedBases = append(spannedBases, base)
+	}
+	sort.Strings(spannedBases)
+
+	for _, base := range spannedBases {
+		parts := spanned[base]
+		sort.Slice(parts, func(i, j int) bool {
+			return spannedZipIndex(parts[i]) < spannedZipIndex(parts[j])
+		})
+		jobs = append(jobs, archiveJob{Kind: "zip", Parts: append(parts, spannedLast[base])})
+	}
+
+	return jobs
+}
+
+// .z01 -> 1，.z100 -> 100
+func spannedZipIndex(path string) int {
+	m := spannedZipPattern.FindStringSubmatch(path)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[2])
+	return n
+}
+
+// 解压目录：压缩包旁边的同名文件夹
+func extractTargetDir(archivePath string) string {
+	name := filepath.Base(archivePath)
+	if m := splitZipPattern.FindStringSubmatch(name); m != nil {
+		name = m[1]
+	} else if m := spannedZipPattern.FindStringSubmatch(name); m != nil {
+		name = m[1]
+	}
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			name = name[:len(name)-len(ext)]
+			break
+		}
+	}
+	return filepath.Join(filepath.Dir(archivePath), name)
+}
+
+// 下载完成后的解压处理，原始压缩包保留用于做种
+func (sts *SimpleTorrentService) extractArchives(t *torrent.Torrent, hash string) {
+	var paths []string
+	for _, file := range t.Files() {
+		paths = append(paths, file.Path())
+	}
+
+	jobs := findArchives(paths)
+	if len(jobs) == 0 {
+		return
+	}
+
+	dataDir := sts.torrentDataDir(hash)
+	for _, job := range jobs {
+		for i, part := range job.Parts {
+			job.Parts[i] = filepath.Join(dataDir, part)
+		}
+	}
+
+	progress := &extractProgress{sts: sts, hash: hash}
+	progress.init(len(jobs))
+
+	// 先计算解压总大小用于显示进度
+	for _, job := range jobs {
+		progress.addTotal(sts.archiveSize(job))
+	}
+
+	sts.addEvent(hash, "extract", fmt.Sprintf("开始解压 %d 个压缩包", len(jobs)))
+
+	for _, job := range jobs {
+		name := filepath.Base(job.Parts[0])
+		progress.setCurrent(name)
+
+		if err := sts.extractArchive(job, progress); err != nil {
+			log.Printf("解压失败: %s, 错误: %v", name, err)
+			progress.fail()
+			sts.addEvent(hash, "extract_failed", fmt.Sprintf("解压失败: %s: %v", name, err))
+			continue
+		}
+
+		log.Printf("解压完成: %s", name)
+		sts.addEvent(hash, "extracted", fmt.Sprintf("解压完成: %s", name))
+	}
+
+	progress.finish()
+}
+
+// 计算压缩包解压后的大小
+func (sts *SimpleTorrentService) archiveSize(job archiveJob) int64 {
+	if job.Kind != "zip" {
+		// tar需要完整读取才能得知大小，使用压缩包大小估算
+		if info, err := os.Stat(job.Parts[0]); err == nil {
+			return info.Size()
+		}
+		return 0
+	}
+
+	reader, closer, err := sts.openZip(job)
+	if err != nil {
+		return 0
+	}
+	defer closer()
+
+	var total int64
+	for _, f := range reader.File {
+		total += int64(f.UncompressedSize64)
+	}
+	return total
+}
+
+func (sts *SimpleTorrentService) extractArchive(job archiveJob, progress *extractProgress) error {
+	target := extractTargetDir(job.Parts[0])
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("创建解压目录失败: %v", err)
+	}
+
+	switch job.Kind {
+	case "zip":
+		return sts.extractZip(job, target, progress)
+	case "tar", "tar.gz":
+		return sts.extractTar(job, target, progress)
+	default:
+		return fmt.Errorf("不支持的压缩格式: %s", job.Kind)
+	}
+}
+
+// 打开zip，分卷zip按顺序拼接后读取
+func (sts *SimpleTorrentService) openZip(job archiveJob) (*zip.Reader, func(), error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	var readers []io.ReaderAt
+	var sizes []int64
+	for _, part := range job.Parts {
+		f, err := os.Open(part)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		files = append(files, f)
+
+		info, err := f.Stat()
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		readers = append(readers, f)
+		sizes = append(sizes, info.Size())
+	}
+
+	multi := newMultiReaderAt(readers, sizes)
+	reader, err := zip.NewReader(multi, multi.Size())
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return reader, closeAll, nil
+}
+
+func (sts *SimpleTorrentService) extractZip(job archiveJob, target string, progress *extractProgress) error {
+	reader, closer, err := sts.openZip(job)
+	if err != nil {
+		return fmt.Errorf("打开zip失败: %v", err)
+	}
+	defer closer()
+
+	for _, f := range reader.File {
+		dst, err := safeExtractPath(target, f.Name)
+		if err != nil {
+			return err
+		}
+
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("读取 %s 失败: %v", f.Name, err)
+		}
+		err = writeExtractedFile(dst, rc, progress)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sts *SimpleTorrentService) extractTar(job archiveJob, target string, progress *extractProgress) error {
+	file, err := os.Open(job.Parts[0])
+	if err != nil {
+		return fmt.Errorf("打开tar失败: %v", err)
+	}
+	defer file.Close()
+
+	// 按读取的压缩包字节计算进度，tar.gz解压后大小未知
+	counter := &countingReader{r: file, progress: progress}
+	var r io.Reader = counter
+	if job.Kind == "tar.gz" {
+		gz, err := gzip.NewReader(counter)
+		if err != nil {
+			return fmt.Errorf("打开gzip失败: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("读取tar失败: %v", err)
+		}
+
+		dst, err := safeExtractPath(target, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeExtractedFile(dst, tr, nil); err != nil {
+				return err
+			}
+		default:
+			// 跳过链接等特殊文件
+			log.Printf("跳过特殊文件: %s", header.Name)
+		}
+	}
+}
+
+// 防止压缩包内的路径逃逸出解压目录
+func safeExtractPath(target, name string) (string, error) {
+	dst := filepath.Join(target, name)
+	if dst != target && !strings.HasPrefix(dst, target+string(os.PathSeparator)) {
+		return "", fmt.Errorf("非法的压缩包路径: %s", name)
+	}
+	return dst, nil
+}
+
+func writeExtractedFile(dst string, r io.Reader, progress *extractProgress) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("创建文件失败: %v", err)
+	}
+	defer out.Close()
+
+	var w io.Writer = out
+	if progress != nil {
+		w = io.MultiWriter(out, progress)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("写入 %s 失败: %v", dst, err)
+	}
+	return nil
+}
+
+// 解压进度写入任务状态的间隔，避免每个写入块都获取全局锁
+const (
+	extractProgressInterval = time.Second
+	extractProgressBytes    = 1 << 20
+)
+
+// 解压进度，写入任务状态
+type extractProgress struct {
+	sts  *SimpleTorrentService
+	hash string
+	mu   sync.Mutex
+	done int64
+
+	reported     int64
+	reportedTime time.Time
+}
+
+func (p *extractProgress) update(fn func(es *ExtractStatus)) {
+	p.sts.mutex.Lock()
+	defer p.sts.mutex.Unlock()
+	if status, exists := p.sts.torrents[p.hash]; exists && status.Extract != nil {
+		fn(status.Extract)
+	}
+}
+
+func (p *extractProgress) init(archives int) {
+	p.sts.mutex.Lock()
+	defer p.sts.mutex.Unlock()
+	if status, exists := p.sts.torrents[p.hash]; exists {
+		status.Extract = &ExtractStatus{Status: "解压中", Archives: archives}
+	}
+}
+
+func (p *extractProgress) addTotal(n int64) {
+	p.update(func(es *ExtractStatus) { es.Total += n })
+}
+
+func (p *extractProgress) setCurrent(name string) {
+	p.update(func(es *ExtractStatus) { es.Current = name })
+}
+
+func (p *extractProgress) fail() {
+	p.update(func(es *ExtractStatus) { es.Failed++ })
+}
+
+func (p *extractProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	p.done += int64(len(b))
+	done := p.done
+	if done-p.reported < extractProgressBytes && time.Since(p.reportedTime) < extractProgressInterval {
+		p.mu.Unlock()
+		return len(b), nil
+	}
+	p.reported = done
+	p.reportedTime = time.Now()
+	p.mu.Unlock()
+
+	p.report(done)
+	return len(b), nil
+}
+
+func (p *extractProgress) report(done int64) {
+	p.update(func(es *ExtractStatus) {
+		es.Extracted = done
+		if es.Total > 0 {
+			es.Progress = float64(done) / float64(es.Total) * 100
+			if es.Progress > 100 {
+				es.Progress = 100
+			}
+		}
+	})
+}
+
+func (p *extractProgress) finish() {
+	// 写入最后一次节流期间未报告的进度
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+	p.report(done)
+
+	p.update(func(es *ExtractStatus) {
+		es.Current = ""
+		if es.Failed > 0 {
+			es.Status = "解压失败"
+		} else {
+			es.Status = "解压完成"
+			es.Progress = 100
+		}
+	})
+}
+
+// 统计读取的字节数用于tar进度
+type countingReader struct {
+	r        io.Reader
+	progress *extractProgress
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.progress.Write(b[:n])
+	}
+	return n, err
+}
+
+// 将多个分卷拼接为一个连续的ReaderAt
+type multiReaderAt struct {
+	readers []io.ReaderAt
+	sizes   []int64
+	total   int64
+}
+
+func newMultiReaderAt(readers []io.ReaderAt, sizes []int64) *multiReaderAt {
+	m := &multiReaderAt{readers: readers, sizes: sizes}
+	for _, s := range sizes {
+		m.total += s
+	}
+	return m
+}
+
+func (m *multiReaderAt) Size() int64 {
+	return m.total
+}
+
+func (m *multiReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= m.total {
+		return 0, io.EOF
+	}
+
+	read := 0
+	for i, r := range m.readers {
+		if off >= m.sizes[i] {
+			off -= m.sizes[i]
+			continue
+		}
+		for read < len(p) && off < m.sizes[i] {
+			want := p[read:]
+			if int64(len(want)) > m.sizes[i]-off {
+				want = want[:m.sizes[i]-off]
+			}
+			n, err := r.ReadAt(want, off)
+			read += n
+			off += int64(n)
+			if err != nil && err != io.EOF {
+				return read, err
+			}
+			if n == 0 {
+				return read, io.ErrUnexpectedEOF
+			}
+		}
+		if read == len(p) {
+			return read, nil
+		}
+		off = 0
+	}
+
+	return read, io.EOF
+}
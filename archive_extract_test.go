@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindArchives(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		want  []archiveJob
+	}{
+		{"单个zip", []string{"a/x.zip", "a/readme.txt"}, []archiveJob{{Kind: "zip", Parts: []string{"a/x.zip"}}}},
+		{"tar和tgz", []string{"b.tar", "c.tgz", "d.tar.gz"}, []archiveJob{
+			{Kind: "tar", Parts: []string{"b.tar"}},
+			{Kind: "tar.gz", Parts: []string{"c.tgz"}},
+			{Kind: "tar.gz", Parts: []string{"d.tar.gz"}},
+		}},
+		{"zip.001分卷", []string{"v.zip.002", "v.zip.001"}, []archiveJob{{Kind: "zip", Parts: []string{"v.zip.001", "v.zip.002"}}}},
+		{"z01分卷以zip结尾", []string{"s.zip", "s.z10", "s.z02", "s.z01", "other.zip"}, []archiveJob{
+			{Kind: "zip", Parts: []string{"other.zip"}},
+			{Kind: "zip", Parts: []string{"s.z01", "s.z02", "s.z10", "s.zip"}},
+		}},
+		{"z01分卷缺少最后一卷", []string{"m.z01", "m.z02"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findArchives(tt.paths); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("findArchives() = %+v, 期望 %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractTargetDir(t *testing.T) {
+	for path, want := range map[string]string{
+		"d/movie.zip":     "d/movie",
+		"d/movie.zip.001": "d/movie",
+		"d/movie.z01":     "d/movie",
+		"d/movie.tar.gz":  "d/movie",
+	} {
+		if got := extractTargetDir(filepath.FromSlash(path)); got != filepath.FromSlash(want) {
+			t.Errorf("extractTargetDir(%q) = %q, 期望 %q", path, got, want)
+		}
+	}
+}
+
+// z01分卷按顺序拼接后即为完整的zip
+func TestExtractSpannedZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	content := bytes.Repeat([]byte("spanned zip content "), 5000)
+	w, _ := zw.Create("inner/data.txt")
+	w.Write(content)
+	zw.Close()
+
+	dir := t.TempDir()
+	data := buf.Bytes()
+	third := len(data) / 3
+	parts := map[string][]byte{"s.z01": data[:third], "s.z02": data[third : 2*third], "s.zip": data[2*third:]}
+	var paths []string
+	for name, part := range parts {
+		os.WriteFile(filepath.Join(dir, name), part, 0644)
+		paths = append(paths, name)
+	}
+
+	jobs := findArchives(paths)
+	if len(jobs) != 1 {
+		t.Fatalf("期望一个压缩包，实际 %+v", jobs)
+	}
+	for i, part := range jobs[0].Parts {
+		jobs[0].Parts[i] = filepath.Join(dir, part)
+	}
+
+	sts := &SimpleTorrentService{torrents: map[string]*TorrentStatus{"h": {}}}
+	progress := &extractProgress{sts: sts, hash: "h"}
+	progress.init(1)
+	if err := sts.extractArchive(jobs[0], progress); err != nil {
+		t.Fatalf("解压失败: %v", err)
+	}
+	progress.finish()
+
+	got, err := os.ReadFile(filepath.Join(dir, "s", "inner", "data.txt"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("解压内容错误: %v", err)
+	}
+	if es := sts.torrents["h"].Extract; es.Status != "解压完成" || es.Extracted != int64(len(content)) {
+		t.Fatalf("解压状态错误: %+v", es)
+	}
+}
+
+// 小块写入不逐块更新任务状态，结束时补写最终进度
+func TestExtractProgressThrottled(t *testing.T) {
+	sts := &SimpleTorrentService{torrents: map[string]*TorrentStatus{"h": {}}}
+	progress := &extractProgress{sts: sts, hash: "h"}
+	progress.init(1)
+	progress.addTotal(4 << 20)
+
+	chunk := make([]byte, 32<<10)
+	updates := 0
+	last := int64(0)
+	for i := 0; i < 128; i++ {
+		io.Copy(progress, bytes.NewReader(chunk))
+		if extracted := sts.torrents["h"].Extract.Extracted; extracted != last {
+			updates++
+			last = extracted
+		}
+	}
+	if updates == 0 || updates > 8 {
+		t.Fatalf("状态更新次数 %d，期望按每MB节流", updates)
+	}
+
+	progress.finish()
+	if es := sts.torrents["h"].Extract; es.Extracted != 4<<20 || es.Progress != 100 {
+		t.Fatalf("最终进度错误: %+v", es)
+	}
+}
+
+func TestExtractStatusClone(t *testing.T) {
+	var nilStatus *ExtractStatus
+	if nilStatus.clone() != nil {
+		t.Fatal("nil应返回nil")
+	}
+	es := &ExtractStatus{Status: "解压中", Extracted: 10}
+	copied := es.clone()
+	es.Extracted = 20
+	if copied == es || copied.Extracted != 10 {
+		t.Fatalf("clone未复制: %+v", copied)
+	}
+}
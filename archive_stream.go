@@ -0,0 +1,644 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 打包格式
+const (
+	archiveFormatZip = "zip"
+	archiveFormatTar = "tar"
+)
+
+// torrent中的文件没有可靠的修改时间（运行时的Metainfo().CreationDate为当前时间），
+// 使用固定时间，保证同一任务每次生成的内容和ETag相同，断点续传才能生效
+var archiveTorrentModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// 超过该值的大小和偏移需要ZIP64扩展
+const zipMax32 = 0xFFFFFFFF
+
+const (
+	zipLocalHeaderSig    = 0x04034b50
+	zipDescriptorSig     = 0x08074b50
+	zipCentralHeaderSig  = 0x02014b50
+	zip64EndSig          = 0x06064b50
+	zip64EndLocatorSig   = 0x07064b50
+	zipEndSig            = 0x06054b50
+	zipFlagDescriptor    = 0x0008
+	zipFlagUTF8          = 0x0800
+	zipVersionDefault    = 20
+	zipVersionZip64      = 45
+	zipExtraZip64        = 0x0001
+	tarBlockSize         = 512
+	zipLocalHeaderLength = 30
+)
+
+// 打包中的单个文件
+type archiveEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+	// CRC缓存的键，文件内容不变时相同
+	key  string
+	open func(ctx context.Context) (io.ReadSeekCloser, error)
+}
+
+type archiveSegmentKind int
+
+const (
+	// 预先生成的头部
+	segmentBytes archiveSegmentKind = iota
+	// 文件内容
+	segmentData
+	// ZIP数据描述符，需要文件的CRC
+	segmentDescriptor
+	// ZIP中央目录，需要所有文件的CRC
+	segmentCentral
+)
+
+type archiveSegment struct {
+	kind   archiveSegmentKind
+	offset int64
+	length int64
+	entry  int
+	data   []byte
+}
+
+// 打包文件的布局：各段的位置在开始发送前确定，因此总大小已知并支持Range请求
+type archiveLayout struct {
+	format   string
+	entries  []archiveEntry
+	segments []archiveSegment
+	size     int64
+	// ZIP中各文件本地头的偏移和中央目录的偏移
+	localOffsets  []int64
+	centralOffset int64
+}
+
+func (l *archiveLayout) add(kind archiveSegmentKind, entry int, length int64, data []byte) {
+	if length == 0 {
+		return
+	}
+	l.segments = append(l.segments, archiveSegment{kind: kind, offset: l.size, length: length, entry: entry, data: data})
+	l.size += length
+}
+
+func newArchiveLayout(format string, entries []archiveEntry) (*archiveLayout, error) {
+	layout := &archiveLayout{format: format, entries: entries}
+	switch format {
+	case archiveFormatZip:
+		layout.localOffsets = make([]int64, len(entries))
+		for i, entry := range entries {
+			layout.localOffsets[i] = layout.size
+			header := zipLocalHeader(entry)
+			layout.add(segmentBytes, i, int64(len(header)), header)
+			layout.add(segmentData, i, entry.size, nil)
+			layout.add(segmentDescriptor, i, zipDescriptorLength(entry), nil)
+		}
+		layout.centralOffset = layout.size
+		// 中央目录的长度与CRC无关
+		central := layout.centralDirectory(make([]uint32, len(entries)))
+		layout.add(segmentCentral, -1, int64(len(central)), nil)
+	case archiveFormatTar:
+		for i, entry := range entries {
+			header, err := tarHeader(entry)
+			if err != nil {
+				return nil, err
+			}
+			layout.add(segmentBytes, i, int64(len(header)), header)
+			layout.add(segmentData, i, entry.size, nil)
+			if padding := (tarBlockSize - entry.size%tarBlockSize) % tarBlockSize; padding > 0 {
+				layout.add(segmentBytes, i, padding, make([]byte, padding))
+			}
+		}
+		layout.add(segmentBytes, -1, 2*tarBlockSize, make([]byte, 2*tarBlockSize))
+	default:
+		return nil, fmt.Errorf("不支持的打包格式: %s", format)
+	}
+	return layout, nil
+}
+
+// ---- ZIP（存储模式，不压缩） ----
+
+func zipNeedsZip64(entry archiveEntry) bool {
+	return entry.size >= zipMax32
+}
+
+// MS-DOS格式的日期和时间，早于1980年时使用1980-01-01
+func zipDOSTime(t time.Time) (uint16, uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	date := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	clock := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	return date, clock
+}
+
+// 本地文件头：CRC和大小写在文件内容之后的数据描述符中
+func zipLocalHeader(entry archiveEntry) []byte {
+	version, size := uint16(zipVersionDefault), uint32(0)
+	var extra []byte
+	if zipNeedsZip64(entry) {
+		version, size = zipVersionZip64, zipMax32
+		extra = binary.LittleEndian.AppendUint16(nil, zipExtraZip64)
+		extra = binary.LittleEndian.AppendUint16(extra, 16)
+		extra = append(extra, make([]byte, 16)...)
+	}
+	date, clock := zipDOSTime(entry.modTime)
+
+	b := make([]byte, 0, zipLocalHeaderLength+len(entry.name)+len(extra))
+	b = binary.LittleEndian.AppendUint32(b, zipLocalHeaderSig)
+	b = binary.LittleEndian.AppendUint16(b, version)
+	b = binary.LittleEndian.AppendUint16(b, zipFlagDescriptor|zipFlagUTF8)
+	b = binary.LittleEndian.AppendUint16(b, 0) // 存储
+	b = binary.LittleEndian.AppendUint16(b, clock)
+	b = binary.LittleEndian.AppendUint16(b, date)
+	b = binary.LittleEndian.AppendUint32(b, 0) // CRC
+	b = binary.LittleEndian.AppendUint32(b, size)
+	b = binary.LittleEndian.AppendUint32(b, size)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(entry.name)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(extra)))
+	b = append(b, entry.name...)
+	return append(b, extra...)
+}
+
+// 本地头带有ZIP64扩展时，数据描述符中的大小为8字节
+func zipDescriptorLength(entry archiveEntry) int64 {
+	if zipNeedsZip64(entry) {
+		return 24
+	}
+	return 16
+}
+
+func zipDescriptor(entry archiveEntry, crc uint32) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, zipDescriptorSig)
+	b = binary.LittleEndian.AppendUint32(b, crc)
+	if zipNeedsZip64(entry) {
+		b = binary.LittleEndian.AppendUint64(b, uint64(entry.size))
+		return binary.LittleEndian.AppendUint64(b, uint64(entry.size))
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(entry.size))
+	return binary.LittleEndian.AppendUint32(b, uint32(entry.size))
+}
+
+// 中央目录及结束记录，文件数、目录大小或偏移超出范围时写入ZIP64结束记录
+func (l *archiveLayout) centralDirectory(crcs []uint32) []byte {
+	var b []byte
+	for i, entry := range l.entries {
+		size, offset := uint32(entry.size), uint32(l.localOffsets[i])
+		var extra []byte
+		if entry.size >= zipMax32 {
+			size = zipMax32
+			extra = binary.LittleEndian.AppendUint64(extra, uint64(entry.size))
+			extra = binary.LittleEndian.AppendUint64(extra, uint64(entry.size))
+		}
+		if l.localOffsets[i] >= zipMax32 {
+			offset = zipMax32
+			extra = binary.LittleEndian.AppendUint64(extra, uint64(l.localOffsets[i]))
+		}
+		version := uint16(zipVersionDefault)
+		if len(extra) > 0 || zipNeedsZip64(entry) {
+			version = zipVersionZip64
+			extra = append(binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, zipExtraZip64), uint16(len(extra))), extra...)
+		}
+		date, clock := zipDOSTime(entry.modTime)
+
+		b = binary.LittleEndian.AppendUint32(b, zipCentralHeaderSig)
+		b = binary.LittleEndian.AppendUint16(b, 3<<8|zipVersionZip64) // Unix
+		b = binary.LittleEndian.AppendUint16(b, version)
+		b = binary.LittleEndian.AppendUint16(b, zipFlagDescriptor|zipFlagUTF8)
+		b = binary.LittleEndian.AppendUint16(b, 0)
+		b = binary.LittleEndian.AppendUint16(b, clock)
+		b = binary.LittleEndian.AppendUint16(b, date)
+		b = binary.LittleEndian.AppendUint32(b, crcs[i])
+		b = binary.LittleEndian.AppendUint32(b, size)
+		b = binary.LittleEndian.AppendUint32(b, size)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(entry.name)))
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(extra)))
+		b = binary.LittleEndian.AppendUint16(b, 0) // 注释
+		b = binary.LittleEndian.AppendUint16(b, 0) // 磁盘号
+		b = binary.LittleEndian.AppendUint16(b, 0) // 内部属性
+		b = binary.LittleEndian.AppendUint32(b, 0100644<<16)
+		b = binary.LittleEndian.AppendUint32(b, offset)
+		b = append(b, entry.name...)
+		b = append(b, extra...)
+	}
+
+	count := uint64(len(l.entries))
+	centralSize := uint64(len(b))
+	centralOffset := uint64(l.centralOffset)
+	if count >= 0xFFFF || centralSize >= zipMax32 || centralOffset >= zipMax32 {
+		end64Offset := centralOffset + centralSize
+		b = binary.LittleEndian.AppendUint32(b, zip64EndSig)
+		b = binary.LittleEndian.AppendUint64(b, 44)
+		b = binary.LittleEndian.AppendUint16(b, 3<<8|zipVersionZip64)
+		b = binary.LittleEndian.AppendUint16(b, zipVersionZip64)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint64(b, count)
+		b = binary.LittleEndian.AppendUint64(b, count)
+		b = binary.LittleEndian.AppendUint64(b, centralSize)
+		b = binary.LittleEndian.AppendUint64(b, centralOffset)
+
+		b = binary.LittleEndian.AppendUint32(b, zip64EndLocatorSig)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint64(b, end64Offset)
+		b = binary.LittleEndian.AppendUint32(b, 1)
+
+		count = min64(count, 0xFFFF)
+		centralSize = min64(centralSize, zipMax32)
+		centralOffset = min64(centralOffset, zipMax32)
+	}
+	b = binary.LittleEndian.AppendUint32(b, zipEndSig)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(count))
+	b = binary.LittleEndian.AppendUint16(b, uint16(count))
+	b = binary.LittleEndian.AppendUint32(b, uint32(centralSize))
+	b = binary.LittleEndian.AppendUint32(b, uint32(centralOffset))
+	return binary.LittleEndian.AppendUint16(b, 0)
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ---- TAR ----
+
+// 文件头（长文件名和非ASCII文件名使用PAX扩展头）
+func tarHeader(entry archiveEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     entry.name,
+		Size:     entry.size,
+		Mode:     0644,
+		ModTime:  entry.modTime.Truncate(time.Second),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("生成tar文件头失败: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ---- 读取 ----
+
+// 按布局依次输出各段，支持Seek以响应Range请求
+type archiveReader struct {
+	ctx    context.Context
+	sts    *SimpleTorrentService
+	layout *archiveLayout
+	pos    int64
+
+	// 当前打开的文件
+	source      io.ReadSeekCloser
+	sourceEntry int
+	sourcePos   int64
+
+	// 从头顺序读取文件内容时同时计算CRC
+	crc      hash.Hash32
+	crcEntry int
+	crcPos   int64
+	crcs     map[int]uint32
+	central  []byte
+}
+
+func newArchiveReader(ctx context.Context, sts *SimpleTorrentService, layout *archiveLayout) *archiveReader {
+	return &archiveReader{
+		ctx:         ctx,
+		sts:         sts,
+		layout:      layout,
+		sourceEntry: -1,
+		crcEntry:    -1,
+		crcs:        make(map[int]uint32),
+	}
+}
+
+func (r *archiveReader) Read(p []byte) (int, error) {
+	if r.pos >= r.layout.size {
+		return 0, io.EOF
+	}
+	segments := r.layout.segments
+	i := sort.Search(len(segments), func(i int) bool { return segments[i].offset+segments[i].length > r.pos })
+	segment := segments[i]
+	within := r.pos - segment.offset
+	if remaining := segment.length - within; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	var n int
+	var err error
+	switch segment.kind {
+	case segmentBytes:
+		n = copy(p, segment.data[within:])
+	case segmentData:
+		n, err = r.readData(segment.entry, within, p)
+	case segmentDescriptor:
+		var crc uint32
+		if crc, err = r.entryCRC(segment.entry); err == nil {
+			n = copy(p, zipDescriptor(r.layout.entries[segment.entry], crc)[within:])
+		}
+	case segmentCentral:
+		if err = r.buildCentral(); err == nil {
+			n = copy(p, r.central[within:])
+		}
+	}
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *archiveReader) readData(index int, offset int64, p []byte) (int, error) {
+	entry := r.layout.entries[index]
+	if r.sourceEntry != index {
+		if r.source != nil {
+			r.source.Close()
+			r.source = nil
+		}
+		source, err := entry.open(r.ctx)
+		if err != nil {
+			return 0, err
+		}
+		r.source, r.sourceEntry, r.sourcePos = source, index, 0
+	}
+	if r.sourcePos != offset {
+		if _, err := r.source.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.sourcePos = offset
+	}
+	if offset == 0 {
+		r.crc, r.crcEntry, r.crcPos = crc32.NewIEEE(), index, 0
+	}
+
+	n, err := r.source.Read(p)
+	r.sourcePos += int64(n)
+	if err == io.EOF {
+		// 打包开始后文件被截断
+		if n == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+
+	if r.crcEntry == index && r.crcPos == offset {
+		r.crc.Write(p[:n])
+		r.crcPos += int64(n)
+		if r.crcPos == entry.size {
+			r.storeCRC(index, r.crc.Sum32())
+		}
+	}
+	return n, err
+}
+
+func (r *archiveReader) storeCRC(index int, crc uint32) {
+	r.crcs[index] = crc
+	r.sts.probeMutex.Lock()
+	r.sts.archiveCRCs[r.layout.entries[index].key] = crc
+	r.sts.probeMutex.Unlock()
+}
+
+// 文件的CRC，没有顺序读取过时（如断点续传）读取整个文件计算
+func (r *archiveReader) entryCRC(index int) (uint32, error) {
+	if crc, ok := r.crcs[index]; ok {
+		return crc, nil
+	}
+	entry := r.layout.entries[index]
+	r.sts.probeMutex.Lock()
+	crc, ok := r.sts.archiveCRCs[entry.key]
+	r.sts.probeMutex.Unlock()
+	if ok {
+		r.crcs[index] = crc
+		return crc, nil
+	}
+
+	source, err := entry.open(r.ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+	h := crc32.NewIEEE()
+	if n, err := io.Copy(h, source); err != nil {
+		return 0, err
+	} else if n != entry.size {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.storeCRC(index, h.Sum32())
+	return h.Sum32(), nil
+}
+
+func (r *archiveReader) buildCentral() error {
+	if r.central != nil {
+		return nil
+	}
+	crcs := make([]uint32, len(r.layout.entries))
+	for i := range r.layout.entries {
+		crc, err := r.entryCRC(i)
+		if err != nil {
+			return err
+		}
+		crcs[i] = crc
+	}
+	r.central = r.layout.centralDirectory(crcs)
+	return nil
+}
+
+func (r *archiveReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.layout.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("无效的偏移: %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *archiveReader) Close() error {
+	if r.source != nil {
+		return r.source.Close()
+	}
+	return nil
+}
+
+// ---- 文件来源 ----
+
+// torrent中的文件，selected为选择的文件索引，为空时打包所有文件
+func (sts *SimpleTorrentService) torrentArchiveEntries(hash string, selected []int) (string, []archiveEntry, error) {
+	files, err := sts.GetTorrentFiles(hash)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(selected) == 0 {
+		for i := range files {
+			selected = append(selected, i)
+		}
+	}
+
+	t := files[0].Torrent()
+	var entries []archiveEntry
+	for _, index := range selected {
+		if index < 0 || index >= len(files) {
+			return "", nil, fmt.Errorf("文件索引无效: %d", index)
+		}
+		file := files[index]
+		entries = append(entries, archiveEntry{
+			name:    file.Path(),
+			size:    file.Length(),
+			modTime: archiveTorrentModTime,
+			key:     hash + "/" + file.Path(),
+			open: func(ctx context.Context) (io.ReadSeekCloser, error) {
+				return newTorrentFileReader(ctx, file, sts.streamReadaheadLimit()), nil
+			},
+		})
+	}
+	return t.Name(), entries, nil
+}
+
+// 下载目录下某个目录中的所有文件（包含子目录，跳过缓存目录），未下载完成的torrent文件通过torrent读取
+func (sts *SimpleTorrentService) directoryArchiveEntries(dir string) (string, []archiveEntry, error) {
+	root := filepath.Join(sts.downloadDir, filepath.FromSlash(dir))
+	rel, err := filepath.Rel(sts.downloadDir, root)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", nil, fmt.Errorf("无效的目录: %s", dir)
+	}
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return "", nil, fmt.Errorf("目录不存在: %s", dir)
+	}
+
+	name := filepath.Base(root)
+	var entries []archiveEntry
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p != root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(root, p)
+		localPath := p
+		entry := archiveEntry{
+			name:    name + "/" + filepath.ToSlash(relPath),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			key:     fmt.Sprintf("%s@%d-%d", p, info.ModTime().UnixNano(), info.Size()),
+			open: func(ctx context.Context) (io.ReadSeekCloser, error) {
+				return os.Open(localPath)
+			},
+		}
+		if torrentFile := sts.LocalTorrentFile(p); torrentFile != nil && torrentFile.BytesCompleted() < torrentFile.Length() {
+			entry.size = torrentFile.Length()
+			entry.key = torrentFile.Torrent().InfoHash().HexString() + "/" + torrentFile.Path()
+			entry.open = func(ctx context.Context) (io.ReadSeekCloser, error) {
+				return newTorrentFileReader(ctx, torrentFile, sts.streamReadaheadLimit()), nil
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("读取目录失败: %v", err)
+	}
+	if len(entries) == 0 {
+		return "", nil, fmt.Errorf("目录中没有文件")
+	}
+	return name, entries, nil
+}
+
+// 文件列表和格式相同时ETag相同，用于断点续传的If-Range
+func archiveETag(format string, entries []archiveEntry) string {
+	h := sha1.New()
+	io.WriteString(h, format)
+	for _, entry := range entries {
+		fmt.Fprintf(h, "\x00%s\x00%d\x00%d\x00%s", entry.name, entry.size, entry.modTime.Unix(), entry.key)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:12])
+}
+
+func serveArchive(c *gin.Context, ts *SimpleTorrentService, name string, entries []archiveEntry) {
+	format := c.DefaultQuery("format", archiveFormatZip)
+	layout, err := newArchiveLayout(format, entries)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contentType := "application/zip"
+	if format == archiveFormatTar {
+		contentType = "application/x-tar"
+	}
+	reader := newArchiveReader(c.Request.Context(), ts, layout)
+	defer reader.Close()
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", url.PathEscape(name+"."+format)))
+	serveContent(c, reader, rangeContent{
+		ContentType: contentType,
+		Size:        layout.size,
+		ETag:        archiveETag(format, entries),
+	})
+}
+
+// 设置打包下载路由
+func setupArchiveRoutes(r *gin.Engine, ts *SimpleTorrentService) {
+	// 将torrent中的文件打包下载: /archive/:hash?format=zip|tar&files=0,2
+	r.GET("/archive/:hash", func(c *gin.Context) {
+		var selected []int
+		if files := c.Query("files"); files != "" {
+			for _, value := range strings.Split(files, ",") {
+				index, err := strconv.Atoi(strings.TrimSpace(value))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "无效的文件索引: " + value})
+					return
+				}
+				selected = append(selected, index)
+			}
+		}
+
+		name, entries, err := ts.torrentArchiveEntries(c.Param("hash"), selected)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		serveArchive(c, ts, name, entries)
+	})
+
+	// 将下载目录下的某个目录打包下载: /archive/dir/剧集/第一季?format=tar
+	r.GET("/archive/dir/*path", func(c *gin.Context) {
+		name, entries, err := ts.directoryArchiveEntries(strings.Trim(c.Param("path"), "/"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		serveArchive(c, ts, name, entries)
+	})
+}
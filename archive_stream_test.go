@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+func memoryArchiveEntry(name string, data []byte) archiveEntry {
+	return archiveEntry{
+		name:    name,
+		size:    int64(len(data)),
+		modTime: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		key:     "test/" + name,
+		open: func(ctx context.Context) (io.ReadSeekCloser, error) {
+			return nopReadSeekCloser{bytes.NewReader(data)}, nil
+		},
+	}
+}
+
+func testArchiveEntries() ([]archiveEntry, map[string][]byte) {
+	files := map[string][]byte{
+		"a.txt":                               []byte("hello"),
+		"dir/空文件":                             {},
+		"dir/" + strings.Repeat("长", 60):      bytes.Repeat([]byte("0123456789"), 100),
+		"dir/sub/" + strings.Repeat("x", 120): bytes.Repeat([]byte{0xAB}, 513),
+	}
+	var entries []archiveEntry
+	for _, name := range []string{"a.txt", "dir/空文件", "dir/" + strings.Repeat("长", 60), "dir/sub/" + strings.Repeat("x", 120)} {
+		entries = append(entries, memoryArchiveEntry(name, files[name]))
+	}
+	return entries, files
+}
+
+func newTestArchiveReader(layout *archiveLayout) *archiveReader {
+	sts := &SimpleTorrentService{archiveCRCs: make(map[string]uint32)}
+	return newArchiveReader(context.Background(), sts, layout)
+}
+
+func TestArchiveLayoutRoundTrip(t *testing.T) {
+	tests := []struct {
+		format string
+		read   func(t *testing.T, data []byte) map[string][]byte
+	}{
+		{archiveFormatZip, func(t *testing.T, data []byte) map[string][]byte {
+			zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatalf("读取zip失败: %v", err)
+			}
+			got := make(map[string][]byte)
+			for _, f := range zr.File {
+				if f.Method != zip.Store {
+					t.Fatalf("%s 的压缩方式 %d", f.Name, f.Method)
+				}
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// 读到结尾时archive/zip校验CRC
+				content, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatalf("读取 %s 失败: %v", f.Name, err)
+				}
+				got[f.Name] = content
+			}
+			return got
+		}},
+		{archiveFormatTar, func(t *testing.T, data []byte) map[string][]byte {
+			tr := tar.NewReader(bytes.NewReader(data))
+			got := make(map[string][]byte)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("读取tar失败: %v", err)
+				}
+				content, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[header.Name] = content
+			}
+			return got
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			entries, files := testArchiveEntries()
+			layout, err := newArchiveLayout(tt.format, entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(newTestArchiveReader(layout))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(data)) != layout.size {
+				t.Fatalf("输出 %d 字节, 布局大小 %d", len(data), layout.size)
+			}
+			got := tt.read(t, data)
+			if len(got) != len(files) {
+				t.Fatalf("文件数 %d, 期望 %d", len(got), len(files))
+			}
+			for name, content := range files {
+				if !bytes.Equal(got[name], content) {
+					t.Fatalf("%s 的内容不一致", name)
+				}
+			}
+
+			// 从任意位置开始读取（断点续传）的结果与完整输出一致，此时CRC需要单独计算
+			for _, offset := range []int64{1, layout.size / 3, layout.size / 2, layout.size - 30, layout.size - 1} {
+				r := newTestArchiveReader(layout)
+				if _, err := r.Seek(offset, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				part, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("从 %d 读取失败: %v", offset, err)
+				}
+				if !bytes.Equal(part, data[offset:]) {
+					t.Fatalf("从 %d 读取的内容不一致", offset)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveLayoutErrors(t *testing.T) {
+	if _, err := newArchiveLayout("rar", nil); err == nil || !strings.Contains(err.Error(), "不支持的打包格式") {
+		t.Fatalf("错误 %v", err)
+	}
+
+	// 打包开始后文件被截断
+	entry := memoryArchiveEntry("short.bin", []byte("abc"))
+	entry.size = 10
+	for _, format := range []string{archiveFormatZip, archiveFormatTar} {
+		layout, err := newArchiveLayout(format, []archiveEntry{entry})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(newTestArchiveReader(layout)); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%s: 错误 %v", format, err)
+		}
+	}
+}
+
+func TestTarHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+	}{
+		{"short.txt", 0},
+		{strings.Repeat("d/", 60) + "long.txt", 1},
+		{"中文/文件名.mkv", 1 << 40},
+	}
+	for _, tt := range tests {
+		entry := archiveEntry{name: tt.name, size: tt.size, modTime: time.Date(2024, 1, 1, 0, 0, 0, 500, time.UTC)}
+		data, err := tarHeader(entry)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(data)%tarBlockSize != 0 {
+			t.Fatalf("%s: 文件头长度 %d", tt.name, len(data))
+		}
+		header, err := tar.NewReader(bytes.NewReader(data)).Next()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if header.Name != tt.name || header.Size != tt.size || !header.ModTime.Equal(entry.modTime.Truncate(time.Second)) {
+			t.Fatalf("文件头 %+v", header)
+		}
+	}
+}
+
+func TestZipNeedsZip64(t *testing.T) {
+	tests := []struct {
+		size int64
+		want bool
+	}{
+		{0, false},
+		{zipMax32 - 1, false},
+		{zipMax32, true},
+		{1 << 40, true},
+	}
+	for _, tt := range tests {
+		if got := zipNeedsZip64(archiveEntry{size: tt.size}); got != tt.want {
+			t.Errorf("zipNeedsZip64(%d) = %v, 期望 %v", tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// 服务配置 - 从config.json加载，文件不存在时使用默认值
+type Config struct {
+	// 下载完成后自动解压压缩包
+	AutoExtract bool `json:"auto_extract"`
+	// 最小剩余磁盘空间(MB)，低于该值时暂停所有下载，0表示不检查
+	MinFreeSpaceMB int64 `json:"min_free_space_mb"`
+	// 自动添加.torrent文件的监视目录
+	WatchDirs            []WatchDirConfig `json:"watch_dirs"`
+	WatchIntervalSeconds int              `json:"watch_interval_seconds"`
+	// RSS订阅
+	RSSFeeds []RSSFeedConfig `json:"rss_feeds"`
+	// Torznab/Jackett索引器
+	Indexers []IndexerConfig `json:"indexers"`
+	// 存储后端
+	Storage StorageConfig `json:"storage"`
+	// 已完成任务的自动清理策略
+	Retention RetentionConfig `json:"retention"`
+	// HLS转码
+	Transcode TranscodeConfig `json:"transcode"`
+	// 缩略图和进度条预览图
+	Thumbnails ThumbnailConfig `json:"thumbnails"`
+	// DLNA/UPnP媒体服务器
+	DLNA DLNAConfig `json:"dlna"`
+	// 边下边播的预读
+	Stream StreamConfig `json:"stream"`
+}
+
+// 边下边播配置
+type StreamConfig struct {
+	// 按码率保持播放位置之后多少秒的数据优先下载
+	ReadaheadSeconds int `json:"readahead_seconds"`
+	// 同时播放的最大数量（同一客户端播放同一文件算作一个），0为不限制
+	MaxSessions int `json:"max_sessions"`
+}
+
+// HLS转码配置，需要本地安装ffmpeg
+type TranscodeConfig struct {
+	// 为空时在PATH中查找
+	FFmpegPath  string `json:"ffmpeg_path"`
+	FFprobePath string `json:"ffprobe_path"`
+	// 每个分片的时长（秒）
+	SegmentSeconds int `json:"segment_seconds"`
+	// 没有请求分片超过该时间后停止转码进程（秒）
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds"`
+	// 转码分片缓存的保留时间（分钟）
+	CacheMinutes int `json:"cache_minutes"`
+}
+
+// 清理策略配置，各项为0表示不启用
+type RetentionConfig struct {
+	// 完成后保留的最长天数
+	MaxAgeDays int `json:"max_age_days"`
+	// 所有任务数据的总大小上限(MB)
+	MaxTotalSizeMB int64 `json:"max_total_size_mb"`
+	// 每个分类保留最近完成的N个任务
+	KeepPerCategory int `json:"keep_per_category"`
+	// 检查间隔（分钟）
+	IntervalMinutes int `json:"interval_minutes"`
+}
+
+// 存储配置
+type StorageConfig struct {
+	// file(默认), mmap, sqlite, streaming
+	Type string `json:"type"`
+	// streaming模式的缓存上限，sqlite模式下为数据库容量上限（0不限制）
+	CacheSizeMB int64 `json:"cache_size_mb"`
+	// streaming模式的缓存位置: disk(默认) 或 memory
+	CacheLocation string `json:"cache_location"`
+}
+
+// 监视目录配置
+type WatchDirConfig struct {
+	Path     string `json:"path"`
+	Category string `json:"category"`
+	// 保存路径，相对路径基于下载目录
+	SavePath string `json:"save_path"`
+}
+
+// 索引器配置，URL为Torznab接口地址（可省略结尾的 /api）
+type IndexerConfig struct {
+	Name           string   `json:"name"`
+	URL            string   `json:"url"`
+	APIKey         string   `json:"api_key"`
+	Categories     []string `json:"categories"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+}
+
+// 缩略图配置，使用transcode中的ffmpeg
+type ThumbnailConfig struct {
+	// 同时运行的ffmpeg进程数
+	Workers int `json:"workers"`
+	// 预览图中相邻缩略图的时间间隔（秒），视频较长时自动增大
+	IntervalSeconds int `json:"interval_seconds"`
+	// 每个视频最多的缩略图数量
+	MaxTiles int `json:"max_tiles"`
+	// 每张缩略图的宽度（像素）
+	TileWidth int `json:"tile_width"`
+}
+
+// SSDP在线通告的最小间隔（秒）
+const minDLNANotifyIntervalSeconds = 30
+
+// DLNA媒体服务器配置，默认关闭
+type DLNAConfig struct {
+	Enabled bool `json:"enabled"`
+	// 在电视上显示的名称，为空时使用 "iMagnetRest (主机名)"
+	FriendlyName string `json:"friendly_name"`
+	// SSDP在线通告的发送间隔（秒）
+	NotifyIntervalSeconds int `json:"notify_interval_seconds"`
+}
+
+// RSS订阅配置
+type RSSFeedConfig struct {
+	Name            string          `json:"name"`
+	URL             string          `json:"url"`
+	IntervalMinutes int             `json:"interval_minutes"`
+	Rules           []RSSRuleConfig `json:"rules"`
+}
+
+// RSS自动下载规则，按顺序匹配第一条
+type RSSRuleConfig struct {
+	Name      string `json:"name"`
+	Include   string `json:"include"`
+	Exclude   string `json:"exclude"`
+	MinSizeMB int64  `json:"min_size_mb"`
+	MaxSizeMB int64  `json:"max_size_mb"`
+	// 记录已下载的剧集编号，避免重复下载
+	TrackEpisodes bool   `json:"track_episodes"`
+	Category      string `json:"category"`
+	SavePath      string `json:"save_path"`
+}
+
+// 默认配置
+func DefaultConfig() *Config {
+	return &Config{
+		AutoExtract:          false,
+		MinFreeSpaceMB:       0,
+		WatchIntervalSeconds: 10,
+		Retention: RetentionConfig{
+			IntervalMinutes: 60,
+		},
+		Transcode: TranscodeConfig{
+			SegmentSeconds:     6,
+			IdleTimeoutSeconds: 60,
+			CacheMinutes:       60,
+		},
+		Thumbnails: ThumbnailConfig{
+			Workers:         1,
+			IntervalSeconds: 10,
+			MaxTiles:        100,
+			TileWidth:       160,
+		},
+		DLNA: DLNAConfig{
+			NotifyIntervalSeconds: 300,
+		},
+		Stream: StreamConfig{
+			ReadaheadSeconds: 60,
+		},
+	}
+}
+
+// 加载配置文件
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("配置文件不存在，使用默认配置: %s", path)
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %v", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %v", err)
+	}
+
+	// SSDP通告间隔为0或负数时无法创建定时器，过小则会频繁广播
+	if cfg.DLNA.NotifyIntervalSeconds <= 0 {
+		cfg.DLNA.NotifyIntervalSeconds = 300
+	} else if cfg.DLNA.NotifyIntervalSeconds < minDLNANotifyIntervalSeconds {
+		cfg.DLNA.NotifyIntervalSeconds = minDLNANotifyIntervalSeconds
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigNormalizesDLNANotifyInterval(t *testing.T) {
+	tests := []struct {
+		json string
+		want int
+	}{
+		{`{}`, 300},
+		{`{"dlna": {"notify_interval_seconds": 0}}`, 300},
+		{`{"dlna": {"notify_interval_seconds": -5}}`, 300},
+		{`{"dlna": {"notify_interval_seconds": 1}}`, minDLNANotifyIntervalSeconds},
+		{`{"dlna": {"notify_interval_seconds": 600}}`, 600},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(tt.json), 0644)
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("加载配置失败: %v", err)
+		}
+		if cfg.DLNA.NotifyIntervalSeconds != tt.want {
+			t.Errorf("%s: notify_interval_seconds = %d, 期望 %d", tt.json, cfg.DLNA.NotifyIntervalSeconds, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
+)
+
+// 磁盘使用情况
+type DiskUsage struct {
+	Path        string  `json:"path"`
+	Total       int64   `json:"total"`
+	Free        int64   `json:"free"`
+	Used        int64   `json:"used"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+func newDiskUsage(path string, total int64, free int64) DiskUsage {
+	usage := DiskUsage{
+		Path:  path,
+		Total: total,
+		Free:  free,
+		Used:  total - free,
+	}
+	if total > 0 {
+		usage.UsedPercent = float64(usage.Used) / float64(total) * 100
+	}
+	return usage
+}
+
+// 最小剩余空间（字节）
+func (sts *SimpleTorrentService) minFreeSpace() int64 {
+	return sts.config.MinFreeSpaceMB * 1024 * 1024
+}
+
+// 任务数据所在的目录，调用方需持有锁
+func (sts *SimpleTorrentService) statusDataDir(status *TorrentStatus) string {
+	if status.SavePath != "" {
+		return status.SavePath
+	}
+	return sts.downloadDir
+}
+
+// 获取到种子信息时检查任务保存路径的剩余空间是否足够，不足则暂停下载
+func (sts *SimpleTorrentService) checkDiskSpaceForTorrent(t *torrent.Torrent, hash string) bool {
+	if sts.minFreeSpace() <= 0 {
+		return true
+	}
+
+	dataDir := sts.torrentDataDir(hash)
+	usage, err := getDiskUsage(dataDir)
+	if err != nil {
+		log.Printf("获取磁盘空间失败: %s, %v", dataDir, err)
+		return true
+	}
+
+	remaining := t.Length() - t.BytesCompleted()
+	if usage.Free-remaining >= sts.minFreeSpace() {
+		return true
+	}
+
+	t.DisallowDataDownload()
+
+	sts.mutex.Lock()
+	if status, exists := sts.torrents[hash]; exists {
+		status.PausedForDisk = true
+		status.Status = "磁盘空间不足"
+	}
+	sts.mutex.Unlock()
+
+	message := fmt.Sprintf("磁盘空间不足: %s 需要 %d bytes, 剩余 %d bytes", dataDir, remaining, usage.Free)
+	log.Printf("%s (%s)", message, hash[:8])
+	sts.addEvent(hash, "disk_full", message)
+	return false
+}
+
+// 定期检查磁盘空间，低于阈值时暂停所有下载，空间恢复后继续
+func (sts *SimpleTorrentService) monitorDiskSpace() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sts.checkDiskSpace()
+	}
+}
+
+// 按任务的保存路径分别检查，自定义路径可能位于其他磁盘
+func (sts *SimpleTorrentService) checkDiskSpace() {
+	// 未设置阈值时不检查，之前暂停的任务全部恢复
+	if sts.minFreeSpace() <= 0 {
+		sts.resumeAfterDisk("", DiskUsage{})
+		return
+	}
+
+	dirs := map[string]bool{sts.downloadDir: true}
+	sts.mutex.RLock()
+	for _, status := range sts.torrents {
+		dirs[sts.statusDataDir(status)] = true
+	}
+	sts.mutex.RUnlock()
+
+	for dir := range dirs {
+		usage, err := getDiskUsage(dir)
+		if err != nil {
+			log.Printf("获取磁盘空间失败: %s, %v", dir, err)
+			continue
+		}
+
+		if usage.Free < sts.minFreeSpace() {
+			sts.pauseAllForDisk(dir, usage)
+		} else {
+			sts.resumeAfterDisk(dir, usage)
+		}
+	}
+}
+
+// 暂停保存在dir中的下载
+func (sts *SimpleTorrentService) pauseAllForDisk(dir string, usage DiskUsage) {
+	var paused []string
+
+	sts.mutex.Lock()
+	for hash, status := range sts.torrents {
+		if sts.statusDataDir(status) != dir {
+			continue
+		}
+		if status.PausedForDisk || status.Status == "下载完成" || status.Status == "已取消" {
+			continue
+		}
+		status.Torrent.DisallowDataDownload()
+		status.PausedForDisk = true
+		status.Status = "磁盘空间不足"
+		paused = append(paused, hash)
+	}
+	sts.mutex.Unlock()
+
+	if len(paused) == 0 {
+		return
+	}
+
+	log.Printf("磁盘剩余空间不足: %s (%d bytes)，已暂停 %d 个下载", dir, usage.Free, len(paused))
+	for _, hash := range paused {
+		sts.addEvent(hash, "disk_paused", fmt.Sprintf("剩余空间 %d bytes 低于阈值，已暂停下载", usage.Free))
+	}
+}
+
+// 恢复保存在dir中的下载，dir为空时（未设置阈值）恢复所有因空间不足暂停的任务
+func (sts *SimpleTorrentService) resumeAfterDisk(dir string, usage DiskUsage) {
+	var resumed []string
+	free := usage.Free
+
+	sts.mutex.Lock()
+	for hash, status := range sts.torrents {
+		if !status.PausedForDisk {
+			continue
+		}
+
+		if dir != "" {
+			if sts.statusDataDir(status) != dir {
+				continue
+			}
+			// 剩余空间需能容纳该任务尚未下载的部分
+			remaining := status.Total - status.Torrent.BytesCompleted()
+			if free-remaining < sts.minFreeSpace() {
+				continue
+			}
+			free -= remaining
+		}
+
+		status.Torrent.AllowDataDownload()
+		status.PausedForDisk = false
+		status.Status = "下载中"
+		resumed = append(resumed, hash)
+	}
+	sts.mutex.Unlock()
+
+	for _, hash := range resumed {
+		log.Printf("磁盘空间已恢复，继续下载: %s", hash[:8])
+		sts.addEvent(hash, "disk_resumed", "磁盘空间已恢复，继续下载")
+	}
+}
+
+// 设置系统信息路由
+func setupSystemRoutes(r *gin.Engine, ts *SimpleTorrentService) {
+	// 磁盘使用情况和低空间暂停状态
+	r.GET("/system", func(c *gin.Context) {
+		usage, err := getDiskUsage(ts.downloadDir)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "获取磁盘空间失败"})
+			return
+		}
+
+		ts.mutex.RLock()
+		pausedForDisk := 0
+		for _, status := range ts.torrents {
+			if status.PausedForDisk {
+				pausedForDisk++
+			}
+		}
+		torrentCount := len(ts.torrents)
+		ts.mutex.RUnlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"disk":            usage,
+			"min_free_space":  ts.minFreeSpace(),
+			"low_space":       ts.minFreeSpace() > 0 && usage.Free < ts.minFreeSpace(),
+			"paused_for_disk": pausedForDisk,
+			"torrents":        torrentCount,
+			"goroutines":      runtime.NumGoroutine(),
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// 直接添加到客户端的任务，不启动handleTorrent
+func addTestTorrentStatus(t *testing.T, ts *SimpleTorrentService, name string, savePath string) (string, *torrent.Torrent) {
+	mi, err := metainfo.Load(bytes.NewReader(buildTestTorrent(t, t.TempDir(), name, []byte("data of "+name))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err := ts.client.AddTorrent(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := tor.InfoHash().String()
+	ts.mutex.Lock()
+	ts.torrents[hash] = &TorrentStatus{Torrent: tor, Name: name, Status: "下载中", Total: tor.Length(), SavePath: savePath}
+	ts.mutex.Unlock()
+	return hash, tor
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	ts := newTestTorrentService(t)
+	other := t.TempDir()
+	inDefault, _ := addTestTorrentStatus(t, ts, "a.bin", "")
+	inOther, _ := addTestTorrentStatus(t, ts, "b.bin", other)
+	done, _ := addTestTorrentStatus(t, ts, "c.bin", other)
+	ts.torrents[done].Status = "下载完成"
+
+	paused := func(hash string) bool {
+		ts.mutex.RLock()
+		defer ts.mutex.RUnlock()
+		return ts.torrents[hash].PausedForDisk
+	}
+
+	// 阈值大于任何磁盘的剩余空间：默认目录和自定义路径的下载都暂停，已完成的任务不变
+	ts.config.MinFreeSpaceMB = 1 << 40
+	ts.checkDiskSpace()
+	if !paused(inDefault) || !paused(inOther) || paused(done) {
+		t.Fatalf("暂停状态错误: %v %v %v", paused(inDefault), paused(inOther), paused(done))
+	}
+	if events, _ := ts.GetTaskEvents(inOther); len(events) == 0 || events[len(events)-1].Type != "disk_paused" {
+		t.Fatalf("应记录暂停事件: %+v", events)
+	}
+
+	// 阈值改为0后不再检查，之前暂停的任务继续下载
+	ts.config.MinFreeSpaceMB = 0
+	ts.checkDiskSpace()
+	if paused(inDefault) || paused(inOther) {
+		t.Fatal("阈值为0时应恢复暂停的任务")
+	}
+	ts.mutex.RLock()
+	status := ts.torrents[inOther].Status
+	ts.mutex.RUnlock()
+	if status != "下载中" {
+		t.Fatalf("恢复后状态 %q", status)
+	}
+}
+
+func TestCheckDiskSpaceForTorrentUsesSavePath(t *testing.T) {
+	ts := newTestTorrentService(t)
+	ts.config.MinFreeSpaceMB = 1 << 40
+
+	// 阈值为0时不检查
+	hash, tor := addTestTorrentStatus(t, ts, "a.bin", "")
+	ts.config.MinFreeSpaceMB = 0
+	if !ts.checkDiskSpaceForTorrent(tor, hash) {
+		t.Fatal("阈值为0时不应暂停")
+	}
+
+	ts.config.MinFreeSpaceMB = 1 << 40
+	if ts.checkDiskSpaceForTorrent(tor, hash) {
+		t.Fatal("剩余空间不足时应暂停")
+	}
+
+	// 保存路径无法获取磁盘空间时不暂停，说明检查的是任务的保存路径而不是下载目录
+	missing, tor2 := addTestTorrentStatus(t, ts, "b.bin", filepath.Join(t.TempDir(), "missing"))
+	if !ts.checkDiskSpaceForTorrent(tor2, missing) {
+		t.Fatal("应检查任务的保存路径")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// 获取路径所在磁盘的使用情况
+func getDiskUsage(path string) (DiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return DiskUsage{}, err
+	}
+
+	total := int64(stat.Blocks) * int64(stat.Bsize)
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+
+	return newDiskUsage(path, total, free), nil
+}
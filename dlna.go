@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ssdpAddr = "239.255.255.250:1900"
+	// SSDP通告的有效期（秒）
+	ssdpMaxAge = 1800
+
+	mediaServerType       = "urn:schemas-upnp-org:device:MediaServer:1"
+	contentDirectoryType  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	connectionManagerType = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+	// OP=01表示支持按字节范围跳转，FLAGS声明流式传输
+	dlnaContentFeatures = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+
+	// 内容目录中的对象ID
+	dlnaRootID     = "0"
+	dlnaLocalID    = "local"
+	dlnaTorrentsID = "torrents"
+)
+
+// DLNA媒体服务器 - SSDP发现和ContentDirectory浏览，媒体通过 /stream/ 播放
+type DLNAServer struct {
+	ts     *SimpleTorrentService
+	config DLNAConfig
+	port   int
+	uuid   string
+	name   string
+}
+
+func NewDLNAServer(ts *SimpleTorrentService, config DLNAConfig, port int) *DLNAServer {
+	hostname, _ := os.Hostname()
+	name := config.FriendlyName
+	if name == "" {
+		name = "iMagnetRest"
+		if hostname != "" {
+			name += " (" + hostname + ")"
+		}
+	}
+	if config.NotifyIntervalSeconds <= 0 {
+		config.NotifyIntervalSeconds = 300
+	}
+
+	return &DLNAServer{
+		ts:     ts,
+		config: config,
+		port:   port,
+		uuid:   dlnaDeviceUUID(hostname + "/" + name),
+		name:   name,
+	}
+}
+
+// 根据主机名和名称生成固定的UUID，重启后电视仍能识别为同一设备
+func dlnaDeviceUUID(seed string) string {
+	sum := sha1.Sum([]byte("iMagnetRest-dlna/" + seed))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	h := hex.EncodeToString(sum[:16])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+// 启动SSDP监听和定期通告
+func (d *DLNAServer) Start() {
+	go d.serveSSDP()
+	go d.notifyLoop()
+	log.Printf("DLNA媒体服务器已启动: %s (uuid:%s)", d.name, d.uuid)
+}
+
+func (d *DLNAServer) location(ip net.IP) string {
+	return fmt.Sprintf("http://%s/dlna/device.xml", net.JoinHostPort(ip.String(), strconv.Itoa(d.port)))
+}
+
+// 通告和搜索应答的类型及对应的USN
+func (d *DLNAServer) ssdpTargets() [][2]string {
+	udn := "uuid:" + d.uuid
+	return [][2]string{
+		{"upnp:rootdevice", udn + "::upnp:rootdevice"},
+		{udn, udn},
+		{mediaServerType, udn + "::" + mediaServerType},
+		{contentDirectoryType, udn + "::" + contentDirectoryType},
+		{connectionManagerType, udn + "::" + connectionManagerType},
+	}
+}
+
+// 监听组播的M-SEARCH请求
+func (d *DLNAServer) serveSSDP() {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		log.Printf("解析SSDP地址失败: %v", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Printf("监听SSDP失败，电视将无法自动发现本服务: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 8192)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("读取SSDP请求失败: %v", err)
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		go d.handleSearch(data, remote)
+	}
+}
+
+func (d *DLNAServer) handleSearch(data []byte, remote *net.UDPAddr) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+		return
+	}
+
+	st := req.Header.Get("ST")
+	var matched [][2]string
+	for _, target := range d.ssdpTargets() {
+		if st == "ssdp:all" || st == target[0] {
+			matched = append(matched, target)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	// 按MX在等待时间内随机延迟应答，避免大量设备同时应答
+	mx, _ := strconv.Atoi(req.Header.Get("MX"))
+	if mx > 0 {
+		if mx > 3 {
+			mx = 3
+		}
+		time.Sleep(time.Duration(mathrand.Int63n(int64(mx) * int64(time.Second) / 2)))
+	}
+
+	conn, err := net.DialUDP("udp4", nil, remote)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// 通过发往请求方的路由确定本机地址
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	for _, target := range matched {
+		response := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age=%d\r\n"+
+			"DATE: %s\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: %s\r\n"+
+			"SERVER: %s\r\n"+
+			"ST: %s\r\n"+
+			"USN: %s\r\n\r\n",
+			ssdpMaxAge, time.Now().UTC().Format(http.TimeFormat), d.location(localIP), dlnaServerHeader(), target[0], target[1])
+		conn.Write([]byte(response))
+	}
+}
+
+func dlnaServerHeader() string {
+	return "Linux/1.0 UPnP/1.0 iMagnetRest/1.0"
+}
+
+// 定期在每个网卡上发送ssdp:alive通告
+func (d *DLNAServer) notifyLoop() {
+	ticker := time.NewTicker(time.Duration(d.config.NotifyIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		for _, ip := range multicastIPv4s() {
+			d.notify(ip)
+		}
+	}
+}
+
+func (d *DLNAServer) notify(ip net.IP) {
+	group, _ := net.ResolveUDPAddr("udp4", ssdpAddr)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		log.Printf("发送SSDP通告失败: %s, %v", ip, err)
+		return
+	}
+	defer conn.Close()
+
+	for _, target := range d.ssdpTargets() {
+		message := fmt.Sprintf("NOTIFY * HTTP/1.1\r\n"+
+			"HOST: %s\r\n"+
+			"CACHE-CONTROL: max-age=%d\r\n"+
+			"LOCATION: %s\r\n"+
+			"NT: %s\r\n"+
+			"NTS: ssdp:alive\r\n"+
+			"SERVER: %s\r\n"+
+			"USN: %s\r\n\r\n",
+			ssdpAddr, ssdpMaxAge, d.location(ip), target[0], dlnaServerHeader(), target[1])
+		conn.WriteTo([]byte(message), group)
+	}
+}
+
+// 已启用且支持组播的网卡的IPv4地址
+func multicastIPv4s() []net.IP {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+// 设备描述
+func (d *DLNAServer) deviceDescription() string {
+	var name bytes.Buffer
+	xml.EscapeText(&name, []byte(d.name))
+
+	return xml.Header + `<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>` + mediaServerType + `</deviceType>
+    <friendlyName>` + name.String() + `</friendlyName>
+    <manufacturer>iMagnetRest</manufacturer>
+    <modelName>iMagnetRest</modelName>
+    <modelNumber>1.0</modelNumber>
+    <UDN>uuid:` + d.uuid + `</UDN>
+    <dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+    <serviceList>
+      <service>
+        <serviceType>` + contentDirectoryType + `</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/dlna/ContentDirectory.xml</SCPDURL>
+        <controlURL>/dlna/control/ContentDirectory</controlURL>
+        <eventSubURL>/dlna/event/ContentDirectory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>` + connectionManagerType + `</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>/dlna/ConnectionManager.xml</SCPDURL>
+        <controlURL>/dlna/control/ConnectionManager</controlURL>
+        <eventSubURL>/dlna/event/ConnectionManager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>
+`
+}
+
+const contentDirectorySCPD = `<?xml version="1.0" encoding="UTF-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>Browse</name>
+      <argumentList>
+        <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+        <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+        <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+        <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+        <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+        <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+        <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSearchCapabilities</name>
+      <argumentList>
+        <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSortCapabilities</name>
+      <argumentList>
+        <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSystemUpdateID</name>
+      <argumentList>
+        <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+const connectionManagerSCPD = `<?xml version="1.0" encoding="UTF-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>GetProtocolInfo</name>
+      <argumentList>
+        <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+        <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetCurrentConnectionIDs</name>
+      <argumentList>
+        <argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetCurrentConnectionInfo</name>
+      <argumentList>
+        <argument><name>ConnectionID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+        <argument><name>RcsID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_RcsID</relatedStateVariable></argument>
+        <argument><name>AVTransportID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_AVTransportID</relatedStateVariable></argument>
+        <argument><name>ProtocolInfo</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ProtocolInfo</relatedStateVariable></argument>
+        <argument><name>PeerConnectionManager</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionManager</relatedStateVariable></argument>
+        <argument><name>PeerConnectionID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+        <argument><name>Direction</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Direction</relatedStateVariable></argument>
+        <argument><name>Status</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionStatus</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionStatus</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>OK</allowedValue><allowedValue>ContentFormatMismatch</allowedValue><allowedValue>InsufficientBandwidth</allowedValue><allowedValue>UnreliableChannel</allowedValue><allowedValue>Unknown</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionManager</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Direction</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>Input</allowedValue><allowedValue>Output</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionID</name><dataType>i4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_AVTransportID</name><dataType>i4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_RcsID</name><dataType>i4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+// SOAP请求：从Body中取出动作名和参数
+func parseSOAPAction(body io.Reader) (string, map[string]string, error) {
+	decoder := xml.NewDecoder(body)
+	args := make(map[string]string)
+	var action, current string
+	depth, bodyDepth := 0, -1
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("解析SOAP请求失败: %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case bodyDepth < 0 && t.Name.Local == "Body":
+				bodyDepth = depth
+			case bodyDepth >= 0 && depth == bodyDepth+1:
+				action = t.Name.Local
+			case bodyDepth >= 0 && depth == bodyDepth+2:
+				current = t.Name.Local
+				args[current] = ""
+			}
+		case xml.CharData:
+			if current != "" {
+				args[current] += string(t)
+			}
+		case xml.EndElement:
+			if depth == bodyDepth+2 {
+				current = ""
+			}
+			depth--
+		}
+	}
+
+	if action == "" {
+		return "", nil, fmt.Errorf("SOAP请求中没有动作")
+	}
+	return action, args, nil
+}
+
+type soapArg struct {
+	name  string
+	value string
+}
+
+func writeSOAPResponse(c *gin.Context, serviceType string, action string, args ...soapArg) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&b, `<u:%sResponse xmlns:u="%s">`, action, serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&b, "<%s>", arg.name)
+		xml.EscapeText(&b, []byte(arg.value))
+		fmt.Fprintf(&b, "</%s>", arg.name)
+	}
+	fmt.Fprintf(&b, `</u:%sResponse></s:Body></s:Envelope>`, action)
+
+	c.Header("EXT", "")
+	c.Data(http.StatusOK, `text/xml; charset="utf-8"`, b.Bytes())
+}
+
+// UPnP错误：401无效动作，402无效参数，701对象不存在
+func writeSOAPError(c *gin.Context, code int, description string) {
+	var desc bytes.Buffer
+	xml.EscapeText(&desc, []byte(description))
+
+	body := xml.Header + `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>` + strconv.Itoa(code) + `</errorCode><errorDescription>` + desc.String() + `</errorDescription></UPnPError>` +
+		`</detail></s:Fault></s:Body></s:Envelope>`
+	c.Data(http.StatusInternalServerError, `text/xml; charset="utf-8"`, []byte(body))
+}
+
+// DIDL-Lite元数据
+type didlLite struct {
+	XMLName    xml.Name        `xml:"DIDL-Lite"`
+	Xmlns      string          `xml:"xmlns,attr"`
+	XmlnsDC    string          `xml:"xmlns:dc,attr"`
+	XmlnsUPnP  string          `xml:"xmlns:upnp,attr"`
+	Containers []didlContainer `xml:"container"`
+	Items      []didlItem      `xml:"item"`
+}
+
+type didlContainer struct {
+	ID         string `xml:"id,attr"`
+	ParentID   string `xml:"parentID,attr"`
+	Restricted string `xml:"restricted,attr"`
+	ChildCount int    `xml:"childCount,attr"`
+	Title      string `xml:"dc:title"`
+	Class      string `xml:"upnp:class"`
+}
+
+type didlItem struct {
+	ID         string  `xml:"id,attr"`
+	ParentID   string  `xml:"parentID,attr"`
+	Restricted string  `xml:"restricted,attr"`
+	Title      string  `xml:"dc:title"`
+	Class      string  `xml:"upnp:class"`
+	Res        didlRes `xml:"res"`
+}
+
+type didlRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Size         int64  `xml:"size,attr,omitempty"`
+	// H:MM:SS.mmm
+	Duration   string `xml:"duration,attr,omitempty"`
+	Resolution string `xml:"resolution,attr,omitempty"`
+	URL        string `xml:",chardata"`
+}
+
+// 内容目录中的一个对象（目录或文件）
+type dlnaObject struct {
+	ID       string
+	ParentID string
+	Title    string
+	// 目录的子对象数量，文件为-1
+	ChildCount int
+	// 文件的播放地址（/stream/后的路径）和大小
+	StreamPath string
+	Size       int64
+	Media      *MediaInfo
+}
+
+func (o dlnaObject) isContainer() bool {
+	return o.ChildCount >= 0
+}
+
+func renderDIDL(objects []dlnaObject, baseURL string) (string, error) {
+	didl := didlLite{
+		Xmlns:     "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/",
+		XmlnsDC:   "http://purl.org/dc/elements/1.1/",
+		XmlnsUPnP: "urn:schemas-upnp-org:metadata-1-0/upnp/",
+	}
+
+	for _, object := range objects {
+		if object.isContainer() {
+			didl.Containers = append(didl.Containers, didlContainer{
+				ID:         object.ID,
+				ParentID:   object.ParentID,
+				Restricted: "1",
+				ChildCount: object.ChildCount,
+				Title:      object.Title,
+				Class:      "object.container.storageFolder",
+			})
+			continue
+		}
+
+		res := didlRes{
+			ProtocolInfo: "http-get:*:" + getContentType(object.StreamPath) + ":" + dlnaContentFeatures,
+			Size:         object.Size,
+			URL:          streamURL(baseURL, object.StreamPath),
+		}
+		if object.Media != nil {
+			if object.Media.Duration > 0 {
+				res.Duration = formatDIDLDuration(object.Media.Duration)
+			}
+			if video := object.Media.Video; video != nil && video.Width > 0 && video.Height > 0 {
+				res.Resolution = fmt.Sprintf("%dx%d", video.Width, video.Height)
+			}
+		}
+		didl.Items = append(didl.Items, didlItem{
+			ID:         object.ID,
+			ParentID:   object.ParentID,
+			Restricted: "1",
+			Title:      object.Title,
+			Class:      "object.item.videoItem",
+			Res:        res,
+		})
+	}
+
+	data, err := xml.Marshal(didl)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func formatDIDLDuration(seconds float64) string {
+	ms := secondsToDuration(seconds).Milliseconds()
+	return fmt.Sprintf("%d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// 对象ID:
+//
+//	0                       根目录
+//	local, local/<相对路径>  下载目录中的目录和文件
+//	torrents                下载中的任务
+//	torrent/<hash>          任务中的视频文件
+//	torrent/<hash>/<索引>   任务中的某个文件
+func (d *DLNAServer) object(id string) (dlnaObject, error) {
+	switch {
+	case id == dlnaRootID:
+		return dlnaObject{ID: dlnaRootID, ParentID: "-1", Title: d.name, ChildCount: 2}, nil
+	case id == dlnaLocalID || strings.HasPrefix(id, dlnaLocalID+"/"):
+		return d.localObject(id)
+	case id == dlnaTorrentsID:
+		return dlnaObject{ID: dlnaTorrentsID, ParentID: dlnaRootID, Title: "下载中", ChildCount: len(d.torrentContainers())}, nil
+	case strings.HasPrefix(id, "torrent/"):
+		return d.torrentObject(id)
+	}
+	return dlnaObject{}, fmt.Errorf("对象不存在: %s", id)
+}
+
+func (d *DLNAServer) children(id string) ([]dlnaObject, error) {
+	switch {
+	case id == dlnaRootID:
+		local, err := d.localObject(dlnaLocalID)
+		if err != nil {
+			return nil, err
+		}
+		torrents, _ := d.object(dlnaTorrentsID)
+		return []dlnaObject{local, torrents}, nil
+	case id == dlnaLocalID || strings.HasPrefix(id, dlnaLocalID+"/"):
+		return d.localChildren(id)
+	case id == dlnaTorrentsID:
+		return d.torrentContainers(), nil
+	case strings.HasPrefix(id, "torrent/") && strings.Count(id, "/") == 1:
+		return d.torrentFiles(strings.TrimPrefix(id, "torrent/"))
+	}
+	if _, err := d.object(id); err != nil {
+		return nil, err
+	}
+	// 文件没有子对象
+	return nil, nil
+}
+
+// 对象ID对应的本地路径，拒绝下载目录以外的路径
+func (d *DLNAServer) localPath(id string) (string, string, error) {
+	rel := strings.Trim(strings.TrimPrefix(id, dlnaLocalID), "/")
+	full := filepath.Join(d.ts.downloadDir, filepath.FromSlash(rel))
+	check, err := filepath.Rel(d.ts.downloadDir, full)
+	if err != nil || check == ".." || strings.HasPrefix(check, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("对象不存在: %s", id)
+	}
+	return rel, full, nil
+}
+
+func localObjectID(rel string) string {
+	if rel == "" {
+		return dlnaLocalID
+	}
+	return dlnaLocalID + "/" + rel
+}
+
+func localParentID(rel string) string {
+	if rel == "" {
+		return dlnaRootID
+	}
+	parent := path.Dir(rel)
+	if parent == "." {
+		parent = ""
+	}
+	return localObjectID(parent)
+}
+
+func (d *DLNAServer) localObject(id string) (dlnaObject, error) {
+	rel, full, err := d.localPath(id)
+	if err != nil {
+		return dlnaObject{}, err
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		return dlnaObject{}, fmt.Errorf("对象不存在: %s", id)
+	}
+	return d.localEntry(rel, full, info)
+}
+
+func (d *DLNAServer) localEntry(rel string, full string, info os.FileInfo) (dlnaObject, error) {
+	object := dlnaObject{
+		ID:       localObjectID(rel),
+		ParentID: localParentID(rel),
+		Title:    info.Name(),
+	}
+	if rel == "" {
+		object.Title = "已下载"
+	}
+
+	if info.IsDir() {
+		object.ChildCount = localChildCount(full)
+		return object, nil
+	}
+
+	if !isVideoFile(info.Name()) {
+		return dlnaObject{}, fmt.Errorf("对象不存在: %s", object.ID)
+	}
+	object.ChildCount = -1
+	object.StreamPath = rel
+	object.Size = info.Size()
+	if media, err := d.ts.ProbeLocalFile(full); err == nil {
+		object.Media = media
+	}
+	return object, nil
+}
+
+// 目录直接包含的子目录和视频文件数量，只统计条目，不探测文件
+func localChildCount(dir string) int {
+	children, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, child := range children {
+		if !strings.HasPrefix(child.Name(), ".") && (child.IsDir() || isVideoFile(child.Name())) {
+			count++
+		}
+	}
+	return count
+}
+
+// 目录中的子目录和视频文件，跳过缓存等隐藏目录
+func (d *DLNAServer) localChildren(id string) ([]dlnaObject, error) {
+	rel, full, err := d.localPath(id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(full)
+	if err != nil {
+		return nil, fmt.Errorf("对象不存在: %s", id)
+	}
+
+	var dirs, files []dlnaObject
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		childRel := path.Join(rel, entry.Name())
+		if entry.IsDir() {
+			dirs = append(dirs, dlnaObject{
+				ID:         localObjectID(childRel),
+				ParentID:   localObjectID(rel),
+				Title:      entry.Name(),
+				ChildCount: localChildCount(filepath.Join(full, entry.Name())),
+			})
+			continue
+		}
+		if !isVideoFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		object, err := d.localEntry(childRel, filepath.Join(full, entry.Name()), info)
+		if err != nil {
+			continue
+		}
+		files = append(files, object)
+	}
+
+	sort.SliceStable(dirs, func(i, j int) bool { return naturalLess(dirs[i].Title, dirs[j].Title) })
+	sort.SliceStable(files, func(i, j int) bool { return playlistLess(files[i].StreamPath, files[j].StreamPath) })
+	return append(dirs, files...), nil
+}
+
+// 下载中的任务；非文件存储时已完成的任务不在下载目录中，也在此列出
+func (d *DLNAServer) torrentContainers() []dlnaObject {
+	d.ts.mutex.RLock()
+	var hashes []string
+	names := make(map[string]string)
+	for hash, status := range d.ts.torrents {
+		if status.Torrent == nil || status.Torrent.Info() == nil || status.Status == "已取消" {
+			continue
+		}
+		if status.Status == "下载完成" && d.ts.fileStorage() {
+			continue
+		}
+		hashes = append(hashes, hash)
+		names[hash] = status.Name
+	}
+	d.ts.mutex.RUnlock()
+
+	var containers []dlnaObject
+	for _, hash := range hashes {
+		count := d.torrentVideoCount(hash)
+		if count == 0 {
+			continue
+		}
+		containers = append(containers, dlnaObject{
+			ID:         "torrent/" + hash,
+			ParentID:   dlnaTorrentsID,
+			Title:      names[hash],
+			ChildCount: count,
+		})
+	}
+	sort.SliceStable(containers, func(i, j int) bool { return naturalLess(containers[i].Title, containers[j].Title) })
+	return containers
+}
+
+// 任务中的视频文件数量，不探测文件
+func (d *DLNAServer) torrentVideoCount(hash string) int {
+	files, err := d.ts.GetTorrentFiles(hash)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, file := range files {
+		if isVideoFile(file.Path()) {
+			count++
+		}
+	}
+	return count
+}
+
+func (d *DLNAServer) torrentFileObject(hash string, index int, file *torrent.File) dlnaObject {
+	object := dlnaObject{
+		ID:         fmt.Sprintf("torrent/%s/%d", hash, index),
+		ParentID:   "torrent/" + hash,
+		Title:      path.Base(file.Path()),
+		ChildCount: -1,
+		StreamPath: "torrent/" + hash + "/" + file.Path(),
+		Size:       file.Length(),
+	}
+	if media, err := d.ts.ProbeTorrentFile(file); err == nil {
+		object.Media = media
+	}
+	return object
+}
+
+func (d *DLNAServer) torrentFiles(hash string) ([]dlnaObject, error) {
+	files, err := d.ts.GetTorrentFiles(hash)
+	if err != nil {
+		return nil, fmt.Errorf("对象不存在: torrent/%s", hash)
+	}
+
+	var objects []dlnaObject
+	for index, file := range files {
+		if isVideoFile(file.Path()) {
+			objects = append(objects, d.torrentFileObject(hash, index, file))
+		}
+	}
+	sort.SliceStable(objects, func(i, j int) bool { return playlistLess(objects[i].StreamPath, objects[j].StreamPath) })
+	return objects, nil
+}
+
+func (d *DLNAServer) torrentObject(id string) (dlnaObject, error) {
+	parts := strings.Split(strings.TrimPrefix(id, "torrent/"), "/")
+	files, err := d.ts.GetTorrentFiles(parts[0])
+	if err != nil {
+		return dlnaObject{}, fmt.Errorf("对象不存在: %s", id)
+	}
+	switch len(parts) {
+	case 1:
+		count := d.torrentVideoCount(parts[0])
+		if count == 0 {
+			break
+		}
+		return dlnaObject{ID: id, ParentID: dlnaTorrentsID, Title: files[0].Torrent().Name(), ChildCount: count}, nil
+	case 2:
+		// 只探测请求的文件
+		index, err := strconv.Atoi(parts[1])
+		if err != nil || index < 0 || index >= len(files) || !isVideoFile(files[index].Path()) {
+			break
+		}
+		return d.torrentFileObject(parts[0], index, files[index]), nil
+	}
+	return dlnaObject{}, fmt.Errorf("对象不存在: %s", id)
+}
+
+// 处理Browse请求
+func (d *DLNAServer) browse(c *gin.Context, args map[string]string) {
+	id := args["ObjectID"]
+	start, _ := strconv.Atoi(args["StartingIndex"])
+	count, _ := strconv.Atoi(args["RequestedCount"])
+	if start < 0 || count < 0 {
+		writeSOAPError(c, 402, "无效的参数")
+		return
+	}
+
+	var objects []dlnaObject
+	total := 0
+	switch args["BrowseFlag"] {
+	case "BrowseMetadata":
+		object, err := d.object(id)
+		if err != nil {
+			writeSOAPError(c, 701, err.Error())
+			return
+		}
+		objects, total = []dlnaObject{object}, 1
+	case "BrowseDirectChildren":
+		children, err := d.children(id)
+		if err != nil {
+			writeSOAPError(c, 701, err.Error())
+			return
+		}
+		total = len(children)
+		if start > len(children) {
+			start = len(children)
+		}
+		children = children[start:]
+		// RequestedCount为0表示全部返回
+		if count > 0 && count < len(children) {
+			children = children[:count]
+		}
+		objects = children
+	default:
+		writeSOAPError(c, 402, "无效的BrowseFlag: "+args["BrowseFlag"])
+		return
+	}
+
+	result, err := renderDIDL(objects, requestBaseURL(c))
+	if err != nil {
+		writeSOAPError(c, 501, err.Error())
+		return
+	}
+	writeSOAPResponse(c, contentDirectoryType, "Browse",
+		soapArg{"Result", result},
+		soapArg{"NumberReturned", strconv.Itoa(len(objects))},
+		soapArg{"TotalMatches", strconv.Itoa(total)},
+		soapArg{"UpdateID", d.systemUpdateID()},
+	)
+}
+
+// 内容随下载进度不断变化，按分钟变化的ID让电视定期刷新列表
+func (d *DLNAServer) systemUpdateID() string {
+	return strconv.FormatInt(time.Now().Unix()/60%(1<<31), 10)
+}
+
+// 电视通过HEAD或GET时的 getcontentFeatures.dlna.org 头确认是否支持跳转
+func dlnaStreamHeaders(c *gin.Context) {
+	if c.GetHeader("getcontentFeatures.dlna.org") == "1" {
+		c.Header("contentFeatures.dlna.org", dlnaContentFeatures)
+	}
+	if c.GetHeader("transferMode.dlna.org") != "" || c.GetHeader("getcontentFeatures.dlna.org") != "" {
+		c.Header("transferMode.dlna.org", "Streaming")
+	}
+	c.Next()
+}
+
+func dlnaSubscriptionID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	h := hex.EncodeToString(buf)
+	return fmt.Sprintf("uuid:%s-%s-%s-%s-%s", h[:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+// 设置DLNA路由
+func setupDLNARoutes(r *gin.Engine, d *DLNAServer) {
+	xmlContentType := `text/xml; charset="utf-8"`
+
+	// 设备和服务描述
+	r.GET("/dlna/device.xml", func(c *gin.Context) {
+		c.Data(http.StatusOK, xmlContentType, []byte(d.deviceDescription()))
+	})
+	r.GET("/dlna/ContentDirectory.xml", func(c *gin.Context) {
+		c.Data(http.StatusOK, xmlContentType, []byte(contentDirectorySCPD))
+	})
+	r.GET("/dlna/ConnectionManager.xml", func(c *gin.Context) {
+		c.Data(http.StatusOK, xmlContentType, []byte(connectionManagerSCPD))
+	})
+
+	// 内容目录: Browse等SOAP动作
+	r.POST("/dlna/control/ContentDirectory", func(c *gin.Context) {
+		action, args, err := parseSOAPAction(c.Request.Body)
+		if err != nil {
+			writeSOAPError(c, 401, err.Error())
+			return
+		}
+
+		switch action {
+		case "Browse":
+			d.browse(c, args)
+		case "GetSearchCapabilities":
+			writeSOAPResponse(c, contentDirectoryType, action, soapArg{"SearchCaps", ""})
+		case "GetSortCapabilities":
+			writeSOAPResponse(c, contentDirectoryType, action, soapArg{"SortCaps", ""})
+		case "GetSystemUpdateID":
+			writeSOAPResponse(c, contentDirectoryType, action, soapArg{"Id", d.systemUpdateID()})
+		default:
+			writeSOAPError(c, 401, "不支持的动作: "+action)
+		}
+	})
+
+	r.POST("/dlna/control/ConnectionManager", func(c *gin.Context) {
+		action, _, err := parseSOAPAction(c.Request.Body)
+		if err != nil {
+			writeSOAPError(c, 401, err.Error())
+			return
+		}
+
+		switch action {
+		case "GetProtocolInfo":
+			var sources []string
+			for _, ext := range []string{".mp4", ".avi", ".mkv", ".mov", ".wmv", ".flv", ".webm", ".m4v"} {
+				sources = append(sources, "http-get:*:"+getContentType(ext)+":*")
+			}
+			writeSOAPResponse(c, connectionManagerType, action, soapArg{"Source", strings.Join(sources, ",")}, soapArg{"Sink", ""})
+		case "GetCurrentConnectionIDs":
+			writeSOAPResponse(c, connectionManagerType, action, soapArg{"ConnectionIDs", "0"})
+		case "GetCurrentConnectionInfo":
+			writeSOAPResponse(c, connectionManagerType, action,
+				soapArg{"RcsID", "-1"},
+				soapArg{"AVTransportID", "-1"},
+				soapArg{"ProtocolInfo", ""},
+				soapArg{"PeerConnectionManager", ""},
+				soapArg{"PeerConnectionID", "-1"},
+				soapArg{"Direction", "Output"},
+				soapArg{"Status", "OK"},
+			)
+		default:
+			writeSOAPError(c, 401, "不支持的动作: "+action)
+		}
+	})
+
+	// 事件订阅：部分电视要求订阅成功才会继续浏览，这里只应答不推送事件
+	r.Handle("SUBSCRIBE", "/dlna/event/:service", func(c *gin.Context) {
+		sid := c.GetHeader("SID")
+		if sid == "" {
+			sid = dlnaSubscriptionID()
+		}
+		c.Header("SID", sid)
+		c.Header("TIMEOUT", "Second-1800")
+		c.Status(http.StatusOK)
+	})
+	r.Handle("UNSUBSCRIBE", "/dlna/event/:service", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLocalChildCount(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.mkv", "b.mp4", "c.txt", ".hidden.mkv"} {
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	os.Mkdir(filepath.Join(dir, "season1"), 0755)
+	os.Mkdir(filepath.Join(dir, ".thumbnails"), 0755)
+
+	if got := localChildCount(dir); got != 3 {
+		t.Fatalf("localChildCount = %d, 期望 3", got)
+	}
+	if got := localChildCount(filepath.Join(dir, "missing")); got != 0 {
+		t.Fatalf("不存在的目录应返回0，实际 %d", got)
+	}
+}
+
+func browseRequest(objectID string, flag string, start int, count int) string {
+	return xml.Header + `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+		`<u:Browse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1">` +
+		`<ObjectID>` + objectID + `</ObjectID><BrowseFlag>` + flag + `</BrowseFlag><Filter>*</Filter>` +
+		`<StartingIndex>` + strconv.Itoa(start) + `</StartingIndex><RequestedCount>` + strconv.Itoa(count) + `</RequestedCount>` +
+		`<SortCriteria></SortCriteria></u:Browse></s:Body></s:Envelope>`
+}
+
+func TestDLNABrowse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ts := newTestTorrentService(t)
+	for _, name := range []string{"Show.E10.mkv", "Show.E2.mkv", "Show.E1.mkv", "notes.txt"} {
+		os.WriteFile(filepath.Join(ts.downloadDir, name), []byte("x"), 0644)
+	}
+	os.Mkdir(filepath.Join(ts.downloadDir, "Season 1"), 0755)
+
+	r := gin.New()
+	setupDLNARoutes(r, NewDLNAServer(ts, DLNAConfig{Enabled: true}, 0))
+
+	tests := []struct {
+		name     string
+		objectID string
+		flag     string
+		start    int
+		count    int
+		// 返回的对象ID，目录在前，按集数排序
+		want  []string
+		total string
+		code  string
+	}{
+		{"全部子对象", "local", "BrowseDirectChildren", 0, 0, []string{"local/Season 1", "local/Show.E1.mkv", "local/Show.E2.mkv", "local/Show.E10.mkv"}, "4", ""},
+		{"分页", "local", "BrowseDirectChildren", 1, 2, []string{"local/Show.E1.mkv", "local/Show.E2.mkv"}, "4", ""},
+		{"数量超出剩余对象", "local", "BrowseDirectChildren", 3, 10, []string{"local/Show.E10.mkv"}, "4", ""},
+		{"起始位置超出对象数", "local", "BrowseDirectChildren", 10, 5, nil, "4", ""},
+		{"根目录", "0", "BrowseDirectChildren", 0, 0, []string{"local", "torrents"}, "2", ""},
+		{"对象元数据", "local/Show.E2.mkv", "BrowseMetadata", 0, 0, []string{"local/Show.E2.mkv"}, "1", ""},
+		{"对象不存在", "local/missing", "BrowseDirectChildren", 0, 0, nil, "", "701"},
+		{"下载目录以外的路径", "local/../..", "BrowseDirectChildren", 0, 0, nil, "", "701"},
+		{"无效的BrowseFlag", "local", "BrowseAll", 0, 0, nil, "", "402"},
+		{"负数起始位置", "local", "BrowseDirectChildren", -1, 0, nil, "", "402"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/dlna/control/ContentDirectory", strings.NewReader(browseRequest(tt.objectID, tt.flag, tt.start, tt.count)))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			action, args, err := parseSOAPAction(strings.NewReader(w.Body.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" {
+				if w.Code != http.StatusInternalServerError || action != "Fault" || !strings.Contains(w.Body.String(), "<errorCode>"+tt.code+"</errorCode>") {
+					t.Fatalf("状态码 %d, 响应 %s %v, 期望错误 %s", w.Code, action, args, tt.code)
+				}
+				return
+			}
+			if w.Code != http.StatusOK || action != "BrowseResponse" {
+				t.Fatalf("状态码 %d, 动作 %s", w.Code, action)
+			}
+
+			var didl didlLite
+			if err := xml.Unmarshal([]byte(args["Result"]), &didl); err != nil {
+				t.Fatalf("解析DIDL失败: %v", err)
+			}
+			var got []string
+			for _, container := range didl.Containers {
+				got = append(got, container.ID)
+			}
+			for _, item := range didl.Items {
+				got = append(got, item.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("对象 %v, 期望 %v", got, tt.want)
+			}
+			if args["NumberReturned"] != strconv.Itoa(len(tt.want)) || args["TotalMatches"] != tt.total {
+				t.Fatalf("NumberReturned %s, TotalMatches %s", args["NumberReturned"], args["TotalMatches"])
+			}
+		})
+	}
+}
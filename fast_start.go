@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// 无论容器类型都优先下载的文件头和文件尾
+const (
+	fastStartHeadBytes = 2 * 1024 * 1024
+	fastStartTailBytes = 1 * 1024 * 1024
+)
+
+// 索引定位的最长等待时间，超时后按普通顺序下载
+const fastStartTimeout = 10 * time.Minute
+
+// 开始播放前需要的区域：MP4的moov，MKV的SeekHead、Info、Tracks和Cues
+type mediaRegion struct {
+	Name   string
+	Start  int64
+	Length int64
+}
+
+// 解析出头部和索引所在的区域。读取到尚未下载的数据时停止，pending为需要先下载的偏移，
+// 全部定位完成时pending为-1
+func locateMediaRegions(r io.ReaderAt, size int64) ([]mediaRegion, int64, error) {
+	head := make([]byte, 12)
+	if size < int64(len(head)) {
+		return nil, -1, errUnsupportedContainer
+	}
+	if _, err := r.ReadAt(head, 0); err != nil {
+		if errors.Is(err, errMediaDataUnavailable) {
+			return nil, 0, nil
+		}
+		return nil, -1, err
+	}
+
+	switch {
+	case string(head[4:8]) == "ftyp":
+		return locateMP4Regions(r, size)
+	case binary.BigEndian.Uint32(head) == ebmlIDHeader:
+		return locateMatroskaRegions(r, size)
+	}
+	return nil, -1, errUnsupportedContainer
+}
+
+// 逐个读取顶层box头直到找到moov，moov在文件末尾时只需下载各box头所在的piece
+func locateMP4Regions(r io.ReaderAt, size int64) ([]mediaRegion, int64, error) {
+	for offset := int64(0); size-offset >= 8; {
+		box, err := readMP4Box(r, offset, size)
+		if errors.Is(err, errMediaDataUnavailable) {
+			return nil, offset, nil
+		}
+		if err != nil {
+			return nil, -1, err
+		}
+		if box.typ == "moov" {
+			return []mediaRegion{{Name: "moov", Start: box.offset, Length: box.size}}, -1, nil
+		}
+		offset = box.end()
+	}
+	return nil, -1, fmt.Errorf("MP4文件缺少moov")
+}
+
+// Cluster之前的元素按顺序读取，位于Cluster之后的Tracks和Cues通过SeekHead定位
+func locateMatroskaRegions(r io.ReaderAt, size int64) ([]mediaRegion, int64, error) {
+	_, headerSize, headerLen, err := readEBMLElementHeader(r, 0, size)
+	if errors.Is(err, errMediaDataUnavailable) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	if headerSize == ebmlUnknownSize {
+		return nil, -1, fmt.Errorf("无效的EBML头")
+	}
+
+	segmentOffset := headerLen + headerSize
+	id, segmentSize, segmentHeaderLen, err := readEBMLElementHeader(r, segmentOffset, size)
+	if errors.Is(err, errMediaDataUnavailable) {
+		return nil, segmentOffset, nil
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	if id != mkvIDSegment {
+		return nil, -1, fmt.Errorf("Matroska文件缺少Segment")
+	}
+	segmentStart := segmentOffset + segmentHeaderLen
+	segmentEnd := size
+	if segmentSize != ebmlUnknownSize && segmentStart+segmentSize < size {
+		segmentEnd = segmentStart + segmentSize
+	}
+
+	names := map[uint32]string{mkvIDSeekHead: "SeekHead", mkvIDInfo: "Info", mkvIDTracks: "Tracks", mkvIDCues: "Cues"}
+	found := make(map[uint32]bool)
+	positions := make(map[uint32]int64)
+	var regions []mediaRegion
+
+	for offset := segmentStart; offset < segmentEnd; {
+		id, elementSize, elementHeaderLen, err := readEBMLElementHeader(r, offset, segmentEnd)
+		if errors.Is(err, errMediaDataUnavailable) {
+			return regions, offset, nil
+		}
+		if err != nil {
+			return nil, -1, err
+		}
+		if id == mkvIDCluster || elementSize == ebmlUnknownSize || elementSize > segmentEnd-offset-elementHeaderLen {
+			break
+		}
+
+		if name, ok := names[id]; ok {
+			regions = append(regions, mediaRegion{Name: name, Start: offset, Length: elementHeaderLen + elementSize})
+			found[id] = true
+			if id == mkvIDSeekHead && elementSize <= maxMediaHeaderElement {
+				data := make([]byte, elementSize)
+				if _, err := r.ReadAt(data, offset+elementHeaderLen); err != nil {
+					if errors.Is(err, errMediaDataUnavailable) {
+						return regions, offset, nil
+					}
+					return nil, -1, err
+				}
+				parseMatroskaSeekHead(data, segmentStart, positions)
+			}
+		}
+		offset += elementHeaderLen + elementSize
+	}
+
+	for _, id := range []uint32{mkvIDInfo, mkvIDTracks, mkvIDCues} {
+		// SeekPosition来自文件内容，过大的值与segmentStart相加后会溢出为负数
+		position, ok := positions[id]
+		if found[id] || !ok || position < segmentStart || position >= segmentEnd {
+			continue
+		}
+		_, elementSize, elementHeaderLen, err := readEBMLElementHeader(r, position, segmentEnd)
+		if errors.Is(err, errMediaDataUnavailable) {
+			return regions, position, nil
+		}
+		if err != nil || elementSize == ebmlUnknownSize || elementSize > segmentEnd-position-elementHeaderLen {
+			continue
+		}
+		regions = append(regions, mediaRegion{Name: names[id], Start: position, Length: elementHeaderLen + elementSize})
+	}
+	return regions, -1, nil
+}
+
+// 一次快速启动对piece的优先级声明，与播放请求的声明共同决定piece的优先级，
+// 快速启动结束时撤销
+type mediaIndexClaim struct {
+	file   *torrent.File
+	pieces map[int]bool
+}
+
+func newMediaIndexClaim(file *torrent.File) *mediaIndexClaim {
+	return &mediaIndexClaim{file: file, pieces: make(map[int]bool)}
+}
+
+// 将文件内的字节范围对应的piece设为最高优先级，播放请求撤销自己的声明后仍然保持
+func (sts *SimpleTorrentService) prioritizeFileRange(claim *mediaIndexClaim, start, length int64) {
+	file := claim.file
+	if start < 0 {
+		length += start
+		start = 0
+	}
+	if start+length > file.Length() {
+		length = file.Length() - start
+	}
+	if length <= 0 {
+		return
+	}
+
+	t := file.Torrent()
+	pieceLength := t.Info().PieceLength
+	startPiece := int((file.Offset() + start) / pieceLength)
+	endPiece := int((file.Offset() + start + length - 1) / pieceLength)
+	for index := startPiece; index <= endPiece && index < t.NumPieces(); index++ {
+		if !claim.pieces[index] && !t.Piece(index).State().Complete {
+			claim.pieces[index] = true
+			sts.streamPriorities.set(claim, streamPieceKey{t, index}, torrent.PiecePriorityNow)
+		}
+	}
+}
+
+// 撤销快速启动的所有声明，任务已关闭时声明已随任务清理
+func (sts *SimpleTorrentService) releaseMediaIndexClaim(claim *mediaIndexClaim) {
+	t := claim.file.Torrent()
+	select {
+	case <-t.Closed():
+		return
+	default:
+	}
+	for index := range claim.pieces {
+		sts.streamPriorities.set(claim, streamPieceKey{t, index}, torrent.PiecePriorityNone)
+	}
+}
+
+func mediaRegionsComplete(file *torrent.File, regions []mediaRegion) bool {
+	for _, region := range regions {
+		if !isTorrentPositionPlayable(file, region.Start, region.Length) {
+			return false
+		}
+	}
+	return true
+}
+
+// 快速启动：立即下载文件头、文件尾，再逐步定位并下载moov或MKV索引，
+// 每个文件同时只运行一个
+func (sts *SimpleTorrentService) prioritizeMediaIndex(file *torrent.File) {
+	key := file.Torrent().InfoHash().HexString() + "/" + file.Path()
+	sts.probeMutex.Lock()
+	if sts.fastStarts[key] {
+		sts.probeMutex.Unlock()
+		return
+	}
+	sts.fastStarts[key] = true
+	sts.probeMutex.Unlock()
+
+	go func() {
+		claim := newMediaIndexClaim(file)
+		defer func() {
+			// 种子内容不可信，解析异常时只放弃快速启动，不影响服务
+			if recovered := recover(); recovered != nil {
+				log.Printf("定位媒体索引失败: %s, %v", file.Path(), recovered)
+			}
+			// 结束后（索引就绪、不支持的容器、超时或任务关闭）恢复这些piece的优先级，
+			// 之后由播放请求的调度决定
+			sts.releaseMediaIndexClaim(claim)
+			sts.probeMutex.Lock()
+			delete(sts.fastStarts, key)
+			sts.probeMutex.Unlock()
+		}()
+
+		sts.prioritizeFileRange(claim, 0, fastStartHeadBytes)
+		sts.prioritizeFileRange(claim, file.Length()-fastStartTailBytes, fastStartTailBytes)
+
+		deadline := time.After(fastStartTimeout)
+		for {
+			regions, pending, err := sts.mediaRegions(file)
+			if err != nil {
+				// 无法解析的容器只依赖文件头和文件尾
+				return
+			}
+			for _, region := range regions {
+				sts.prioritizeFileRange(claim, region.Start, region.Length)
+			}
+			if pending < 0 {
+				if mediaRegionsComplete(file, regions) {
+					log.Printf("媒体索引已就绪: %s", file.Path())
+					return
+				}
+			} else {
+				sts.prioritizeFileRange(claim, pending, 16)
+			}
+
+			select {
+			case <-file.Torrent().Closed():
+				return
+			case <-deadline:
+				log.Printf("等待媒体索引超时: %s", file.Path())
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	}()
+}
+
+// 定位结果在全部找到后缓存
+func (sts *SimpleTorrentService) mediaRegions(file *torrent.File) ([]mediaRegion, int64, error) {
+	key := file.Torrent().InfoHash().HexString() + "/" + file.Path()
+	sts.probeMutex.Lock()
+	regions, ok := sts.mediaIndexes[key]
+	sts.probeMutex.Unlock()
+	if ok {
+		return regions, -1, nil
+	}
+
+	regions, pending, err := locateMediaRegions(torrentPieceReaderAt{file: file}, file.Length())
+	if err != nil || pending >= 0 {
+		return regions, pending, err
+	}
+
+	sts.probeMutex.Lock()
+	sts.mediaIndexes[key] = regions
+	sts.probeMutex.Unlock()
+	return regions, -1, nil
+}
+
+// 头部和索引都已下载时才可以开始播放
+func (sts *SimpleTorrentService) mediaIndexReady(file *torrent.File) bool {
+	regions, pending, err := sts.mediaRegions(file)
+	return err == nil && pending < 0 && mediaRegionsComplete(file, regions)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// 构造EBML元素：ID按原样写入，大小固定使用8字节变长整数
+func ebmlElement(id uint32, payload ...[]byte) []byte {
+	var buf bytes.Buffer
+	idBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBytes, id)
+	for len(idBytes) > 1 && idBytes[0] == 0 {
+		idBytes = idBytes[1:]
+	}
+	buf.Write(idBytes)
+
+	data := bytes.Join(payload, nil)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(data)))
+	size[0] = 0x01
+	buf.Write(size)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func ebmlUintBytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func ebmlIDBytes(id uint32) []byte {
+	b := ebmlUintBytes(uint64(id))
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// SeekHead中指向Tracks的单条Seek
+func matroskaSeek(id uint32, position uint64) []byte {
+	return ebmlElement(mkvIDSeek,
+		ebmlElement(mkvIDSeekID, ebmlIDBytes(id)),
+		ebmlElement(mkvIDSeekPosition, ebmlUintBytes(position)),
+	)
+}
+
+// EBML头 + Segment，Segment中包含给定的子元素
+func matroskaFile(children ...[]byte) []byte {
+	header := ebmlElement(ebmlIDHeader, ebmlElement(ebmlIDDocType, []byte("matroska")))
+	return append(header, ebmlElement(mkvIDSegment, children...)...)
+}
+
+func TestLocateMatroskaRegionsRejectsInvalidSeekPositions(t *testing.T) {
+	tests := []struct {
+		name     string
+		position uint64
+	}{
+		{"溢出为负数", math.MaxInt64},
+		{"超出uint63", math.MaxUint64},
+		{"超出Segment", 1 << 40},
+		{"指向Segment末尾", 0xFFFF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := matroskaFile(ebmlElement(mkvIDSeekHead, matroskaSeek(mkvIDTracks, tt.position)))
+			regions, pending, err := locateMediaRegions(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatalf("不应返回错误: %v", err)
+			}
+			if pending != -1 {
+				t.Fatalf("pending = %d, 期望 -1", pending)
+			}
+			for _, region := range regions {
+				if region.Name == "Tracks" {
+					t.Fatalf("不应定位到Tracks: %+v", region)
+				}
+			}
+		})
+	}
+}
+
+func TestLocateMatroskaRegionsFollowsSeekHead(t *testing.T) {
+	tracks := ebmlElement(mkvIDTracks, ebmlElement(mkvIDTrackEntry, ebmlElement(mkvIDTrackNumber, []byte{1})))
+	cluster := ebmlElement(mkvIDCluster, make([]byte, 64))
+
+	// SeekHead自身长度固定，先用占位位置计算Tracks的偏移
+	seekHead := ebmlElement(mkvIDSeekHead, matroskaSeek(mkvIDTracks, 0))
+	position := uint64(len(seekHead) + len(cluster))
+	seekHead = ebmlElement(mkvIDSeekHead, matroskaSeek(mkvIDTracks, position))
+	data := matroskaFile(seekHead, cluster, tracks)
+
+	regions, pending, err := locateMediaRegions(bytes.NewReader(data), int64(len(data)))
+	if err != nil || pending != -1 {
+		t.Fatalf("定位失败: pending=%d, err=%v", pending, err)
+	}
+	var found *mediaRegion
+	for i := range regions {
+		if regions[i].Name == "Tracks" {
+			found = &regions[i]
+		}
+	}
+	if found == nil {
+		t.Fatalf("未找到Tracks: %+v", regions)
+	}
+	if found.Start+found.Length != int64(len(data)) || found.Length != int64(len(tracks)) {
+		t.Fatalf("Tracks区域错误: %+v, 文件大小 %d", *found, len(data))
+	}
+}
+
+func TestLocateMatroskaRegionsTruncatedElement(t *testing.T) {
+	// 元素声明的大小超出Segment时停止遍历
+	info := ebmlElement(mkvIDInfo, make([]byte, 16))
+	binary.BigEndian.PutUint64(info[4:], 1<<50)
+	info[4] = 0x01
+	data := matroskaFile(info)
+	if _, _, err := locateMediaRegions(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("不应返回错误: %v", err)
+	}
+}
+
+func TestLocateMP4RegionsFindsMoov(t *testing.T) {
+	box := func(typ string, payload []byte) []byte {
+		b := make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+		copy(b[4:], typ)
+		return append(b, payload...)
+	}
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00"))
+	mdat := box("mdat", make([]byte, 100))
+	moov := box("moov", box("mvhd", make([]byte, 100)))
+	data := bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+
+	regions, pending, err := locateMediaRegions(bytes.NewReader(data), int64(len(data)))
+	if err != nil || pending != -1 {
+		t.Fatalf("定位失败: pending=%d, err=%v", pending, err)
+	}
+	if len(regions) != 1 || regions[0].Start != int64(len(ftyp)+len(mdat)) || regions[0].Length != int64(len(moov)) {
+		t.Fatalf("moov区域错误: %+v", regions)
+	}
+
+	// box大小超出文件时返回错误而不是越界
+	binary.BigEndian.PutUint32(data[len(ftyp):], 0xFFFFFFF0)
+	if _, _, err := locateMediaRegions(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Fatalf("期望返回错误")
+	}
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
+)
+
+// HLS转码管理 - 调用本地ffmpeg将浏览器无法直接播放的视频按需转码为HLS分片
+type HLSManager struct {
+	ts       *SimpleTorrentService
+	config   TranscodeConfig
+	ffmpeg   string
+	ffprobe  string
+	cacheDir string
+	// 内部HTTP服务地址，ffmpeg通过它读取torrent数据（支持seek）
+	inputBase string
+	sessions  map[string]*hlsSession
+	// token -> 文件，key(hash-索引) -> token，token -> 最近使用时间；
+	// 字幕提取等不属于转码会话的输入按最近使用时间过期
+	inputs      map[string]*torrent.File
+	inputTokens map[string]string
+	inputAccess map[string]time.Time
+	mutex       sync.Mutex
+}
+
+// 单个文件的转码会话
+type hlsSession struct {
+	key      string
+	dir      string
+	input    string
+	duration float64
+	segments int
+
+	mutex    sync.Mutex
+	prepared bool
+	// 已被清理，持有该会话的请求需要重新创建
+	removed    bool
+	lastAccess time.Time
+	cmd        *exec.Cmd
+	// 当前转码进程的起始分片
+	cmdStart int
+	cmdDone  chan struct{}
+}
+
+func NewHLSManager(ts *SimpleTorrentService, config TranscodeConfig) *HLSManager {
+	hm := &HLSManager{
+		ts:          ts,
+		config:      config,
+		cacheDir:    filepath.Join(ts.downloadDir, ".hls"),
+		sessions:    make(map[string]*hlsSession),
+		inputs:      make(map[string]*torrent.File),
+		inputTokens: make(map[string]string),
+		inputAccess: make(map[string]time.Time),
+	}
+
+	hm.ffmpeg = findExecutable(config.FFmpegPath, "ffmpeg")
+	hm.ffprobe = findExecutable(config.FFprobePath, "ffprobe")
+	if !hm.Available() {
+		log.Printf("未找到ffmpeg/ffprobe，HLS转码不可用")
+		return hm
+	}
+
+	if err := hm.startInputServer(); err != nil {
+		log.Printf("启动转码输入服务失败: %v", err)
+		hm.ffmpeg = ""
+		return hm
+	}
+
+	// 上次运行留下的分片缓存
+	os.RemoveAll(hm.cacheDir)
+
+	log.Printf("HLS转码已启用: %s", hm.ffmpeg)
+	go hm.reapIdle()
+	return hm
+}
+
+func findExecutable(configured string, name string) string {
+	if configured != "" {
+		name = configured
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+func (hm *HLSManager) Available() bool {
+	return hm.ffmpeg != "" && hm.ffprobe != ""
+}
+
+func (hm *HLSManager) segmentSeconds() int {
+	if hm.config.SegmentSeconds > 0 {
+		return hm.config.SegmentSeconds
+	}
+	return 6
+}
+
+// 只监听本机回环地址，ffmpeg通过Range请求读取torrent文件
+func (hm *HLSManager) startInputServer() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	hm.inputBase = "http://" + listener.Addr().String()
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+	inputHandler := func(c *gin.Context) {
+		token := c.Param("token")
+		if !hm.touchInput(token) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		// 读取时间较长时结束后再次记录，避免读取期间过期
+		defer hm.touchInput(token)
+
+		hm.mutex.Lock()
+		file := hm.inputs[token]
+		hm.mutex.Unlock()
+		// ffmpeg的读取登记为播放会话，计入max_sessions
+		serveScheduledTorrentFile(c, hm.ts, file, "application/octet-stream", -1)
+	}
+	r.GET("/input/:token", inputHandler)
+	r.HEAD("/input/:token", inputHandler)
+
+	go func() {
+		if err := http.Serve(listener, r); err != nil {
+			log.Printf("转码输入服务已停止: %v", err)
+		}
+	}()
+	return nil
+}
+
+// 获取或创建torrent文件的转码会话
+func (hm *HLSManager) session(hash string, fileIndex int) (*hlsSession, error) {
+	files, err := hm.ts.GetTorrentFiles(hash)
+	if err != nil {
+		return nil, err
+	}
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return nil, fmt.Errorf("文件索引无效: %d", fileIndex)
+	}
+
+	key := fmt.Sprintf("%s-%d", hash, fileIndex)
+	return hm.openSession(key, func() string {
+		return hm.inputURLLocked(key, files[fileIndex])
+	})
+}
+
+// 获取或创建下载目录中本地文件的转码会话，ffmpeg直接读取文件；
+// 属于未完成torrent任务的文件通过内部输入服务读取
+func (hm *HLSManager) localSession(relPath string) (*hlsSession, error) {
+	filePath, ok := downloadFilePath(relPath)
+	if !ok {
+		return nil, fmt.Errorf("非法的文件路径: %s", relPath)
+	}
+	if info, err := os.Stat(filePath); err != nil || info.IsDir() {
+		return nil, fmt.Errorf("文件不存在: %s", relPath)
+	}
+
+	sum := sha1.Sum([]byte(relPath))
+	key := "local-" + hex.EncodeToString(sum[:8])
+	return hm.openSession(key, func() string {
+		if torrentFile := hm.ts.LocalTorrentFile(filePath); torrentFile != nil && torrentFile.BytesCompleted() < torrentFile.Length() {
+			return hm.inputURLLocked(key, torrentFile)
+		}
+		return absPath(filePath)
+	})
+}
+
+// input在持有管理器锁时调用。获取时长期间持有会话锁，
+// 清理协程只尝试加锁，不会与ffprobe读取输入服务（需要管理器锁）互相等待
+func (hm *HLSManager) openSession(key string, input func() string) (*hlsSession, error) {
+	for {
+		hm.mutex.Lock()
+		s, exists := hm.sessions[key]
+		if !exists {
+			s = &hlsSession{
+				key:   key,
+				dir:   filepath.Join(hm.cacheDir, key),
+				input: input(),
+			}
+			hm.sessions[key] = s
+		}
+		hm.mutex.Unlock()
+
+		s.mutex.Lock()
+		if s.removed {
+			// 会话刚被清理，重新创建
+			s.mutex.Unlock()
+			continue
+		}
+		s.lastAccess = time.Now()
+		var err error
+		if !s.prepared {
+			err = hm.prepare(s)
+		}
+		s.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+}
+
+// ffmpeg读取torrent文件的内部地址，调用方需持有锁
+func (hm *HLSManager) inputURLLocked(key string, file *torrent.File) string {
+	token, exists := hm.inputTokens[key]
+	if !exists {
+		token = randomToken()
+		hm.inputTokens[key] = token
+		hm.inputs[token] = file
+	}
+	hm.inputAccess[token] = time.Now()
+	return hm.inputBase + "/input/" + token
+}
+
+// 记录输入的使用时间，token不存在时返回false
+func (hm *HLSManager) touchInput(token string) bool {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	if _, exists := hm.inputs[token]; !exists {
+		return false
+	}
+	hm.inputAccess[token] = time.Now()
+	return true
+}
+
+// ffmpeg读取torrent文件的内部地址
+func (hm *HLSManager) inputURL(hash string, fileIndex int, file *torrent.File) string {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	return hm.inputURLLocked(fmt.Sprintf("%s-%d", hash, fileIndex), file)
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 获取时长并计算分片数量，调用方需持有会话锁
+func (hm *HLSManager) prepare(s *hlsSession) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, hm.ffprobe,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		s.input,
+	).Output()
+	if err != nil {
+		return fmt.Errorf("获取视频时长失败: %v", err)
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("无法识别视频时长: %s", strings.TrimSpace(string(out)))
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("创建转码缓存目录失败: %v", err)
+	}
+
+	segment := float64(hm.segmentSeconds())
+	s.duration = duration
+	s.segments = int(math.Ceil(duration / segment))
+	s.prepared = true
+	log.Printf("HLS会话: %s, 时长: %.1fs, 分片: %d", s.key, duration, s.segments)
+	return nil
+}
+
+// 按固定时长生成完整的VOD播放列表，播放器可直接跳转到任意分片
+func (hm *HLSManager) playlist(s *hlsSession) string {
+	segment := float64(hm.segmentSeconds())
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", hm.segmentSeconds()+1)
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i := 0; i < s.segments; i++ {
+		length := segment
+		if remaining := s.duration - float64(i)*segment; remaining < segment {
+			length = remaining
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.6f,\n%s\n", length, segmentName(i))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+func segmentName(index int) string {
+	return fmt.Sprintf("seg_%05d.ts", index)
+}
+
+// 解析分片文件名，返回分片序号
+func parseSegmentName(name string) (int, bool) {
+	if !strings.HasPrefix(name, "seg_") || !strings.HasSuffix(name, ".ts") {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "seg_"), ".ts"))
+	return index, err == nil && index >= 0
+}
+
+// 等待分片转码完成并返回分片路径
+func (hm *HLSManager) segment(ctx context.Context, s *hlsSession, index int) (string, error) {
+	path := filepath.Join(s.dir, segmentName(index))
+
+	s.mutex.Lock()
+	if s.removed {
+		s.mutex.Unlock()
+		return "", fmt.Errorf("转码会话已清理，请重新加载播放列表")
+	}
+	s.lastAccess = time.Now()
+	if fileExists(path) {
+		s.mutex.Unlock()
+		return path, nil
+	}
+	done := hm.ensureTranscoding(s, index)
+	s.mutex.Unlock()
+
+	// ffmpeg使用temp_file写入，分片文件出现即表示已完成
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(2 * time.Minute)
+
+	for {
+		if fileExists(path) {
+			return path, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			if fileExists(path) {
+				return path, nil
+			}
+			return "", fmt.Errorf("转码进程已退出，分片 %d 未生成", index)
+		case <-timeout:
+			return "", fmt.Errorf("等待分片 %d 超时", index)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// 请求的分片不在当前转码进程即将生成的范围内时（如快进），从该分片重新开始转码
+// 调用方需持有会话锁
+func (hm *HLSManager) ensureTranscoding(s *hlsSession, index int) chan struct{} {
+	if s.cmd != nil {
+		select {
+		case <-s.cmdDone:
+		default:
+			if index >= s.cmdStart && index <= hm.nextSegment(s)+3 {
+				return s.cmdDone
+			}
+			log.Printf("HLS跳转到分片 %d，重新开始转码: %s", index, s.key)
+			s.cmd.Process.Kill()
+			<-s.cmdDone
+		}
+	}
+
+	start := float64(index * hm.segmentSeconds())
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', 3, 64))
+	}
+	args = append(args,
+		"-i", s.input,
+		"-map", "0:v:0?", "-map", "0:a:0?", "-sn",
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		// 在分片边界强制关键帧，保证每个分片时长与播放列表一致
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hm.segmentSeconds()),
+		"-c:a", "aac", "-ac", "2", "-b:a", "160k",
+		"-output_ts_offset", strconv.FormatFloat(start, 'f', 3, 64),
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hm.segmentSeconds()),
+		"-hls_list_size", "0",
+		"-hls_flags", "temp_file",
+		"-start_number", strconv.Itoa(index),
+		"-hls_segment_filename", filepath.Join(s.dir, "seg_%05d.ts"),
+		filepath.Join(s.dir, "ffmpeg.m3u8"),
+	)
+
+	cmd := exec.Command(hm.ffmpeg, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	done := make(chan struct{})
+	if err := cmd.Start(); err != nil {
+		log.Printf("启动ffmpeg失败: %v", err)
+		close(done)
+		return done
+	}
+	log.Printf("开始HLS转码: %s, 起始分片: %d", s.key, index)
+
+	s.cmd = cmd
+	s.cmdStart = index
+	s.cmdDone = done
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil && stderr.Len() > 0 {
+			log.Printf("ffmpeg退出: %s, %v: %s", s.key, err, strings.TrimSpace(stderr.String()))
+		}
+		close(done)
+	}()
+	return done
+}
+
+// 当前转码进程下一个将生成的分片，调用方需持有会话锁
+func (hm *HLSManager) nextSegment(s *hlsSession) int {
+	next := s.cmdStart
+	for next < s.segments && fileExists(filepath.Join(s.dir, segmentName(next))) {
+		next++
+	}
+	return next
+}
+
+// 停止空闲的转码进程，清理过期的分片缓存
+func (hm *HLSManager) reapIdle() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	idleTimeout := time.Duration(hm.config.IdleTimeoutSeconds) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute
+	}
+	cacheTimeout := time.Duration(hm.config.CacheMinutes) * time.Minute
+	if cacheTimeout < idleTimeout {
+		cacheTimeout = idleTimeout
+	}
+
+	for range ticker.C {
+		hm.reapOnce(idleTimeout, cacheTimeout)
+	}
+}
+
+func (hm *HLSManager) reapOnce(idleTimeout time.Duration, cacheTimeout time.Duration) {
+	// 先复制会话列表，检查会话时不持有管理器锁
+	hm.mutex.Lock()
+	sessions := make([]*hlsSession, 0, len(hm.sessions))
+	for _, s := range hm.sessions {
+		sessions = append(sessions, s)
+	}
+	hm.mutex.Unlock()
+
+	for _, s := range sessions {
+		// 正在获取时长的会话跳过，下次再检查
+		if !s.mutex.TryLock() {
+			continue
+		}
+		key := s.key
+		idle := time.Since(s.lastAccess)
+
+		if s.cmd != nil && idle > idleTimeout {
+			select {
+			case <-s.cmdDone:
+			default:
+				log.Printf("停止空闲的HLS转码: %s", key)
+				s.cmd.Process.Kill()
+			}
+		}
+
+		if idle > cacheTimeout {
+			s.removed = true
+			os.RemoveAll(s.dir)
+			hm.mutex.Lock()
+			delete(hm.sessions, key)
+			hm.removeInputLocked(key)
+			hm.mutex.Unlock()
+			log.Printf("清理HLS缓存: %s", key)
+		}
+		s.mutex.Unlock()
+	}
+
+	// 没有转码会话的输入（字幕提取）超过缓存时间未使用时失效
+	hm.mutex.Lock()
+	for key, token := range hm.inputTokens {
+		if _, exists := hm.sessions[key]; !exists && time.Since(hm.inputAccess[token]) > cacheTimeout {
+			hm.removeInputLocked(key)
+		}
+	}
+	hm.mutex.Unlock()
+}
+
+// 删除key对应的输入地址，调用方需持有锁
+func (hm *HLSManager) removeInputLocked(key string) {
+	token := hm.inputTokens[key]
+	delete(hm.inputs, token)
+	delete(hm.inputAccess, token)
+	delete(hm.inputTokens, key)
+}
+
+// 设置HLS路由
+func setupHLSRoutes(r *gin.Engine, hm *HLSManager) {
+	// 转码是否可用，播放页据此决定是否回退到HLS
+	r.GET("/hls/capabilities", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"available":       hm.Available(),
+			"segment_seconds": hm.segmentSeconds(),
+		})
+	})
+
+	// 播放列表: /hls/:hash/:fileIndex/index.m3u8，分片: /hls/:hash/:fileIndex/seg_00000.ts
+	r.GET("/hls/:hash/:fileIndex/:name", func(c *gin.Context) {
+		if !hm.Available() {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "未找到ffmpeg，HLS转码不可用"})
+			return
+		}
+
+		fileIndex, err := strconv.Atoi(c.Param("fileIndex"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的文件索引"})
+			return
+		}
+
+		s, err := hm.session(c.Param("hash"), fileIndex)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		serveHLS(c, hm, s)
+	})
+
+	// 下载目录中的本地文件: /hls/local/:fileId/index.m3u8，fileId与观看记录相同
+	r.GET("/hls/local/:fileId/:name", func(c *gin.Context) {
+		if !hm.Available() {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "未找到ffmpeg，HLS转码不可用"})
+			return
+		}
+
+		streamPath, err := parsePlaybackFileID(c.Param("fileId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s, err := hm.localSession(streamPath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		serveHLS(c, hm, s)
+	})
+}
+
+// 返回播放列表或等待分片转码完成
+func serveHLS(c *gin.Context, hm *HLSManager, s *hlsSession) {
+	name := c.Param("name")
+	if name == "index.m3u8" {
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(hm.playlist(s)))
+		return
+	}
+
+	index, ok := parseSegmentName(name)
+	if !ok || index >= s.segments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "分片不存在"})
+		return
+	}
+
+	path, err := hm.segment(c.Request.Context(), s, index)
+	if err != nil {
+		if c.Request.Context().Err() == nil {
+			log.Printf("获取HLS分片失败: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.Header("Content-Type", "video/mp2t")
+	c.File(path)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// 用脚本代替ffprobe：先执行hook（模拟读取输入），再输出固定时长
+func fakeFFprobe(t *testing.T, hook string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("需要sh")
+	}
+	path := filepath.Join(t.TempDir(), "ffprobe")
+	script := "#!/bin/sh\n" + hook + "\necho 30.5\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestHLSManager(t *testing.T, ffprobe string) *HLSManager {
+	return &HLSManager{
+		ts:          &SimpleTorrentService{downloadDir: t.TempDir()},
+		ffprobe:     ffprobe,
+		cacheDir:    t.TempDir(),
+		sessions:    make(map[string]*hlsSession),
+		inputs:      make(map[string]*torrent.File),
+		inputTokens: make(map[string]string),
+		inputAccess: make(map[string]time.Time),
+	}
+}
+
+func TestHLSOpenSessionPreparesOnce(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "calls")
+	hm := newTestHLSManager(t, fakeFFprobe(t, "echo x >> "+counter))
+
+	for i := 0; i < 3; i++ {
+		s, err := hm.openSession("k", func() string { return "input" })
+		if err != nil {
+			t.Fatalf("创建会话失败: %v", err)
+		}
+		if s.duration != 30.5 || s.segments != 6 {
+			t.Fatalf("时长或分片数错误: %v %d", s.duration, s.segments)
+		}
+	}
+	data, _ := os.ReadFile(counter)
+	if len(data) != 2 {
+		t.Fatalf("ffprobe应只运行一次，实际输出: %q", data)
+	}
+}
+
+// 获取时长期间清理协程运行，ffprobe读取输入时仍能获取管理器锁
+func TestHLSReapDuringPrepare(t *testing.T) {
+	release := filepath.Join(t.TempDir(), "release")
+	hm := newTestHLSManager(t, fakeFFprobe(t, "while [ ! -f "+release+" ]; do sleep 0.05; done"))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := hm.openSession("k", func() string { return "input" })
+		done <- err
+	}()
+
+	// 等待会话创建并进入prepare
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hm.mutex.Lock()
+		s := hm.sessions["k"]
+		hm.mutex.Unlock()
+		if s != nil && !s.mutex.TryLock() {
+			break
+		}
+		if s != nil {
+			s.mutex.Unlock()
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("会话未进入prepare")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reaped := make(chan struct{})
+	go func() {
+		hm.reapOnce(0, 0)
+		close(reaped)
+	}()
+	select {
+	case <-reaped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("清理协程等待正在prepare的会话")
+	}
+
+	// 模拟输入服务获取管理器锁
+	locked := make(chan struct{})
+	go func() {
+		hm.mutex.Lock()
+		hm.mutex.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("prepare期间无法获取管理器锁")
+	}
+
+	os.WriteFile(release, nil, 0644)
+	if err := <-done; err != nil {
+		t.Fatalf("创建会话失败: %v", err)
+	}
+}
+
+func TestHLSReapRemovesIdleSession(t *testing.T) {
+	hm := newTestHLSManager(t, fakeFFprobe(t, ""))
+	s, err := hm.openSession("k", func() string { return "input" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	s.lastAccess = time.Now().Add(-time.Hour)
+	s.mutex.Unlock()
+
+	hm.reapOnce(time.Minute, time.Minute)
+	if !s.removed || fileExists(s.dir) {
+		t.Fatal("空闲会话未被清理")
+	}
+	if _, err := hm.segment(context.Background(), s, 0); err == nil {
+		t.Fatal("已清理的会话不应继续转码")
+	}
+
+	// 之后的请求重新创建会话
+	again, err := hm.openSession("k", func() string { return "input" })
+	if err != nil || again == s || !again.prepared {
+		t.Fatalf("未重新创建会话: %v", err)
+	}
+}
+
+func TestHLSLocalSessionRejectsEscapingPath(t *testing.T) {
+	hm := newTestHLSManager(t, fakeFFprobe(t, ""))
+	for _, path := range []string{"../config.json", "../../etc/passwd", "missing.mkv"} {
+		if _, err := hm.localSession(path); err == nil {
+			t.Errorf("localSession(%q) 期望返回错误", path)
+		}
+	}
+}
+
+func TestHLSReapExpiresUnusedInputs(t *testing.T) {
+	hm := newTestHLSManager(t, fakeFFprobe(t, ""))
+	hm.inputURL("subtitle", 0, nil)
+	if _, err := hm.openSession("session", func() string { return hm.inputURLLocked("session", nil) }); err != nil {
+		t.Fatal(err)
+	}
+	for token := range hm.inputAccess {
+		hm.inputAccess[token] = time.Now().Add(-time.Hour)
+	}
+
+	// 字幕提取的输入过期，转码会话的输入随会话保留
+	hm.reapOnce(time.Hour, time.Minute)
+	if _, exists := hm.inputTokens["subtitle-0"]; exists {
+		t.Fatal("未使用的输入应过期")
+	}
+	token, exists := hm.inputTokens["session"]
+	if !exists || !hm.touchInput(token) {
+		t.Fatal("转码会话的输入不应过期")
+	}
+	if len(hm.inputs) != 1 || len(hm.inputAccess) != 1 {
+		t.Fatalf("输入记录未清理: %d %d", len(hm.inputs), len(hm.inputAccess))
+	}
+
+	// 最近使用的输入保留
+	hm.inputURL("subtitle", 0, nil)
+	hm.reapOnce(time.Hour, time.Minute)
+	if _, exists := hm.inputTokens["subtitle-0"]; !exists {
+		t.Fatal("最近使用的输入不应过期")
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 通过Range请求提供的内容 - 本地文件和torrent文件共用
+type rangeContent struct {
+	ContentType string
+	Size        int64
+	// 为零值时不发送Last-Modified
+	ModTime time.Time
+	// 带引号的强ETag，为空时不发送
+	ETag string
+}
+
+// 单个字节范围
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+var (
+	errInvalidRange = errors.New("无效的Range请求")
+	errNoOverlap    = errors.New("请求范围超出文件大小")
+)
+
+// 解析Range头，支持 bytes=a-b、bytes=a-、后缀范围 bytes=-n 以及逗号分隔的多个范围
+// 与文件没有交集的范围被忽略，全部没有交集时返回errNoOverlap
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errInvalidRange
+	}
+
+	var ranges []httpRange
+	noOverlap := false
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = textproto.TrimString(spec)
+		if spec == "" {
+			continue
+		}
+		startStr, endStr, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		startStr, endStr = textproto.TrimString(startStr), textproto.TrimString(endStr)
+
+		var r httpRange
+		if startStr == "" {
+			// 后缀范围: 最后n个字节
+			if endStr == "" || endStr[0] == '-' {
+				return nil, errInvalidRange
+			}
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = start
+
+			if endStr == "" {
+				r.length = size - start
+			} else {
+				end, err := strconv.ParseInt(endStr, 10, 64)
+				if err != nil || start > end {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+				r.length = end - start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// 按http.ServeContent的语义提供内容：条件请求、HEAD、单个及多个Range
+func serveContent(c *gin.Context, content io.ReadSeeker, rc rangeContent) {
+	header := c.Writer.Header()
+	if rc.ETag != "" {
+		header.Set("ETag", rc.ETag)
+	}
+	if !rc.ModTime.IsZero() {
+		header.Set("Last-Modified", rc.ModTime.UTC().Format(http.TimeFormat))
+	}
+	header.Set("Accept-Ranges", "bytes")
+
+	if done := checkPreconditions(c, rc); done {
+		return
+	}
+
+	if rc.ContentType != "" {
+		header.Set("Content-Type", rc.ContentType)
+		header.Set("X-Content-Type-Options", "nosniff")
+		if isActiveContentType(rc.ContentType) {
+			header.Set("Content-Security-Policy", "sandbox")
+		}
+	}
+
+	rangeHeader := c.GetHeader("Range")
+	if !checkIfRange(c, rc) {
+		rangeHeader = ""
+	}
+
+	ranges, err := parseRange(rangeHeader, rc.Size)
+	if err != nil {
+		// 语法错误的Range按规范忽略，返回完整内容；没有交集时返回416
+		if err != errNoOverlap {
+			ranges = nil
+		} else {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", rc.Size))
+			c.String(http.StatusRequestedRangeNotSatisfiable, err.Error())
+			return
+		}
+	}
+
+	// 多个范围的总大小超过文件本身时直接返回完整内容
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if total > rc.Size {
+		ranges = nil
+	}
+
+	method := c.Request.Method
+	switch {
+	case len(ranges) == 0:
+		header.Set("Content-Length", strconv.FormatInt(rc.Size, 10))
+		c.Status(http.StatusOK)
+		c.Writer.WriteHeaderNow()
+		if method == http.MethodHead {
+			return
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		copyContent(c, content, rc.Size)
+
+	case len(ranges) == 1:
+		r := ranges[0]
+		header.Set("Content-Range", r.contentRange(rc.Size))
+		header.Set("Content-Length", strconv.FormatInt(r.length, 10))
+		c.Status(http.StatusPartialContent)
+		c.Writer.WriteHeaderNow()
+		if method == http.MethodHead {
+			return
+		}
+		if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+			return
+		}
+		copyContent(c, content, r.length)
+
+	default:
+		serveMultipartRanges(c, content, rc, ranges)
+	}
+}
+
+// multipart/byteranges响应
+func serveMultipartRanges(c *gin.Context, content io.ReadSeeker, rc rangeContent, ranges []httpRange) {
+	// 先计算响应大小以设置Content-Length
+	var counter countingWriter
+	mw := multipart.NewWriter(&counter)
+	for _, r := range ranges {
+		mw.CreatePart(r.mimeHeader(rc.ContentType, rc.Size))
+		counter += countingWriter(r.length)
+	}
+	mw.Close()
+
+	mw = multipart.NewWriter(c.Writer)
+	header := c.Writer.Header()
+	header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	header.Set("Content-Length", strconv.FormatInt(int64(counter), 10))
+	c.Status(http.StatusPartialContent)
+	c.Writer.WriteHeaderNow()
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+
+	for _, r := range ranges {
+		part, err := mw.CreatePart(r.mimeHeader(rc.ContentType, rc.Size))
+		if err != nil {
+			return
+		}
+		if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+			return
+		}
+		if !copyContentTo(c, part, content, r.length) {
+			return
+		}
+	}
+	mw.Close()
+}
+
+// 只统计写入字节数的Writer
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// 按块写入响应并立即刷新，客户端断开时停止
+func copyContent(c *gin.Context, content io.Reader, length int64) bool {
+	return copyContentTo(c, c.Writer, content, length)
+}
+
+func copyContentTo(c *gin.Context, w io.Writer, content io.Reader, length int64) bool {
+	buffer := make([]byte, 32768) // 32KB缓冲区，适合视频流
+	remaining := length
+
+	for remaining > 0 {
+		toRead := int64(len(buffer))
+		if remaining < toRead {
+			toRead = remaining
+		}
+
+		n, err := content.Read(buffer[:toRead])
+		if n > 0 {
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				return false
+			}
+			c.Writer.Flush()
+			remaining -= int64(n)
+		}
+		if err != nil {
+			if err != io.EOF && c.Request.Context().Err() == nil {
+				log.Printf("读取数据失败: %v", err)
+			}
+			return remaining == 0
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			log.Printf("客户端断开连接")
+			return false
+		default:
+		}
+	}
+	return true
+}
+
+// 检查If-Match、If-Unmodified-Since、If-None-Match和If-Modified-Since，
+// 已写出304/412响应时返回true
+func checkPreconditions(c *gin.Context, rc rangeContent) bool {
+	method := c.Request.Method
+
+	if im := c.GetHeader("If-Match"); im != "" {
+		if !etagListMatch(im, rc.ETag, false) {
+			c.Status(http.StatusPreconditionFailed)
+			return true
+		}
+	} else if ius := c.GetHeader("If-Unmodified-Since"); ius != "" && !rc.ModTime.IsZero() {
+		if t, err := http.ParseTime(ius); err == nil && rc.ModTime.Truncate(time.Second).After(t) {
+			c.Status(http.StatusPreconditionFailed)
+			return true
+		}
+	}
+
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		if etagListMatch(inm, rc.ETag, true) {
+			if method == http.MethodGet || method == http.MethodHead {
+				writeNotModified(c)
+			} else {
+				c.Status(http.StatusPreconditionFailed)
+			}
+			return true
+		}
+	} else if ims := c.GetHeader("If-Modified-Since"); ims != "" && !rc.ModTime.IsZero() &&
+		(method == http.MethodGet || method == http.MethodHead) {
+		if t, err := http.ParseTime(ims); err == nil && !rc.ModTime.Truncate(time.Second).After(t) {
+			writeNotModified(c)
+			return true
+		}
+	}
+
+	return false
+}
+
+// If-Range条件不满足时应忽略Range返回完整内容
+func checkIfRange(c *gin.Context, rc rangeContent) bool {
+	ir := c.GetHeader("If-Range")
+	if ir == "" || c.GetHeader("Range") == "" {
+		return true
+	}
+
+	// If-Range为ETag时需强比较
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return rc.ETag != "" && !strings.HasPrefix(ir, "W/") && ir == rc.ETag
+	}
+
+	if rc.ModTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && rc.ModTime.Truncate(time.Second).Equal(t)
+}
+
+func writeNotModified(c *gin.Context) {
+	header := c.Writer.Header()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	c.Status(http.StatusNotModified)
+}
+
+// 匹配If-Match/If-None-Match中的ETag列表，weak为true时忽略W/前缀。
+// "*"匹配任何当前存在的内容，没有ETag时也匹配
+func etagListMatch(list string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = textproto.TrimString(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if etag == "" {
+			continue
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		} else if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []httpRange
+		err    error
+	}{
+		{"", nil, nil},
+		{"bytes=0-4", []httpRange{{0, 5}}, nil},
+		{"bytes=5-", []httpRange{{5, 5}}, nil},
+		{"bytes=8-100", []httpRange{{8, 2}}, nil},
+		{"bytes=-3", []httpRange{{7, 3}}, nil},
+		{"bytes=-20", []httpRange{{0, 10}}, nil},
+		{"bytes= 0-1 , 4-5", []httpRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=0-1,20-30", []httpRange{{0, 2}}, nil},
+		{"bytes=10-", nil, errNoOverlap},
+		{"bytes=-0", nil, errNoOverlap},
+		{"bytes=5-2", nil, errInvalidRange},
+		{"bytes=a-b", nil, errInvalidRange},
+		{"bytes=--1", nil, errInvalidRange},
+		{"items=0-1", nil, errInvalidRange},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, 10)
+		if err != tt.err || len(got) != len(tt.want) {
+			t.Errorf("parseRange(%q) = %v, %v, 期望 %v, %v", tt.header, got, err, tt.want, tt.err)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseRange(%q) = %v, 期望 %v", tt.header, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const data = "0123456789"
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	lastModified := modTime.Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		noETag  bool
+
+		status int
+		body   string
+		// 响应头的期望值
+		want map[string]string
+		// multipart/byteranges响应中各部分的Content-Range和内容
+		parts [][2]string
+	}{
+		{
+			name:   "完整内容",
+			status: http.StatusOK,
+			body:   data,
+			want:   map[string]string{"Content-Length": "10", "Accept-Ranges": "bytes", "ETag": `"v1"`, "Last-Modified": lastModified},
+		},
+		{
+			name:    "单个范围",
+			headers: map[string]string{"Range": "bytes=2-4"},
+			status:  http.StatusPartialContent,
+			body:    "234",
+			want:    map[string]string{"Content-Range": "bytes 2-4/10", "Content-Length": "3"},
+		},
+		{
+			name:    "后缀范围",
+			headers: map[string]string{"Range": "bytes=-3"},
+			status:  http.StatusPartialContent,
+			body:    "789",
+			want:    map[string]string{"Content-Range": "bytes 7-9/10"},
+		},
+		{
+			name:    "起点超出文件大小",
+			headers: map[string]string{"Range": "bytes=10-"},
+			status:  http.StatusRequestedRangeNotSatisfiable,
+			body:    errNoOverlap.Error(),
+			want:    map[string]string{"Content-Range": "bytes */10"},
+		},
+		{
+			name:    "语法错误的Range返回完整内容",
+			headers: map[string]string{"Range": "bytes=a-b"},
+			status:  http.StatusOK,
+			body:    data,
+		},
+		{
+			name:    "多个范围",
+			headers: map[string]string{"Range": "bytes=0-1,5-6"},
+			status:  http.StatusPartialContent,
+			parts:   [][2]string{{"bytes 0-1/10", "01"}, {"bytes 5-6/10", "56"}},
+		},
+		{
+			name:    "多个范围的总大小超过文件时返回完整内容",
+			headers: map[string]string{"Range": "bytes=0-8,1-9"},
+			status:  http.StatusOK,
+			body:    data,
+		},
+		{
+			name:    "If-Range的ETag匹配",
+			headers: map[string]string{"Range": "bytes=0-1", "If-Range": `"v1"`},
+			status:  http.StatusPartialContent,
+			body:    "01",
+		},
+		{
+			name:    "If-Range的ETag不匹配时返回完整内容",
+			headers: map[string]string{"Range": "bytes=0-1", "If-Range": `"v0"`},
+			status:  http.StatusOK,
+			body:    data,
+		},
+		{
+			name:    "If-Range的弱ETag不匹配",
+			headers: map[string]string{"Range": "bytes=0-1", "If-Range": `W/"v1"`},
+			status:  http.StatusOK,
+			body:    data,
+		},
+		{
+			name:    "If-Range的时间匹配",
+			headers: map[string]string{"Range": "bytes=0-1", "If-Range": lastModified},
+			status:  http.StatusPartialContent,
+			body:    "01",
+		},
+		{
+			name:   "HEAD",
+			method: http.MethodHead,
+			status: http.StatusOK,
+			want:   map[string]string{"Content-Length": "10"},
+		},
+		{
+			name:    "HEAD带Range",
+			method:  http.MethodHead,
+			headers: map[string]string{"Range": "bytes=2-4"},
+			status:  http.StatusPartialContent,
+			want:    map[string]string{"Content-Length": "3", "Content-Range": "bytes 2-4/10"},
+		},
+		{
+			name:    "If-None-Match弱比较",
+			headers: map[string]string{"If-None-Match": `"v0", W/"v1"`},
+			status:  http.StatusNotModified,
+		},
+		{
+			name:    "If-Modified-Since",
+			headers: map[string]string{"If-Modified-Since": lastModified},
+			status:  http.StatusNotModified,
+		},
+		{
+			name:    "If-Match不匹配",
+			headers: map[string]string{"If-Match": `"v0"`},
+			status:  http.StatusPreconditionFailed,
+		},
+		{
+			name:    "If-Match为*时没有ETag也匹配",
+			headers: map[string]string{"If-Match": "*"},
+			noETag:  true,
+			status:  http.StatusOK,
+			body:    data,
+		},
+		{
+			name:    "If-Unmodified-Since早于修改时间",
+			headers: map[string]string{"If-Unmodified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)},
+			status:  http.StatusPreconditionFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := rangeContent{ContentType: "video/mp4", Size: int64(len(data)), ModTime: modTime, ETag: `"v1"`}
+			if tt.noETag {
+				rc.ETag = ""
+			}
+			r := gin.New()
+			handler := func(c *gin.Context) { serveContent(c, strings.NewReader(data), rc) }
+			r.GET("/", handler)
+			r.HEAD("/", handler)
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("状态码 %d, 期望 %d", w.Code, tt.status)
+			}
+			for key, value := range tt.want {
+				if got := w.Header().Get(key); got != value {
+					t.Fatalf("%s: %q, 期望 %q", key, got, value)
+				}
+			}
+			if tt.parts == nil {
+				if w.Body.String() != tt.body {
+					t.Fatalf("响应内容 %q, 期望 %q", w.Body.String(), tt.body)
+				}
+				return
+			}
+
+			mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+			if err != nil || mediaType != "multipart/byteranges" {
+				t.Fatalf("Content-Type %q", w.Header().Get("Content-Type"))
+			}
+			if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+				t.Fatalf("Content-Length %s, 实际 %d", w.Header().Get("Content-Length"), w.Body.Len())
+			}
+			mr := multipart.NewReader(bytes.NewReader(w.Body.Bytes()), params["boundary"])
+			for _, want := range tt.parts {
+				part, err := mr.NextPart()
+				if err != nil {
+					t.Fatal(err)
+				}
+				content, _ := io.ReadAll(part)
+				if part.Header.Get("Content-Range") != want[0] || string(content) != want[1] || part.Header.Get("Content-Type") != "video/mp4" {
+					t.Fatalf("部分 %v %q, 期望 %v", part.Header, content, want)
+				}
+			}
+			if _, err := mr.NextPart(); err != io.EOF {
+				t.Fatalf("多余的部分: %v", err)
+			}
+		})
+	}
+}
+
+func TestETagListMatch(t *testing.T) {
+	tests := []struct {
+		list string
+		etag string
+		weak bool
+		want bool
+	}{
+		{`"a"`, `"a"`, false, true},
+		{`"b", "a"`, `"a"`, false, true},
+		{`W/"a"`, `"a"`, false, false},
+		{`W/"a"`, `"a"`, true, true},
+		{`"a"`, `W/"a"`, true, true},
+		{`"b"`, `"a"`, true, false},
+		{"*", `"a"`, false, true},
+		{"*", "", false, true},
+		{`"a"`, "", true, false},
+	}
+	for _, tt := range tests {
+		if got := etagListMatch(tt.list, tt.etag, tt.weak); got != tt.want {
+			t.Errorf("etagListMatch(%q, %q, %v) = %v, 期望 %v", tt.list, tt.etag, tt.weak, got, tt.want)
+		}
+	}
+}
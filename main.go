@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -11,31 +12,84 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// HTTP服务端口
+const httpPort = 8080
+
 func main() {
 	// 创建下载目录
 	if err := os.MkdirAll("downloads", 0755); err != nil {
 		log.Fatal("创建下载目录失败:", err)
 	}
 
+	// 加载配置
+	config, err := LoadConfig("config.json")
+	if err != nil {
+		log.Fatal("加载配置失败:", err)
+	}
+
 	// 创建Gin路由器
 	r := gin.Default()
 
 	// 创建torrent服务
-	torrentService := NewSimpleTorrentService("downloads")
+	torrentService := NewSimpleTorrentService("downloads", config)
 
 	// 设置路由
 	setupRoutes(r, torrentService)
 	setupUploadRoutes(r, torrentService)
 	setupTorrentRoutes(r, torrentService)
+	setupSystemRoutes(r, torrentService)
+	setupRetentionRoutes(r, torrentService)
+	setupStreamRoutes(r, torrentService)
+	setupSeekIndexRoutes(r, torrentService)
+
+	// RSS订阅自动下载
+	rssManager := NewRSSManager(torrentService, config.RSSFeeds, "rss_state.json")
+	rssManager.Start()
+	setupRSSRoutes(r, rssManager)
+
+	// 索引器搜索
+	setupSearchRoutes(r, NewTorznabSearcher(config.Indexers))
+
+	// HLS转码（需要本地安装ffmpeg）
+	hlsManager := NewHLSManager(torrentService, config.Transcode)
+	setupHLSRoutes(r, hlsManager)
+
+	// 字幕（外挂字幕转换为WebVTT，内嵌字幕需要ffmpeg）
+	setupSubtitleRoutes(r, NewSubtitleService(torrentService, hlsManager))
+
+	// 观看记录
+	setupPlaybackRoutes(r, torrentService)
+
+	// 一步播放magnet链接
+	setupPlayRoutes(r, torrentService)
+
+	// 打包下载整个torrent或目录
+	setupArchiveRoutes(r, torrentService)
+
+	// 带签名和有效期的分享链接
+	setupShareRoutes(r, torrentService, NewShareStore("share_state.json"))
 
-	fmt.Println("服务器启动在端口 8080")
+	// 外部播放器使用的M3U/XSPF播放列表
+	setupPlaylistRoutes(r, torrentService)
+
+	// 海报图和进度条预览图（需要ffmpeg）
+	setupThumbnailRoutes(r, NewThumbnailService(torrentService, hlsManager, config.Thumbnails))
+
+	// DLNA媒体服务器（智能电视发现和浏览）
+	if config.DLNA.Enabled {
+		dlnaServer := NewDLNAServer(torrentService, config.DLNA, httpPort)
+		setupDLNARoutes(r, dlnaServer)
+		dlnaServer.Start()
+	}
+
+	fmt.Printf("服务器启动在端口 %d\n", httpPort)
 	fmt.Println("使用方法:")
 	fmt.Println("POST /download - 下载magnet链接/torrent文件/torrent URL")
 	fmt.Println("POST /upload - 上传torrent文件并下载")
 	fmt.Println("GET /stream/:filename - 流式播放视频文件")
 	fmt.Println("GET /files - 查看已下载的文件")
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", httpPort), r))
 }
 
 func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
@@ -45,6 +99,8 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 			MagnetURL   string `json:"magnet_url"`
 			TorrentFile string `json:"torrent_file"`
 			TorrentURL  string `json:"torrent_url"`
+			// 可选的HTTP镜像地址
+			WebSeeds []string `json:"web_seeds"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -52,11 +108,19 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 			return
 		}
 
+		for _, u := range req.WebSeeds {
+			if err := validateWebSeedURL(u); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		opts := AddOptions{WebSeeds: req.WebSeeds}
+
 		// 判断下载类型
 		if req.MagnetURL != "" {
 			// Magnet链接下载
 			go func() {
-				if err := ts.DownloadMagnet(req.MagnetURL); err != nil {
+				if err := ts.DownloadMagnetWithOptions(req.MagnetURL, opts); err != nil {
 					log.Printf("Magnet下载失败: %v", err)
 				}
 			}()
@@ -68,7 +132,7 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 		} else if req.TorrentFile != "" {
 			// 本地torrent文件下载
 			go func() {
-				if err := ts.DownloadTorrentFile(req.TorrentFile); err != nil {
+				if err := ts.DownloadTorrentFileWithOptions(req.TorrentFile, opts); err != nil {
 					log.Printf("Torrent文件下载失败: %v", err)
 				}
 			}()
@@ -80,7 +144,7 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 		} else if req.TorrentURL != "" {
 			// HTTP torrent文件下载
 			go func() {
-				if err := ts.DownloadTorrentFromURL(req.TorrentURL); err != nil {
+				if err := ts.DownloadTorrentFromURLWithOptions(req.TorrentURL, opts); err != nil {
 					log.Printf("远程Torrent文件下载失败: %v", err)
 				}
 			}()
@@ -97,7 +161,7 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 	})
 
 	// 流式播放视频 - 支持Range请求和实时播放，支持中文文件名和子目录，支持边下载边播放
-	r.GET("/stream/*filepath", func(c *gin.Context) {
+	streamHandler := func(c *gin.Context) {
 		// 获取完整的文件路径，去掉开头的斜杠
 		requestPath := strings.TrimPrefix(c.Param("filepath"), "/")
 		
@@ -108,7 +172,11 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 		}
 		
 		// 原有的本地文件流播放逻辑
-		filePath := filepath.Join("downloads", requestPath)
+		filePath, ok := downloadFilePath(requestPath)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "非法的文件路径"})
+			return
+		}
 		log.Printf("尝试访问视频文件: %s", filePath)
 
 		// 检查文件是否存在
@@ -131,9 +199,8 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 
 		log.Printf("找到文件: %s, 大小: %d bytes", filePath, fileInfo.Size())
 
-		// 检查是否为视频文件
-		if !isVideoFile(filepath.Base(filePath)) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "不是视频文件"})
+		if fileInfo.IsDir() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "不能播放目录"})
 			return
 		}
 
@@ -145,25 +212,14 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 		}
 		defer file.Close()
 
-		// 获取文件大小
-		fileSize := fileInfo.Size()
-
 		// 设置基本响应头
-		c.Header("Content-Type", getContentType(filepath.Base(filePath)))
-		c.Header("Accept-Ranges", "bytes")
 		c.Header("Cache-Control", "no-cache")
 
 		// 处理Range请求（支持快进和断点续传）
-		rangeHeader := c.GetHeader("Range")
-		if rangeHeader != "" {
-			handleRangeRequest(c, file, fileSize, rangeHeader)
-		} else {
-			// 普通请求，返回整个文件
-			c.Header("Content-Length", fmt.Sprintf("%d", fileSize))
-			c.Status(http.StatusOK)
-			streamFile(c, file, fileSize)
-		}
-	})
+		serveLocalFile(c, file, fileInfo, localContentType(file, filepath.Base(filePath)))
+	}
+	r.GET("/stream/*filepath", dlnaStreamHeaders, streamHandler)
+	r.HEAD("/stream/*filepath", dlnaStreamHeaders, streamHandler)
 
 	// 获取文件列表
 	r.GET("/files", func(c *gin.Context) {
@@ -207,7 +263,41 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 	// 静态文件服务（用于直接访问下载的文件）- 支持文件下载
 	r.GET("/downloads/*filepath", func(c *gin.Context) {
 		requestPath := strings.TrimPrefix(c.Param("filepath"), "/")
-		filePath := filepath.Join("downloads", requestPath)
+
+		// 保存在下载目录之外的任务文件 (格式: torrent/{hash}/{filename})，通过torrent读取器提供
+		if strings.HasPrefix(requestPath, "torrent/") {
+			parts := strings.SplitN(requestPath, "/", 3)
+			if len(parts) < 3 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的torrent文件路径"})
+				return
+			}
+			torrentFile, err := ts.GetTorrentFileByPath(parts[1], parts[2])
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+				return
+			}
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(parts[2])))
+			// 未下载完成时与流播放相同，登记为播放会话
+			if torrentFile.BytesCompleted() < torrentFile.Length() {
+				serveScheduledTorrentFile(c, ts, torrentFile, "application/octet-stream", -1)
+			} else {
+				serveTorrentFile(c, torrentFile, "application/octet-stream", ts.streamReadaheadLimit())
+			}
+			return
+		}
+
+		filePath, ok := downloadFilePath(requestPath)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "非法的文件路径"})
+			return
+		}
+
+		// 未下载完成的torrent文件在磁盘上只有部分数据，通过torrent读取器提供，登记为播放会话
+		if torrentFile := ts.LocalTorrentFile(filePath); torrentFile != nil && torrentFile.BytesCompleted() < torrentFile.Length() {
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(filePath)))
+			serveScheduledTorrentFile(c, ts, torrentFile, "application/octet-stream", -1)
+			return
+		}
 
 		// 检查文件是否存在
 		fileInfo, err := os.Stat(filePath)
@@ -245,6 +335,12 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 			return
 		}
 
+		// 只允许删除下载目录中的文件
+		if strings.HasPrefix(req.FilePath, "torrent/") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "该文件保存在下载目录之外，不能删除"})
+			return
+		}
+
 		// 构建完整的文件路径
 		fullPath := filepath.Join("downloads", req.FilePath)
 		
@@ -288,6 +384,16 @@ func setupRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 	})
 }
 
+// 请求路径对应的下载目录中的文件，路径跳出下载目录时返回false
+func downloadFilePath(requestPath string) (string, bool) {
+	filePath := filepath.Join("downloads", filepath.FromSlash(requestPath))
+	rel, err := filepath.Rel("downloads", filePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filePath, true
+}
+
 // 检查是否为视频文件
 func isVideoFile(filename string) bool {
 	ext := filepath.Ext(filename)
@@ -321,7 +427,23 @@ func getContentType(filename string) string {
 		return "video/webm"
 	case ".m4v":
 		return "video/x-m4v"
+	case ".mp3":
+		return "audio/mpeg"
+	case ".flac":
+		return "audio/flac"
+	case ".m4a":
+		return "audio/mp4"
+	case ".aac":
+		return "audio/aac"
+	case ".ogg", ".opus":
+		return "audio/ogg"
+	case ".wav":
+		return "audio/wav"
 	default:
+		// 其他类型（图片、PDF等）使用系统的扩展名映射
+		if contentType := mime.TypeByExtension(strings.ToLower(ext)); contentType != "" {
+			return contentType
+		}
 		return "application/octet-stream"
 	}
 }
\ No newline at end of file
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDownloadFilePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"movie.mp4", "downloads/movie.mp4", true},
+		{"剧集/第一季/01.mkv", "downloads/剧集/第一季/01.mkv", true},
+		{"a/../b.mp4", "downloads/b.mp4", true},
+		{"", "downloads", true},
+		{"../config.json", "", false},
+		{"../../../etc/passwd", "", false},
+		{"a/../../etc/passwd", "", false},
+		{"..", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := downloadFilePath(tt.path)
+		if ok != tt.ok || (ok && got != filepath.FromSlash(tt.want)) {
+			t.Errorf("downloadFilePath(%q) = %q, %v, 期望 %q, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// 读取未下载完成的torrent文件计入同时播放数量
+func TestDownloadsPartialFileCountsAsSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ts := newTestTorrentService(t)
+	ts.config.Stream.MaxSessions = 1
+	hash, tor := addTestTorrentStatus(t, ts, "a.bin", "")
+	<-tor.GotInfo()
+
+	r := gin.New()
+	setupRoutes(r, ts)
+	get := func() int {
+		w := httptest.NewRecorder()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/downloads/torrent/"+hash+"/a.bin", nil).WithContext(ctx))
+		return w.Code
+	}
+
+	session, err := ts.streamSessions.open("10.0.0.2", tor.Files()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Fatalf("达到上限时应返回503, 实际 %d", code)
+	}
+	ts.streamSessions.close(session)
+	if code := get(); code == http.StatusServiceUnavailable {
+		t.Fatal("会话结束后应可以读取")
+	}
+}
@@ -0,0 +1,893 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+)
+
+// 媒体信息 - 从MP4(moov)或Matroska头部解析，不依赖ffprobe
+type MediaInfo struct {
+	// mp4、mov、matroska或webm
+	Container string `json:"container"`
+	// 时长（秒）
+	Duration float64 `json:"duration"`
+	// 平均码率（bit/s），由文件大小和时长估算
+	Bitrate   int64                `json:"bitrate"`
+	Video     *VideoStreamInfo     `json:"video,omitempty"`
+	Audio     []AudioStreamInfo    `json:"audio"`
+	Subtitles []SubtitleStreamInfo `json:"subtitles"`
+	// 浏览器能否直接播放（不转码）
+	BrowserPlayable bool `json:"browser_playable"`
+	// 不能直接播放的原因
+	Issues []string `json:"issues,omitempty"`
+}
+
+type VideoStreamInfo struct {
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type AudioStreamInfo struct {
+	Codec      string `json:"codec"`
+	Channels   int    `json:"channels,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Language   string `json:"language,omitempty"`
+}
+
+type SubtitleStreamInfo struct {
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+var (
+	// 头部所在的piece尚未下载完成，稍后重试
+	errMediaDataUnavailable = errors.New("媒体头部数据尚未下载")
+	errUnsupportedContainer = errors.New("不支持的媒体容器")
+)
+
+// 浏览器普遍支持的容器和编码，编码名与ffprobe一致
+var (
+	browserContainers  = map[string]bool{"mp4": true, "mov": true, "webm": true}
+	browserVideoCodecs = map[string]bool{"h264": true, "vp8": true, "vp9": true, "av1": true}
+	browserAudioCodecs = map[string]bool{"aac": true, "mp3": true, "opus": true, "vorbis": true, "flac": true}
+)
+
+// 头部中单个box/元素的读取上限，避免损坏的文件导致大量读取
+const maxMediaHeaderElement = 4 * 1024 * 1024
+
+// 根据文件头识别容器并解析
+func probeMedia(r io.ReaderAt, size int64) (_ *MediaInfo, err error) {
+	// 文件内容不可信，解析中的异常作为错误返回，不影响调用方的goroutine
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("解析媒体头部失败: %v", recovered)
+		}
+	}()
+
+	head := make([]byte, 12)
+	if size < int64(len(head)) {
+		return nil, errUnsupportedContainer
+	}
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+
+	var info *MediaInfo
+	switch {
+	case string(head[4:8]) == "ftyp":
+		info, err = parseMP4(r, size)
+	case binary.BigEndian.Uint32(head) == 0x1A45DFA3:
+		info, err = parseMatroska(r, size)
+	default:
+		return nil, errUnsupportedContainer
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Duration > 0 {
+		info.Bitrate = int64(float64(size) * 8 / info.Duration)
+	}
+	info.evaluatePlayability()
+	return info, nil
+}
+
+func (m *MediaInfo) evaluatePlayability() {
+	m.Issues = nil
+	if !browserContainers[m.Container] {
+		m.Issues = append(m.Issues, fmt.Sprintf("浏览器不支持%s容器", m.Container))
+	}
+	if m.Video != nil && !browserVideoCodecs[m.Video.Codec] {
+		m.Issues = append(m.Issues, fmt.Sprintf("浏览器不支持%s视频编码", m.Video.Codec))
+	}
+	// 浏览器只播放第一条音轨
+	if len(m.Audio) > 0 && !browserAudioCodecs[m.Audio[0].Codec] {
+		m.Issues = append(m.Issues, fmt.Sprintf("浏览器不支持%s音频编码", m.Audio[0].Codec))
+	}
+	m.BrowserPlayable = len(m.Issues) == 0
+}
+
+// ---- MP4 ----
+
+type mp4Box struct {
+	typ    string
+	offset int64
+	size   int64
+	// box头长度，数据从offset+header开始
+	header int64
+}
+
+func (b mp4Box) dataOffset() int64 { return b.offset + b.header }
+func (b mp4Box) end() int64        { return b.offset + b.size }
+
+func readMP4Box(r io.ReaderAt, offset, limit int64) (mp4Box, error) {
+	if limit-offset < 8 {
+		return mp4Box{}, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, 16)
+	n := int64(16)
+	if limit-offset < n {
+		n = 8
+	}
+	if _, err := r.ReadAt(buf[:n], offset); err != nil {
+		return mp4Box{}, err
+	}
+
+	box := mp4Box{typ: string(buf[4:8]), offset: offset, size: int64(binary.BigEndian.Uint32(buf)), header: 8}
+	switch box.size {
+	case 0:
+		// 延伸到文件末尾
+		box.size = limit - offset
+	case 1:
+		if n < 16 {
+			return mp4Box{}, io.ErrUnexpectedEOF
+		}
+		box.size = int64(binary.BigEndian.Uint64(buf[8:16]))
+		box.header = 16
+	}
+	if box.size < box.header || box.size > limit-offset {
+		return mp4Box{}, fmt.Errorf("无效的MP4 box: %s", box.typ)
+	}
+	return box, nil
+}
+
+// 遍历[start, end)内的子box
+func walkMP4Boxes(r io.ReaderAt, start, end int64, fn func(box mp4Box) error) error {
+	for offset := start; end-offset >= 8; {
+		box, err := readMP4Box(r, offset, end)
+		if err != nil {
+			return err
+		}
+		if err := fn(box); err != nil {
+			return err
+		}
+		offset = box.end()
+	}
+	return nil
+}
+
+func readMP4BoxData(r io.ReaderAt, box mp4Box) ([]byte, error) {
+	size := box.size - box.header
+	if size > maxMediaHeaderElement {
+		return nil, fmt.Errorf("MP4 box过大: %s", box.typ)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, box.dataOffset()); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func parseMP4(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	info := &MediaInfo{Container: "mp4", Audio: []AudioStreamInfo{}, Subtitles: []SubtitleStreamInfo{}}
+	foundMoov := false
+
+	err := walkMP4Boxes(r, 0, size, func(box mp4Box) error {
+		switch box.typ {
+		case "ftyp":
+			data, err := readMP4BoxData(r, box)
+			if err != nil {
+				return err
+			}
+			if len(data) >= 4 && string(data[:4]) == "qt  " {
+				info.Container = "mov"
+			}
+		case "moov":
+			foundMoov = true
+			return walkMP4Boxes(r, box.dataOffset(), box.end(), func(child mp4Box) error {
+				switch child.typ {
+				case "mvhd":
+					data, err := readMP4BoxData(r, child)
+					if err != nil {
+						return err
+					}
+					info.Duration = parseMP4Duration(data, 12, 20)
+				case "trak":
+					return parseMP4Track(r, child, info)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !foundMoov {
+		return nil, fmt.Errorf("MP4文件缺少moov")
+	}
+	return info, nil
+}
+
+// 解析mvhd/mdhd中的timescale和duration，v0与v1的字段偏移不同
+func parseMP4Duration(data []byte, v0Offset, v1Offset int) float64 {
+	if len(data) < 4 {
+		return 0
+	}
+	if data[0] == 1 {
+		if len(data) < v1Offset+12 {
+			return 0
+		}
+		timescale := binary.BigEndian.Uint32(data[v1Offset:])
+		duration := binary.BigEndian.Uint64(data[v1Offset+4:])
+		if timescale == 0 {
+			return 0
+		}
+		return float64(duration) / float64(timescale)
+	}
+	if len(data) < v0Offset+8 {
+		return 0
+	}
+	timescale := binary.BigEndian.Uint32(data[v0Offset:])
+	duration := binary.BigEndian.Uint32(data[v0Offset+4:])
+	if timescale == 0 || duration == math.MaxUint32 {
+		return 0
+	}
+	return float64(duration) / float64(timescale)
+}
+
+// 单条轨道：tkhd提供分辨率，mdia下的hdlr/mdhd/stsd提供类型、语言和编码
+func parseMP4Track(r io.ReaderAt, trak mp4Box, info *MediaInfo) error {
+	var handler, language, codec string
+	var width, height, channels, sampleRate int
+
+	var walk func(box mp4Box) error
+	walk = func(box mp4Box) error {
+		switch box.typ {
+		case "mdia", "minf", "stbl":
+			return walkMP4Boxes(r, box.dataOffset(), box.end(), walk)
+		case "tkhd":
+			data, err := readMP4BoxData(r, box)
+			if err != nil {
+				return err
+			}
+			// 宽高为最后8字节的16.16定点数
+			if len(data) >= 8 {
+				width = int(binary.BigEndian.Uint32(data[len(data)-8:]) >> 16)
+				height = int(binary.BigEndian.Uint32(data[len(data)-4:]) >> 16)
+			}
+		case "hdlr":
+			data, err := readMP4BoxData(r, box)
+			if err != nil {
+				return err
+			}
+			if len(data) >= 12 {
+				handler = string(data[8:12])
+			}
+		case "mdhd":
+			data, err := readMP4BoxData(r, box)
+			if err != nil {
+				return err
+			}
+			langOffset := 20
+			if len(data) > 0 && data[0] == 1 {
+				langOffset = 32
+			}
+			if len(data) >= langOffset+2 {
+				language = decodeMP4Language(binary.BigEndian.Uint16(data[langOffset:]))
+			}
+		case "stsd":
+			data, err := readMP4BoxData(r, box)
+			if err != nil {
+				return err
+			}
+			// 版本标志(4) + 条目数(4)，之后为第一个sample entry
+			if len(data) < 16 {
+				return nil
+			}
+			codec = mp4CodecName(string(data[12:16]))
+			entry := data[16:]
+			switch handler {
+			case "vide":
+				// 6字节保留 + 2字节索引 + 16字节预留，之后为宽高
+				if (width == 0 || height == 0) && len(entry) >= 28 {
+					width = int(binary.BigEndian.Uint16(entry[24:]))
+					height = int(binary.BigEndian.Uint16(entry[26:]))
+				}
+			case "soun":
+				// 6字节保留 + 2字节索引 + 8字节保留，之后为声道数、位深、保留、16.16采样率
+				if len(entry) >= 28 {
+					channels = int(binary.BigEndian.Uint16(entry[16:]))
+					sampleRate = int(binary.BigEndian.Uint32(entry[24:]) >> 16)
+				}
+			}
+		}
+		return nil
+	}
+	if err := walkMP4Boxes(r, trak.dataOffset(), trak.end(), walk); err != nil {
+		return err
+	}
+
+	switch handler {
+	case "vide":
+		// 只记录第一条视频轨道（封面图等附加轨道忽略）
+		if info.Video == nil {
+			info.Video = &VideoStreamInfo{Codec: codec, Width: width, Height: height}
+		}
+	case "soun":
+		info.Audio = append(info.Audio, AudioStreamInfo{Codec: codec, Channels: channels, SampleRate: sampleRate, Language: language})
+	case "sbtl", "text", "subt":
+		info.Subtitles = append(info.Subtitles, SubtitleStreamInfo{Codec: codec, Language: language})
+	}
+	return nil
+}
+
+// mdhd中的语言为3个5位字母（ISO 639-2/T）
+func decodeMP4Language(packed uint16) string {
+	if packed == 0 || packed == 0x7FFF {
+		return ""
+	}
+	lang := string([]byte{
+		byte(packed>>10&0x1F) + 0x60,
+		byte(packed>>5&0x1F) + 0x60,
+		byte(packed&0x1F) + 0x60,
+	})
+	if lang == "und" {
+		return ""
+	}
+	return lang
+}
+
+func mp4CodecName(fourcc string) string {
+	switch fourcc {
+	case "avc1", "avc3":
+		return "h264"
+	case "hvc1", "hev1":
+		return "hevc"
+	case "av01":
+		return "av1"
+	case "vp08":
+		return "vp8"
+	case "vp09":
+		return "vp9"
+	case "mp4v":
+		return "mpeg4"
+	case "mp4a":
+		return "aac"
+	case ".mp3":
+		return "mp3"
+	case "ac-3":
+		return "ac3"
+	case "ec-3":
+		return "eac3"
+	case "Opus":
+		return "opus"
+	case "fLaC":
+		return "flac"
+	case "tx3g":
+		return "mov_text"
+	case "wvtt":
+		return "webvtt"
+	}
+	return strings.TrimSpace(fourcc)
+}
+
+// ---- Matroska / WebM ----
+
+const (
+	ebmlIDHeader       = 0x1A45DFA3
+	ebmlIDDocType      = 0x4282
+	mkvIDSegment       = 0x18538067
+	mkvIDSeekHead      = 0x114D9B74
+	mkvIDSeek          = 0x4DBB
+	mkvIDSeekID        = 0x53AB
+	mkvIDSeekPosition  = 0x53AC
+	mkvIDInfo          = 0x1549A966
+	mkvIDTimecodeScale = 0x2AD7B1
+	mkvIDDuration      = 0x4489
+	mkvIDTracks        = 0x1654AE6B
+	mkvIDTrackEntry    = 0xAE
+	mkvIDTrackNumber   = 0xD7
+	mkvIDTrackType     = 0x83
+	mkvIDCodecID       = 0x86
+	mkvIDLanguage      = 0x22B59C
+	mkvIDLanguageBCP47 = 0x22B59D
+	mkvIDName          = 0x536E
+	mkvIDVideo         = 0xE0
+	mkvIDPixelWidth    = 0xB0
+	mkvIDPixelHeight   = 0xBA
+	mkvIDAudio         = 0xE1
+	mkvIDSamplingFreq  = 0xB5
+	mkvIDChannels      = 0x9F
+	mkvIDCluster       = 0x1F43B675
+	mkvIDCues          = 0x1C53BB6B
+	mkvIDCuePoint      = 0xBB
+	mkvIDCueTime       = 0xB3
+	mkvIDCuePositions  = 0xB7
+	mkvIDCueTrack      = 0xF7
+	mkvIDCueCluster    = 0xF1
+)
+
+// 大小未知（直播流等）的元素
+const ebmlUnknownSize = -1
+
+// 读取变长整数，keepMarker为true时保留长度标记位（用于元素ID）
+func readEBMLVint(b []byte, keepMarker bool) (uint64, int, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	n := bits.LeadingZeros8(b[0]) + 1
+	if len(b) < n {
+		return 0, 0, false
+	}
+	value := uint64(b[0])
+	if !keepMarker {
+		value &= 0xFF >> n
+	}
+	for i := 1; i < n; i++ {
+		value = value<<8 | uint64(b[i])
+	}
+	return value, n, true
+}
+
+// 解析元素头，返回ID、数据大小和头长度
+func parseEBMLHeader(b []byte) (uint32, int64, int, bool) {
+	id, idLen, ok := readEBMLVint(b, true)
+	if !ok || idLen > 4 {
+		return 0, 0, 0, false
+	}
+	size, sizeLen, ok := readEBMLVint(b[idLen:], false)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	if size == 1<<(7*uint(sizeLen))-1 {
+		return uint32(id), ebmlUnknownSize, idLen + sizeLen, true
+	}
+	return uint32(id), int64(size), idLen + sizeLen, true
+}
+
+func readEBMLElementHeader(r io.ReaderAt, offset, limit int64) (uint32, int64, int64, error) {
+	if offset < 0 || offset >= limit {
+		return 0, 0, 0, fmt.Errorf("无效的EBML元素: 偏移 %d", offset)
+	}
+	buf := make([]byte, 12)
+	if limit-offset < int64(len(buf)) {
+		buf = buf[:limit-offset]
+	}
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return 0, 0, 0, err
+	}
+	id, size, headerLen, ok := parseEBMLHeader(buf)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("无效的EBML元素: 偏移 %d", offset)
+	}
+	return id, size, int64(headerLen), nil
+}
+
+// 遍历内存中的子元素
+func walkEBMLElements(data []byte, fn func(id uint32, payload []byte)) error {
+	for len(data) > 0 {
+		id, size, headerLen, ok := parseEBMLHeader(data)
+		if !ok || size == ebmlUnknownSize || int64(len(data)-headerLen) < size {
+			return fmt.Errorf("无效的EBML数据")
+		}
+		fn(id, data[headerLen:int64(headerLen)+size])
+		data = data[int64(headerLen)+size:]
+	}
+	return nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func ebmlString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+func parseMatroska(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	info := &MediaInfo{Container: "matroska", Audio: []AudioStreamInfo{}, Subtitles: []SubtitleStreamInfo{}}
+
+	id, headerSize, headerLen, err := readEBMLElementHeader(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	if id != ebmlIDHeader || headerSize == ebmlUnknownSize || headerSize > maxMediaHeaderElement {
+		return nil, fmt.Errorf("无效的EBML头")
+	}
+	header := make([]byte, headerSize)
+	if _, err := r.ReadAt(header, headerLen); err != nil {
+		return nil, err
+	}
+	walkEBMLElements(header, func(id uint32, payload []byte) {
+		if id == ebmlIDDocType && ebmlString(payload) == "webm" {
+			info.Container = "webm"
+		}
+	})
+
+	segmentOffset := headerLen + headerSize
+	id, segmentSize, segmentHeaderLen, err := readEBMLElementHeader(r, segmentOffset, size)
+	if err != nil {
+		return nil, err
+	}
+	if id != mkvIDSegment {
+		return nil, fmt.Errorf("Matroska文件缺少Segment")
+	}
+	segmentStart := segmentOffset + segmentHeaderLen
+	segmentEnd := size
+	if segmentSize != ebmlUnknownSize && segmentStart+segmentSize < size {
+		segmentEnd = segmentStart + segmentSize
+	}
+
+	// Info和Tracks通常位于Cluster之前，否则通过SeekHead定位
+	positions := make(map[uint32]int64)
+	var foundInfo, foundTracks bool
+	parseElement := func(id uint32, offset int64) error {
+		if offset < segmentStart || offset >= segmentEnd {
+			return fmt.Errorf("无效的Matroska元素位置: %x", id)
+		}
+		_, elementSize, elementHeaderLen, err := readEBMLElementHeader(r, offset, segmentEnd)
+		if err != nil {
+			return err
+		}
+		if elementSize == ebmlUnknownSize || elementSize > maxMediaHeaderElement || elementSize > segmentEnd-offset-elementHeaderLen {
+			return fmt.Errorf("无效的Matroska元素: %x", id)
+		}
+		data := make([]byte, elementSize)
+		if _, err := r.ReadAt(data, offset+elementHeaderLen); err != nil {
+			return err
+		}
+		switch id {
+		case mkvIDSeekHead:
+			return parseMatroskaSeekHead(data, segmentStart, positions)
+		case mkvIDInfo:
+			foundInfo = true
+			return parseMatroskaInfo(data, info)
+		case mkvIDTracks:
+			foundTracks = true
+			return parseMatroskaTracks(data, info)
+		}
+		return nil
+	}
+
+	for offset := segmentStart; offset < segmentEnd && !(foundInfo && foundTracks); {
+		id, elementSize, elementHeaderLen, err := readEBMLElementHeader(r, offset, segmentEnd)
+		if err != nil {
+			return nil, err
+		}
+		if id == mkvIDCluster || elementSize == ebmlUnknownSize {
+			break
+		}
+		switch id {
+		case mkvIDSeekHead, mkvIDInfo, mkvIDTracks:
+			if err := parseElement(id, offset); err != nil {
+				return nil, err
+			}
+		}
+		offset += elementHeaderLen + elementSize
+	}
+
+	if !foundInfo {
+		if pos, ok := positions[mkvIDInfo]; ok {
+			if err := parseElement(mkvIDInfo, pos); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !foundTracks {
+		pos, ok := positions[mkvIDTracks]
+		if !ok {
+			return nil, fmt.Errorf("Matroska文件缺少Tracks")
+		}
+		if err := parseElement(mkvIDTracks, pos); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// SeekHead中的位置相对于Segment数据起点
+func parseMatroskaSeekHead(data []byte, segmentStart int64, positions map[uint32]int64) error {
+	return walkEBMLElements(data, func(id uint32, payload []byte) {
+		if id != mkvIDSeek {
+			return
+		}
+		var seekID uint32
+		var position int64 = -1
+		walkEBMLElements(payload, func(id uint32, value []byte) {
+			switch id {
+			case mkvIDSeekID:
+				seekID = uint32(ebmlUint(value))
+			case mkvIDSeekPosition:
+				position = int64(ebmlUint(value))
+			}
+		})
+		// 超出int64或与segmentStart相加后溢出的位置丢弃
+		if seekID != 0 && position >= 0 && position <= math.MaxInt64-segmentStart {
+			positions[seekID] = segmentStart + position
+		}
+	})
+}
+
+func parseMatroskaInfo(data []byte, info *MediaInfo) error {
+	timecodeScale := uint64(1000000)
+	var duration float64
+	err := walkEBMLElements(data, func(id uint32, payload []byte) {
+		switch id {
+		case mkvIDTimecodeScale:
+			timecodeScale = ebmlUint(payload)
+		case mkvIDDuration:
+			duration = ebmlFloat(payload)
+		}
+	})
+	info.Duration = duration * float64(timecodeScale) / 1e9
+	return err
+}
+
+func parseMatroskaTracks(data []byte, info *MediaInfo) error {
+	return walkEBMLElements(data, func(id uint32, entry []byte) {
+		if id != mkvIDTrackEntry {
+			return
+		}
+		var trackType uint64
+		var codecID, name string
+		// Language缺省值为eng
+		language, bcp47 := "eng", ""
+		var pixelWidth, pixelHeight, channels int
+		var sampleRate float64
+		walkEBMLElements(entry, func(id uint32, payload []byte) {
+			switch id {
+			case mkvIDTrackType:
+				trackType = ebmlUint(payload)
+			case mkvIDCodecID:
+				codecID = ebmlString(payload)
+			case mkvIDLanguage:
+				language = ebmlString(payload)
+			case mkvIDLanguageBCP47:
+				bcp47 = ebmlString(payload)
+			case mkvIDName:
+				name = ebmlString(payload)
+			case mkvIDVideo:
+				walkEBMLElements(payload, func(id uint32, value []byte) {
+					switch id {
+					case mkvIDPixelWidth:
+						pixelWidth = int(ebmlUint(value))
+					case mkvIDPixelHeight:
+						pixelHeight = int(ebmlUint(value))
+					}
+				})
+			case mkvIDAudio:
+				walkEBMLElements(payload, func(id uint32, value []byte) {
+					switch id {
+					case mkvIDSamplingFreq:
+						sampleRate = ebmlFloat(value)
+					case mkvIDChannels:
+						channels = int(ebmlUint(value))
+					}
+				})
+			}
+		})
+		if bcp47 != "" {
+			language = bcp47
+		}
+		if language == "und" {
+			language = ""
+		}
+
+		codec := matroskaCodecName(codecID)
+		switch trackType {
+		case 1:
+			if info.Video == nil {
+				info.Video = &VideoStreamInfo{Codec: codec, Width: pixelWidth, Height: pixelHeight}
+			}
+		case 2:
+			if sampleRate == 0 {
+				sampleRate = 8000
+			}
+			if channels == 0 {
+				channels = 1
+			}
+			info.Audio = append(info.Audio, AudioStreamInfo{Codec: codec, Channels: channels, SampleRate: int(sampleRate), Language: language})
+		case 17:
+			info.Subtitles = append(info.Subtitles, SubtitleStreamInfo{Codec: codec, Language: language, Name: name})
+		}
+	})
+}
+
+func matroskaCodecName(codecID string) string {
+	switch {
+	case codecID == "V_MPEG4/ISO/AVC":
+		return "h264"
+	case codecID == "V_MPEGH/ISO/HEVC":
+		return "hevc"
+	case codecID == "V_AV1":
+		return "av1"
+	case codecID == "V_VP8":
+		return "vp8"
+	case codecID == "V_VP9":
+		return "vp9"
+	case strings.HasPrefix(codecID, "V_MPEG4/ISO/"):
+		return "mpeg4"
+	case codecID == "V_MPEG2":
+		return "mpeg2video"
+	case strings.HasPrefix(codecID, "A_AAC"):
+		return "aac"
+	case codecID == "A_MPEG/L3":
+		return "mp3"
+	case codecID == "A_AC3":
+		return "ac3"
+	case codecID == "A_EAC3":
+		return "eac3"
+	case strings.HasPrefix(codecID, "A_DTS"):
+		return "dts"
+	case codecID == "A_OPUS":
+		return "opus"
+	case codecID == "A_VORBIS":
+		return "vorbis"
+	case codecID == "A_FLAC":
+		return "flac"
+	case codecID == "A_TRUEHD":
+		return "truehd"
+	case codecID == "S_TEXT/UTF8":
+		return "subrip"
+	case codecID == "S_TEXT/ASS", codecID == "S_TEXT/SSA", codecID == "S_ASS", codecID == "S_SSA":
+		return "ass"
+	case codecID == "S_TEXT/WEBVTT":
+		return "webvtt"
+	case codecID == "S_HDMV/PGS":
+		return "hdmv_pgs_subtitle"
+	case codecID == "S_VOBSUB":
+		return "dvd_subtitle"
+	}
+	return strings.ToLower(codecID)
+}
+
+// ---- 数据来源 ----
+
+// 只读取已下载完成的piece，数据不可用时返回errMediaDataUnavailable而不等待
+type torrentPieceReaderAt struct {
+	file *torrent.File
+}
+
+func (r torrentPieceReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.file.Length() {
+		return 0, io.EOF
+	}
+	if remaining := r.file.Length() - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !isTorrentPositionPlayable(r.file, off, int64(len(p))) {
+		return 0, errMediaDataUnavailable
+	}
+
+	reader := r.file.NewReader()
+	defer reader.Close()
+	reader.SetReadahead(0)
+	if _, err := reader.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(reader, p)
+}
+
+// 探测torrent中的视频文件，结果按info-hash和路径缓存
+func (sts *SimpleTorrentService) ProbeTorrentFile(file *torrent.File) (*MediaInfo, error) {
+	key := file.Torrent().InfoHash().HexString() + "/" + file.Path()
+	return sts.probeCached(key, func() (*MediaInfo, error) {
+		return probeMedia(torrentPieceReaderAt{file: file}, file.Length())
+	})
+}
+
+// 探测本地文件，文件修改后重新探测
+func (sts *SimpleTorrentService) ProbeLocalFile(path string) (*MediaInfo, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s@%d-%d", path, fileInfo.ModTime().UnixNano(), fileInfo.Size())
+	return sts.probeCached(key, func() (*MediaInfo, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		info, err := probeMedia(file, fileInfo.Size())
+		if err == nil {
+			sts.forgetLocalMediaProbes(path)
+		}
+		return info, err
+	})
+}
+
+// 同一文件只保留最新版本的探测结果，避免下载过程中反复修改的文件不断增加缓存
+func (sts *SimpleTorrentService) forgetLocalMediaProbes(path string) {
+	sts.probeMutex.Lock()
+	defer sts.probeMutex.Unlock()
+	for key := range sts.mediaProbes {
+		if strings.HasPrefix(key, path+"@") {
+			delete(sts.mediaProbes, key)
+		}
+	}
+}
+
+// 只缓存成功的结果，数据未下载或解析失败时下次重新探测
+func (sts *SimpleTorrentService) probeCached(key string, probe func() (*MediaInfo, error)) (*MediaInfo, error) {
+	sts.probeMutex.Lock()
+	info, ok := sts.mediaProbes[key]
+	sts.probeMutex.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	info, err := probe()
+	if err != nil {
+		return nil, err
+	}
+
+	sts.probeMutex.Lock()
+	sts.mediaProbes[key] = info
+	sts.probeMutex.Unlock()
+	return info, nil
+}
+
+// 移除任务时清理其探测缓存
+func (sts *SimpleTorrentService) forgetMediaProbes(hash string) {
+	sts.probeMutex.Lock()
+	defer sts.probeMutex.Unlock()
+	for key := range sts.mediaProbes {
+		if strings.HasPrefix(key, hash+"/") {
+			delete(sts.mediaProbes, key)
+		}
+	}
+	for key := range sts.mediaIndexes {
+		if strings.HasPrefix(key, hash+"/") {
+			delete(sts.mediaIndexes, key)
+		}
+	}
+	for key := range sts.seekIndexes {
+		if strings.HasPrefix(key, hash+"/") {
+			delete(sts.seekIndexes, key)
+		}
+	}
+	for key := range sts.archiveCRCs {
+		if strings.HasPrefix(key, hash+"/") {
+			delete(sts.archiveCRCs, key)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func ebmlFloatBytes(v float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(v))
+	return b
+}
+
+// 一条H.264视频轨道和一条AAC音频轨道，时长90秒
+func testMatroskaTracks() []byte {
+	return ebmlElement(mkvIDTracks,
+		ebmlElement(mkvIDTrackEntry,
+			ebmlElement(mkvIDTrackNumber, []byte{1}),
+			ebmlElement(mkvIDTrackType, []byte{1}),
+			ebmlElement(mkvIDCodecID, []byte("V_MPEG4/ISO/AVC")),
+			ebmlElement(mkvIDVideo,
+				ebmlElement(mkvIDPixelWidth, ebmlUintBytes(1920)),
+				ebmlElement(mkvIDPixelHeight, ebmlUintBytes(1080)),
+			),
+		),
+		ebmlElement(mkvIDTrackEntry,
+			ebmlElement(mkvIDTrackNumber, []byte{2}),
+			ebmlElement(mkvIDTrackType, []byte{2}),
+			ebmlElement(mkvIDCodecID, []byte("A_AAC")),
+			ebmlElement(mkvIDLanguage, []byte("chi")),
+			ebmlElement(mkvIDAudio,
+				ebmlElement(mkvIDChannels, []byte{2}),
+				ebmlElement(mkvIDSamplingFreq, ebmlFloatBytes(48000)),
+			),
+		),
+	)
+}
+
+func testMatroskaInfo() []byte {
+	return ebmlElement(mkvIDInfo,
+		ebmlElement(mkvIDTimecodeScale, ebmlUintBytes(1000000)),
+		ebmlElement(mkvIDDuration, ebmlFloatBytes(90000)),
+	)
+}
+
+func mp4TestBox(typ string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(b, uint32(8+len(data)))
+	copy(b[4:], typ)
+	return append(b, data...)
+}
+
+// ftyp + moov（mvhd时长120秒 + 1280x720的H.264轨道）
+func testMP4File() []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 120000)
+
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 1280<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 720<<16)
+
+	mdhd := make([]byte, 24)
+	// "eng"的打包值
+	binary.BigEndian.PutUint16(mdhd[20:], 0x15C7)
+	hdlr := append(make([]byte, 8), []byte("vide\x00\x00\x00\x00")...)
+	stsd := append(make([]byte, 8), make([]byte, 8+28)...)
+	copy(stsd[12:], "avc1")
+
+	trak := mp4TestBox("trak",
+		mp4TestBox("tkhd", tkhd),
+		mp4TestBox("mdia",
+			mp4TestBox("mdhd", mdhd),
+			mp4TestBox("hdlr", hdlr),
+			mp4TestBox("minf", mp4TestBox("stbl", mp4TestBox("stsd", stsd))),
+		),
+	)
+	return bytes.Join([][]byte{
+		mp4TestBox("ftyp", []byte("isom\x00\x00\x02\x00")),
+		mp4TestBox("moov", mp4TestBox("mvhd", mvhd), trak),
+		mp4TestBox("mdat", make([]byte, 1000)),
+	}, nil)
+}
+
+func TestProbeMedia(t *testing.T) {
+	tracks := testMatroskaTracks()
+	cluster := ebmlElement(mkvIDCluster, make([]byte, 64))
+	seekHead := func(position uint64) []byte {
+		return ebmlElement(mkvIDSeekHead, matroskaSeek(mkvIDTracks, position))
+	}
+	// Tracks位于Cluster之后，通过SeekHead定位
+	info := testMatroskaInfo()
+	position := uint64(len(seekHead(0)) + len(info) + len(cluster))
+	trailingTracks := matroskaFile(seekHead(position), info, cluster, tracks)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		container string
+		duration  float64
+		video     string
+		audio     string
+	}{
+		{"MKV", matroskaFile(testMatroskaInfo(), tracks), "matroska", 90, "h264", "aac"},
+		{"MKV通过SeekHead定位Tracks", trailingTracks, "matroska", 90, "h264", "aac"},
+		{"MP4", testMP4File(), "mp4", 120, "h264", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := probeMedia(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if info.Container != tt.container || info.Duration != tt.duration {
+				t.Fatalf("容器或时长错误: %s %v", info.Container, info.Duration)
+			}
+			if info.Video == nil || info.Video.Codec != tt.video {
+				t.Fatalf("视频轨道错误: %+v", info.Video)
+			}
+			if tt.audio != "" && (len(info.Audio) != 1 || info.Audio[0].Codec != tt.audio || info.Audio[0].Channels != 2 || info.Audio[0].SampleRate != 48000) {
+				t.Fatalf("音频轨道错误: %+v", info.Audio)
+			}
+		})
+	}
+}
+
+func TestProbeMediaRejectsInvalidInput(t *testing.T) {
+	badMoov := testMP4File()
+	// moov的大小改为超出文件
+	binary.BigEndian.PutUint32(badMoov[16:], 0xFFFFFF00)
+	hugeBox := testMP4File()
+	// 64位大小的ftyp，大小接近int64上限
+	largeSize := append([]byte{0, 0, 0, 1, 'f', 't', 'y', 'p'}, ebmlUintBytes(math.MaxInt64-4)...)
+	hugeBox = append(largeSize, hugeBox[16:]...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"空文件", nil},
+		{"未知格式", []byte("not a media file at all")},
+		{"SeekHead指向Segment之外", matroskaFile(ebmlElement(mkvIDSeekHead, matroskaSeek(mkvIDTracks, 1<<40)))},
+		{"SeekHead位置溢出", matroskaFile(ebmlElement(mkvIDSeekHead, matroskaSeek(mkvIDTracks, math.MaxInt64)))},
+		{"缺少Tracks", matroskaFile(testMatroskaInfo())},
+		{"moov超出文件", badMoov},
+		{"box大小接近int64上限", hugeBox},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := probeMedia(bytes.NewReader(tt.data), int64(len(tt.data))); err == nil {
+				t.Fatalf("期望返回错误")
+			}
+		})
+	}
+}
+
+// 任意截断和逐字节篡改的文件都不能导致解析器panic
+func TestMediaParsersDoNotPanic(t *testing.T) {
+	samples := [][]byte{
+		matroskaFile(ebmlElement(mkvIDSeekHead, matroskaSeek(mkvIDTracks, 0)), testMatroskaInfo(), testMatroskaTracks()),
+		testMP4File(),
+	}
+	check := func(data []byte) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				t.Fatalf("解析%d字节的数据时panic: %v", len(data), recovered)
+			}
+		}()
+		r, size := bytes.NewReader(data), int64(len(data))
+		if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+			parseMP4(r, size)
+		} else {
+			parseMatroska(r, size)
+		}
+		locateMediaRegions(r, size)
+		buildSeekIndex(r, size)
+	}
+
+	for _, sample := range samples {
+		for n := 12; n <= len(sample); n++ {
+			check(sample[:n])
+		}
+		for i := 0; i < len(sample); i++ {
+			for _, value := range []byte{0x00, 0x01, 0x7F, 0xFF} {
+				data := append([]byte(nil), sample...)
+				data[i] = value
+				check(data)
+			}
+		}
+	}
+}
+
+func TestReadEBMLElementHeaderBounds(t *testing.T) {
+	data := matroskaFile(testMatroskaInfo())
+	r := bytes.NewReader(data)
+	for _, offset := range []int64{-1, int64(len(data)), int64(len(data)) + 100} {
+		if _, _, _, err := readEBMLElementHeader(r, offset, int64(len(data))); err == nil {
+			t.Fatalf("偏移 %d 期望返回错误", offset)
+		}
+	}
+	id, _, _, err := readEBMLElementHeader(r, 0, int64(len(data)))
+	if err != nil || id != ebmlIDHeader {
+		t.Fatalf("读取EBML头失败: %x %v", id, err)
+	}
+}
+
+func TestGetDownloadingVideoFiles(t *testing.T) {
+	ts := newTestTorrentService(t)
+	hash, _ := addTestTorrentStatus(t, ts, "movie.mkv", "")
+	addTestTorrentStatus(t, ts, "readme.txt", "")
+	done, _ := addTestTorrentStatus(t, ts, "done.mp4", "")
+	ts.torrents[done].Status = "下载完成"
+
+	files := ts.GetDownloadingVideoFiles()
+	if len(files) != 1 {
+		t.Fatalf("视频文件 %+v", files)
+	}
+	file := files[0]
+	// 数据尚未下载，无法解析媒体头部
+	if file.Hash != hash || file.FileName != "movie.mkv" || file.TorrentName != "movie.mkv" || file.Playable || file.Media != nil {
+		t.Fatalf("视频文件 %+v", file)
+	}
+	if file.FileID != playbackFileID("torrent/"+hash+"/movie.mkv") {
+		t.Fatalf("文件ID %q", file.FileID)
+	}
+}
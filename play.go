@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
+)
+
+// 等待种子信息的默认和最长时间
+const (
+	defaultPlayTimeout = 30 * time.Second
+	maxPlayTimeout     = 120 * time.Second
+)
+
+// 添加magnet链接，任务已存在时直接复用，返回info-hash
+func (sts *SimpleTorrentService) AddOrReuseMagnet(magnetURL string) (string, bool, error) {
+	spec, err := torrent.TorrentSpecFromMagnetUri(magnetURL)
+	if err != nil {
+		return "", false, fmt.Errorf("无效的magnet链接: %v", err)
+	}
+	hash := spec.InfoHash.HexString()
+
+	// 检查和添加在同一次加锁中完成，并发请求同一个magnet时只添加一次
+	err = sts.DownloadMagnet(magnetURL)
+	if errors.Is(err, errTorrentExists) {
+		return hash, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return hash, true, nil
+}
+
+// 等待任务获取到种子信息，超时或请求取消时返回错误
+func (sts *SimpleTorrentService) WaitForInfo(ctx context.Context, hash string, timeout time.Duration) (*torrent.Torrent, error) {
+	sts.mutex.RLock()
+	status, exists := sts.torrents[hash]
+	sts.mutex.RUnlock()
+	if !exists || status.Torrent == nil {
+		return nil, fmt.Errorf("torrent不存在")
+	}
+
+	select {
+	case <-status.Torrent.GotInfo():
+		return status.Torrent, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(timeout):
+		return nil, context.DeadlineExceeded
+	}
+}
+
+// 选择要播放的文件：指定了文件索引或路径时使用该文件，否则为最大的视频文件
+func selectPlayFile(t *torrent.Torrent, requested string) (int, *torrent.File, error) {
+	files := t.Files()
+	if requested != "" {
+		if index, err := strconv.Atoi(requested); err == nil {
+			if index < 0 || index >= len(files) {
+				return 0, nil, fmt.Errorf("文件索引无效: %d", index)
+			}
+			return index, files[index], nil
+		}
+		for i, file := range files {
+			if file.Path() == requested || file.DisplayPath() == requested {
+				return i, file, nil
+			}
+		}
+		return 0, nil, fmt.Errorf("文件不存在: %s", requested)
+	}
+
+	selected := -1
+	for i, file := range files {
+		if isVideoFile(file.Path()) && (selected < 0 || file.Length() > files[selected].Length()) {
+			selected = i
+		}
+	}
+	if selected < 0 {
+		return 0, nil, fmt.Errorf("torrent中没有视频文件")
+	}
+	return selected, files[selected], nil
+}
+
+// 与浏览器的encodeURIComponent一致，空格编码为%20
+func encodeURIComponent(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// 播放页地址，file参数与Web界面一样经过两次编码
+func playerPageURL(streamPath string) string {
+	return "/static/video_player.html?file=" + encodeURIComponent(encodeURIComponent(streamPath)) +
+		"&title=" + encodeURIComponent(path.Base(streamPath))
+}
+
+func setupPlayRoutes(r *gin.Engine, ts *SimpleTorrentService) {
+	// 一步播放：添加或复用任务，等待种子信息，选择视频文件并优先下载开头，
+	// 然后跳转到播放页（to=stream时跳转到流地址），format=json时返回JSON
+	r.GET("/play", func(c *gin.Context) {
+		hash := strings.ToLower(c.Query("hash"))
+		added := false
+		if magnet := c.Query("magnet"); magnet != "" {
+			var err error
+			hash, added, err = ts.AddOrReuseMagnet(magnet)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if hash == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请提供magnet或hash"})
+			return
+		}
+
+		timeout := defaultPlayTimeout
+		if value := c.Query("timeout"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的timeout"})
+				return
+			}
+			timeout = time.Duration(seconds) * time.Second
+			if timeout > maxPlayTimeout {
+				timeout = maxPlayTimeout
+			}
+		}
+
+		t, err := ts.WaitForInfo(c.Request.Context(), hash, timeout)
+		switch {
+		case err == context.DeadlineExceeded:
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": "获取种子信息超时", "hash": hash})
+			return
+		case err != nil:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "hash": hash})
+			return
+		}
+
+		fileIndex, file, err := selectPlayFile(t, c.Query("file"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "hash": hash})
+			return
+		}
+
+		// 文件头、文件尾及moov/MKV索引优先下载
+		ts.prioritizeMediaIndex(file)
+
+		streamPath := "torrent/" + hash + "/" + file.Path()
+		if c.Query("format") == "json" {
+			baseURL := requestBaseURL(c)
+			result := gin.H{
+				"hash":       hash,
+				"name":       t.Name(),
+				"added":      added,
+				"file":       file.Path(),
+				"file_index": fileIndex,
+				"size":       file.Length(),
+				"stream_url": streamURL(baseURL, streamPath),
+				"player_url": baseURL + playerPageURL(streamPath),
+			}
+			if media, err := ts.ProbeTorrentFile(file); err == nil {
+				result["media"] = media
+			}
+			c.JSON(http.StatusOK, result)
+			return
+		}
+
+		if c.Query("to") == "stream" {
+			c.Redirect(http.StatusFound, streamURL("", streamPath))
+			return
+		}
+		c.Redirect(http.StatusFound, playerPageURL(streamPath))
+	})
+}
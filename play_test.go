@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAddOrReuseMagnetConcurrent(t *testing.T) {
+	ts := newTestTorrentService(t)
+	const magnet = "magnet:?xt=urn:btih:17690e02bc8f7f0a1f9d39cd4bdde5d4e31f5395&dn=seek"
+
+	// 并发请求同一个magnet时只有一个请求添加任务
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hash, isNew, err := ts.AddOrReuseMagnet(magnet)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if hash != "17690e02bc8f7f0a1f9d39cd4bdde5d4e31f5395" {
+				t.Errorf("hash %q", hash)
+			}
+			if isNew {
+				added.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added.Load() != 1 {
+		t.Fatalf("添加了 %d 次", added.Load())
+	}
+
+	// 取消的任务重新添加
+	if err := ts.CancelDownload("17690e02bc8f7f0a1f9d39cd4bdde5d4e31f5395"); err != nil {
+		t.Fatal(err)
+	}
+	if _, isNew, err := ts.AddOrReuseMagnet(magnet); err != nil || !isNew {
+		t.Fatalf("取消后应重新添加: %v %v", isNew, err)
+	}
+}
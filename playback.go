@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
+)
+
+// 播放到该比例即视为看完
+const watchedRatio = 0.9
+
+// 播放进度
+type PlaybackState struct {
+	// 上次播放位置和总时长（秒）
+	Position  float64   `json:"position"`
+	Duration  float64   `json:"duration"`
+	Watched   bool      `json:"watched"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 观看记录 - 按文件保存播放进度，定期写入磁盘
+type PlaybackStore struct {
+	path   string
+	states map[string]*PlaybackState
+	dirty  bool
+	mutex  sync.Mutex
+}
+
+func NewPlaybackStore(path string) *PlaybackStore {
+	ps := &PlaybackStore{
+		path:   path,
+		states: make(map[string]*PlaybackState),
+	}
+	ps.load()
+	go ps.flushLoop()
+	return ps
+}
+
+// 文件ID为播放地址（/stream/后的路径）的base64url编码，播放页可直接计算
+func playbackFileID(streamPath string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(streamPath))
+}
+
+func parsePlaybackFileID(fileID string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(fileID, "="))
+	if err != nil || len(data) == 0 {
+		return "", fmt.Errorf("无效的文件ID: %s", fileID)
+	}
+	return strings.TrimPrefix(string(data), "/"), nil
+}
+
+// torrent文件的播放地址
+func torrentPlaybackKey(hash string, file *torrent.File) string {
+	return "torrent/" + hash + "/" + file.Path()
+}
+
+// 将播放地址转换为记录键。每个文件只有一个键，与任务是否在运行中无关：
+// 磁盘上的文件使用下载目录中的相对路径（下载目录之外使用绝对路径），torrent文件使用其数据在磁盘上的路径，
+// 这样重启后任务未重新添加时本地文件的记录不变；不落盘的流媒体存储使用torrent路径
+func (sts *SimpleTorrentService) playbackKey(streamPath string) string {
+	if !strings.HasPrefix(streamPath, "torrent/") {
+		return sts.localPlaybackKey(filepath.Join(sts.downloadDir, filepath.FromSlash(streamPath)))
+	}
+
+	parts := strings.SplitN(streamPath, "/", 3)
+	if len(parts) < 3 {
+		return streamPath
+	}
+	hash := strings.ToLower(parts[1])
+
+	sts.mutex.RLock()
+	defer sts.mutex.RUnlock()
+	if status, exists := sts.torrents[hash]; exists && sts.fileStorage() {
+		return sts.localPlaybackKey(filepath.Join(sts.statusDataDir(status), filepath.FromSlash(parts[2])))
+	}
+	return streamPath
+}
+
+// torrent文件的记录键，调用方需持有锁
+func (sts *SimpleTorrentService) torrentFilePlaybackKeyLocked(hash string, status *TorrentStatus, file *torrent.File) string {
+	if !sts.fileStorage() {
+		return torrentPlaybackKey(hash, file)
+	}
+	return sts.localPlaybackKey(filepath.Join(sts.statusDataDir(status), filepath.FromSlash(file.Path())))
+}
+
+// 磁盘上文件的记录键
+func (sts *SimpleTorrentService) localPlaybackKey(fullPath string) string {
+	full := absPath(fullPath)
+	rel, err := filepath.Rel(absPath(sts.downloadDir), full)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(full)
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func (ps *PlaybackStore) Get(key string) *PlaybackState {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	state, exists := ps.states[key]
+	if !exists {
+		return nil
+	}
+	copied := *state
+	return &copied
+}
+
+// 更新播放进度，播放到90%或播放页报告播放结束时标记为看完
+func (ps *PlaybackStore) Update(key string, position float64, duration float64, ended bool) PlaybackState {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	state, exists := ps.states[key]
+	if !exists {
+		state = &PlaybackState{}
+		ps.states[key] = state
+	}
+	wasWatched := state.Watched
+
+	state.Position = position
+	if duration > 0 {
+		state.Duration = duration
+	}
+	if ended || (state.Duration > 0 && position >= state.Duration*watchedRatio) {
+		state.Watched = true
+	}
+	state.UpdatedAt = time.Now()
+	ps.dirty = true
+
+	// 看完状态变化立即保存，播放位置定期保存
+	if state.Watched != wasWatched {
+		ps.saveLocked()
+	}
+	return *state
+}
+
+// 记录移到新的键，新键已有记录时保留新键的记录
+func (ps *PlaybackStore) rename(from string, to string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	state, exists := ps.states[from]
+	if !exists {
+		return
+	}
+	delete(ps.states, from)
+	if _, exists := ps.states[to]; !exists {
+		ps.states[to] = state
+	}
+	ps.saveLocked()
+}
+
+// 清除记录（标记为未看）
+func (ps *PlaybackStore) Delete(key string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if _, exists := ps.states[key]; exists {
+		delete(ps.states, key)
+		ps.saveLocked()
+	}
+}
+
+func (ps *PlaybackStore) load() {
+	data, err := os.ReadFile(ps.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取观看记录失败: %v", err)
+		}
+		return
+	}
+
+	var states map[string]*PlaybackState
+	if err := json.Unmarshal(data, &states); err != nil {
+		log.Printf("解析观看记录失败: %v", err)
+		return
+	}
+	if states != nil {
+		ps.states = states
+	}
+}
+
+func (ps *PlaybackStore) flushLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ps.mutex.Lock()
+		if ps.dirty {
+			ps.saveLocked()
+		}
+		ps.mutex.Unlock()
+	}
+}
+
+// 保存记录，调用方需持有锁
+func (ps *PlaybackStore) saveLocked() {
+	data, err := json.MarshalIndent(ps.states, "", "  ")
+	if err != nil {
+		log.Printf("序列化观看记录失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(ps.path, data, 0644); err != nil {
+		log.Printf("保存观看记录失败: %v", err)
+		return
+	}
+	ps.dirty = false
+}
+
+// 设置观看记录路由
+func setupPlaybackRoutes(r *gin.Engine, ts *SimpleTorrentService) {
+	pathFromParam := func(c *gin.Context) (string, bool) {
+		streamPath, err := parsePlaybackFileID(c.Param("fileId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return "", false
+		}
+		return streamPath, true
+	}
+
+	// 获取上次播放位置，没有记录时position为0。只读取记录，旧键的记录在下次报告进度时迁移
+	r.GET("/playback/:fileId", func(c *gin.Context) {
+		streamPath, ok := pathFromParam(c)
+		if !ok {
+			return
+		}
+		key := ts.playbackKey(streamPath)
+		state := ts.playback.Get(key)
+		if state == nil && key != streamPath {
+			state = ts.playback.Get(streamPath)
+		}
+		if state == nil {
+			state = &PlaybackState{}
+		}
+		c.JSON(http.StatusOK, state)
+	})
+
+	// 播放页定期报告播放位置，只接受存在的文件
+	r.POST("/playback/:fileId", func(c *gin.Context) {
+		streamPath, ok := pathFromParam(c)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Position float64 `json:"position"`
+			Duration float64 `json:"duration"`
+			// 播放结束
+			Ended bool `json:"ended"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Position < 0 || req.Duration < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求格式"})
+			return
+		}
+
+		streamPath, err := ts.shareablePath(streamPath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		key := ts.playbackKey(streamPath)
+		// 之前以torrent路径保存的记录转到新的键
+		if key != streamPath {
+			ts.playback.rename(streamPath, key)
+		}
+
+		c.JSON(http.StatusOK, ts.playback.Update(key, req.Position, req.Duration, req.Ended))
+	})
+
+	// 清除观看记录，包括旧键的记录
+	r.DELETE("/playback/:fileId", func(c *gin.Context) {
+		streamPath, ok := pathFromParam(c)
+		if !ok {
+			return
+		}
+		key := ts.playbackKey(streamPath)
+		ts.playback.Delete(key)
+		if key != streamPath {
+			ts.playback.Delete(streamPath)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "观看记录已清除"})
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParsePlaybackFileID(t *testing.T) {
+	for _, streamPath := range []string{"movie.mp4", "torrent/abc/第一季/01.mkv", "a+b 100%.mp4"} {
+		got, err := parsePlaybackFileID(playbackFileID(streamPath))
+		if err != nil || got != streamPath {
+			t.Errorf("parsePlaybackFileID(playbackFileID(%q)) = %q, %v", streamPath, got, err)
+		}
+	}
+	for _, id := range []string{"", "!!!"} {
+		if _, err := parsePlaybackFileID(id); err == nil {
+			t.Errorf("parsePlaybackFileID(%q) 期望返回错误", id)
+		}
+	}
+}
+
+// torrent文件和磁盘上的同一文件使用同一个键，任务移除（如重启后未重新添加）后键不变
+func TestPlaybackKeyStable(t *testing.T) {
+	ts := newTestTorrentService(t)
+	hash, tor := addTestTorrentStatus(t, ts, "episode.mkv", "")
+	torrentPath := torrentPlaybackKey(hash, tor.Files()[0])
+
+	local := ts.playbackKey("episode.mkv")
+	if local != "episode.mkv" {
+		t.Fatalf("本地文件的键 %q", local)
+	}
+	if key := ts.playbackKey(torrentPath); key != local {
+		t.Fatalf("torrent文件的键 %q, 期望与本地文件相同 %q", key, local)
+	}
+
+	ts.mutex.Lock()
+	delete(ts.torrents, hash)
+	ts.mutex.Unlock()
+	if key := ts.playbackKey("episode.mkv"); key != local {
+		t.Fatalf("任务移除后本地文件的键变为 %q", key)
+	}
+	if key := ts.playbackKey("./sub/../episode.mkv"); key != local {
+		t.Fatalf("路径未规范化: %q", key)
+	}
+}
+
+func TestPlaybackKeyCustomSavePath(t *testing.T) {
+	ts := newTestTorrentService(t)
+	savePath := t.TempDir()
+	hash, tor := addTestTorrentStatus(t, ts, "movie.mkv", savePath)
+
+	key := ts.playbackKey(torrentPlaybackKey(hash, tor.Files()[0]))
+	if want := filepath.ToSlash(absPath(filepath.Join(savePath, "movie.mkv"))); key != want {
+		t.Fatalf("下载目录之外的文件的键 %q, 期望 %q", key, want)
+	}
+
+	// 不落盘的存储使用torrent路径
+	ts.config.Storage.Type = StorageStreaming
+	if key := ts.playbackKey(torrentPlaybackKey(hash, tor.Files()[0])); key != torrentPlaybackKey(hash, tor.Files()[0]) {
+		t.Fatalf("流媒体存储的键 %q", key)
+	}
+}
+
+func TestPlaybackStoreWatched(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playback_state.json")
+	ps := NewPlaybackStore(path)
+	if state := ps.Update("a", 500, 1000, false); state.Watched {
+		t.Fatal("播放一半不应标记为看完")
+	}
+	if state := ps.Update("a", 950, 0, false); !state.Watched || state.Duration != 1000 {
+		t.Fatalf("播放到90%%应标记为看完: %+v", state)
+	}
+	if state := ps.Update("b", 10, 0, true); !state.Watched {
+		t.Fatal("播放结束应标记为看完")
+	}
+
+	// 看完状态变化立即保存
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("记录未保存: %v", err)
+	}
+	if state := NewPlaybackStore(path).Get("a"); state == nil || !state.Watched {
+		t.Fatalf("重新加载后记录错误: %+v", state)
+	}
+}
+
+func TestPlaybackRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ts := newTestTorrentService(t)
+	hash, tor := addTestTorrentStatus(t, ts, "episode.mkv", "")
+	torrentPath := torrentPlaybackKey(hash, tor.Files()[0])
+	r := gin.New()
+	setupPlaybackRoutes(r, ts)
+
+	request := func(method string, streamPath string, body string) (int, PlaybackState) {
+		req := httptest.NewRequest(method, "/playback/"+playbackFileID(streamPath), strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var state PlaybackState
+		json.Unmarshal(w.Body.Bytes(), &state)
+		return w.Code, state
+	}
+
+	// 之前以torrent路径保存的记录，读取时不迁移也不写入磁盘
+	ts.playback.Update(torrentPath, 100, 1000, false)
+	if code, state := request(http.MethodGet, torrentPath, ""); code != http.StatusOK || state.Position != 100 {
+		t.Fatalf("读取旧记录: %d %+v", code, state)
+	}
+	if ts.playback.Get(torrentPath) == nil || ts.playback.Get("episode.mkv") != nil {
+		t.Fatal("GET不应迁移记录")
+	}
+	if _, err := os.Stat(ts.playback.path); !os.IsNotExist(err) {
+		t.Fatalf("GET不应保存记录: %v", err)
+	}
+
+	// 报告进度时迁移到新键
+	if code, state := request(http.MethodPost, torrentPath, `{"position":200,"duration":1000}`); code != http.StatusOK || state.Position != 200 {
+		t.Fatalf("报告进度: %d %+v", code, state)
+	}
+	if ts.playback.Get(torrentPath) != nil {
+		t.Fatal("旧键应删除")
+	}
+	if state := ts.playback.Get("episode.mkv"); state == nil || state.Position != 200 {
+		t.Fatalf("新键的记录 %+v", state)
+	}
+
+	// 不存在的文件和下载目录以外的路径不记录
+	for _, streamPath := range []string{"missing.mkv", "../outside.mkv", "torrent/" + hash + "/missing.mkv"} {
+		if code, _ := request(http.MethodPost, streamPath, `{"position":1}`); code != http.StatusNotFound {
+			t.Fatalf("%s: 状态码 %d", streamPath, code)
+		}
+	}
+	if code, _ := request(http.MethodPost, "episode.mkv", `{"position":-1}`); code != http.StatusBadRequest {
+		t.Fatalf("负数位置: 状态码 %d", code)
+	}
+
+	if code, _ := request(http.MethodDelete, torrentPath, ""); code != http.StatusOK {
+		t.Fatalf("清除记录: 状态码 %d", code)
+	}
+	if code, state := request(http.MethodGet, "episode.mkv", ""); code != http.StatusOK || state.Position != 0 {
+		t.Fatalf("清除后的记录 %+v", state)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 播放列表条目
+type playlistEntry struct {
+	Title string
+	URL   string
+	// 时长（秒），未知时为0
+	Duration float64
+	// 排序用的相对路径
+	sortPath string
+}
+
+// 按目录、剧集编号和自然顺序（数字按数值比较）排序
+func sortPlaylist(entries []playlistEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return playlistLess(entries[i].sortPath, entries[j].sortPath)
+	})
+}
+
+var (
+	// 目录名中的季编号: Season 2、S02、第2季
+	folderSeasonPattern = regexp.MustCompile(`(?i)\b(?:season\s*|s)(\d{1,2})\b|第\s*(\d{1,2})\s*季`)
+	// 一位数的集编号: E1、EP1
+	shortEpisodePattern = regexp.MustCompile(`(?i)\bEP?(\d)\b`)
+)
+
+// 同一目录中带集编号的文件在前，按季、集编号排序，文件名没有季编号时使用目录的季编号（没有时为0）；
+// 其余文件按自然顺序排在后面。每个文件的排序键固定，比较满足传递性
+func playlistLess(a, b string) bool {
+	dirA, dirB := path.Dir(a), path.Dir(b)
+	if dirA != dirB {
+		return naturalLess(dirA, dirB)
+	}
+
+	nameA, nameB := path.Base(a), path.Base(b)
+	seasonA, episodeA, okA := episodeNumber(nameA)
+	seasonB, episodeB, okB := episodeNumber(nameB)
+	if okA != okB {
+		return okA
+	}
+	if okA {
+		dirSeason := folderSeason(path.Base(dirA))
+		if seasonA == 0 {
+			seasonA = dirSeason
+		}
+		if seasonB == 0 {
+			seasonB = dirSeason
+		}
+		if seasonA != seasonB {
+			return seasonA < seasonB
+		}
+		if episodeA != episodeB {
+			return episodeA < episodeB
+		}
+	}
+	return naturalLess(nameA, nameB)
+}
+
+func folderSeason(dir string) int {
+	m := folderSeasonPattern.FindStringSubmatch(dir)
+	if m == nil {
+		return 0
+	}
+	season, _ := strconv.Atoi(m[1] + m[2])
+	return season
+}
+
+// 从文件名解析季和集编号，与RSS规则使用相同的识别方式；文件名中的E1等一位数集编号也识别
+func episodeNumber(name string) (int, int, bool) {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	_, episode := parseEpisode(base)
+	var season, number int
+	if _, err := fmt.Sscanf(episode, "S%dE%d", &season, &number); err == nil {
+		return season, number, true
+	}
+	if _, err := fmt.Sscanf(episode, "E%d", &number); err == nil {
+		return 0, number, true
+	}
+	if m := shortEpisodePattern.FindStringSubmatch(base); m != nil {
+		number, _ = strconv.Atoi(m[1])
+		return 0, number, true
+	}
+	return 0, 0, false
+}
+
+// 自然排序：连续数字按数值比较，其余字符不区分大小写
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		digitsA, digitsB := leadingDigits(a), leadingDigits(b)
+		if digitsA != "" && digitsB != "" {
+			numA, numB := strings.TrimLeft(digitsA, "0"), strings.TrimLeft(digitsB, "0")
+			if len(numA) != len(numB) {
+				return len(numA) < len(numB)
+			}
+			if numA != numB {
+				return numA < numB
+			}
+			a, b = a[len(digitsA):], b[len(digitsB):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// 请求的外部地址，外部播放器需要绝对URL
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// /stream/地址，逐段转义路径
+func streamURL(baseURL string, streamPath string) string {
+	segments := strings.Split(streamPath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return baseURL + "/stream/" + strings.Join(segments, "/")
+}
+
+// torrent中的所有视频文件
+func (sts *SimpleTorrentService) torrentPlaylist(hash string, baseURL string) (string, []playlistEntry, error) {
+	files, err := sts.GetTorrentFiles(hash)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var entries []playlistEntry
+	for _, file := range files {
+		if !isVideoFile(file.Path()) {
+			continue
+		}
+		entry := playlistEntry{
+			Title:    path.Base(file.Path()),
+			URL:      streamURL(baseURL, "torrent/"+hash+"/"+file.Path()),
+			sortPath: file.Path(),
+		}
+		if media, err := sts.ProbeTorrentFile(file); err == nil {
+			entry.Duration = media.Duration
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return "", nil, fmt.Errorf("没有视频文件")
+	}
+
+	name := hash
+	if len(files) > 0 {
+		name = files[0].Torrent().Name()
+	}
+	sortPlaylist(entries)
+	return name, entries, nil
+}
+
+// 下载目录下某个目录中的所有视频文件（包含子目录）
+func (sts *SimpleTorrentService) directoryPlaylist(dir string, baseURL string) (string, []playlistEntry, error) {
+	root := filepath.Join(sts.downloadDir, filepath.FromSlash(dir))
+	rel, err := filepath.Rel(sts.downloadDir, root)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", nil, fmt.Errorf("无效的目录: %s", dir)
+	}
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return "", nil, fmt.Errorf("目录不存在: %s", dir)
+	}
+
+	var entries []playlistEntry
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// 跳过转码、缩略图等缓存目录
+		if info.IsDir() && p != root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !isVideoFile(p) {
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(sts.downloadDir, p)
+		relPath = filepath.ToSlash(relPath)
+		entry := playlistEntry{
+			Title:    info.Name(),
+			URL:      streamURL(baseURL, relPath),
+			sortPath: relPath,
+		}
+		if media, err := sts.ProbeLocalFile(p); err == nil {
+			entry.Duration = media.Duration
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("读取目录失败: %v", err)
+	}
+	if len(entries) == 0 {
+		return "", nil, fmt.Errorf("没有视频文件")
+	}
+
+	name := filepath.Base(root)
+	sortPlaylist(entries)
+	return name, entries, nil
+}
+
+// 扩展M3U
+func renderM3U(entries []playlistEntry) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, entry := range entries {
+		duration := -1
+		if entry.Duration > 0 {
+			duration = int(math.Round(entry.Duration))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", duration, entry.Title, entry.URL)
+	}
+	return b.String()
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+	// 毫秒
+	Duration int64 `xml:"duration,omitempty"`
+}
+
+func renderXSPF(title string, entries []playlistEntry) (string, error) {
+	playlist := xspfPlaylist{
+		Version: "1",
+		Xmlns:   "http://xspf.org/ns/0/",
+		Title:   title,
+	}
+	for _, entry := range entries {
+		playlist.Tracks = append(playlist.Tracks, xspfTrack{
+			Location: entry.URL,
+			Title:    entry.Title,
+			Duration: int64(entry.Duration * 1000),
+		})
+	}
+	data, err := xml.MarshalIndent(playlist, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(data) + "\n", nil
+}
+
+// 按格式输出播放列表，format为m3u8、m3u或xspf
+func servePlaylist(c *gin.Context, name string, format string, entries []playlistEntry) {
+	var body, contentType string
+	switch format {
+	case "m3u8", "m3u":
+		body = renderM3U(entries)
+		contentType = "audio/x-mpegurl; charset=utf-8"
+	case "xspf":
+		var err error
+		if body, err = renderXSPF(name, entries); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		contentType = "application/xspf+xml; charset=utf-8"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不支持的播放列表格式: " + format})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", url.PathEscape(name+"."+format)))
+	c.Data(http.StatusOK, contentType, []byte(body))
+}
+
+// 设置播放列表路由
+func setupPlaylistRoutes(r *gin.Engine, ts *SimpleTorrentService) {
+	// torrent中所有视频文件的播放列表: /playlist/:hash.m3u8 或 /playlist/:hash.xspf
+	r.GET("/playlist/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		format := strings.TrimPrefix(path.Ext(name), ".")
+		hash := strings.TrimSuffix(name, path.Ext(name))
+
+		title, entries, err := ts.torrentPlaylist(hash, requestBaseURL(c))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		servePlaylist(c, title, format, entries)
+	})
+
+	// 下载目录下某个目录的播放列表: /playlist/dir/剧集/第一季?format=xspf（默认m3u8）
+	r.GET("/playlist/dir/*path", func(c *gin.Context) {
+		dir := strings.Trim(c.Param("path"), "/")
+		format := c.DefaultQuery("format", "m3u8")
+
+		title, entries, err := ts.directoryPlaylist(dir, requestBaseURL(c))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		servePlaylist(c, title, format, entries)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSortPlaylist(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+	}{
+		{
+			name:  "集编号按数值排序",
+			paths: []string{"Show.E2.mkv", "Show.E10.mkv", "Show.E1.mkv"},
+		},
+		{
+			name:  "按季和集排序",
+			paths: []string{"Show.S02E01.mkv", "Show.S01E10.mkv", "Show.S01E02.mkv"},
+		},
+		{
+			name: "混合带季和不带季的文件名，没有季编号时为0",
+			paths: []string{
+				"Show.S02E01.mkv", "Show - 03.mkv", "Show.S01E05.mkv", "Show.E01.mkv", "Show.S01E01.mkv",
+			},
+		},
+		{
+			name: "没有季编号时使用目录的季编号",
+			paths: []string{
+				"Show Season 2/Show.S02E02.mkv", "Show Season 2/第1集.mkv", "Show Season 2/Show.S01E09.mkv", "Show Season 2/Show.E03.mkv",
+			},
+		},
+		{
+			name:  "中文目录的季编号",
+			paths: []string{"第3季/S03E02.mkv", "第3季/第01集.mkv", "第3季/S02E05.mkv"},
+		},
+		{
+			name:  "没有集编号的文件排在后面",
+			paths: []string{"Extras.mkv", "Show.E02.mkv", "Behind 10.mkv", "Behind 9.mkv", "Show.E01.mkv"},
+		},
+		{
+			name:  "先按目录排序",
+			paths: []string{"Season 10/E01.mkv", "Season 2/E02.mkv", "Season 2/E01.mkv"},
+		},
+	}
+	want := map[string][]string{
+		"集编号按数值排序": {"Show.E1.mkv", "Show.E2.mkv", "Show.E10.mkv"},
+		"按季和集排序":   {"Show.S01E02.mkv", "Show.S01E10.mkv", "Show.S02E01.mkv"},
+		"混合带季和不带季的文件名，没有季编号时为0": {"Show.E01.mkv", "Show - 03.mkv", "Show.S01E01.mkv", "Show.S01E05.mkv", "Show.S02E01.mkv"},
+		"没有季编号时使用目录的季编号":        {"Show Season 2/Show.S01E09.mkv", "Show Season 2/第1集.mkv", "Show Season 2/Show.S02E02.mkv", "Show Season 2/Show.E03.mkv"},
+		"中文目录的季编号":              {"第3季/S02E05.mkv", "第3季/第01集.mkv", "第3季/S03E02.mkv"},
+		"没有集编号的文件排在后面":          {"Show.E01.mkv", "Show.E02.mkv", "Behind 9.mkv", "Behind 10.mkv", "Extras.mkv"},
+		"先按目录排序":                {"Season 2/E01.mkv", "Season 2/E02.mkv", "Season 10/E01.mkv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := make([]playlistEntry, len(tt.paths))
+			for i, p := range tt.paths {
+				entries[i] = playlistEntry{sortPath: p}
+			}
+			sortPlaylist(entries)
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.sortPath)
+			}
+			if !reflect.DeepEqual(got, want[tt.name]) {
+				t.Fatalf("顺序 %v, 期望 %v", got, want[tt.name])
+			}
+
+			// 任意三个文件的比较满足传递性
+			for _, a := range tt.paths {
+				for _, b := range tt.paths {
+					for _, c := range tt.paths {
+						if playlistLess(a, b) && playlistLess(b, c) && !playlistLess(a, c) {
+							t.Fatalf("不满足传递性: %s < %s < %s", a, b, c)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRenderXSPF(t *testing.T) {
+	entries := []playlistEntry{
+		{Title: `Tom & Jerry <1>.mkv`, URL: "http://host/stream/a%26b.mkv?x=1&y=2", Duration: 90.5},
+		{Title: "无时长.mp4", URL: "http://host/stream/b.mp4"},
+	}
+	body, err := renderXSPF(`剧集 "A&B"`, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(body, "Tom & Jerry") || strings.Contains(body, "<1>") || !strings.Contains(body, "x=1&amp;y=2") {
+		t.Fatalf("未转义:\n%s", body)
+	}
+
+	var playlist xspfPlaylist
+	if err := xml.Unmarshal([]byte(body), &playlist); err != nil {
+		t.Fatalf("解析XSPF失败: %v", err)
+	}
+	want := []xspfTrack{
+		{Location: entries[0].URL, Title: entries[0].Title, Duration: 90500},
+		{Location: entries[1].URL, Title: entries[1].Title},
+	}
+	if playlist.Title != `剧集 "A&B"` || !reflect.DeepEqual(playlist.Tracks, want) {
+		t.Fatalf("播放列表 %+v", playlist)
+	}
+	if strings.Contains(body, "<duration>0</duration>") {
+		t.Fatal("未知时长不应输出duration")
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 按保留策略将被清理的任务
+type RetentionCandidate struct {
+	Hash          string    `json:"hash"`
+	Name          string    `json:"name"`
+	Category      string    `json:"category,omitempty"`
+	Size          int64     `json:"size"`
+	CompletedTime time.Time `json:"completed_time"`
+	// max_age, keep_per_category 或 max_total_size
+	Reason string `json:"reason"`
+	// 任务不在当前运行中（重启前完成且未重新添加），只删除记录的数据
+	Inactive bool `json:"inactive,omitempty"`
+}
+
+// 已完成任务的记录：任务不会在重启后恢复，记录保留完成时间、固定状态和数据路径，
+// 重新添加时沿用原来的完成时间，未重新添加的任务也能按策略清理其数据
+type retentionRecord struct {
+	Name          string    `json:"name"`
+	Category      string    `json:"category,omitempty"`
+	CompletedTime time.Time `json:"completed_time,omitempty"`
+	Pinned        bool      `json:"pinned,omitempty"`
+	Paths         []string  `json:"paths,omitempty"`
+}
+
+// 记录的修改只在内存中进行，由调用方在释放服务的锁之后调用save写入磁盘
+type RetentionStore struct {
+	path    string
+	records map[string]*retentionRecord
+	dirty   bool
+	mutex   sync.Mutex
+	// 保证写入文件的顺序与修改顺序一致
+	saveMutex sync.Mutex
+}
+
+func NewRetentionStore(path string) *RetentionStore {
+	rs := &RetentionStore{
+		path:    path,
+		records: make(map[string]*retentionRecord),
+	}
+	rs.load()
+	return rs
+}
+
+// 记录任务完成，已有记录时返回原来的完成时间和固定状态
+func (rs *RetentionStore) complete(hash string, record retentionRecord) (time.Time, bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if existing, exists := rs.records[hash]; exists {
+		if !existing.CompletedTime.IsZero() {
+			record.CompletedTime = existing.CompletedTime
+		}
+		record.Pinned = record.Pinned || existing.Pinned
+	}
+	rs.records[hash] = &record
+	rs.dirty = true
+	return record.CompletedTime, record.Pinned
+}
+
+// 保存固定状态，未完成的任务也记录，重新添加后仍然固定
+func (rs *RetentionStore) setPinned(hash string, name string, pinned bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	record, exists := rs.records[hash]
+	if !exists {
+		if !pinned {
+			return
+		}
+		record = &retentionRecord{Name: name}
+		rs.records[hash] = record
+	}
+	record.Pinned = pinned
+	rs.dirty = true
+}
+
+func (rs *RetentionStore) pinned(hash string) bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	record, exists := rs.records[hash]
+	return exists && record.Pinned
+}
+
+// 任务被手动移除，之后不再管理其数据
+func (rs *RetentionStore) forget(hash string) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if _, exists := rs.records[hash]; exists {
+		delete(rs.records, hash)
+		rs.dirty = true
+	}
+}
+
+// 不在运行中的已完成任务，数据已全部不存在的记录被清理
+func (rs *RetentionStore) inactive(loaded map[string]bool) map[string]retentionRecord {
+	rs.mutex.Lock()
+
+	records := make(map[string]retentionRecord)
+	removed := false
+	for hash, record := range rs.records {
+		if loaded[hash] || record.CompletedTime.IsZero() {
+			continue
+		}
+		exists := false
+		for _, path := range record.Paths {
+			if _, err := os.Stat(path); err == nil {
+				exists = true
+			}
+		}
+		if !exists {
+			delete(rs.records, hash)
+			removed = true
+			continue
+		}
+		records[hash] = *record
+	}
+	rs.dirty = rs.dirty || removed
+	rs.mutex.Unlock()
+
+	rs.save()
+	return records
+}
+
+// 取出要删除数据的记录，固定的记录不删除
+func (rs *RetentionStore) take(hash string) (*retentionRecord, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	record, exists := rs.records[hash]
+	if !exists {
+		return nil, fmt.Errorf("任务记录不存在")
+	}
+	if record.Pinned {
+		return nil, fmt.Errorf("任务已固定，不能删除")
+	}
+	delete(rs.records, hash)
+	rs.dirty = true
+	return record, nil
+}
+
+func (rs *RetentionStore) load() {
+	data, err := os.ReadFile(rs.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取任务记录失败: %v", err)
+		}
+		return
+	}
+	var records map[string]*retentionRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		log.Printf("解析任务记录失败: %v", err)
+		return
+	}
+	if records != nil {
+		rs.records = records
+	}
+}
+
+// 保存有修改的记录：在锁内序列化，在锁外写入文件，调用方不能持有服务的锁
+func (rs *RetentionStore) save() {
+	rs.saveMutex.Lock()
+	defer rs.saveMutex.Unlock()
+
+	rs.mutex.Lock()
+	if !rs.dirty {
+		rs.mutex.Unlock()
+		return
+	}
+	data, err := json.MarshalIndent(rs.records, "", "  ")
+	rs.dirty = false
+	rs.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("序列化任务记录失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(rs.path, data, 0644); err != nil {
+		log.Printf("保存任务记录失败: %v", err)
+	}
+}
+
+// 任务完成时更新记录，调用方需持有锁，释放锁后调用sts.retention.save()写入磁盘
+func (sts *SimpleTorrentService) recordCompletionLocked(hash string, status *TorrentStatus) {
+	status.CompletedTime, status.Pinned = sts.retention.complete(hash, retentionRecord{
+		Name:          status.Name,
+		Category:      status.Category,
+		CompletedTime: time.Now(),
+		Pinned:        status.Pinned,
+		Paths:         sts.taskDataPathsLocked(hash, status),
+	})
+}
+
+// 路径在磁盘上的总大小
+func pathsSize(paths []string) int64 {
+	var size int64
+	for _, root := range paths {
+		filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+// 清理结果
+type RetentionResult struct {
+	Removed []RetentionCandidate `json:"removed"`
+	Errors  []string             `json:"errors"`
+}
+
+func (rc RetentionConfig) enabled() bool {
+	return rc.MaxAgeDays > 0 || rc.MaxTotalSizeMB > 0 || rc.KeepPerCategory > 0
+}
+
+// 定期按保留策略清理已完成任务
+func (sts *SimpleTorrentService) runRetentionJanitor() {
+	policy := sts.config.Retention
+	if !policy.enabled() {
+		return
+	}
+
+	interval := time.Duration(policy.IntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	log.Printf("自动清理已启用，检查间隔: %v", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result := sts.ApplyRetention()
+		if len(result.Removed) > 0 || len(result.Errors) > 0 {
+			log.Printf("自动清理: 删除 %d 个任务, 失败 %d 个", len(result.Removed), len(result.Errors))
+		}
+	}
+}
+
+// 计算按保留策略应清理的任务（不执行删除），按完成时间从旧到新排列
+func (sts *SimpleTorrentService) PlanRetention() []RetentionCandidate {
+	policy := sts.config.Retention
+	candidates := []RetentionCandidate{}
+	if !policy.enabled() {
+		return candidates
+	}
+
+	sts.mutex.RLock()
+	var totalSize int64
+	var completed []RetentionCandidate
+	loaded := make(map[string]bool, len(sts.torrents))
+	for hash, status := range sts.torrents {
+		loaded[hash] = true
+		size := status.Total
+		if status.Extract != nil {
+			size += status.Extract.Extracted
+		}
+		totalSize += size
+
+		// 固定、未完成或正在解压的任务不清理
+		if status.Pinned || status.Status != "下载完成" || status.CompletedTime.IsZero() {
+			continue
+		}
+		if status.Extract != nil && status.Extract.Status == "解压中" {
+			continue
+		}
+		completed = append(completed, RetentionCandidate{
+			Hash:          hash,
+			Name:          status.Name,
+			Category:      status.Category,
+			Size:          size,
+			CompletedTime: status.CompletedTime,
+		})
+	}
+	sts.mutex.RUnlock()
+
+	// 重启前完成、当前未添加的任务
+	for hash, record := range sts.retention.inactive(loaded) {
+		size := pathsSize(record.Paths)
+		totalSize += size
+		if record.Pinned {
+			continue
+		}
+		completed = append(completed, RetentionCandidate{
+			Hash:          hash,
+			Name:          record.Name,
+			Category:      record.Category,
+			Size:          size,
+			CompletedTime: record.CompletedTime,
+			Inactive:      true,
+		})
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].CompletedTime.Before(completed[j].CompletedTime)
+	})
+
+	reasons := make(map[string]string)
+
+	// 每个分类只保留最近完成的N个
+	if policy.KeepPerCategory > 0 {
+		kept := make(map[string]int)
+		for i := len(completed) - 1; i >= 0; i-- {
+			c := completed[i]
+			if kept[c.Category] < policy.KeepPerCategory {
+				kept[c.Category]++
+				continue
+			}
+			reasons[c.Hash] = "keep_per_category"
+		}
+	}
+
+	// 超过保留天数
+	if policy.MaxAgeDays > 0 {
+		deadline := time.Now().AddDate(0, 0, -policy.MaxAgeDays)
+		for _, c := range completed {
+			if _, selected := reasons[c.Hash]; !selected && c.CompletedTime.Before(deadline) {
+				reasons[c.Hash] = "max_age"
+			}
+		}
+	}
+
+	// 总大小超限时从最旧的开始删除
+	if policy.MaxTotalSizeMB > 0 {
+		limit := policy.MaxTotalSizeMB * 1024 * 1024
+		for _, c := range completed {
+			if _, selected := reasons[c.Hash]; selected {
+				totalSize -= c.Size
+			}
+		}
+		for _, c := range completed {
+			if totalSize <= limit {
+				break
+			}
+			if _, selected := reasons[c.Hash]; selected {
+				continue
+			}
+			reasons[c.Hash] = "max_total_size"
+			totalSize -= c.Size
+		}
+	}
+
+	for _, c := range completed {
+		if reason, selected := reasons[c.Hash]; selected {
+			c.Reason = reason
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+// 按保留策略删除任务及其数据
+func (sts *SimpleTorrentService) ApplyRetention() RetentionResult {
+	result := RetentionResult{
+		Removed: []RetentionCandidate{},
+		Errors:  []string{},
+	}
+
+	for _, c := range sts.PlanRetention() {
+		remove := sts.RemoveDownloadWithData
+		if c.Inactive {
+			remove = sts.removeInactiveData
+		}
+		if err := remove(c.Hash); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", c.Name, err))
+			continue
+		}
+		log.Printf("自动清理任务: %s (%s), 原因: %s", c.Name, c.Hash[:8], c.Reason)
+		result.Removed = append(result.Removed, c)
+	}
+	return result
+}
+
+// 移除任务并删除已下载的数据（包括解压出的文件夹）
+func (sts *SimpleTorrentService) RemoveDownloadWithData(hash string) error {
+	// 固定检查和移除在同一次加锁中完成，避免检查之后任务被固定
+	sts.mutex.Lock()
+	status, exists := sts.torrents[hash]
+	if !exists {
+		sts.mutex.Unlock()
+		return fmt.Errorf("下载任务不存在")
+	}
+	if status.Pinned {
+		sts.mutex.Unlock()
+		return fmt.Errorf("任务已固定，不能删除")
+	}
+	paths := sts.taskDataPathsLocked(hash, status)
+	sts.removeDownloadLocked(hash, status)
+	sts.mutex.Unlock()
+	sts.retention.save()
+
+	return removePaths(paths)
+}
+
+// 删除不在运行中的任务记录的数据
+func (sts *SimpleTorrentService) removeInactiveData(hash string) error {
+	sts.mutex.Lock()
+	if _, loaded := sts.torrents[hash]; loaded {
+		sts.mutex.Unlock()
+		return fmt.Errorf("任务已重新添加")
+	}
+	record, err := sts.retention.take(hash)
+	sts.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	sts.retention.save()
+	return removePaths(record.Paths)
+}
+
+func removePaths(paths []string) error {
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("删除文件失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// 任务在磁盘上的数据路径，调用方需持有锁
+func (sts *SimpleTorrentService) taskDataPathsLocked(hash string, status *TorrentStatus) []string {
+	// sqlite和流媒体缓存中保存的是piece而不是原始文件，由存储按容量淘汰，下载目录中的同名文件不属于该任务
+	if status.Torrent.Info() == nil || !sts.dataOnDisk() {
+		return nil
+	}
+
+	dataDir := sts.downloadDir
+	if status.SavePath != "" {
+		dataDir = status.SavePath
+	}
+	root := filepath.Join(dataDir, status.Torrent.Info().BestName())
+	paths := []string{root}
+
+	// 单文件种子解压出的文件夹与压缩包同级
+	if status.Extract != nil && !status.Torrent.Info().IsDir() {
+		if target := extractTargetDir(root); target != root {
+			paths = append(paths, target)
+		}
+	}
+
+	// 只删除保存目录内的路径
+	var safe []string
+	for _, path := range paths {
+		rel, err := filepath.Rel(dataDir, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			log.Printf("跳过保存目录外的路径: %s (%s)", path, hash[:8])
+			continue
+		}
+		safe = append(safe, path)
+	}
+	return safe
+}
+
+// 固定或取消固定任务，固定的任务不会被自动清理
+func (sts *SimpleTorrentService) SetPinned(hash string, pinned bool) error {
+	sts.mutex.Lock()
+	status, exists := sts.torrents[hash]
+	if !exists {
+		sts.mutex.Unlock()
+		return fmt.Errorf("下载任务不存在")
+	}
+	status.Pinned = pinned
+	sts.retention.setPinned(hash, status.Name, pinned)
+	sts.mutex.Unlock()
+	sts.retention.save()
+
+	if pinned {
+		sts.addEvent(hash, "pinned", "任务已固定，不参与自动清理")
+	} else {
+		sts.addEvent(hash, "unpinned", "已取消固定")
+	}
+	return nil
+}
+
+// 设置自动清理路由
+func setupRetentionRoutes(r *gin.Engine, ts *SimpleTorrentService) {
+	// 预览将被清理的任务（不执行删除）
+	r.GET("/retention/preview", func(c *gin.Context) {
+		candidates := ts.PlanRetention()
+
+		var size int64
+		for _, candidate := range candidates {
+			size += candidate.Size
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"policy":     ts.config.Retention,
+			"candidates": candidates,
+			"total_size": size,
+		})
+	})
+
+	// 立即执行清理
+	r.POST("/retention/run", func(c *gin.Context) {
+		c.JSON(http.StatusOK, ts.ApplyRetention())
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionStoreKeepsCompletionTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retention_state.json")
+	rs := NewRetentionStore(path)
+	first := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	if got, _ := rs.complete("h", retentionRecord{Name: "a", CompletedTime: first}); !got.Equal(first) {
+		t.Fatalf("完成时间 %v", got)
+	}
+	// 修改只在内存中进行，save时写入磁盘
+	if fileExists(path) {
+		t.Fatal("complete不应写入文件")
+	}
+
+	// 重启后重新添加并再次完成，沿用原来的完成时间和固定状态
+	rs.setPinned("h", "a", true)
+	rs.save()
+	reloaded := NewRetentionStore(path)
+	got, pinned := reloaded.complete("h", retentionRecord{Name: "a", CompletedTime: time.Now()})
+	if !got.Equal(first) || !pinned {
+		t.Fatalf("重启后完成时间 %v, 固定 %v", got, pinned)
+	}
+
+	// 未完成的任务固定后也保存
+	reloaded.setPinned("pending", "b", true)
+	reloaded.save()
+	if !NewRetentionStore(path).pinned("pending") {
+		t.Fatal("固定状态未保存")
+	}
+}
+
+// 重启前完成且未重新添加的任务按策略删除其数据
+func TestRetentionInactiveRecords(t *testing.T) {
+	ts := newTestTorrentService(t)
+	ts.config.Retention = RetentionConfig{MaxAgeDays: 7}
+
+	write := func(name string) string {
+		path := filepath.Join(ts.downloadDir, name)
+		if err := os.WriteFile(path, make([]byte, 1024), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	old := time.Now().AddDate(0, 0, -30)
+	hash := func(c string) string { return strings.Repeat(c, 40) }
+	expired, pinned, recent := write("expired.mkv"), write("pinned.mkv"), write("recent.mkv")
+	ts.retention.complete(hash("a"), retentionRecord{Name: "expired", CompletedTime: old, Paths: []string{expired}})
+	ts.retention.complete(hash("b"), retentionRecord{Name: "pinned", CompletedTime: old, Pinned: true, Paths: []string{pinned}})
+	ts.retention.complete(hash("c"), retentionRecord{Name: "recent", CompletedTime: time.Now(), Paths: []string{recent}})
+	ts.retention.complete(hash("d"), retentionRecord{Name: "gone", CompletedTime: old, Paths: []string{filepath.Join(ts.downloadDir, "gone.mkv")}})
+
+	candidates := ts.PlanRetention()
+	if len(candidates) != 1 || candidates[0].Hash != hash("a") || !candidates[0].Inactive || candidates[0].Size != 1024 {
+		t.Fatalf("清理计划错误: %+v", candidates)
+	}
+	if _, exists := ts.retention.records[hash("d")]; exists {
+		t.Fatal("数据已不存在的记录应被清理")
+	}
+
+	result := ts.ApplyRetention()
+	if len(result.Removed) != 1 || len(result.Errors) != 0 {
+		t.Fatalf("清理结果错误: %+v", result)
+	}
+	if fileExists(expired) || !fileExists(pinned) || !fileExists(recent) {
+		t.Fatal("删除的文件错误")
+	}
+	if _, err := ts.retention.take(hash("a")); err == nil {
+		t.Fatal("删除后记录应移除")
+	}
+}
+
+// 固定检查和移除在同一次加锁中完成
+func TestRemoveDownloadWithDataRespectsPin(t *testing.T) {
+	ts := newTestTorrentService(t)
+	hash, _ := addTestTorrentStatus(t, ts, "a.bin", "")
+	if err := ts.SetPinned(hash, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.RemoveDownloadWithData(hash); err == nil {
+		t.Fatal("固定的任务不应删除")
+	}
+	if !ts.retention.pinned(hash) {
+		t.Fatal("固定状态应写入记录")
+	}
+
+	if !NewRetentionStore(ts.retention.path).pinned(hash) {
+		t.Fatal("固定状态应写入磁盘")
+	}
+
+	ts.SetPinned(hash, false)
+	if err := ts.RemoveDownloadWithData(hash); err != nil {
+		t.Fatalf("删除失败: %v", err)
+	}
+	if _, exists := ts.retention.records[hash]; exists {
+		t.Fatal("移除任务后应删除记录")
+	}
+	if _, exists := NewRetentionStore(ts.retention.path).records[hash]; exists {
+		t.Fatal("移除任务后记录应写入磁盘")
+	}
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RSS订阅中的条目
+type RSSItem struct {
+	GUID      string    `json:"guid"`
+	Title     string    `json:"title"`
+	Link      string    `json:"link"` // magnet链接或torrent URL
+	Size      int64     `json:"size"`
+	Published time.Time `json:"published"`
+	Show      string    `json:"show,omitempty"`
+	Episode   string    `json:"episode,omitempty"`
+}
+
+// 规则处理记录
+type RSSHistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Feed    string    `json:"feed"`
+	Rule    string    `json:"rule"`
+	Title   string    `json:"title"`
+	Link    string    `json:"link"`
+	Episode string    `json:"episode,omitempty"`
+	Action  string    `json:"action"` // added, failed, duplicate
+	Error   string    `json:"error,omitempty"`
+}
+
+// 预览时每个条目的匹配结果
+type RSSPreviewItem struct {
+	RSSItem
+	Rule      string `json:"rule,omitempty"`
+	Matched   bool   `json:"matched"`
+	Duplicate bool   `json:"duplicate"`
+	Processed bool   `json:"processed"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// 持久化状态：已处理条目、已下载剧集和历史
+type rssState struct {
+	Seen     map[string]time.Time `json:"seen"`
+	Episodes map[string]time.Time `json:"episodes"`
+	History  []RSSHistoryEntry    `json:"history"`
+}
+
+const rssHistoryLimit = 500
+
+type rssRule struct {
+	config  RSSRuleConfig
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+type rssFeed struct {
+	// 定时拉取和手动刷新可能同时进行，同一订阅依次处理
+	checking  sync.Mutex
+	config    RSSFeedConfig
+	rules     []*rssRule
+	lastCheck time.Time
+	lastError string
+	itemCount int
+}
+
+// RSS订阅管理 - 定时拉取订阅并按规则自动下载
+type RSSManager struct {
+	ts        *SimpleTorrentService
+	feeds     []*rssFeed
+	statePath string
+	state     rssState
+	client    *http.Client
+	mutex     sync.Mutex
+}
+
+func NewRSSManager(ts *SimpleTorrentService, feeds []RSSFeedConfig, statePath string) *RSSManager {
+	rm := &RSSManager{
+		ts:        ts,
+		statePath: statePath,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		state: rssState{
+			Seen:     make(map[string]time.Time),
+			Episodes: make(map[string]time.Time),
+		},
+	}
+
+	for i, feedConfig := range feeds {
+		if feedConfig.Name == "" {
+			feedConfig.Name = fmt.Sprintf("feed-%d", i+1)
+		}
+		feed := &rssFeed{config: feedConfig}
+
+		for _, ruleConfig := range feedConfig.Rules {
+			rule, err := compileRSSRule(ruleConfig)
+			if err != nil {
+				log.Printf("RSS规则无效，已忽略: %s/%s, 错误: %v", feedConfig.Name, ruleConfig.Name, err)
+				continue
+			}
+			feed.rules = append(feed.rules, rule)
+		}
+
+		rm.feeds = append(rm.feeds, feed)
+	}
+
+	rm.loadState()
+	return rm
+}
+
+func compileRSSRule(config RSSRuleConfig) (*rssRule, error) {
+	rule := &rssRule{config: config}
+	var err error
+
+	if config.Include != "" {
+		if rule.include, err = regexp.Compile("(?i)" + config.Include); err != nil {
+			return nil, fmt.Errorf("include正则无效: %v", err)
+		}
+	}
+	if config.Exclude != "" {
+		if rule.exclude, err = regexp.Compile("(?i)" + config.Exclude); err != nil {
+			return nil, fmt.Errorf("exclude正则无效: %v", err)
+		}
+	}
+	return rule, nil
+}
+
+// 启动所有订阅的定时拉取
+func (rm *RSSManager) Start() {
+	for _, feed := range rm.feeds {
+		go rm.pollFeed(feed)
+	}
+}
+
+func (rm *RSSManager) pollFeed(feed *rssFeed) {
+	interval := time.Duration(feed.config.IntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = 15 * time.Minute
+	}
+
+	log.Printf("RSS订阅: %s, 间隔: %v, 规则数: %d", feed.config.Name, interval, len(feed.rules))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		rm.checkFeed(feed)
+		<-ticker.C
+	}
+}
+
+// 拉取订阅并处理匹配的条目
+func (rm *RSSManager) checkFeed(feed *rssFeed) error {
+	feed.checking.Lock()
+	defer feed.checking.Unlock()
+
+	items, err := rm.fetchFeed(feed.config.URL)
+
+	rm.mutex.Lock()
+	feed.lastCheck = time.Now()
+	if err != nil {
+		feed.lastError = err.Error()
+		rm.mutex.Unlock()
+		log.Printf("拉取RSS订阅失败: %s, 错误: %v", feed.config.Name, err)
+		return err
+	}
+	feed.lastError = ""
+	feed.itemCount = len(items)
+	rm.mutex.Unlock()
+
+	for _, item := range items {
+		rm.mutex.Lock()
+		preview := rm.evaluate(feed, item)
+		rm.mutex.Unlock()
+
+		if !preview.Matched || preview.Processed {
+			continue
+		}
+
+		entry := RSSHistoryEntry{
+			Time:    time.Now(),
+			Feed:    feed.config.Name,
+			Rule:    preview.Rule,
+			Title:   item.Title,
+			Link:    item.Link,
+			Episode: item.Episode,
+		}
+
+		if preview.Duplicate {
+			entry.Action = "duplicate"
+			rm.record(feed, item, entry, "")
+			continue
+		}
+
+		rule := rm.findRule(feed, preview.Rule)
+		opts := AddOptions{Category: rule.config.Category, SavePath: rule.config.SavePath}
+		if strings.HasPrefix(item.Link, "magnet:") {
+			err = rm.ts.DownloadMagnetWithOptions(item.Link, opts)
+		} else {
+			err = rm.ts.DownloadTorrentFromURLWithOptions(item.Link, opts)
+		}
+
+		episodeKey := ""
+		if rule.config.TrackEpisodes {
+			episodeKey = rssEpisodeKey(item)
+		}
+
+		if errors.Is(err, errTorrentExists) {
+			// 任务已存在（如手动添加过），标记为已处理，不再重试
+			log.Printf("RSS条目的任务已存在，跳过: %s", item.Title)
+			entry.Action = "duplicate"
+			rm.record(feed, item, entry, episodeKey)
+			continue
+		}
+		if err != nil {
+			// 失败的条目不标记为已处理，下次拉取时重试
+			log.Printf("RSS自动下载失败: %s, 错误: %v", item.Title, err)
+			entry.Action = "failed"
+			entry.Error = err.Error()
+			rm.mutex.Lock()
+			rm.appendHistory(entry)
+			rm.mutex.Unlock()
+			continue
+		}
+
+		log.Printf("RSS自动下载: [%s/%s] %s", feed.config.Name, rule.config.Name, item.Title)
+		entry.Action = "added"
+		rm.record(feed, item, entry, episodeKey)
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	rm.saveState()
+	return nil
+}
+
+// 判断条目是否匹配规则，调用方需持有锁
+func (rm *RSSManager) evaluate(feed *rssFeed, item RSSItem) RSSPreviewItem {
+	preview := RSSPreviewItem{RSSItem: item}
+	_, preview.Processed = rm.state.Seen[rssSeenKey(feed, item)]
+
+	if item.Link == "" {
+		preview.Reason = "没有下载链接"
+		return preview
+	}
+
+	reasons := []string{}
+	for _, rule := range feed.rules {
+		if reason := rule.mismatch(item); reason != "" {
+			reasons = append(reasons, rule.config.Name+": "+reason)
+			continue
+		}
+
+		preview.Matched = true
+		preview.Rule = rule.config.Name
+		if rule.config.TrackEpisodes {
+			if key := rssEpisodeKey(item); key != "" {
+				_, preview.Duplicate = rm.state.Episodes[key]
+			}
+		}
+		return preview
+	}
+
+	preview.Reason = strings.Join(reasons, "; ")
+	return preview
+}
+
+// 返回不匹配的原因，匹配时返回空字符串
+func (rule *rssRule) mismatch(item RSSItem) string {
+	if rule.include != nil && !rule.include.MatchString(item.Title) {
+		return "标题不匹配include"
+	}
+	if rule.exclude != nil && rule.exclude.MatchString(item.Title) {
+		return "标题匹配exclude"
+	}
+
+	// 订阅未提供大小时不做大小过滤
+	if item.Size > 0 {
+		if rule.config.MinSizeMB > 0 && item.Size < rule.config.MinSizeMB*1024*1024 {
+			return "小于最小大小"
+		}
+		if rule.config.MaxSizeMB > 0 && item.Size > rule.config.MaxSizeMB*1024*1024 {
+			return "超过最大大小"
+		}
+	}
+
+	if rule.config.TrackEpisodes && item.Episode == "" {
+		return "无法识别剧集编号"
+	}
+	return ""
+}
+
+func (rm *RSSManager) findRule(feed *rssFeed, name string) *rssRule {
+	for _, rule := range feed.rules {
+		if rule.config.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// 记录已处理的条目
+func (rm *RSSManager) record(feed *rssFeed, item RSSItem, entry RSSHistoryEntry, episodeKey string) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	rm.state.Seen[rssSeenKey(feed, item)] = time.Now()
+	if episodeKey != "" {
+		rm.state.Episodes[episodeKey] = time.Now()
+	}
+	rm.appendHistory(entry)
+}
+
+func (rm *RSSManager) appendHistory(entry RSSHistoryEntry) {
+	rm.state.History = append(rm.state.History, entry)
+	if len(rm.state.History) > rssHistoryLimit {
+		rm.state.History = rm.state.History[len(rm.state.History)-rssHistoryLimit:]
+	}
+}
+
+func rssSeenKey(feed *rssFeed, item RSSItem) string {
+	id := item.GUID
+	if id == "" {
+		id = item.Link
+	}
+	return feed.config.Name + "|" + id
+}
+
+// 同一剧集只下载一次，与匹配的规则和订阅无关
+func rssEpisodeKey(item RSSItem) string {
+	if item.Episode == "" {
+		return ""
+	}
+	return item.Show + "|" + item.Episode
+}
+
+// 剧集编号识别
+var (
+	seasonEpisodePattern  = regexp.MustCompile(`(?i)\bS(\d{1,2})\s?E(\d{1,4})\b`)
+	chineseEpisodePattern = regexp.MustCompile(`第\s*(\d{1,4})\s*[集话話]`)
+	episodeOnlyPattern    = regexp.MustCompile(`(?i)\bEP?(\d{2,4})\b`)
+	dashEpisodePattern    = regexp.MustCompile(`\s-\s(\d{2,4})(?:v\d)?(?:\s|\[|\(|$)`)
+)
+
+// 从标题中解析剧名和剧集编号
+func parseEpisode(title string) (show string, episode string) {
+	if m := seasonEpisodePattern.FindStringSubmatchIndex(title); m != nil {
+		season, _ := strconv.Atoi(title[m[2]:m[3]])
+		ep, _ := strconv.Atoi(title[m[4]:m[5]])
+		return normalizeShowName(title[:m[0]]), fmt.Sprintf("S%02dE%02d", season, ep)
+	}
+
+	for _, pattern := range []*regexp.Regexp{chineseEpisodePattern, episodeOnlyPattern, dashEpisodePattern} {
+		if m := pattern.FindStringSubmatchIndex(title); m != nil {
+			ep, _ := strconv.Atoi(title[m[2]:m[3]])
+			return normalizeShowName(title[:m[0]]), fmt.Sprintf("E%02d", ep)
+		}
+	}
+	return "", ""
+}
+
+// 归一化剧名：只保留字母数字并转为小写
+func normalizeShowName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// RSS 2.0 和 Atom 文档
+type feedDocument struct {
+	Channel struct {
+		Items []rssXMLItem `xml:"item"`
+	} `xml:"channel"`
+	Entries []atomXMLEntry `xml:"entry"`
+}
+
+type rssXMLItem struct {
+	Title     string `xml:"title"`
+	Link      string `xml:"link"`
+	GUID      string `xml:"guid"`
+	PubDate   string `xml:"pubDate"`
+	Enclosure struct {
+		URL    string `xml:"url,attr"`
+		Length string `xml:"length,attr"`
+		Type   string `xml:"type,attr"`
+	} `xml:"enclosure"`
+	// torrent命名空间扩展
+	MagnetURI     string `xml:"magnetURI"`
+	ContentLength string `xml:"contentLength"`
+	Size          string `xml:"size"`
+}
+
+type atomXMLEntry struct {
+	Title   string `xml:"title"`
+	ID      string `xml:"id"`
+	Updated string `xml:"updated"`
+	Links   []struct {
+		Href   string `xml:"href,attr"`
+		Rel    string `xml:"rel,attr"`
+		Type   string `xml:"type,attr"`
+		Length string `xml:"length,attr"`
+	} `xml:"link"`
+}
+
+// 拉取并解析订阅
+func (rm *RSSManager) fetchFeed(feedURL string) ([]RSSItem, error) {
+	resp, err := rm.client.Get(feedURL)
+	if err != nil {
+		return nil, fmt.Errorf("请求订阅失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("请求订阅失败，状态码: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("读取订阅失败: %v", err)
+	}
+
+	return parseFeed(data)
+}
+
+func parseFeed(data []byte) ([]RSSItem, error) {
+	var doc feedDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("解析订阅失败: %v", err)
+	}
+
+	var items []RSSItem
+	for _, x := range doc.Channel.Items {
+		item := RSSItem{
+			GUID:      strings.TrimSpace(x.GUID),
+			Title:     strings.TrimSpace(x.Title),
+			Published: parseFeedTime(x.PubDate),
+		}
+
+		link := strings.TrimSpace(x.Link)
+		switch {
+		case x.MagnetURI != "":
+			item.Link = strings.TrimSpace(x.MagnetURI)
+		case strings.HasPrefix(link, "magnet:"):
+			item.Link = link
+		case x.Enclosure.URL != "":
+			item.Link = strings.TrimSpace(x.Enclosure.URL)
+		default:
+			item.Link = link
+		}
+
+		for _, size := range []string{x.ContentLength, x.Enclosure.Length, x.Size} {
+			if n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64); err == nil && n > 0 {
+				item.Size = n
+				break
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	for _, x := range doc.Entries {
+		item := RSSItem{
+			GUID:      strings.TrimSpace(x.ID),
+			Title:     strings.TrimSpace(x.Title),
+			Published: parseFeedTime(x.Updated),
+		}
+
+		for _, link := range x.Links {
+			if link.Rel == "enclosure" || strings.HasPrefix(link.Href, "magnet:") {
+				item.Link = link.Href
+				item.Size, _ = strconv.ParseInt(link.Length, 10, 64)
+				break
+			}
+			if item.Link == "" {
+				item.Link = link.Href
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	for i := range items {
+		items[i].Show, items[i].Episode = parseEpisode(items[i].Title)
+	}
+
+	return items, nil
+}
+
+func parseFeedTime(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123, time.RFC3339, "Mon, 2 Jan 2006 15:04:05 -0700"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// 预览订阅中的条目和规则匹配结果，不会下载
+func (rm *RSSManager) Preview(name string) ([]RSSPreviewItem, error) {
+	feed := rm.findFeed(name)
+	if feed == nil {
+		return nil, fmt.Errorf("订阅不存在: %s", name)
+	}
+
+	items, err := rm.fetchFeed(feed.config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	previews := make([]RSSPreviewItem, 0, len(items))
+	for _, item := range items {
+		previews = append(previews, rm.evaluate(feed, item))
+	}
+	return previews, nil
+}
+
+func (rm *RSSManager) findFeed(name string) *rssFeed {
+	for _, feed := range rm.feeds {
+		if feed.config.Name == name {
+			return feed
+		}
+	}
+	return nil
+}
+
+// 订阅列表
+func (rm *RSSManager) Feeds() []gin.H {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	feeds := []gin.H{}
+	for _, feed := range rm.feeds {
+		var lastCheck *time.Time
+		if !feed.lastCheck.IsZero() {
+			t := feed.lastCheck
+			lastCheck = &t
+		}
+		feeds = append(feeds, gin.H{
+			"name":             feed.config.Name,
+			"url":              feed.config.URL,
+			"interval_minutes": feed.config.IntervalMinutes,
+			"rules":            feed.config.Rules,
+			"last_check":       lastCheck,
+			"last_error":       feed.lastError,
+			"item_count":       feed.itemCount,
+		})
+	}
+	return feeds
+}
+
+// 规则处理历史，可按订阅和规则过滤，最新的在前
+func (rm *RSSManager) History(feedName string, ruleName string) []RSSHistoryEntry {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	history := []RSSHistoryEntry{}
+	for i := len(rm.state.History) - 1; i >= 0; i-- {
+		entry := rm.state.History[i]
+		if feedName != "" && entry.Feed != feedName {
+			continue
+		}
+		if ruleName != "" && entry.Rule != ruleName {
+			continue
+		}
+		history = append(history, entry)
+	}
+	return history
+}
+
+func (rm *RSSManager) loadState() {
+	data, err := os.ReadFile(rm.statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取RSS状态失败: %v", err)
+		}
+		return
+	}
+
+	var state rssState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("解析RSS状态失败: %v", err)
+		return
+	}
+	if state.Seen != nil {
+		rm.state.Seen = state.Seen
+	}
+	for key, t := range state.Episodes {
+		// 旧版本的键包含规则名（规则|剧名|剧集）
+		if parts := strings.Split(key, "|"); len(parts) == 3 {
+			key = parts[1] + "|" + parts[2]
+		}
+		if existing, ok := rm.state.Episodes[key]; !ok || t.Before(existing) {
+			rm.state.Episodes[key] = t
+		}
+	}
+	rm.state.History = state.History
+}
+
+// 保存状态，调用方需持有锁
+func (rm *RSSManager) saveState() {
+	// 清理90天前处理过的条目
+	cutoff := time.Now().AddDate(0, 0, -90)
+	for key, t := range rm.state.Seen {
+		if t.Before(cutoff) {
+			delete(rm.state.Seen, key)
+		}
+	}
+
+	data, err := json.MarshalIndent(rm.state, "", "  ")
+	if err != nil {
+		log.Printf("序列化RSS状态失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(rm.statePath, data, 0644); err != nil {
+		log.Printf("保存RSS状态失败: %v", err)
+	}
+}
+
+// 设置RSS订阅路由
+func setupRSSRoutes(r *gin.Engine, rm *RSSManager) {
+	// 订阅列表
+	r.GET("/rss/feeds", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"feeds": rm.Feeds()})
+	})
+
+	// 预览订阅条目和匹配结果
+	r.GET("/rss/feeds/:name/preview", func(c *gin.Context) {
+		items, err := rm.Preview(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": items})
+	})
+
+	// 立即拉取订阅
+	r.POST("/rss/feeds/:name/refresh", func(c *gin.Context) {
+		feed := rm.findFeed(c.Param("name"))
+		if feed == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "订阅不存在"})
+			return
+		}
+		if err := rm.checkFeed(feed); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "订阅已刷新"})
+	})
+
+	// 规则处理历史
+	r.GET("/rss/history", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"history": rm.History(c.Query("feed"), c.Query("rule")),
+		})
+	})
+}
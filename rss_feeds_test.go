@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRSSFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:torrent="http://xmlns.ezrss.it/0.1/">
+<channel>
+  <title>fixture</title>
+  <item>
+    <title>Show Name S01E01 1080p</title>
+    <guid>ep1</guid>
+    <link>%[1]s/ep1.torrent</link>
+    <pubDate>Mon, 02 Jan 2006 15:04:05 +0000</pubDate>
+  </item>
+  <item>
+    <title>Show Name S01E02 1080p</title>
+    <guid>ep2</guid>
+    <enclosure url="%[1]s/missing.torrent" length="1048576" type="application/x-bittorrent"/>
+  </item>
+  <item>
+    <title>Show Name S01E03 720p</title>
+    <guid>ep3</guid>
+    <link>%[1]s/ep3.torrent</link>
+  </item>
+</channel>
+</rss>`
+
+func TestParseFeed(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		items []RSSItem
+	}{
+		{
+			name: "RSS磁力链接",
+			data: `<rss><channel><item><title>A S02E05</title><guid>g1</guid>
+				<torrent:magnetURI xmlns:torrent="http://xmlns.ezrss.it/0.1/">magnet:?xt=urn:btih:abc</torrent:magnetURI>
+				<torrent:contentLength xmlns:torrent="http://xmlns.ezrss.it/0.1/">2048</torrent:contentLength>
+				<link>https://example.com/page</link></item></channel></rss>`,
+			items: []RSSItem{{GUID: "g1", Title: "A S02E05", Link: "magnet:?xt=urn:btih:abc", Size: 2048, Show: "a", Episode: "S02E05"}},
+		},
+		{
+			name: "RSS附件",
+			data: `<rss><channel><item><title>[组] 动画 - 07 [1080p]</title>
+				<enclosure url="https://example.com/7.torrent" length="1000" type="application/x-bittorrent"/>
+				</item></channel></rss>`,
+			items: []RSSItem{{Title: "[组] 动画 - 07 [1080p]", Link: "https://example.com/7.torrent", Size: 1000, Show: "组动画", Episode: "E07"}},
+		},
+		{
+			name: "Atom",
+			data: `<feed xmlns="http://www.w3.org/2005/Atom"><entry><title>电视剧 第12集</title><id>e1</id>
+				<updated>2024-01-02T03:04:05Z</updated>
+				<link href="https://example.com/page"/>
+				<link rel="enclosure" href="https://example.com/12.torrent" length="512"/></entry></feed>`,
+			items: []RSSItem{{GUID: "e1", Title: "电视剧 第12集", Link: "https://example.com/12.torrent", Size: 512,
+				Published: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Show: "电视剧", Episode: "E12"}},
+		},
+		{
+			name:  "空订阅",
+			data:  `<rss><channel></channel></rss>`,
+			items: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := parseFeed([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if len(items) != len(tt.items) {
+				t.Fatalf("条目数 %d, 期望 %d: %+v", len(items), len(tt.items), items)
+			}
+			for i := range items {
+				if !items[i].Published.Equal(tt.items[i].Published) {
+					t.Fatalf("发布时间错误: %v", items[i].Published)
+				}
+				items[i].Published = tt.items[i].Published
+				if items[i] != tt.items[i] {
+					t.Fatalf("条目错误:\n%+v\n期望:\n%+v", items[i], tt.items[i])
+				}
+			}
+		})
+	}
+
+	if _, err := parseFeed([]byte("<rss><channel><item>")); err == nil {
+		t.Fatal("不完整的XML应返回错误")
+	}
+}
+
+// 本地HTTP服务器提供订阅和torrent文件
+type rssFixtureServer struct {
+	*httptest.Server
+	torrentRequests int32
+	feedHook        func()
+}
+
+func newRSSFixtureServer(t *testing.T) *rssFixtureServer {
+	fs := &rssFixtureServer{}
+	torrents := map[string][]byte{
+		"/ep1.torrent": testTorrentFile(t, "ep1.mkv"),
+		"/ep3.torrent": testTorrentFile(t, "ep3.mkv"),
+	}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/feed.xml" {
+			if fs.feedHook != nil {
+				fs.feedHook()
+			}
+			fmt.Fprintf(w, testRSSFeed, fs.URL)
+			return
+		}
+		atomic.AddInt32(&fs.torrentRequests, 1)
+		if data, ok := torrents[r.URL.Path]; ok {
+			w.Write(data)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+func newTestRSSManager(t *testing.T, ts *SimpleTorrentService, url string) *RSSManager {
+	return NewRSSManager(ts, []RSSFeedConfig{{
+		Name: "fixture",
+		URL:  url,
+		Rules: []RSSRuleConfig{{
+			Name:          "1080p",
+			Include:       "1080p",
+			TrackEpisodes: true,
+			Category:      "tv",
+		}},
+	}}, filepath.Join(t.TempDir(), "rss_state.json"))
+}
+
+func TestRSSCheckFeed(t *testing.T) {
+	server := newRSSFixtureServer(t)
+	ts := newTestTorrentService(t)
+	rm := newTestRSSManager(t, ts, server.URL+"/feed.xml")
+	feed := rm.feeds[0]
+
+	if err := rm.checkFeed(feed); err != nil {
+		t.Fatalf("拉取订阅失败: %v", err)
+	}
+
+	ts.mutex.RLock()
+	count := len(ts.torrents)
+	var category string
+	for _, status := range ts.torrents {
+		category = status.Category
+	}
+	ts.mutex.RUnlock()
+	if count != 1 || category != "tv" {
+		t.Fatalf("应添加一个tv分类的任务, 实际 %d 个, 分类 %q", count, category)
+	}
+
+	actions := map[string]string{}
+	for _, entry := range rm.History("", "") {
+		actions[entry.Title] = entry.Action
+	}
+	if actions["Show Name S01E01 1080p"] != "added" || actions["Show Name S01E02 1080p"] != "failed" {
+		t.Fatalf("处理历史错误: %v", actions)
+	}
+	if _, ok := actions["Show Name S01E03 720p"]; ok {
+		t.Fatal("不匹配规则的条目不应处理")
+	}
+
+	// 再次拉取：已添加的条目跳过，失败的条目重试
+	if err := rm.checkFeed(feed); err != nil {
+		t.Fatalf("拉取订阅失败: %v", err)
+	}
+	if got := atomic.LoadInt32(&server.torrentRequests); got != 3 {
+		t.Fatalf("torrent请求次数 %d, 期望 3", got)
+	}
+	if data, err := os.ReadFile(rm.statePath); err != nil || len(data) == 0 {
+		t.Fatalf("状态未保存: %v", err)
+	}
+}
+
+// 任务已存在的条目记为重复并标记为已处理，不再重试
+func TestRSSCheckFeedExistingTask(t *testing.T) {
+	server := newRSSFixtureServer(t)
+	ts := newTestTorrentService(t)
+	rm := newTestRSSManager(t, ts, server.URL+"/feed.xml")
+	feed := rm.feeds[0]
+
+	existing := filepath.Join(t.TempDir(), "ep1.torrent")
+	if err := os.WriteFile(existing, testTorrentFile(t, "ep1.mkv"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.DownloadTorrentFileWithOptions(existing, AddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := rm.checkFeed(feed); err != nil {
+			t.Fatalf("拉取订阅失败: %v", err)
+		}
+	}
+
+	var actions []string
+	for _, entry := range rm.History("", "") {
+		if entry.Title == "Show Name S01E01 1080p" {
+			actions = append(actions, entry.Action)
+		}
+	}
+	if len(actions) != 1 || actions[0] != "duplicate" {
+		t.Fatalf("处理历史错误: %v", actions)
+	}
+	// 第二次拉取只重试下载失败的条目
+	if got := atomic.LoadInt32(&server.torrentRequests); got != 3 {
+		t.Fatalf("torrent请求次数 %d, 期望 3", got)
+	}
+}
+
+// 同一剧集在不同订阅和规则中只下载一次
+func TestRSSEpisodeAcrossFeeds(t *testing.T) {
+	rule := func(name, include string) RSSRuleConfig {
+		return RSSRuleConfig{Name: name, Include: include, TrackEpisodes: true}
+	}
+	statePath := filepath.Join(t.TempDir(), "rss_state.json")
+	rm := NewRSSManager(nil, []RSSFeedConfig{
+		{Name: "a", Rules: []RSSRuleConfig{rule("1080p", "1080p")}},
+		{Name: "b", Rules: []RSSRuleConfig{rule("720p", "720p")}},
+	}, statePath)
+
+	first := RSSItem{GUID: "1", Title: "Show S01E01 1080p", Link: "magnet:?a", Show: "show", Episode: "S01E01"}
+	second := RSSItem{GUID: "2", Title: "Show S01E01 720p", Link: "magnet:?b", Show: "show", Episode: "S01E01"}
+	rm.record(rm.feeds[0], first, RSSHistoryEntry{Action: "added"}, rssEpisodeKey(first))
+	if preview := rm.evaluate(rm.feeds[1], second); !preview.Matched || !preview.Duplicate {
+		t.Fatalf("其他订阅中的同一剧集应为重复: %+v", preview)
+	}
+
+	// 旧版本按规则记录的剧集在加载时转换
+	if err := os.WriteFile(statePath, []byte(`{"episodes": {"1080p|show|S01E02": "2024-01-01T00:00:00Z"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rm = NewRSSManager(nil, []RSSFeedConfig{{Name: "b", Rules: []RSSRuleConfig{rule("720p", "720p")}}}, statePath)
+	third := RSSItem{GUID: "3", Title: "Show S01E02 720p", Link: "magnet:?c", Show: "show", Episode: "S01E02"}
+	if preview := rm.evaluate(rm.feeds[0], third); !preview.Duplicate {
+		t.Fatalf("旧状态中的剧集应为重复: %+v", preview)
+	}
+}
+
+// 定时拉取和手动刷新同时进行时依次处理
+func TestRSSCheckFeedSerialized(t *testing.T) {
+	server := newRSSFixtureServer(t)
+	var inFlight, maxInFlight int32
+	server.feedHook = func() {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			old := atomic.LoadInt32(&maxInFlight)
+			if n <= old || atomic.CompareAndSwapInt32(&maxInFlight, old, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	ts := newTestTorrentService(t)
+	rm := newTestRSSManager(t, ts, server.URL+"/feed.xml")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rm.checkFeed(rm.feeds[0])
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight != 1 {
+		t.Fatalf("同一订阅同时拉取 %d 次", maxInFlight)
+	}
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	if len(ts.torrents) != 1 {
+		t.Fatalf("任务数 %d, 期望 1", len(ts.torrents))
+	}
+	added := 0
+	for _, entry := range rm.History("", "") {
+		if entry.Action == "added" {
+			added++
+		}
+	}
+	if added != 1 {
+		t.Fatalf("同一条目被添加 %d 次", added)
+	}
+}
+
+// 下载torrent文件期间不持有服务锁，且有超时
+func TestDownloadTorrentFromURLOutsideLock(t *testing.T) {
+	release := make(chan struct{})
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := torrentFetchClient
+	torrentFetchClient = &http.Client{Timeout: 500 * time.Millisecond}
+	defer func() { torrentFetchClient = client }()
+
+	ts := newTestTorrentService(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- ts.DownloadTorrentFromURLWithOptions(server.URL+"/slow.torrent", AddOptions{})
+	}()
+
+	<-requested
+	locked := make(chan struct{})
+	go func() {
+		ts.mutex.Lock()
+		ts.mutex.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("下载torrent文件期间持有服务锁")
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("超时应返回错误")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("下载torrent文件没有超时")
+	}
+}
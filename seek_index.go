@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
+)
+
+// 索引数据（MP4的sample表、MKV的Cues）的读取上限
+const maxSeekIndexElement = 16 * 1024 * 1024
+
+// 没有同步帧表的MP4（所有帧都是关键帧）每秒最多保留一个索引点
+const seekIndexMinInterval = 1.0
+
+// MP4视频轨道的sample数上限（60fps约46小时），避免构造的sample表导致长时间循环
+const maxMP4SeekSamples = 10000000
+
+// 关键帧的时间和在文件中的字节偏移
+type SeekPoint struct {
+	Time   float64 `json:"time"`
+	Offset int64   `json:"offset"`
+}
+
+type SeekIndex struct {
+	// mp4或matroska
+	Container string      `json:"container"`
+	Duration  float64     `json:"duration"`
+	Points    []SeekPoint `json:"points"`
+}
+
+// 不晚于指定时间的最后一个关键帧，早于第一个关键帧时返回第一个
+func (idx *SeekIndex) Locate(seconds float64) SeekPoint {
+	i := sort.Search(len(idx.Points), func(i int) bool { return idx.Points[i].Time > seconds })
+	if i > 0 {
+		i--
+	}
+	return idx.Points[i]
+}
+
+// 根据文件头识别容器并建立索引，索引所在的数据尚未下载时返回errMediaDataUnavailable
+func buildSeekIndex(r io.ReaderAt, size int64) (_ *SeekIndex, err error) {
+	// 文件内容不可信，解析中的异常作为错误返回，不影响请求的goroutine
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("建立关键帧索引失败: %v", recovered)
+		}
+	}()
+
+	regions, pending, err := locateMediaRegions(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if pending >= 0 {
+		return nil, errMediaDataUnavailable
+	}
+
+	var index *SeekIndex
+	for _, region := range regions {
+		if region.Name == "moov" {
+			index, err = buildMP4SeekIndex(r, region)
+			break
+		}
+		if region.Name == "Cues" {
+			index, err = buildMatroskaSeekIndex(r, size, regions)
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if index == nil || len(index.Points) == 0 {
+		return nil, fmt.Errorf("文件中没有关键帧索引")
+	}
+	return index, nil
+}
+
+// ---- MP4 ----
+
+// 视频轨道的sample表
+type mp4SampleTable struct {
+	timescale    uint32
+	duration     float64
+	timeToSample []byte // stts
+	syncSamples  []byte // stss，不存在时所有sample都是关键帧
+	sampleToChnk []byte // stsc
+	sampleSizes  []byte // stsz
+	chunkOffsets []byte // stco或co64
+	largeOffsets bool
+}
+
+func readMP4IndexBox(r io.ReaderAt, box mp4Box) ([]byte, error) {
+	size := box.size - box.header
+	if size > maxSeekIndexElement {
+		return nil, fmt.Errorf("MP4 box过大: %s", box.typ)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, box.dataOffset()); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func buildMP4SeekIndex(r io.ReaderAt, moov mediaRegion) (*SeekIndex, error) {
+	box, err := readMP4Box(r, moov.Start, moov.Start+moov.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	var table *mp4SampleTable
+	err = walkMP4Boxes(r, box.dataOffset(), box.end(), func(trak mp4Box) error {
+		if trak.typ != "trak" || table != nil {
+			return nil
+		}
+		t, err := readMP4SampleTable(r, trak)
+		if err != nil {
+			return err
+		}
+		table = t
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if table == nil {
+		return nil, fmt.Errorf("MP4文件没有视频轨道")
+	}
+
+	points, err := table.keyframes()
+	if err != nil {
+		return nil, err
+	}
+	return &SeekIndex{Container: "mp4", Duration: table.duration, Points: points}, nil
+}
+
+// 读取轨道的sample表，不是视频轨道时返回nil
+func readMP4SampleTable(r io.ReaderAt, trak mp4Box) (*mp4SampleTable, error) {
+	table := &mp4SampleTable{}
+	var handler string
+
+	var walk func(box mp4Box) error
+	walk = func(box mp4Box) error {
+		var target *[]byte
+		switch box.typ {
+		case "mdia", "minf", "stbl":
+			return walkMP4Boxes(r, box.dataOffset(), box.end(), walk)
+		case "hdlr":
+			data, err := readMP4BoxData(r, box)
+			if err != nil {
+				return err
+			}
+			if len(data) >= 12 {
+				handler = string(data[8:12])
+			}
+			return nil
+		case "mdhd":
+			data, err := readMP4BoxData(r, box)
+			if err != nil {
+				return err
+			}
+			table.duration = parseMP4Duration(data, 12, 20)
+			timescaleOffset := 12
+			if len(data) > 0 && data[0] == 1 {
+				timescaleOffset = 20
+			}
+			if len(data) >= timescaleOffset+4 {
+				table.timescale = binary.BigEndian.Uint32(data[timescaleOffset:])
+			}
+			return nil
+		case "stts":
+			target = &table.timeToSample
+		case "stss":
+			target = &table.syncSamples
+		case "stsc":
+			target = &table.sampleToChnk
+		case "stsz":
+			target = &table.sampleSizes
+		case "stco":
+			target = &table.chunkOffsets
+		case "co64":
+			target = &table.chunkOffsets
+			table.largeOffsets = true
+		default:
+			return nil
+		}
+		// 只有视频轨道需要读取sample表
+		if handler != "vide" {
+			return nil
+		}
+		data, err := readMP4IndexBox(r, box)
+		if err != nil {
+			return err
+		}
+		*target = data
+		return nil
+	}
+	if err := walkMP4Boxes(r, trak.dataOffset(), trak.end(), walk); err != nil {
+		return nil, err
+	}
+
+	if handler != "vide" {
+		return nil, nil
+	}
+	if table.timescale == 0 || table.timeToSample == nil || table.sampleToChnk == nil || table.sampleSizes == nil || table.chunkOffsets == nil {
+		return nil, fmt.Errorf("MP4视频轨道缺少sample表")
+	}
+	return table, nil
+}
+
+// full box的条目数和条目数据
+func mp4TableEntries(data []byte, headerLen, entrySize int) ([]byte, int, error) {
+	if len(data) < headerLen {
+		return nil, 0, fmt.Errorf("无效的MP4 sample表")
+	}
+	count := int(binary.BigEndian.Uint32(data[headerLen-4:]))
+	entries := data[headerLen:]
+	if count < 0 || len(entries)/entrySize < count {
+		return nil, 0, fmt.Errorf("无效的MP4 sample表")
+	}
+	return entries, count, nil
+}
+
+// stsc中各段chunk的sample数之和，超过上限后不再累加
+func mp4ChunkSampleCapacity(stsc []byte, stscCount int, chunkCount int) int64 {
+	var total int64
+	for i := 0; i < stscCount && total <= maxMP4SeekSamples; i++ {
+		first := int64(binary.BigEndian.Uint32(stsc[i*12:]))
+		next := int64(chunkCount) + 1
+		if i+1 < stscCount {
+			if n := int64(binary.BigEndian.Uint32(stsc[(i+1)*12:])); n < next {
+				next = n
+			}
+		}
+		// 与遍历时一致，第一段从第一个chunk开始
+		if i == 0 || first < 1 {
+			first = 1
+		}
+		if next > first {
+			total += (next - first) * int64(binary.BigEndian.Uint32(stsc[i*12+4:]))
+		}
+	}
+	return total
+}
+
+// 按chunk顺序遍历所有sample，计算关键帧的解码时间和偏移
+func (t *mp4SampleTable) keyframes() ([]SeekPoint, error) {
+	stts, sttsCount, err := mp4TableEntries(t.timeToSample, 8, 8)
+	if err != nil {
+		return nil, err
+	}
+	stsc, stscCount, err := mp4TableEntries(t.sampleToChnk, 8, 12)
+	if err != nil {
+		return nil, err
+	}
+	offsetSize := 4
+	if t.largeOffsets {
+		offsetSize = 8
+	}
+	offsets, chunkCount, err := mp4TableEntries(t.chunkOffsets, 8, offsetSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.sampleSizes) < 12 {
+		return nil, fmt.Errorf("无效的MP4 sample表")
+	}
+	uniformSize := int64(binary.BigEndian.Uint32(t.sampleSizes[4:]))
+	sampleCount := int(binary.BigEndian.Uint32(t.sampleSizes[8:]))
+	if uniformSize == 0 && (len(t.sampleSizes)-12)/4 < sampleCount {
+		return nil, fmt.Errorf("无效的MP4 sample表")
+	}
+	// 大小统一时stsz中只有sample数，不能超过各chunk能容纳的sample总数
+	if capacity := mp4ChunkSampleCapacity(stsc, stscCount, chunkCount); capacity < int64(sampleCount) {
+		sampleCount = int(capacity)
+	}
+	if sampleCount > maxMP4SeekSamples {
+		return nil, fmt.Errorf("MP4 sample数超出上限: %d", sampleCount)
+	}
+
+	var sync []byte
+	syncCount := -1
+	if t.syncSamples != nil {
+		if sync, syncCount, err = mp4TableEntries(t.syncSamples, 8, 4); err != nil {
+			return nil, err
+		}
+	}
+
+	var points []SeekPoint
+	var decodeTime uint64
+	sttsIndex, sttsRemaining := 0, uint32(0)
+	syncIndex := 0
+	stscIndex := 0
+	sample := 1
+	for chunk := 1; chunk <= chunkCount && sample <= sampleCount; chunk++ {
+		for stscIndex+1 < stscCount && int(binary.BigEndian.Uint32(stsc[(stscIndex+1)*12:])) <= chunk {
+			stscIndex++
+		}
+		if stscCount == 0 {
+			break
+		}
+		samplesPerChunk := int(binary.BigEndian.Uint32(stsc[stscIndex*12+4:]))
+
+		var offset int64
+		if t.largeOffsets {
+			offset = int64(binary.BigEndian.Uint64(offsets[(chunk-1)*8:]))
+		} else {
+			offset = int64(binary.BigEndian.Uint32(offsets[(chunk-1)*4:]))
+		}
+
+		for i := 0; i < samplesPerChunk && sample <= sampleCount; i++ {
+			keyframe := syncCount < 0
+			for syncIndex < syncCount && int(binary.BigEndian.Uint32(sync[syncIndex*4:])) < sample {
+				syncIndex++
+			}
+			if syncIndex < syncCount && int(binary.BigEndian.Uint32(sync[syncIndex*4:])) == sample {
+				keyframe = true
+			}
+			if keyframe {
+				seconds := float64(decodeTime) / float64(t.timescale)
+				if syncCount >= 0 || len(points) == 0 || seconds-points[len(points)-1].Time >= seekIndexMinInterval {
+					points = append(points, SeekPoint{Time: seconds, Offset: offset})
+				}
+			}
+
+			size := uniformSize
+			if size == 0 {
+				size = int64(binary.BigEndian.Uint32(t.sampleSizes[12+(sample-1)*4:]))
+			}
+			offset += size
+
+			for sttsRemaining == 0 && sttsIndex < sttsCount {
+				sttsRemaining = binary.BigEndian.Uint32(stts[sttsIndex*8:])
+				sttsIndex++
+			}
+			if sttsRemaining > 0 {
+				decodeTime += uint64(binary.BigEndian.Uint32(stts[(sttsIndex-1)*8+4:]))
+				sttsRemaining--
+			}
+			sample++
+		}
+	}
+	return points, nil
+}
+
+// ---- Matroska ----
+
+// 读取定位到的元素内容
+func readMatroskaRegion(r io.ReaderAt, region mediaRegion) ([]byte, error) {
+	_, size, headerLen, err := readEBMLElementHeader(r, region.Start, region.Start+region.Length)
+	if err != nil {
+		return nil, err
+	}
+	if size == ebmlUnknownSize || size > maxSeekIndexElement || headerLen+size > region.Length {
+		return nil, fmt.Errorf("无效的Matroska元素: %s", region.Name)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, region.Start+headerLen); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Cues中的Cluster位置相对于Segment数据起点
+func matroskaSegmentStart(r io.ReaderAt, size int64) (int64, error) {
+	_, headerSize, headerLen, err := readEBMLElementHeader(r, 0, size)
+	if err != nil {
+		return 0, err
+	}
+	segmentOffset := headerLen + headerSize
+	_, _, segmentHeaderLen, err := readEBMLElementHeader(r, segmentOffset, size)
+	if err != nil {
+		return 0, err
+	}
+	return segmentOffset + segmentHeaderLen, nil
+}
+
+func buildMatroskaSeekIndex(r io.ReaderAt, size int64, regions []mediaRegion) (*SeekIndex, error) {
+	segmentStart, err := matroskaSegmentStart(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	timecodeScale := uint64(1000000)
+	index := &SeekIndex{Container: "matroska"}
+	var videoTrack uint64
+	var cues []byte
+	for _, region := range regions {
+		data, err := readMatroskaRegion(r, region)
+		if err != nil {
+			return nil, err
+		}
+		switch region.Name {
+		case "Info":
+			info := &MediaInfo{}
+			if err := parseMatroskaInfo(data, info); err != nil {
+				return nil, err
+			}
+			walkEBMLElements(data, func(id uint32, payload []byte) {
+				if id == mkvIDTimecodeScale {
+					timecodeScale = ebmlUint(payload)
+				}
+			})
+			index.Duration = info.Duration
+		case "Tracks":
+			videoTrack = matroskaVideoTrack(data)
+		case "Cues":
+			cues = data
+		}
+	}
+
+	err = walkEBMLElements(cues, func(id uint32, point []byte) {
+		if id != mkvIDCuePoint {
+			return
+		}
+		var cueTime uint64
+		cluster := int64(-1)
+		walkEBMLElements(point, func(id uint32, payload []byte) {
+			switch id {
+			case mkvIDCueTime:
+				cueTime = ebmlUint(payload)
+			case mkvIDCuePositions:
+				var track uint64
+				position := int64(-1)
+				walkEBMLElements(payload, func(id uint32, value []byte) {
+					switch id {
+					case mkvIDCueTrack:
+						track = ebmlUint(value)
+					case mkvIDCueCluster:
+						position = int64(ebmlUint(value))
+					}
+				})
+				// 只使用视频轨道的索引点，无法确定视频轨道时使用第一个
+				if position >= 0 && cluster < 0 && (videoTrack == 0 || track == videoTrack) {
+					cluster = position
+				}
+			}
+		})
+		if cluster >= 0 {
+			index.Points = append(index.Points, SeekPoint{
+				Time:   float64(cueTime) * float64(timecodeScale) / 1e9,
+				Offset: segmentStart + cluster,
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(index.Points, func(i, j int) bool { return index.Points[i].Time < index.Points[j].Time })
+	return index, nil
+}
+
+// 第一个视频轨道的编号，没有时返回0
+func matroskaVideoTrack(tracks []byte) uint64 {
+	var videoTrack uint64
+	walkEBMLElements(tracks, func(id uint32, entry []byte) {
+		if id != mkvIDTrackEntry || videoTrack != 0 {
+			return
+		}
+		var number, trackType uint64
+		walkEBMLElements(entry, func(id uint32, payload []byte) {
+			switch id {
+			case mkvIDTrackNumber:
+				number = ebmlUint(payload)
+			case mkvIDTrackType:
+				trackType = ebmlUint(payload)
+			}
+		})
+		if trackType == 1 {
+			videoTrack = number
+		}
+	})
+	return videoTrack
+}
+
+// ---- 服务 ----
+
+// torrent中视频文件的关键帧索引，建立完成后缓存
+func (sts *SimpleTorrentService) SeekIndex(file *torrent.File) (*SeekIndex, error) {
+	key := file.Torrent().InfoHash().HexString() + "/" + file.Path()
+	sts.probeMutex.Lock()
+	index, ok := sts.seekIndexes[key]
+	sts.probeMutex.Unlock()
+	if ok {
+		return index, nil
+	}
+
+	index, err := buildSeekIndex(torrentPieceReaderAt{file: file}, file.Length())
+	if err != nil {
+		return nil, err
+	}
+
+	sts.probeMutex.Lock()
+	sts.seekIndexes[key] = index
+	sts.probeMutex.Unlock()
+	return index, nil
+}
+
+func setupSeekIndexRoutes(r *gin.Engine, ts *SimpleTorrentService) {
+	// 关键帧索引，带t参数时只返回该时间对应的关键帧
+	r.GET("/seek-index/:hash/:file", func(c *gin.Context) {
+		fileIndex, err := strconv.Atoi(c.Param("file"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的文件索引"})
+			return
+		}
+		files, err := ts.GetTorrentFiles(c.Param("hash"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if fileIndex < 0 || fileIndex >= len(files) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("文件索引无效: %d", fileIndex)})
+			return
+		}
+		file := files[fileIndex]
+
+		index, err := ts.SeekIndex(file)
+		switch {
+		case errors.Is(err, errMediaDataUnavailable):
+			// 优先下载索引所在的区域
+			ts.prioritizeMediaIndex(file)
+			c.Header("Retry-After", "2")
+			c.JSON(http.StatusAccepted, gin.H{"status": "pending"})
+			return
+		case err != nil:
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+
+		if t := c.Query("t"); t != "" {
+			seconds, err := strconv.ParseFloat(t, 64)
+			if err != nil || seconds < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时间"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"path":     file.Path(),
+				"duration": index.Duration,
+				"point":    index.Locate(seconds),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"path":      file.Path(),
+			"container": index.Container,
+			"duration":  index.Duration,
+			"points":    index.Points,
+		})
+	})
+}
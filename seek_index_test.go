@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSeekIndexLocate(t *testing.T) {
+	index := &SeekIndex{Points: []SeekPoint{{0, 100}, {2, 500}, {4, 900}}}
+	tests := []struct {
+		seconds float64
+		want    int64
+	}{
+		{-1, 100},
+		{0, 100},
+		{1.9, 100},
+		{2, 500},
+		{3.5, 500},
+		{100, 900},
+	}
+	for _, tt := range tests {
+		if got := index.Locate(tt.seconds); got.Offset != tt.want {
+			t.Errorf("Locate(%v) = %+v, 期望偏移 %d", tt.seconds, got, tt.want)
+		}
+	}
+}
+
+// full box：version/flags之后依次写入各个32位值
+func mp4FullBox(typ string, values ...uint32) []byte {
+	data := make([]byte, 4+4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(data[4+4*i:], v)
+	}
+	return mp4TestBox(typ, data)
+}
+
+// 4个sample，每个1秒，每个chunk 2个sample
+type testMP4SampleTable struct {
+	stsc  []byte
+	stss  []byte
+	stsz  []byte
+	chunk []byte
+}
+
+func defaultMP4SampleTable() testMP4SampleTable {
+	return testMP4SampleTable{
+		stsc:  mp4FullBox("stsc", 1, 1, 2, 1),
+		stsz:  mp4FullBox("stsz", 100, 4),
+		chunk: mp4FullBox("stco", 2, 1000, 5000),
+	}
+}
+
+func testSeekMP4File(table testMP4SampleTable) []byte {
+	mdhd := make([]byte, 24)
+	binary.BigEndian.PutUint32(mdhd[12:], 1000)
+	binary.BigEndian.PutUint32(mdhd[16:], 4000)
+	hdlr := append(make([]byte, 8), []byte("vide\x00\x00\x00\x00")...)
+
+	stbl := [][]byte{
+		mp4FullBox("stts", 1, 4, 1000),
+		table.stsc,
+		table.stsz,
+		table.chunk,
+	}
+	if table.stss != nil {
+		stbl = append(stbl, table.stss)
+	}
+	trak := mp4TestBox("trak",
+		mp4TestBox("mdia",
+			mp4TestBox("mdhd", mdhd),
+			mp4TestBox("hdlr", hdlr),
+			mp4TestBox("minf", mp4TestBox("stbl", stbl...)),
+		),
+	)
+	return bytes.Join([][]byte{
+		mp4TestBox("ftyp", []byte("isom\x00\x00\x02\x00")),
+		mp4TestBox("moov", trak),
+		mp4TestBox("mdat", make([]byte, 64)),
+	}, nil)
+}
+
+func TestBuildSeekIndexMP4(t *testing.T) {
+	co64 := make([]byte, 4+4+16)
+	binary.BigEndian.PutUint32(co64[4:], 2)
+	binary.BigEndian.PutUint64(co64[8:], 1<<33)
+	binary.BigEndian.PutUint64(co64[16:], 1<<34)
+
+	tests := []struct {
+		name   string
+		modify func(*testMP4SampleTable)
+		want   []SeekPoint
+		err    string
+	}{
+		{
+			name:   "stss中的关键帧",
+			modify: func(table *testMP4SampleTable) { table.stss = mp4FullBox("stss", 2, 1, 3) },
+			want:   []SeekPoint{{0, 1000}, {2, 5000}},
+		},
+		{
+			name:   "没有stss时所有sample都是关键帧",
+			modify: func(table *testMP4SampleTable) {},
+			want:   []SeekPoint{{0, 1000}, {1, 1100}, {2, 5000}, {3, 5100}},
+		},
+		{
+			name:   "sample大小各不相同",
+			modify: func(table *testMP4SampleTable) { table.stsz = mp4FullBox("stsz", 0, 4, 100, 200, 300, 400) },
+			want:   []SeekPoint{{0, 1000}, {1, 1100}, {2, 5000}, {3, 5300}},
+		},
+		{
+			name: "co64的64位偏移",
+			modify: func(table *testMP4SampleTable) {
+				table.chunk = mp4TestBox("co64", co64)
+				table.stss = mp4FullBox("stss", 1, 3)
+			},
+			want: []SeekPoint{{2, 1 << 34}},
+		},
+		{
+			name:   "sample数超出chunk能容纳的数量",
+			modify: func(table *testMP4SampleTable) { table.stsz = mp4FullBox("stsz", 100, 0xFFFFFFFF) },
+			want:   []SeekPoint{{0, 1000}, {1, 1100}, {2, 5000}, {3, 5100}},
+		},
+		{
+			name: "chunk声明的sample数超出上限",
+			modify: func(table *testMP4SampleTable) {
+				table.stsc = mp4FullBox("stsc", 1, 1, 0xFFFFFFFF, 1)
+				table.stsz = mp4FullBox("stsz", 100, 0xFFFFFFFF)
+				table.chunk = mp4FullBox("stco", 1, 1000)
+				table.stss = mp4FullBox("stss", 1, 1)
+			},
+			err: "MP4 sample数超出上限",
+		},
+		{
+			name:   "条目数超出数据",
+			modify: func(table *testMP4SampleTable) { table.chunk = mp4FullBox("stco", 100, 1000) },
+			err:    "无效的MP4 sample表",
+		},
+		{
+			name:   "sample大小表不完整",
+			modify: func(table *testMP4SampleTable) { table.stsz = mp4FullBox("stsz", 0, 4, 100) },
+			err:    "无效的MP4 sample表",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := defaultMP4SampleTable()
+			tt.modify(&table)
+			data := testSeekMP4File(table)
+			index, err := buildSeekIndex(bytes.NewReader(data), int64(len(data)))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("期望错误 %q, 实际 %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("建立索引失败: %v", err)
+			}
+			if index.Container != "mp4" || index.Duration != 4 || !reflect.DeepEqual(index.Points, tt.want) {
+				t.Fatalf("索引 %+v, 期望 %+v", index, tt.want)
+			}
+		})
+	}
+}
+
+type panicReaderAt struct{}
+
+func (panicReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	panic("read failed")
+}
+
+func TestBuildSeekIndexRecoversPanic(t *testing.T) {
+	if _, err := buildSeekIndex(panicReaderAt{}, 1024); err == nil || !strings.Contains(err.Error(), "read failed") {
+		t.Fatalf("错误 %v", err)
+	}
+}
+
+func matroskaCuePoint(timecode uint64, positions ...[2]uint64) []byte {
+	children := [][]byte{ebmlElement(mkvIDCueTime, ebmlUintBytes(timecode))}
+	for _, p := range positions {
+		children = append(children, ebmlElement(mkvIDCuePositions,
+			ebmlElement(mkvIDCueTrack, ebmlUintBytes(p[0])),
+			ebmlElement(mkvIDCueCluster, ebmlUintBytes(p[1])),
+		))
+	}
+	return ebmlElement(mkvIDCuePoint, children...)
+}
+
+func TestBuildSeekIndexMatroska(t *testing.T) {
+	header := ebmlElement(ebmlIDHeader, ebmlElement(ebmlIDDocType, []byte("matroska")))
+	// Segment的ID为4字节，大小为8字节
+	segmentStart := int64(len(header) + 12)
+	audioOnly := ebmlElement(mkvIDTracks,
+		ebmlElement(mkvIDTrackEntry,
+			ebmlElement(mkvIDTrackNumber, []byte{2}),
+			ebmlElement(mkvIDTrackType, []byte{2}),
+		),
+	)
+
+	tests := []struct {
+		name     string
+		children [][]byte
+		want     []SeekPoint
+		err      string
+	}{
+		{
+			name: "只使用视频轨道的索引点并按时间排序",
+			children: [][]byte{testMatroskaInfo(), testMatroskaTracks(), ebmlElement(mkvIDCues,
+				matroskaCuePoint(5000, [2]uint64{1, 300}),
+				matroskaCuePoint(0, [2]uint64{2, 50}, [2]uint64{1, 10}),
+				matroskaCuePoint(2500, [2]uint64{2, 200}),
+			)},
+			want: []SeekPoint{{0, segmentStart + 10}, {5, segmentStart + 300}},
+		},
+		{
+			name: "没有视频轨道时使用第一个位置",
+			children: [][]byte{testMatroskaInfo(), audioOnly, ebmlElement(mkvIDCues,
+				matroskaCuePoint(1000, [2]uint64{2, 50}, [2]uint64{3, 60}),
+			)},
+			want: []SeekPoint{{1, segmentStart + 50}},
+		},
+		{
+			name:     "没有Cues",
+			children: [][]byte{testMatroskaInfo(), testMatroskaTracks()},
+			err:      "文件中没有关键帧索引",
+		},
+		{
+			name:     "Cues中没有视频轨道的索引点",
+			children: [][]byte{testMatroskaInfo(), testMatroskaTracks(), ebmlElement(mkvIDCues, matroskaCuePoint(0, [2]uint64{2, 50}))},
+			err:      "文件中没有关键帧索引",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := matroskaFile(tt.children...)
+			index, err := buildSeekIndex(bytes.NewReader(data), int64(len(data)))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("期望错误 %q, 实际 %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("建立索引失败: %v", err)
+			}
+			if index.Container != "matroska" || index.Duration != 90 || !reflect.DeepEqual(index.Points, tt.want) {
+				t.Fatalf("索引 %+v, 期望 %+v", index, tt.want)
+			}
+		})
+	}
+}
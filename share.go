@@ -0,0 +1,508 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 分享链接的默认和最长有效期
+const (
+	defaultShareExpiry = 24 * time.Hour
+	maxShareExpiry     = 30 * 24 * time.Hour
+)
+
+// 分享链接 - 对外提供单个本地文件或torrent文件，不暴露其他API
+type ShareLink struct {
+	ID string `json:"id"`
+	// 与/stream/之后的路径相同：torrent/{hash}/{文件路径} 或下载目录中的相对路径
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// 最多允许下载的次数，0为不限制
+	MaxDownloads int `json:"max_downloads"`
+	// 已开始的下载次数
+	Downloads int `json:"downloads"`
+	// 开始过下载的客户端地址（TCP连接的对端IP，不使用可伪造的X-Forwarded-For），
+	// 这些客户端之后的Range请求（续传、跳转）属于已计数的下载
+	Clients      []string `json:"clients"`
+	PasswordSalt string   `json:"password_salt,omitempty"`
+	PasswordHash string   `json:"password_hash,omitempty"`
+}
+
+// /shares 返回的分享信息，不包含密码
+type ShareInfo struct {
+	ID            string    `json:"id"`
+	URL           string    `json:"url"`
+	Path          string    `json:"path"`
+	Name          string    `json:"name"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	MaxDownloads  int       `json:"max_downloads"`
+	DownloadCount int       `json:"download_count"`
+	Password      bool      `json:"password"`
+}
+
+// 分享链接存储，签名密钥和分享一起保存在磁盘上，重启后链接仍然有效
+type ShareStore struct {
+	path   string
+	secret []byte
+	shares map[string]*ShareLink
+	mutex  sync.Mutex
+}
+
+type shareState struct {
+	Secret string                `json:"secret"`
+	Shares map[string]*ShareLink `json:"shares"`
+}
+
+func NewShareStore(path string) *ShareStore {
+	ss := &ShareStore{
+		path:   path,
+		shares: make(map[string]*ShareLink),
+	}
+	ss.load()
+	if len(ss.secret) == 0 {
+		ss.secret = make([]byte, 32)
+		rand.Read(ss.secret)
+		ss.mutex.Lock()
+		ss.saveLocked()
+		ss.mutex.Unlock()
+	}
+	return ss
+}
+
+// 链接令牌：分享ID.过期时间.HMAC-SHA256签名，过期时间被篡改时签名不再匹配
+func (ss *ShareStore) token(share *ShareLink) string {
+	payload := share.ID + "." + strconv.FormatInt(share.ExpiresAt.Unix(), 36)
+	return payload + "." + ss.sign(payload)
+}
+
+func (ss *ShareStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, ss.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 校验令牌的签名和有效期，返回分享ID
+func (ss *ShareStore) verify(token string) (string, int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", http.StatusForbidden, fmt.Errorf("无效的分享链接")
+	}
+	expected := ss.sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return "", http.StatusForbidden, fmt.Errorf("无效的分享链接")
+	}
+	expires, err := strconv.ParseInt(parts[1], 36, 64)
+	if err != nil {
+		return "", http.StatusForbidden, fmt.Errorf("无效的分享链接")
+	}
+	if time.Now().Unix() >= expires {
+		return "", http.StatusGone, fmt.Errorf("分享链接已过期")
+	}
+	return parts[0], 0, nil
+}
+
+// 密码哈希以签名密钥为HMAC密钥，只拿到share_state.json中的分享记录无法离线猜测密码
+func (ss *ShareStore) hashPassword(salt string, password string) string {
+	mac := hmac.New(sha256.New, ss.secret)
+	mac.Write([]byte("password." + salt + "."))
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func shareCookieName(id string) string {
+	return "share_" + id
+}
+
+// 输入密码后设置的cookie，值为签名后的分享ID和密码哈希，签名密钥变化后失效
+func (ss *ShareStore) passwordCookie(share *ShareLink) string {
+	return ss.sign("cookie." + share.ID + "." + share.PasswordHash)
+}
+
+func (ss *ShareStore) Create(streamPath string, expiry time.Duration, maxDownloads int, password string) *ShareLink {
+	now := time.Now()
+	share := &ShareLink{
+		ID:           randomToken(),
+		Path:         streamPath,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(expiry).Truncate(time.Second),
+		MaxDownloads: maxDownloads,
+		Clients:      []string{},
+	}
+	if password != "" {
+		share.PasswordSalt = randomToken()
+		share.PasswordHash = ss.hashPassword(share.PasswordSalt, password)
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.shares[share.ID] = share
+	ss.saveLocked()
+	return share
+}
+
+// 撤销分享，之后该链接返回410
+func (ss *ShareStore) Revoke(id string) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if _, exists := ss.shares[id]; !exists {
+		return fmt.Errorf("分享不存在: %s", id)
+	}
+	delete(ss.shares, id)
+	ss.saveLocked()
+	return nil
+}
+
+// 未过期的分享，按创建时间排序；同时清理已过期的分享
+func (ss *ShareStore) List() []ShareLink {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	now := time.Now()
+	removed := false
+	shares := make([]ShareLink, 0, len(ss.shares))
+	for id, share := range ss.shares {
+		if !now.Before(share.ExpiresAt) {
+			delete(ss.shares, id)
+			removed = true
+			continue
+		}
+		shares = append(shares, *share)
+	}
+	if removed {
+		ss.saveLocked()
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].CreatedAt.Before(shares[j].CreatedAt)
+	})
+	return shares
+}
+
+// 访问分享时提供的凭据：HTTP Basic认证的密码或输入密码后设置的cookie
+type shareCredentials struct {
+	Password string
+	Cookie   string
+}
+
+// 访问请求的计数方式
+type shareAccess struct {
+	ClientIP string
+	// HEAD请求不计数
+	Get bool
+	// 没有Range或从第0字节开始，即新的下载
+	FromStart bool
+}
+
+// 没有Range或第一个范围从第0字节开始的请求
+func shareRequestFromStart(rangeHeader string) bool {
+	if rangeHeader == "" {
+		return true
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(rangeHeader, "bytes="))
+	return strings.HasPrefix(spec, "0-")
+}
+
+// 校验访问请求：签名、有效期、密码和下载次数。
+// GET请求从头开始时计为一次下载；未开始过下载的客户端的Range请求也计为一次，避免绕过次数限制
+func (ss *ShareStore) authorize(token string, creds shareCredentials, access shareAccess) (*ShareLink, int, error) {
+	id, status, err := ss.verify(token)
+	if err != nil {
+		return nil, status, err
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	share, exists := ss.shares[id]
+	if !exists {
+		return nil, http.StatusGone, fmt.Errorf("分享已撤销")
+	}
+	if share.PasswordHash != "" && !ss.checkCredentials(share, creds) {
+		return nil, http.StatusUnauthorized, fmt.Errorf("需要密码")
+	}
+
+	known := false
+	for _, client := range share.Clients {
+		if client == access.ClientIP {
+			known = true
+			break
+		}
+	}
+	limited := share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads
+	if !access.Get || (known && !access.FromStart) {
+		if limited && !known {
+			return nil, http.StatusForbidden, fmt.Errorf("下载次数已达上限")
+		}
+		copied := *share
+		return &copied, 0, nil
+	}
+
+	if limited {
+		return nil, http.StatusForbidden, fmt.Errorf("下载次数已达上限")
+	}
+	share.Downloads++
+	if !known {
+		share.Clients = append(share.Clients, access.ClientIP)
+	}
+	ss.saveLocked()
+	copied := *share
+	return &copied, 0, nil
+}
+
+// 校验密码或cookie，调用方需持有锁
+func (ss *ShareStore) checkCredentials(share *ShareLink, creds shareCredentials) bool {
+	if creds.Cookie != "" && hmac.Equal([]byte(creds.Cookie), []byte(ss.passwordCookie(share))) {
+		return true
+	}
+	if creds.Password == "" {
+		return false
+	}
+	hash := ss.hashPassword(share.PasswordSalt, creds.Password)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(share.PasswordHash)) == 1
+}
+
+// 校验表单提交的密码，成功时返回要设置的cookie
+func (ss *ShareStore) login(token string, password string) (*ShareLink, string, int, error) {
+	id, status, err := ss.verify(token)
+	if err != nil {
+		return nil, "", status, err
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	share, exists := ss.shares[id]
+	if !exists {
+		return nil, "", http.StatusGone, fmt.Errorf("分享已撤销")
+	}
+	if share.PasswordHash == "" {
+		return nil, "", http.StatusBadRequest, fmt.Errorf("该分享没有设置密码")
+	}
+	if !ss.checkCredentials(share, shareCredentials{Password: password}) {
+		return nil, "", http.StatusUnauthorized, fmt.Errorf("密码错误")
+	}
+	copied := *share
+	return &copied, ss.passwordCookie(share), 0, nil
+}
+
+func (ss *ShareStore) load() {
+	data, err := os.ReadFile(ss.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取分享记录失败: %v", err)
+		}
+		return
+	}
+
+	var state shareState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("解析分享记录失败: %v", err)
+		return
+	}
+	if secret, err := hex.DecodeString(state.Secret); err == nil {
+		ss.secret = secret
+	}
+	if state.Shares != nil {
+		ss.shares = state.Shares
+	}
+}
+
+// 保存记录，调用方需持有锁
+func (ss *ShareStore) saveLocked() {
+	data, err := json.MarshalIndent(shareState{
+		Secret: hex.EncodeToString(ss.secret),
+		Shares: ss.shares,
+	}, "", "  ")
+	if err != nil {
+		log.Printf("序列化分享记录失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(ss.path, data, 0600); err != nil {
+		log.Printf("保存分享记录失败: %v", err)
+	}
+}
+
+func (ss *ShareStore) info(share ShareLink, baseURL string) ShareInfo {
+	return ShareInfo{
+		ID:            share.ID,
+		URL:           baseURL + "/s/" + ss.token(&share),
+		Path:          share.Path,
+		Name:          path.Base(share.Path),
+		CreatedAt:     share.CreatedAt,
+		ExpiresAt:     share.ExpiresAt,
+		MaxDownloads:  share.MaxDownloads,
+		DownloadCount: share.Downloads,
+		Password:      share.PasswordHash != "",
+	}
+}
+
+// 检查要分享的文件是否存在，返回规范化的路径
+func (sts *SimpleTorrentService) shareablePath(streamPath string) (string, error) {
+	streamPath = strings.Trim(streamPath, "/")
+	if strings.HasPrefix(streamPath, "torrent/") {
+		parts := strings.SplitN(streamPath, "/", 3)
+		if len(parts) < 3 {
+			return "", fmt.Errorf("无效的torrent文件路径: %s", streamPath)
+		}
+		if _, err := sts.GetTorrentFileByPath(strings.ToLower(parts[1]), parts[2]); err != nil {
+			return "", fmt.Errorf("Torrent文件不存在: %s", parts[2])
+		}
+		return "torrent/" + strings.ToLower(parts[1]) + "/" + parts[2], nil
+	}
+
+	fullPath := filepath.Join(sts.downloadDir, filepath.FromSlash(streamPath))
+	rel, err := filepath.Rel(sts.downloadDir, fullPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("非法的文件路径: %s", streamPath)
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		return "", fmt.Errorf("文件不存在: %s", streamPath)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// 转发到/stream/的内部路径，URL.Path为解码后的路径，不需要转义
+func shareStreamPath(streamPath string) string {
+	return "/stream/" + streamPath
+}
+
+func setupShareRoutes(r *gin.Engine, ts *SimpleTorrentService, ss *ShareStore) {
+	// 创建分享链接: {"path": "torrent/{hash}/{文件路径}", "expires_in": 3600, "max_downloads": 3, "password": "..."}
+	r.POST("/share", func(c *gin.Context) {
+		var req struct {
+			Path string `json:"path"`
+			// 也可以使用/files等接口返回的file_id
+			FileID string `json:"file_id"`
+			// 有效期（秒），默认24小时，最长30天
+			ExpiresIn    int64  `json:"expires_in"`
+			MaxDownloads int    `json:"max_downloads"`
+			Password     string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.ExpiresIn < 0 || req.MaxDownloads < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求格式"})
+			return
+		}
+
+		streamPath := req.Path
+		if req.FileID != "" {
+			decoded, err := parsePlaybackFileID(req.FileID)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			streamPath = decoded
+		}
+		if streamPath == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请提供path或file_id"})
+			return
+		}
+		streamPath, err := ts.shareablePath(streamPath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		expiry := defaultShareExpiry
+		if req.ExpiresIn > 0 {
+			expiry = time.Duration(req.ExpiresIn) * time.Second
+			if expiry > maxShareExpiry {
+				expiry = maxShareExpiry
+			}
+		}
+
+		share := ss.Create(streamPath, expiry, req.MaxDownloads, req.Password)
+		log.Printf("创建分享: %s, 过期时间: %s", streamPath, share.ExpiresAt.Format(time.RFC3339))
+		c.JSON(http.StatusOK, ss.info(*share, requestBaseURL(c)))
+	})
+
+	// 未过期的分享链接及下载次数
+	r.GET("/shares", func(c *gin.Context) {
+		baseURL := requestBaseURL(c)
+		shares := ss.List()
+		infos := make([]ShareInfo, 0, len(shares))
+		for _, share := range shares {
+			infos = append(infos, ss.info(share, baseURL))
+		}
+		c.JSON(http.StatusOK, gin.H{"shares": infos})
+	})
+
+	// 撤销分享链接
+	r.DELETE("/share/:id", func(c *gin.Context) {
+		if err := ss.Revoke(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "分享已撤销"})
+	})
+
+	// 访问分享链接：校验后交给/stream/处理，支持Range和边下载边播放；
+	// 密码通过HTTP Basic认证或POST表单提交后的cookie提供（不接受查询参数，避免出现在日志和Referer中），download=1时作为附件下载
+	shareHandler := func(c *gin.Context) {
+		var creds shareCredentials
+		if _, password, ok := c.Request.BasicAuth(); ok {
+			creds.Password = password
+		}
+		if id, _, err := ss.verify(c.Param("token")); err == nil {
+			creds.Cookie, _ = c.Cookie(shareCookieName(id))
+		}
+
+		share, status, err := ss.authorize(c.Param("token"), creds, shareAccess{
+			ClientIP:  c.RemoteIP(),
+			Get:       c.Request.Method == http.MethodGet,
+			FromStart: shareRequestFromStart(c.GetHeader("Range")),
+		})
+		if err != nil {
+			if status == http.StatusUnauthorized {
+				c.Header("WWW-Authenticate", `Basic realm="share", charset="UTF-8"`)
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		if c.Query("download") == "1" {
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", url.PathEscape(path.Base(share.Path))))
+		}
+		c.Request.URL.Path = shareStreamPath(share.Path)
+		c.Request.URL.RawPath = ""
+		r.HandleContext(c)
+	}
+	r.GET("/s/:token", shareHandler)
+	r.HEAD("/s/:token", shareHandler)
+
+	// 表单提交密码：password=...，成功后设置cookie并重定向到分享链接
+	r.POST("/s/:token", func(c *gin.Context) {
+		token := c.Param("token")
+		share, cookie, status, err := ss.login(token, c.PostForm("password"))
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		maxAge := int(time.Until(share.ExpiresAt).Seconds())
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(shareCookieName(share.ID), cookie, maxAge, "/s/", "", c.Request.TLS != nil, true)
+		c.Redirect(http.StatusSeeOther, "/s/"+token)
+	})
+}
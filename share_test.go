@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 分享路由，/stream/返回转发后的路径代替实际的文件
+func newTestShareServer(t *testing.T) (*gin.Engine, *ShareStore) {
+	gin.SetMode(gin.TestMode)
+	ss := NewShareStore(filepath.Join(t.TempDir(), "share_state.json"))
+	r := gin.New()
+	stream := func(c *gin.Context) {
+		c.String(http.StatusOK, c.Request.URL.Path)
+	}
+	r.GET("/stream/*filepath", stream)
+	r.HEAD("/stream/*filepath", stream)
+	setupShareRoutes(r, nil, ss)
+	return r, ss
+}
+
+func shareRequest(r *gin.Engine, method, target, remoteIP string, setup func(req *http.Request)) *httptest.ResponseRecorder {
+	return shareRequestBody(r, method, target, remoteIP, "", setup)
+}
+
+func shareRequestBody(r *gin.Engine, method, target, remoteIP, body string, setup func(req *http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.RemoteAddr = remoteIP + ":40000"
+	if setup != nil {
+		setup(req)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSharePassword(t *testing.T) {
+	r, ss := newTestShareServer(t)
+	share := ss.Create("movie.mp4", time.Hour, 0, "secret")
+	link := "/s/" + ss.token(share)
+
+	tests := []struct {
+		name   string
+		target string
+		setup  func(req *http.Request)
+		status int
+	}{
+		{"没有密码", link, nil, http.StatusUnauthorized},
+		{"查询参数中的密码", link + "?password=secret", nil, http.StatusUnauthorized},
+		{"Basic认证密码错误", link, func(req *http.Request) { req.SetBasicAuth("", "wrong") }, http.StatusUnauthorized},
+		{"Basic认证", link, func(req *http.Request) { req.SetBasicAuth("any", "secret") }, http.StatusOK},
+		{"伪造的cookie", link, func(req *http.Request) {
+			req.AddCookie(&http.Cookie{Name: shareCookieName(share.ID), Value: "forged"})
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := shareRequest(r, http.MethodGet, tt.target, "10.0.0.1", tt.setup)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 %d, 期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("401应返回WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestSharePasswordForm(t *testing.T) {
+	r, ss := newTestShareServer(t)
+	share := ss.Create("movie.mp4", time.Hour, 0, "secret")
+	other := ss.Create("other.mp4", time.Hour, 0, "secret")
+	link := "/s/" + ss.token(share)
+
+	post := func(password string) *httptest.ResponseRecorder {
+		body := url.Values{"password": {password}}.Encode()
+		return shareRequestBody(r, http.MethodPost, link, "10.0.0.1", body, func(req *http.Request) {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		})
+	}
+
+	if w := post("wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("密码错误状态码 %d", w.Code)
+	}
+	w := post("secret")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != link {
+		t.Fatalf("提交密码后应重定向: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("应设置一个HttpOnly cookie: %+v", cookies)
+	}
+
+	withCookie := func(req *http.Request) { req.AddCookie(cookies[0]) }
+	if w := shareRequest(r, http.MethodGet, link, "10.0.0.1", withCookie); w.Code != http.StatusOK {
+		t.Fatalf("使用cookie访问失败: %d", w.Code)
+	}
+	// cookie只对设置它的分享有效
+	otherCookie := func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: shareCookieName(other.ID), Value: cookies[0].Value})
+	}
+	if w := shareRequest(r, http.MethodGet, "/s/"+ss.token(other), "10.0.0.1", otherCookie); w.Code != http.StatusUnauthorized {
+		t.Fatalf("其他分享的cookie不应通过: %d", w.Code)
+	}
+}
+
+// 密码哈希以签名密钥为HMAC密钥，记录中不包含可离线验证的密码
+func TestSharePasswordHash(t *testing.T) {
+	ss := NewShareStore(filepath.Join(t.TempDir(), "a.json"))
+	other := NewShareStore(filepath.Join(t.TempDir(), "b.json"))
+	if ss.hashPassword("salt", "secret") == other.hashPassword("salt", "secret") {
+		t.Fatal("不同签名密钥的哈希不应相同")
+	}
+	if ss.hashPassword("salt", "secret") != ss.hashPassword("salt", "secret") {
+		t.Fatal("哈希应稳定")
+	}
+
+	share := ss.Create("movie.mp4", time.Hour, 0, "secret")
+	sum := sha256.Sum256([]byte(share.PasswordSalt + "secret"))
+	if share.PasswordHash == hex.EncodeToString(sum[:]) {
+		t.Fatal("不应使用无密钥的SHA-256")
+	}
+	reloaded := NewShareStore(ss.path)
+	if _, _, err := reloaded.authorize(ss.token(share), shareCredentials{Password: "secret"}, shareAccess{ClientIP: "10.0.0.1"}); err != nil {
+		t.Fatalf("重启后密码应仍然有效: %v", err)
+	}
+}
+
+// 没有Range或从第0字节开始的GET请求计为一次下载，已开始下载的客户端的续传和跳转不计数
+func TestShareDownloadLimit(t *testing.T) {
+	r, ss := newTestShareServer(t)
+	share := ss.Create("movie.mp4", time.Hour, 2, "")
+	link := "/s/" + ss.token(share)
+	withRange := func(value string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("Range", value) }
+	}
+	forwarded := func(ip string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("X-Forwarded-For", ip) }
+	}
+
+	steps := []struct {
+		name      string
+		method    string
+		remoteIP  string
+		setup     func(req *http.Request)
+		status    int
+		downloads int
+	}{
+		{"HEAD不计数", http.MethodHead, "10.0.0.9", nil, http.StatusOK, 0},
+		{"第一次下载", http.MethodGet, "10.0.0.1", withRange("bytes=0-"), http.StatusOK, 1},
+		{"同一客户端的跳转", http.MethodGet, "10.0.0.1", withRange("bytes=5000-"), http.StatusOK, 1},
+		{"同一客户端的续传", http.MethodGet, "10.0.0.1", withRange("bytes=9000-9999"), http.StatusOK, 1},
+		{"同一客户端重新下载", http.MethodGet, "10.0.0.1", nil, http.StatusOK, 2},
+		{"次数用完后的新下载", http.MethodGet, "10.0.0.1", nil, http.StatusForbidden, 2},
+		{"次数用完后已开始下载的客户端仍可跳转", http.MethodGet, "10.0.0.1", withRange("bytes=100-"), http.StatusOK, 2},
+		{"其他客户端的Range请求", http.MethodGet, "10.0.0.2", withRange("bytes=100-"), http.StatusForbidden, 2},
+		{"伪造X-Forwarded-For", http.MethodGet, "10.0.0.2", forwarded("10.0.0.1"), http.StatusForbidden, 2},
+		{"次数用完后其他客户端的HEAD", http.MethodHead, "10.0.0.2", nil, http.StatusForbidden, 2},
+	}
+	for _, step := range steps {
+		w := shareRequest(r, step.method, link, step.remoteIP, step.setup)
+		if w.Code != step.status {
+			t.Fatalf("%s: 状态码 %d, 期望 %d", step.name, w.Code, step.status)
+		}
+		if info := ss.info(ss.List()[0], ""); info.DownloadCount != step.downloads || info.MaxDownloads != 2 {
+			t.Fatalf("%s: 下载次数 %+v, 期望 %d", step.name, info, step.downloads)
+		}
+	}
+
+	// 未开始过下载的客户端直接发送Range请求也计为一次下载
+	other := ss.Create("movie.mp4", time.Hour, 1, "")
+	otherLink := "/s/" + ss.token(other)
+	if w := shareRequest(r, http.MethodGet, otherLink, "10.0.0.3", withRange("bytes=100-")); w.Code != http.StatusOK {
+		t.Fatalf("状态码 %d", w.Code)
+	}
+	if w := shareRequest(r, http.MethodGet, otherLink, "10.0.0.4", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("Range请求应计入下载次数: %d", w.Code)
+	}
+}
+
+func TestShareRequestFromStart(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", true},
+		{"bytes=0-", true},
+		{"bytes=0-1023", true},
+		{"bytes= 0-1,100-200", true},
+		{"bytes=1-", false},
+		{"bytes=-500", false},
+		{"bytes=100-200,0-1", false},
+	}
+	for _, tt := range tests {
+		if got := shareRequestFromStart(tt.header); got != tt.want {
+			t.Errorf("shareRequestFromStart(%q) = %v, 期望 %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// 令牌篡改返回403，过期和撤销返回410
+func TestShareToken(t *testing.T) {
+	r, ss := newTestShareServer(t)
+	share := ss.Create("dir/movie.mp4", time.Hour, 0, "")
+	token := ss.token(share)
+	parts := strings.Split(token, ".")
+	expired := ss.Create("movie.mp4", -time.Minute, 0, "")
+	otherStore := NewShareStore(filepath.Join(t.TempDir(), "other.json"))
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		body   string
+	}{
+		{"有效", token, http.StatusOK, "/stream/dir/movie.mp4"},
+		{"延长过期时间", parts[0] + "." + strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 36) + "." + parts[2], http.StatusForbidden, ""},
+		{"替换分享ID", expired.ID + "." + parts[1] + "." + parts[2], http.StatusForbidden, ""},
+		{"篡改签名", parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])), http.StatusForbidden, ""},
+		{"其他签名密钥", otherStore.token(share), http.StatusForbidden, ""},
+		{"缺少签名", parts[0] + "." + parts[1], http.StatusForbidden, ""},
+		{"已过期", ss.token(expired), http.StatusGone, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := shareRequest(r, http.MethodGet, "/s/"+tt.token, "10.0.0.1", nil)
+			if w.Code != tt.status {
+				t.Fatalf("状态码 %d, 期望 %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Fatalf("转发到 %q, 期望 %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+
+	if w := shareRequest(r, http.MethodDelete, "/share/"+share.ID, "10.0.0.1", nil); w.Code != http.StatusOK {
+		t.Fatalf("撤销状态码 %d", w.Code)
+	}
+	if w := shareRequest(r, http.MethodGet, "/s/"+token, "10.0.0.1", nil); w.Code != http.StatusGone {
+		t.Fatalf("撤销后状态码 %d, 期望410", w.Code)
+	}
+	if w := shareRequest(r, http.MethodDelete, "/share/"+share.ID, "10.0.0.1", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("重复撤销状态码 %d", w.Code)
+	}
+
+	// 已过期的分享从列表中清理
+	for _, listed := range ss.List() {
+		if listed.ID == expired.ID || listed.ID == share.ID {
+			t.Fatalf("列表中不应包含 %s", listed.ID)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -8,10 +10,14 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
 )
 
 // 数据结构定义
@@ -21,26 +27,74 @@ type DownloadStatus struct {
 }
 
 type TorrentInfo struct {
-	Name       string  `json:"name"`
-	Progress   float64 `json:"progress"`
-	Downloaded int64   `json:"downloaded"`
-	Total      int64   `json:"total"`
-	Speed      int64   `json:"speed"`
-	Status     string  `json:"status"`
-	Hash       string  `json:"hash"`
+	Name       string         `json:"name"`
+	Progress   float64        `json:"progress"`
+	Downloaded int64          `json:"downloaded"`
+	Total      int64          `json:"total"`
+	Speed      int64          `json:"speed"`
+	Status     string         `json:"status"`
+	Hash       string         `json:"hash"`
+	Category   string         `json:"category,omitempty"`
+	Extract    *ExtractStatus `json:"extract,omitempty"`
+	Pinned     bool           `json:"pinned"`
+}
+
+// 任务事件 - 记录后处理等过程中的结果和错误
+type TaskEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
 }
 
 type FileInfo struct {
 	Name string `json:"name"`
 	Size int64  `json:"size"`
 	Path string `json:"path"`
+	// 视频文件的媒体信息，无法解析时为空
+	Media *MediaInfo `json:"media,omitempty"`
+	// 视频文件的观看记录ID和播放进度
+	FileID string         `json:"file_id,omitempty"`
+	Watch  *PlaybackState `json:"watch,omitempty"`
 }
 
 type SimpleTorrentService struct {
 	client      *torrent.Client
+	config      *Config
+	backend     storage.ClientImplCloser
 	downloadDir string
 	torrents    map[string]*TorrentStatus
-	mutex       sync.RWMutex
+	// 自定义保存路径的存储，按路径复用
+	storages map[string]storage.ClientImplCloser
+	// 各任务的web seed来源
+	webSeeds map[string][]*webSeedSource
+	mutex    sync.RWMutex
+	// 媒体头部探测结果缓存
+	mediaProbes map[string]*MediaInfo
+	probeMutex  sync.Mutex
+	// 头部和索引区域的定位结果，以及正在优先下载索引的文件
+	mediaIndexes map[string][]mediaRegion
+	fastStarts   map[string]bool
+	// 关键帧的时间到字节偏移索引
+	seekIndexes map[string]*SeekIndex
+	// 打包下载时计算的文件CRC
+	archiveCRCs map[string]uint32
+	// 播放请求设置的piece优先级
+	streamPriorities *streamPriorityBoard
+	// 正在进行的播放会话
+	streamSessions *streamSessionRegistry
+	// 观看记录
+	playback *PlaybackStore
+	// 已完成任务的完成时间和固定状态
+	retention *RetentionStore
+}
+
+// 添加任务的可选参数
+type AddOptions struct {
+	Category string
+	// 保存路径，相对路径基于下载目录
+	SavePath string
+	// HTTP镜像（web seed）地址
+	WebSeeds []string
 }
 
 type TorrentStatus struct {
@@ -51,43 +105,111 @@ type TorrentStatus struct {
 	Downloaded  int64
 	Total       int64
 	AddedTime   time.Time
+	Category    string
+	SavePath    string
+	Events      []TaskEvent
+	Extract     *ExtractStatus
+	// 因磁盘空间不足而暂停
+	PausedForDisk bool
+	CompletedTime time.Time
+	// 永久保留，不参与自动清理
+	Pinned bool
 }
 
-func NewSimpleTorrentService(downloadDir string) *SimpleTorrentService {
+func NewSimpleTorrentService(downloadDir string, config *Config) *SimpleTorrentService {
 	cfg := torrent.NewDefaultClientConfig()
-	cfg.DataDir = downloadDir
 	cfg.NoUpload = false
 	cfg.Seed = true
 
+	sts, err := newSimpleTorrentService(downloadDir, ".", config, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 磁盘空间监控
+	go sts.monitorDiskSpace()
+
+	// 监视目录自动添加torrent
+	go sts.watchFolders()
+
+	// 按保留策略清理已完成任务
+	go sts.runRetentionJanitor()
+
+	// 多个播放会话之间分配预读
+	go sts.balanceStreams()
+
+	return sts
+}
+
+// 创建服务但不启动后台任务，播放进度等状态文件保存在stateDir中
+func newSimpleTorrentService(downloadDir string, stateDir string, config *Config, cfg *torrent.ClientConfig) (*SimpleTorrentService, error) {
+	cfg.DataDir = downloadDir
+
 	// 确保下载目录存在
 	if err := os.MkdirAll(downloadDir, 0755); err != nil {
-		log.Fatal("创建下载目录失败:", err)
+		return nil, fmt.Errorf("创建下载目录失败: %v", err)
+	}
+
+	// 存储后端
+	backend, err := newStorageBackend(config.Storage, downloadDir)
+	if err != nil {
+		return nil, fmt.Errorf("创建存储失败: %v", err)
+	}
+	if backend != nil {
+		cfg.DefaultStorage = backend
 	}
 
 	client, err := torrent.NewClient(cfg)
 	if err != nil {
-		log.Fatal("创建torrent客户端失败:", err)
+		if backend != nil {
+			backend.Close()
+		}
+		return nil, fmt.Errorf("创建torrent客户端失败: %v", err)
 	}
 
-	log.Printf("Torrent客户端已创建，下载目录: %s", downloadDir)
+	log.Printf("Torrent客户端已创建，下载目录: %s, 存储: %s", downloadDir, config.Storage.Type)
 
-	return &SimpleTorrentService{
+	sts := &SimpleTorrentService{
 		client:      client,
+		config:      config,
+		backend:     backend,
 		downloadDir: downloadDir,
 		torrents:    make(map[string]*TorrentStatus),
+		storages:    make(map[string]storage.ClientImplCloser),
+		webSeeds:    make(map[string][]*webSeedSource),
+		mediaProbes: make(map[string]*MediaInfo),
+		mediaIndexes: make(map[string][]mediaRegion),
+		fastStarts:  make(map[string]bool),
+		seekIndexes: make(map[string]*SeekIndex),
+		archiveCRCs: make(map[string]uint32),
+		streamPriorities: newStreamPriorityBoard(),
+		playback:    NewPlaybackStore(filepath.Join(stateDir, "playback_state.json")),
+		retention:   NewRetentionStore(filepath.Join(stateDir, "retention_state.json")),
 	}
+	sts.streamSessions = newStreamSessionRegistry(sts)
+	return sts, nil
 }
 
 func (sts *SimpleTorrentService) DownloadMagnet(magnetURL string) error {
+	return sts.DownloadMagnetWithOptions(magnetURL, AddOptions{})
+}
+
+// 添加magnet链接，可指定分类和保存路径
+func (sts *SimpleTorrentService) DownloadMagnetWithOptions(magnetURL string, opts AddOptions) error {
 	sts.mutex.Lock()
 	defer sts.mutex.Unlock()
 
-	// 添加torrent
-	t, err := sts.client.AddMagnet(magnetURL)
+	spec, err := torrent.TorrentSpecFromMagnetUri(magnetURL)
 	if err != nil {
 		return fmt.Errorf("添加magnet链接失败: %v", err)
 	}
 
+	// 添加torrent
+	t, savePath, err := sts.addTorrentSpec(spec, opts)
+	if err != nil {
+		return fmt.Errorf("添加magnet链接失败: %w", err)
+	}
+
 	hash := t.InfoHash().String()
 	
 	// 立即存储状态
@@ -99,6 +221,8 @@ func (sts *SimpleTorrentService) DownloadMagnet(magnetURL string) error {
 		Downloaded: 0,
 		Total:     0,
 		AddedTime: time.Now(),
+		Category:  opts.Category,
+		SavePath:  savePath,
 	}
 
 	log.Printf("添加magnet链接成功: %s", hash[:8])
@@ -110,14 +234,29 @@ func (sts *SimpleTorrentService) DownloadMagnet(magnetURL string) error {
 }
 
 func (sts *SimpleTorrentService) DownloadTorrentFile(torrentPath string) error {
+	return sts.DownloadTorrentFileWithOptions(torrentPath, AddOptions{})
+}
+
+// 添加torrent文件，可指定分类和保存路径
+func (sts *SimpleTorrentService) DownloadTorrentFileWithOptions(torrentPath string, opts AddOptions) error {
 	sts.mutex.Lock()
 	defer sts.mutex.Unlock()
 
-	// 添加torrent文件
-	t, err := sts.client.AddTorrentFromFile(torrentPath)
+	// 读取torrent文件
+	mi, err := metainfo.LoadFromFile(torrentPath)
 	if err != nil {
 		return fmt.Errorf("添加torrent文件失败: %v", err)
 	}
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return fmt.Errorf("添加torrent文件失败: %v", err)
+	}
+
+	// 添加torrent
+	t, savePath, err := sts.addTorrentSpec(spec, opts)
+	if err != nil {
+		return fmt.Errorf("添加torrent文件失败: %w", err)
+	}
 
 	hash := t.InfoHash().String()
 	
@@ -130,6 +269,8 @@ func (sts *SimpleTorrentService) DownloadTorrentFile(torrentPath string) error {
 		Downloaded: 0,
 		Total:     0,
 		AddedTime: time.Now(),
+		Category:  opts.Category,
+		SavePath:  savePath,
 	}
 
 	log.Printf("添加torrent文件成功: %s", hash[:8])
@@ -141,37 +282,33 @@ func (sts *SimpleTorrentService) DownloadTorrentFile(torrentPath string) error {
 }
 
 func (sts *SimpleTorrentService) DownloadTorrentFromURL(torrentURL string) error {
-	sts.mutex.Lock()
-	defer sts.mutex.Unlock()
+	return sts.DownloadTorrentFromURLWithOptions(torrentURL, AddOptions{})
+}
 
-	// 从URL下载torrent文件
-	resp, err := http.Get(torrentURL)
+// 从URL添加torrent文件，可指定分类和保存路径
+func (sts *SimpleTorrentService) DownloadTorrentFromURLWithOptions(torrentURL string, opts AddOptions) error {
+	// 在锁外下载，远程服务器响应慢时不阻塞其它请求
+	torrentData, err := fetchTorrentFile(torrentURL)
 	if err != nil {
-		return fmt.Errorf("下载torrent文件失败: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("下载torrent文件失败，状态码: %d", resp.StatusCode)
-	}
+	sts.mutex.Lock()
+	defer sts.mutex.Unlock()
 
-	// 读取torrent数据并保存到临时文件
-	torrentData, err := io.ReadAll(resp.Body)
+	mi, err := metainfo.Load(bytes.NewReader(torrentData))
 	if err != nil {
-		return fmt.Errorf("读取torrent数据失败: %v", err)
+		return fmt.Errorf("解析torrent数据失败: %v", err)
 	}
-
-	// 创建临时文件
-	tempFile := filepath.Join(sts.downloadDir, "temp.torrent")
-	if err := os.WriteFile(tempFile, torrentData, 0644); err != nil {
-		return fmt.Errorf("保存临时torrent文件失败: %v", err)
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return fmt.Errorf("添加torrent失败: %v", err)
 	}
 
-	// 添加torrent文件
-	t, err := sts.client.AddTorrentFromFile(tempFile)
+	// 添加torrent
+	t, savePath, err := sts.addTorrentSpec(spec, opts)
 	if err != nil {
-		os.Remove(tempFile) // 清理临时文件
-		return fmt.Errorf("添加torrent失败: %v", err)
+		return fmt.Errorf("添加torrent失败: %w", err)
 	}
 
 	hash := t.InfoHash().String()
@@ -185,6 +322,8 @@ func (sts *SimpleTorrentService) DownloadTorrentFromURL(torrentURL string) error
 		Downloaded: 0,
 		Total:     0,
 		AddedTime: time.Now(),
+		Category:  opts.Category,
+		SavePath:  savePath,
 	}
 
 	log.Printf("添加远程torrent文件成功: %s", hash[:8])
@@ -192,15 +331,37 @@ func (sts *SimpleTorrentService) DownloadTorrentFromURL(torrentURL string) error
 	// 异步处理
 	go sts.handleTorrent(t, hash)
 
-	// 清理临时文件
-	go func() {
-		time.Sleep(5 * time.Second)
-		os.Remove(tempFile)
-	}()
-
 	return nil
 }
 
+// 下载远程torrent文件的客户端
+var torrentFetchClient = &http.Client{Timeout: 30 * time.Second}
+
+// torrent文件的大小上限
+const maxTorrentFileSize = 10 * 1024 * 1024
+
+// 从URL下载torrent文件，直接在内存中解析（RSS等会并发添加，不使用共享的临时文件）
+func fetchTorrentFile(torrentURL string) ([]byte, error) {
+	resp, err := torrentFetchClient.Get(torrentURL)
+	if err != nil {
+		return nil, fmt.Errorf("下载torrent文件失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("下载torrent文件失败，状态码: %d", resp.StatusCode)
+	}
+
+	torrentData, err := io.ReadAll(io.LimitReader(resp.Body, maxTorrentFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("读取torrent数据失败: %v", err)
+	}
+	if len(torrentData) > maxTorrentFileSize {
+		return nil, fmt.Errorf("torrent文件过大")
+	}
+	return torrentData, nil
+}
+
 func (sts *SimpleTorrentService) handleTorrent(t *torrent.Torrent, hash string) {
 	// 等待种子信息，但设置超时
 	select {
@@ -210,6 +371,8 @@ func (sts *SimpleTorrentService) handleTorrent(t *torrent.Torrent, hash string)
 			status.Name = t.Name()
 			status.Status = "开始下载"
 			status.Total = t.Length()
+			// 重启前固定的任务重新添加后仍然固定
+			status.Pinned = status.Pinned || sts.retention.pinned(hash)
 		}
 		sts.mutex.Unlock()
 		
@@ -220,8 +383,29 @@ func (sts *SimpleTorrentService) handleTorrent(t *torrent.Torrent, hash string)
 			log.Printf("文件 %d: %s (大小: %d bytes)", i, file.Path(), file.Length())
 		}
 		
+		// 仅流媒体模式下只下载播放时读取的部分，进度显示当前缓存的数据
+		if sts.streamingOnly() {
+			sts.mutex.Lock()
+			if status, exists := sts.torrents[hash]; exists {
+				status.Status = "等待播放"
+			}
+			sts.mutex.Unlock()
+			sts.monitorProgress(t, hash)
+			return
+		}
+
+		// 检查剩余磁盘空间，不足时任务保持暂停
+		sts.checkDiskSpaceForTorrent(t, hash)
+
 		// 下载所有文件
 		t.DownloadAll()
+
+		// 视频文件的头部和索引优先下载，尽早可以边下边播
+		for _, file := range t.Files() {
+			if isVideoFile(file.Path()) {
+				sts.prioritizeMediaIndex(file)
+			}
+		}
 		sts.monitorProgress(t, hash)
 		
 	case <-time.After(30 * time.Second):
@@ -250,15 +434,22 @@ func (sts *SimpleTorrentService) monitorProgress(t *torrent.Torrent, hash string
 					status.Progress = math.Min(progress, 100.0)
 				}
 				
-				if t.Complete.Bool() {
+				if sts.streamingOnly() {
+					// 缓存中的piece随时可能被淘汰，任务不会进入完成状态
+					status.Status = "等待播放"
+				} else if t.Complete.Bool() {
 					status.Status = "下载完成"
+					sts.recordCompletionLocked(hash, status)
 					sts.mutex.Unlock()
+					sts.retention.save()
 					log.Printf("下载完成: %s", status.Name)
+					sts.addEvent(hash, "completed", "下载完成")
 					
 					// 列出实际下载的文件
-					log.Printf("下载目录: %s", sts.downloadDir)
+					dataDir := sts.torrentDataDir(hash)
+					log.Printf("下载目录: %s", dataDir)
 					for _, file := range t.Files() {
-						fullPath := filepath.Join(sts.downloadDir, file.Path())
+						fullPath := filepath.Join(dataDir, file.Path())
 						if stat, err := os.Stat(fullPath); err == nil {
 							log.Printf("已下载文件: %s (大小: %d bytes)", fullPath, stat.Size())
 						} else {
@@ -270,7 +461,14 @@ func (sts *SimpleTorrentService) monitorProgress(t *torrent.Torrent, hash string
 							}
 						}
 					}
+
+					// 下载完成后的后处理
+					if sts.config.AutoExtract && sts.dataOnDisk() {
+						go sts.extractArchives(t, hash)
+					}
 					return
+				} else if status.PausedForDisk {
+					status.Status = "磁盘空间不足"
 				} else {
 					status.Status = "下载中"
 					// 显示下载进度详情和文件状态
@@ -314,6 +512,9 @@ func (sts *SimpleTorrentService) GetDownloadStatus() DownloadStatus {
 			Speed:      0,
 			Status:     status.Status,
 			Hash:       hash,
+			Category:   status.Category,
+			Extract:    status.Extract.clone(),
+			Pinned:     status.Pinned,
 		})
 	}
 
@@ -323,6 +524,101 @@ func (sts *SimpleTorrentService) GetDownloadStatus() DownloadStatus {
 	}
 }
 
+// 解析保存路径，空路径使用下载目录
+func (sts *SimpleTorrentService) resolveSavePath(savePath string) string {
+	if savePath == "" {
+		return sts.downloadDir
+	}
+	if filepath.IsAbs(savePath) {
+		return filepath.Clean(savePath)
+	}
+	return filepath.Join(sts.downloadDir, savePath)
+}
+
+// 任务已在列表中，重复添加会覆盖状态且不会应用新的保存路径
+var errTorrentExists = errors.New("任务已存在")
+
+// 按参数添加torrent，调用方需持有锁
+func (sts *SimpleTorrentService) addTorrentSpec(spec *torrent.TorrentSpec, opts AddOptions) (*torrent.Torrent, string, error) {
+	if status, exists := sts.torrents[spec.InfoHash.HexString()]; exists && status.Status != "已取消" {
+		return nil, "", errTorrentExists
+	}
+
+	// 只有文件存储支持按任务指定保存路径，其它存储的数据都在下载目录
+	savePath := sts.downloadDir
+	if sts.fileStorage() {
+		savePath = sts.resolveSavePath(opts.SavePath)
+	}
+	spec.Storage = sts.storageForPath(savePath)
+
+	// web seed单独添加以统计每个来源的字节数
+	specWebSeeds := spec.Webseeds
+	spec.Webseeds = nil
+
+	t, _, err := sts.client.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sts.addWebSeedsLocked(t, specWebSeeds, "torrent")
+	sts.addWebSeedsLocked(t, opts.WebSeeds, "request")
+	return t, savePath, nil
+}
+
+// 获取保存路径对应的存储，下载目录使用客户端默认存储
+func (sts *SimpleTorrentService) storageForPath(savePath string) storage.ClientImpl {
+	if savePath == sts.downloadDir || !sts.fileStorage() {
+		return nil
+	}
+	if s, exists := sts.storages[savePath]; exists {
+		return s
+	}
+
+	s := storage.NewFile(savePath)
+	sts.storages[savePath] = s
+	return s
+}
+
+// 获取任务的数据目录
+func (sts *SimpleTorrentService) torrentDataDir(hash string) string {
+	sts.mutex.RLock()
+	defer sts.mutex.RUnlock()
+
+	if status, exists := sts.torrents[hash]; exists && status.SavePath != "" {
+		return status.SavePath
+	}
+	return sts.downloadDir
+}
+
+// 记录任务事件
+func (sts *SimpleTorrentService) addEvent(hash string, eventType string, message string) {
+	sts.mutex.Lock()
+	defer sts.mutex.Unlock()
+
+	if status, exists := sts.torrents[hash]; exists {
+		status.Events = append(status.Events, TaskEvent{
+			Time:    time.Now(),
+			Type:    eventType,
+			Message: message,
+		})
+	}
+}
+
+// 获取任务事件
+func (sts *SimpleTorrentService) GetTaskEvents(hash string) ([]TaskEvent, error) {
+	sts.mutex.RLock()
+	defer sts.mutex.RUnlock()
+
+	status, exists := sts.torrents[hash]
+	if !exists {
+		return nil, fmt.Errorf("下载任务不存在")
+	}
+
+	events := make([]TaskEvent, len(status.Events))
+	copy(events, status.Events)
+	return events, nil
+}
+
 func (sts *SimpleTorrentService) GetDownloadedFiles() ([]FileInfo, error) {
 	var files []FileInfo
 
@@ -331,19 +627,92 @@ func (sts *SimpleTorrentService) GetDownloadedFiles() ([]FileInfo, error) {
 			return err
 		}
 
+		// 跳过流媒体缓存、转码等隐藏目录
+		if info.IsDir() && path != sts.downloadDir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+
 		if !info.IsDir() && !filepath.HasPrefix(info.Name(), ".torrent") {
 			relPath, _ := filepath.Rel(sts.downloadDir, path)
-			files = append(files, FileInfo{
+			fileInfo := FileInfo{
 				Name: info.Name(),
 				Size: info.Size(),
 				Path: relPath,
-			})
+			}
+			if isVideoFile(path) {
+				fileInfo.Media, _ = sts.ProbeLocalFile(path)
+
+				streamPath := filepath.ToSlash(relPath)
+				fileInfo.FileID = playbackFileID(streamPath)
+				fileInfo.Watch = sts.playback.Get(sts.localPlaybackKey(path))
+			}
+			files = append(files, fileInfo)
 		}
 
 		return nil
 	})
+	if err != nil {
+		return files, err
+	}
+
+	return append(files, sts.externalTaskFiles()...), nil
+}
+
+// 保存在下载目录之外的任务文件，路径使用torrent/{hash}/{文件路径}，通过torrent流播放和下载
+func (sts *SimpleTorrentService) externalTaskFiles() []FileInfo {
+	if !sts.fileStorage() {
+		return nil
+	}
+
+	type externalFile struct {
+		diskPath   string
+		streamPath string
+	}
+	var candidates []externalFile
+
+	sts.mutex.RLock()
+	downloadDir := absPath(sts.downloadDir)
+	for hash, status := range sts.torrents {
+		if status.Torrent == nil || status.Torrent.Info() == nil || status.Status == "已取消" {
+			continue
+		}
+		dataDir := sts.statusDataDir(status)
+		rel, err := filepath.Rel(downloadDir, absPath(dataDir))
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		for _, file := range status.Torrent.Files() {
+			candidates = append(candidates, externalFile{
+				diskPath:   filepath.Join(dataDir, filepath.FromSlash(file.Path())),
+				streamPath: "torrent/" + hash + "/" + file.Path(),
+			})
+		}
+	}
+	sts.mutex.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].streamPath < candidates[j].streamPath
+	})
 
-	return files, err
+	// 在锁外读取磁盘和解析媒体信息
+	var files []FileInfo
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate.diskPath)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		fileInfo := FileInfo{
+			Name: info.Name(),
+			Size: info.Size(),
+			Path: candidate.streamPath,
+		}
+		if isVideoFile(candidate.diskPath) {
+			fileInfo.Media, _ = sts.ProbeLocalFile(candidate.diskPath)
+			fileInfo.FileID = playbackFileID(candidate.streamPath)
+			fileInfo.Watch = sts.playback.Get(sts.localPlaybackKey(candidate.diskPath))
+		}
+		files = append(files, fileInfo)
+	}
+	return files
 }
 
 func (sts *SimpleTorrentService) CancelDownload(hash string) error {
@@ -368,22 +737,76 @@ func (sts *SimpleTorrentService) CancelDownload(hash string) error {
 
 func (sts *SimpleTorrentService) RemoveDownload(hash string) error {
 	sts.mutex.Lock()
-	defer sts.mutex.Unlock()
-
 	status, exists := sts.torrents[hash]
 	if !exists {
+		sts.mutex.Unlock()
 		return fmt.Errorf("下载任务不存在")
 	}
 
+	sts.removeDownloadLocked(hash, status)
+	sts.mutex.Unlock()
+	sts.retention.save()
+	return nil
+}
+
+// 停止并移除任务，调用方需持有锁，释放锁后调用sts.retention.save()
+func (sts *SimpleTorrentService) removeDownloadLocked(hash string, status *TorrentStatus) {
 	// 停止torrent
 	status.Torrent.Drop()
 	
 	// 从列表中移除
 	delete(sts.torrents, hash)
+	delete(sts.webSeeds, hash)
+	sts.forgetMediaProbes(hash)
+	sts.streamPriorities.forget(status.Torrent)
+	sts.retention.forget(hash)
 	
 	log.Printf("移除下载任务: %s (%s)", status.Name, hash[:8])
-	
-	return nil
+}
+
+// 获取任务详情，包含各来源接收的字节数
+func (sts *SimpleTorrentService) GetTorrentDetail(hash string) (*TorrentDetail, error) {
+	sts.mutex.RLock()
+	defer sts.mutex.RUnlock()
+
+	status, exists := sts.torrents[hash]
+	if !exists {
+		return nil, fmt.Errorf("下载任务不存在")
+	}
+
+	stats := status.Torrent.Stats()
+	detail := &TorrentDetail{
+		Hash:        hash,
+		Name:        status.Name,
+		Status:      status.Status,
+		Category:    status.Category,
+		SavePath:    status.SavePath,
+		Progress:    status.Progress,
+		Downloaded:  status.Downloaded,
+		Total:       status.Total,
+		AddedTime:   status.AddedTime,
+		ActivePeers: stats.ActivePeers,
+		Seeders:     stats.ConnectedSeeders,
+		BytesRead:   stats.BytesReadData.Int64(),
+		WebSeeds:    sts.webSeedSourcesLocked(hash),
+		Extract:     status.Extract.clone(),
+		Pinned:      status.Pinned,
+	}
+	if !status.CompletedTime.IsZero() {
+		completed := status.CompletedTime
+		detail.CompletedTime = &completed
+	}
+
+	// 来自peer的字节数 = 总数 - web seed
+	detail.PeerBytes = detail.BytesRead
+	for _, source := range detail.WebSeeds {
+		detail.PeerBytes -= source.BytesReceived
+	}
+	if detail.PeerBytes < 0 {
+		detail.PeerBytes = 0
+	}
+
+	return detail, nil
 }
 
 func (sts *SimpleTorrentService) GetTorrentHash(name string) string {
@@ -401,9 +824,8 @@ func (sts *SimpleTorrentService) GetTorrentHash(name string) string {
 // 获取正在下载的Torrent文件信息 - 支持边下载边播放
 func (sts *SimpleTorrentService) GetTorrentFiles(hash string) ([]*torrent.File, error) {
 	sts.mutex.RLock()
-	defer sts.mutex.RUnlock()
-
 	status, exists := sts.torrents[hash]
+	sts.mutex.RUnlock()
 	if !exists {
 		return nil, fmt.Errorf("torrent不存在")
 	}
@@ -412,7 +834,7 @@ func (sts *SimpleTorrentService) GetTorrentFiles(hash string) ([]*torrent.File,
 		return nil, fmt.Errorf("torrent未初始化")
 	}
 
-	// 等待torrent信息可用
+	// 等待torrent信息可用，等待期间不持有锁，避免阻塞其他请求
 	select {
 	case <-status.Torrent.GotInfo():
 		return status.Torrent.Files(), nil
@@ -437,13 +859,43 @@ func (sts *SimpleTorrentService) GetTorrentFileByPath(hash string, filePath stri
 	return nil, fmt.Errorf("文件不存在: %s", filePath)
 }
 
-// 获取所有正在下载的视频文件 - 包含可播放状态
-func (sts *SimpleTorrentService) GetDownloadingVideoFiles() []DownloadingVideoFile {
+// 本地路径对应的torrent文件，不属于任何任务时返回nil
+func (sts *SimpleTorrentService) LocalTorrentFile(localPath string) *torrent.File {
+	target := absPath(localPath)
+
 	sts.mutex.RLock()
 	defer sts.mutex.RUnlock()
 
-	var videoFiles []DownloadingVideoFile
+	for _, status := range sts.torrents {
+		if status.Torrent == nil || status.Torrent.Info() == nil {
+			continue
+		}
+		dataDir := status.SavePath
+		if dataDir == "" {
+			dataDir = sts.downloadDir
+		}
+		for _, file := range status.Torrent.Files() {
+			if absPath(filepath.Join(dataDir, filepath.FromSlash(file.Path()))) == target {
+				return file
+			}
+		}
+	}
+	return nil
+}
 
+// 获取所有正在下载的视频文件 - 包含可播放状态
+func (sts *SimpleTorrentService) GetDownloadingVideoFiles() []DownloadingVideoFile {
+	// 解析媒体头部需要读取torrent数据，可能等待下载，只在锁内收集文件
+	type candidate struct {
+		hash     string
+		name     string
+		status   string
+		file     *torrent.File
+		watchKey string
+	}
+	var candidates []candidate
+
+	sts.mutex.RLock()
 	for hash, status := range sts.torrents {
 		if status.Torrent == nil || status.Status == "下载完成" || status.Status == "已取消" {
 			continue
@@ -455,29 +907,12 @@ func (sts *SimpleTorrentService) GetDownloadingVideoFiles() []DownloadingVideoFi
 			// 遍历torrent中的所有文件
 			for _, file := range status.Torrent.Files() {
 				if isVideoFile(file.Path()) {
-					// 简化可播放判断逻辑 - 只要有一定的下载进度就认为可播放
-					downloaded := file.BytesCompleted()
-					fileSize := file.Length()
-					progress := float64(downloaded) / float64(fileSize) * 100
-					
-					// 如果下载了至少5%或者5MB的数据，就认为可以开始播放
-					minBytes := int64(5 * 1024 * 1024) // 5MB
-					minProgress := 5.0 // 5%
-					
-					playable := (downloaded >= minBytes) || (progress >= minProgress && downloaded > 1024*1024) // 至少1MB
-					
-					log.Printf("视频文件: %s, 进度: %.2f%%, 已下载: %d bytes, 可播放: %v", 
-						file.Path(), progress, downloaded, playable)
-					
-					videoFiles = append(videoFiles, DownloadingVideoFile{
-						Hash:       hash,
-						TorrentName: status.Name,
-						FileName:   file.Path(),
-						FileSize:   fileSize,
-						Downloaded: downloaded,
-						Progress:   progress,
-						Playable:   playable,
-						Status:     status.Status,
+					candidates = append(candidates, candidate{
+						hash:     hash,
+						name:     status.Name,
+						status:   status.Status,
+						file:     file,
+						watchKey: sts.torrentFilePlaybackKeyLocked(hash, status, file),
 					})
 				}
 			}
@@ -485,10 +920,74 @@ func (sts *SimpleTorrentService) GetDownloadingVideoFiles() []DownloadingVideoFi
 			// torrent信息还未获取到
 		}
 	}
+	sts.mutex.RUnlock()
+
+	var videoFiles []DownloadingVideoFile
+
+	for _, c := range candidates {
+		file := c.file
+		downloaded := file.BytesCompleted()
+		fileSize := file.Length()
+		progress := float64(downloaded) / float64(fileSize) * 100
+		
+		// 能解析出媒体头部，且索引（MP4的moov、MKV的Tracks和Cues）已下载即可开始边下边播
+		media, err := sts.ProbeTorrentFile(file)
+		var playable bool
+		switch err {
+		case nil:
+			playable = sts.mediaIndexReady(file)
+		case errMediaDataUnavailable:
+			playable = false
+		default:
+			// 无法解析的容器（AVI等）按下载量估计：至少5%或者5MB的数据
+			minBytes := int64(5 * 1024 * 1024) // 5MB
+			minProgress := 5.0 // 5%
+			playable = (downloaded >= minBytes) || (progress >= minProgress && downloaded > 1024*1024) // 至少1MB
+		}
+		
+		log.Printf("视频文件: %s, 进度: %.2f%%, 已下载: %d bytes, 可播放: %v", 
+			file.Path(), progress, downloaded, playable)
+		
+		videoFiles = append(videoFiles, DownloadingVideoFile{
+			Hash:       c.hash,
+			TorrentName: c.name,
+			FileName:   file.Path(),
+			FileSize:   fileSize,
+			Downloaded: downloaded,
+			Progress:   progress,
+			Playable:   playable,
+			Status:     c.status,
+			Media:      media,
+			FileID:     playbackFileID(torrentPlaybackKey(c.hash, file)),
+			Watch:      sts.playback.Get(c.watchKey),
+		})
+	}
 
 	return videoFiles
 }
 
+// 任务详情
+type TorrentDetail struct {
+	Hash        string          `json:"hash"`
+	Name        string          `json:"name"`
+	Status      string          `json:"status"`
+	Category    string          `json:"category,omitempty"`
+	SavePath    string          `json:"save_path"`
+	Progress    float64         `json:"progress"`
+	Downloaded  int64           `json:"downloaded"`
+	Total       int64           `json:"total"`
+	AddedTime   time.Time       `json:"added_time"`
+	ActivePeers int             `json:"active_peers"`
+	Seeders     int             `json:"seeders"`
+	BytesRead   int64           `json:"bytes_read"`
+	PeerBytes   int64           `json:"peer_bytes"`
+	WebSeeds    []WebSeedSource `json:"web_seeds"`
+	Extract     *ExtractStatus  `json:"extract,omitempty"`
+	// 完成时间，未完成时为空
+	CompletedTime *time.Time `json:"completed_time,omitempty"`
+	Pinned        bool       `json:"pinned"`
+}
+
 // 正在下载的视频文件信息
 type DownloadingVideoFile struct {
 	Hash        string  `json:"hash"`
@@ -499,6 +998,11 @@ type DownloadingVideoFile struct {
 	Progress    float64 `json:"progress"`
 	Playable    bool    `json:"playable"`
 	Status      string  `json:"status"`
+	// 媒体信息，头部尚未下载时为空
+	Media *MediaInfo `json:"media,omitempty"`
+	// 观看记录ID和播放进度，没有记录时为空
+	FileID string         `json:"file_id"`
+	Watch  *PlaybackState `json:"watch,omitempty"`
 }
 
 func (sts *SimpleTorrentService) Close() {
@@ -510,4 +1014,12 @@ func (sts *SimpleTorrentService) Close() {
 	}
 
 	sts.client.Close()
+
+	for _, s := range sts.storages {
+		s.Close()
+	}
+
+	if sts.backend != nil {
+		sts.backend.Close()
+	}
 }
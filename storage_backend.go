@@ -0,0 +1,287 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/anacrolix/missinggo/v2/filecache"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// 存储类型
+const (
+	StorageFile      = "file"
+	StorageMMap      = "mmap"
+	StorageSqlite    = "sqlite"
+	StorageStreaming = "streaming"
+)
+
+// 根据配置创建存储，返回nil表示使用客户端默认的文件存储
+func newStorageBackend(cfg StorageConfig, downloadDir string) (storage.ClientImplCloser, error) {
+	capacity := cfg.CacheSizeMB * 1024 * 1024
+
+	switch cfg.Type {
+	case "", StorageFile:
+		return nil, nil
+	case StorageMMap:
+		return storage.NewMMap(downloadDir), nil
+	case StorageSqlite:
+		return newSqliteStorage(downloadDir, capacity)
+	case StorageStreaming:
+		if capacity <= 0 {
+			return nil, fmt.Errorf("streaming存储需要设置cache_size_mb")
+		}
+		if cfg.CacheLocation == "memory" {
+			ms := newMemoryPieceStorage(capacity)
+			return newBoundedStorage(ms, capacity, ms.Close), nil
+		}
+		return newDiskCacheStorage(filepath.Join(downloadDir, ".stream-cache"), capacity)
+	default:
+		return nil, fmt.Errorf("未知的存储类型: %s", cfg.Type)
+	}
+}
+
+// 磁盘上的有界LRU缓存，超过容量时淘汰最久未访问的piece
+func newDiskCacheStorage(dir string, capacity int64) (storage.ClientImplCloser, error) {
+	cache, err := filecache.NewCache(dir)
+	if err != nil {
+		return nil, fmt.Errorf("创建磁盘缓存失败: %v", err)
+	}
+	cache.SetCapacity(capacity)
+	log.Printf("流媒体磁盘缓存: %s, 容量: %d bytes", dir, capacity)
+
+	pieces := storage.NewResourcePieces(cache.AsResourceProvider())
+	return newBoundedStorage(pieces, capacity, func() error { return nil }), nil
+}
+
+// 有容量上限的存储，客户端只会请求按优先级排序后容量范围内的piece，
+// 避免缓存中的piece在被读取前就被淘汰
+type boundedStorage struct {
+	storage.ClientImpl
+	capacity func() (int64, bool)
+	close    func() error
+}
+
+func newBoundedStorage(impl storage.ClientImpl, capacity int64, close func() error) *boundedStorage {
+	return &boundedStorage{
+		ClientImpl: impl,
+		capacity:   func() (int64, bool) { return capacity, true },
+		close:      close,
+	}
+}
+
+func (bs *boundedStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := bs.ClientImpl.OpenTorrent(info, infoHash)
+	if err != nil {
+		return t, err
+	}
+	// 所有torrent共享同一个容量
+	t.Capacity = &bs.capacity
+	return t, nil
+}
+
+func (bs *boundedStorage) Close() error {
+	return bs.close()
+}
+
+// 内存中的有界LRU piece缓存
+// 被淘汰的piece读取失败后会被客户端标记为未完成并重新下载
+type memoryPieceStorage struct {
+	mutex    sync.Mutex
+	capacity int64
+	used     int64
+	lru      *list.List
+	pieces   map[memoryPieceKey]*list.Element
+}
+
+type memoryPieceKey struct {
+	infoHash metainfo.Hash
+	index    int
+}
+
+type memoryPieceData struct {
+	key      memoryPieceKey
+	data     []byte
+	complete bool
+}
+
+func newMemoryPieceStorage(capacity int64) *memoryPieceStorage {
+	log.Printf("流媒体内存缓存, 容量: %d bytes", capacity)
+	return &memoryPieceStorage{
+		capacity: capacity,
+		lru:      list.New(),
+		pieces:   make(map[memoryPieceKey]*list.Element),
+	}
+}
+
+func (ms *memoryPieceStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	return storage.TorrentImpl{
+		Piece: func(p metainfo.Piece) storage.PieceImpl {
+			return &memoryPiece{
+				storage: ms,
+				key:     memoryPieceKey{infoHash: infoHash, index: p.Index()},
+				length:  p.Length(),
+			}
+		},
+		Close: func() error {
+			ms.dropTorrent(infoHash)
+			return nil
+		},
+	}, nil
+}
+
+func (ms *memoryPieceStorage) Close() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.lru.Init()
+	ms.pieces = make(map[memoryPieceKey]*list.Element)
+	ms.used = 0
+	return nil
+}
+
+func (ms *memoryPieceStorage) dropTorrent(infoHash metainfo.Hash) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for key, elem := range ms.pieces {
+		if key.infoHash == infoHash {
+			ms.remove(elem)
+		}
+	}
+}
+
+// 获取piece数据并标记为最近使用，调用方需持有锁
+func (ms *memoryPieceStorage) get(key memoryPieceKey) *memoryPieceData {
+	elem, exists := ms.pieces[key]
+	if !exists {
+		return nil
+	}
+	ms.lru.MoveToFront(elem)
+	return elem.Value.(*memoryPieceData)
+}
+
+// 分配piece空间，超出容量时淘汰最久未使用的已完成piece，调用方需持有锁
+// 未完成的piece正在写入，淘汰会丢失已写入的数据，此时暂时超出容量，
+// 客户端按容量限制请求piece，超出的部分有限
+func (ms *memoryPieceStorage) allocate(key memoryPieceKey, length int64) *memoryPieceData {
+	piece := &memoryPieceData{key: key, data: make([]byte, length)}
+	ms.pieces[key] = ms.lru.PushFront(piece)
+	ms.used += length
+
+	for elem := ms.lru.Back(); elem != nil && ms.used > ms.capacity; {
+		prev := elem.Prev()
+		if elem.Value.(*memoryPieceData).complete {
+			ms.remove(elem)
+		}
+		elem = prev
+	}
+	return piece
+}
+
+func (ms *memoryPieceStorage) remove(elem *list.Element) {
+	piece := elem.Value.(*memoryPieceData)
+	ms.lru.Remove(elem)
+	delete(ms.pieces, piece.key)
+	ms.used -= int64(len(piece.data))
+}
+
+type memoryPiece struct {
+	storage *memoryPieceStorage
+	key     memoryPieceKey
+	length  int64
+}
+
+func (p *memoryPiece) ReadAt(b []byte, off int64) (int, error) {
+	p.storage.mutex.Lock()
+	defer p.storage.mutex.Unlock()
+
+	piece := p.storage.get(p.key)
+	if piece == nil {
+		return 0, fmt.Errorf("piece %d 已从缓存中淘汰", p.key.index)
+	}
+	if off >= int64(len(piece.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, piece.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (p *memoryPiece) WriteAt(b []byte, off int64) (int, error) {
+	p.storage.mutex.Lock()
+	defer p.storage.mutex.Unlock()
+
+	piece := p.storage.get(p.key)
+	if piece == nil {
+		piece = p.storage.allocate(p.key, p.length)
+	}
+	if off+int64(len(b)) > int64(len(piece.data)) {
+		return 0, fmt.Errorf("写入超出piece范围")
+	}
+	return copy(piece.data[off:], b), nil
+}
+
+func (p *memoryPiece) MarkComplete() error {
+	p.storage.mutex.Lock()
+	defer p.storage.mutex.Unlock()
+
+	piece := p.storage.get(p.key)
+	if piece == nil {
+		return fmt.Errorf("piece %d 已从缓存中淘汰", p.key.index)
+	}
+	piece.complete = true
+	return nil
+}
+
+func (p *memoryPiece) MarkNotComplete() error {
+	p.storage.mutex.Lock()
+	defer p.storage.mutex.Unlock()
+
+	if piece := p.storage.get(p.key); piece != nil {
+		piece.complete = false
+	}
+	return nil
+}
+
+func (p *memoryPiece) Completion() storage.Completion {
+	p.storage.mutex.Lock()
+	defer p.storage.mutex.Unlock()
+
+	elem, exists := p.storage.pieces[p.key]
+	return storage.Completion{
+		Complete: exists && elem.Value.(*memoryPieceData).complete,
+		Ok:       true,
+	}
+}
+
+// 是否为仅流媒体模式：只下载被播放读取的piece
+func (sts *SimpleTorrentService) streamingOnly() bool {
+	return sts.config.Storage.Type == StorageStreaming
+}
+
+// 流播放的最大预读，有界缓存模式下限制为缓存的1/4，避免预读的piece在播放前被淘汰
+func (sts *SimpleTorrentService) streamReadaheadLimit() int64 {
+	if sts.streamingOnly() {
+		return sts.config.Storage.CacheSizeMB * 1024 * 1024 / 4
+	}
+	return maxReadahead
+}
+
+// 是否使用文件存储，只有文件存储支持按任务指定保存路径
+func (sts *SimpleTorrentService) fileStorage() bool {
+	return sts.config.Storage.Type == "" || sts.config.Storage.Type == StorageFile
+}
+
+// 数据是否以原始文件形式保存在磁盘上，解压和自动清理需要读取或删除这些文件
+func (sts *SimpleTorrentService) dataOnDisk() bool {
+	return sts.fileStorage() || sts.config.Storage.Type == StorageMMap
+}
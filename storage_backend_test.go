@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestMemoryPieceStorageKeepsIncompletePieces(t *testing.T) {
+	const length = 4
+	ms := newMemoryPieceStorage(2 * length)
+	piece := func(index int) *memoryPiece {
+		return &memoryPiece{storage: ms, key: memoryPieceKey{index: index}, length: length}
+	}
+	write := func(index int) {
+		if _, err := piece(index).WriteAt([]byte{byte(index)}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(index int) bool {
+		_, err := piece(index).ReadAt(make([]byte, 1), 0)
+		return err == nil
+	}
+
+	// 超出容量但所有piece都在写入中，不淘汰
+	write(0)
+	write(1)
+	write(2)
+	if !cached(0) || !cached(1) || !cached(2) {
+		t.Fatal("正在写入的piece不应被淘汰")
+	}
+
+	// 只淘汰已完成的piece
+	if err := piece(1).MarkComplete(); err != nil {
+		t.Fatal(err)
+	}
+	write(3)
+	if cached(1) {
+		t.Fatal("已完成的piece应被淘汰")
+	}
+	if !cached(0) || !cached(2) || !cached(3) {
+		t.Fatal("未完成的piece应保留")
+	}
+}
+
+func TestNonFileStorageData(t *testing.T) {
+	ts := newTestTorrentService(t)
+	ts.config.Storage = StorageConfig{Type: StorageStreaming, CacheSizeMB: 64}
+
+	// 流媒体缓存目录不出现在文件列表中
+	cacheDir := filepath.Join(ts.downloadDir, ".stream-cache")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cacheDir, "piece"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ts.GetDownloadedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("不应列出缓存文件: %+v", files)
+	}
+
+	// 忽略保存路径
+	mi, err := metainfo.LoadFromFile(writeWatchTorrent(t, t.TempDir(), "a.torrent", testTorrentFile(t, "a.bin")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.mutex.Lock()
+	_, savePath, err := ts.addTorrentSpec(spec, AddOptions{SavePath: t.TempDir()})
+	ts.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if savePath != ts.downloadDir {
+		t.Fatalf("保存路径 %q", savePath)
+	}
+
+	// 自动清理不删除下载目录中的同名文件
+	hash, _ := addTestTorrentStatus(t, ts, "b.bin", "")
+	ts.mutex.RLock()
+	paths := ts.taskDataPathsLocked(hash, ts.torrents[hash])
+	ts.mutex.RUnlock()
+	if len(paths) != 0 {
+		t.Fatalf("不应返回数据路径: %v", paths)
+	}
+}
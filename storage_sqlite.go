@@ -0,0 +1,18 @@
+//go:build cgo
+
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/storage"
+	sqliteStorage "github.com/anacrolix/torrent/storage/sqlite"
+)
+
+// sqlite piece存储，所有piece保存在一个数据库文件中
+func newSqliteStorage(downloadDir string, capacity int64) (storage.ClientImplCloser, error) {
+	opts := sqliteStorage.NewDirectStorageOpts{}
+	opts.Path = filepath.Join(downloadDir, ".torrent-pieces.db")
+	opts.Capacity = capacity
+	return sqliteStorage.NewDirectStorage(opts)
+}
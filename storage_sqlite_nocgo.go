@@ -0,0 +1,14 @@
+//go:build !cgo
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/torrent/storage"
+)
+
+// sqlite存储依赖cgo
+func newSqliteStorage(downloadDir string, capacity int64) (storage.ClientImplCloser, error) {
+	return nil, fmt.Errorf("sqlite存储需要启用cgo编译")
+}
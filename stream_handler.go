@@ -1,166 +1,100 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 
-	"github.com/gin-gonic/gin"
 	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
 )
 
-// 处理Range请求 - 支持边下载边播放
-func handleRangeRequest(c *gin.Context, file *os.File, fileSize int64, rangeHeader string) {
-	// 解析Range头部 (例如: "bytes=0-1023" 或 "bytes=1024-")
-	ranges := strings.Split(strings.TrimPrefix(rangeHeader, "bytes="), "-")
-	if len(ranges) != 2 {
-		c.Status(http.StatusRequestedRangeNotSatisfiable)
-		return
-	}
-
-	var start, end int64
-	var err error
-
-	// 解析起始位置
-	if ranges[0] != "" {
-		start, err = strconv.ParseInt(ranges[0], 10, 64)
-		if err != nil || start < 0 {
-			c.Status(http.StatusRequestedRangeNotSatisfiable)
-			return
-		}
-	}
-
-	// 解析结束位置
-	if ranges[1] != "" {
-		end, err = strconv.ParseInt(ranges[1], 10, 64)
-		if err != nil || end >= fileSize {
-			end = fileSize - 1
-		}
-	} else {
-		end = fileSize - 1
-	}
-
-	// 验证范围
-	if start > end || start >= fileSize {
-		c.Status(http.StatusRequestedRangeNotSatisfiable)
-		return
-	}
-
-	// 计算内容长度
-	contentLength := end - start + 1
+// 提供本地文件 - 支持Range、条件请求和HEAD
+func serveLocalFile(c *gin.Context, file *os.File, fileInfo os.FileInfo, contentType string) {
+	serveContent(c, file, rangeContent{
+		ContentType: contentType,
+		Size:        fileInfo.Size(),
+		ModTime:     fileInfo.ModTime(),
+		ETag:        fmt.Sprintf(`"%x-%x"`, fileInfo.ModTime().UnixNano(), fileInfo.Size()),
+	})
+}
 
-	// 设置206 Partial Content响应头
-	c.Status(http.StatusPartialContent)
-	c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-	c.Header("Content-Length", fmt.Sprintf("%d", contentLength))
+// 提供Torrent文件 - 支持边下载边播放，客户端断开时停止等待数据
+func serveTorrentFile(c *gin.Context, torrentFile *torrent.File, contentType string, readaheadLimit int64) {
+	reader := newTorrentFileReader(c.Request.Context(), torrentFile, readaheadLimit)
+	defer reader.Close()
 
-	// 定位到起始位置
-	file.Seek(start, 0)
+	serveTorrentContent(c, torrentFile, reader, contentType)
+}
 
-	// 流式传输指定范围的数据
-	streamRange(c, file, contentLength)
+func serveTorrentContent(c *gin.Context, torrentFile *torrent.File, reader io.ReadSeeker, contentType string) {
+	serveContent(c, reader, rangeContent{
+		ContentType: contentType,
+		Size:        torrentFile.Length(),
+		ETag:        torrentFileETag(torrentFile),
+	})
 }
 
-// 处理Torrent文件的Range请求 - 支持边下载边播放
-func handleTorrentRangeRequest(c *gin.Context, torrentFile *torrent.File, rangeHeader string) {
-	fileSize := torrentFile.Length()
-	
-	// 解析Range头部
-	ranges := strings.Split(strings.TrimPrefix(rangeHeader, "bytes="), "-")
-	if len(ranges) != 2 {
-		c.Status(http.StatusRequestedRangeNotSatisfiable)
-		return
-	}
+// torrent内容由info-hash确定，文件在种子中的偏移量可唯一标识文件
+func torrentFileETag(torrentFile *torrent.File) string {
+	return fmt.Sprintf(`"%s-%x-%x"`, torrentFile.Torrent().InfoHash().HexString(), torrentFile.Offset(), torrentFile.Length())
+}
 
-	var start, end int64
-	var err error
+// 内容检测读取的字节数，与http.DetectContentType一致
+const sniffLength = 512
 
-	// 解析起始位置
-	if ranges[0] != "" {
-		start, err = strconv.ParseInt(ranges[0], 10, 64)
-		if err != nil || start < 0 {
-			c.Status(http.StatusRequestedRangeNotSatisfiable)
-			return
-		}
+// 按文件内容检测MIME类型，无法识别时使用扩展名
+func detectContentType(name string, head []byte) string {
+	byExt := getContentType(name)
+	if len(head) == 0 {
+		return byExt
 	}
-
-	// 解析结束位置
-	if ranges[1] != "" {
-		end, err = strconv.ParseInt(ranges[1], 10, 64)
-		if err != nil || end >= fileSize {
-			end = fileSize - 1
-		}
-	} else {
-		end = fileSize - 1
+	sniffed := http.DetectContentType(head)
+	if sniffed == "application/octet-stream" {
+		return byExt
 	}
-
-	// 验证范围
-	if start > end || start >= fileSize {
-		c.Status(http.StatusRequestedRangeNotSatisfiable)
-		return
+	// 同类媒体（如MKV被识别为webm、M4A被识别为video/mp4）时扩展名更准确；
+	// 字幕等文本文件保持text/plain以便在浏览器中直接查看
+	sniffedType, _, _ := strings.Cut(sniffed, "/")
+	extType, _, _ := strings.Cut(byExt, "/")
+	if sniffedType == extType || (sniffedType == "video" && extType == "audio") {
+		return byExt
 	}
-
-	// 计算内容长度
-	contentLength := end - start + 1
-
-	// 设置206 Partial Content响应头
-	c.Status(http.StatusPartialContent)
-	c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-	c.Header("Content-Length", fmt.Sprintf("%d", contentLength))
-
-	// 流式传输Torrent文件的指定范围
-	streamTorrentRange(c, torrentFile, start, contentLength)
+	return sniffed
 }
 
-// 流式传输文件范围
-func streamRange(c *gin.Context, file *os.File, contentLength int64) {
-	buffer := make([]byte, 32768) // 32KB缓冲区，适合视频流
-	remaining := contentLength
-
-	for remaining > 0 {
-		toRead := int64(len(buffer))
-		if remaining < toRead {
-			toRead = remaining
-		}
-
-		n, err := file.Read(buffer[:toRead])
-		if err != nil && err != io.EOF {
-			break
-		}
-		if n == 0 {
-			break
-		}
-
-		// 写入响应并立即刷新
-		if _, writeErr := c.Writer.Write(buffer[:n]); writeErr != nil {
-			break
-		}
-		c.Writer.Flush()
-		
-		remaining -= int64(n)
-	}
+func localContentType(file *os.File, name string) string {
+	head := make([]byte, sniffLength)
+	n, _ := file.ReadAt(head, 0)
+	return detectContentType(name, head[:n])
 }
 
-// 流式传输整个文件
-func streamFile(c *gin.Context, file *os.File, fileSize int64) {
-	buffer := make([]byte, 32768) // 32KB缓冲区
+// 文件开头尚未下载时不等待数据，直接按扩展名判断
+func torrentContentType(ctx context.Context, torrentFile *torrent.File) string {
+	n := torrentFile.Length()
+	if n > sniffLength {
+		n = sniffLength
+	}
+	if n == 0 || !isTorrentPositionPlayable(torrentFile, 0, n) {
+		return getContentType(torrentFile.Path())
+	}
 
-	for {
-		n, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			break
-		}
-		if n == 0 {
-			break
-		}
+	reader := newTorrentFileReader(ctx, torrentFile, 0)
+	defer reader.Close()
+	head := make([]byte, n)
+	read, _ := io.ReadFull(reader, head)
+	return detectContentType(torrentFile.Path(), head[:read])
+}
 
-		// 写入响应并立即刷新
-		if _, writeErr := c.Writer.Write(buffer[:n]); writeErr != nil {
-			break
-		}
-		c.Writer.Flush()
+// 种子中的HTML、SVG等内容可能带有脚本，在沙箱中打开，避免在本服务的源下执行
+func isActiveContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.TrimSpace(mediaType) {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml", "text/javascript", "application/javascript":
+		return true
 	}
-}
\ No newline at end of file
+	return false
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/types"
+	"github.com/gin-gonic/gin"
+)
+
+// 播放位置之后各时间段的优先级：最近的数据立即需要，其后依次降低
+const (
+	streamNowSeconds  = 5
+	streamNextSeconds = 15
+)
+
+// 无法解析码率时按8Mbit/s估算
+const defaultStreamBitrate = 8 * 1000 * 1000
+
+// 按最近该时长内的读取速度估计实际播放速度（倍速播放时高于码率）
+const streamRateWindow = 10 * time.Second
+
+// 估计的播放速度最高为码率的倍数，覆盖常见的倍速播放
+const streamMaxRateFactor = 4
+
+// 同一文件可能同时有多个播放请求和快速启动，每个piece取各声明中的最高优先级
+type streamPieceKey struct {
+	t     *torrent.Torrent
+	index int
+}
+
+// 声明方为播放请求的*streamScheduler或快速启动的*mediaIndexClaim
+type streamPriorityBoard struct {
+	claims map[streamPieceKey]map[interface{}]types.PiecePriority
+	mutex  sync.Mutex
+}
+
+func newStreamPriorityBoard() *streamPriorityBoard {
+	return &streamPriorityBoard{claims: make(map[streamPieceKey]map[interface{}]types.PiecePriority)}
+}
+
+// 更新某个声明方的优先级声明，priority为None时撤销
+func (b *streamPriorityBoard) set(owner interface{}, key streamPieceKey, priority types.PiecePriority) {
+	piece := key.t.Piece(key.index)
+
+	b.mutex.Lock()
+	claims := b.claims[key]
+	if priority == types.PiecePriorityNone {
+		delete(claims, owner)
+	} else {
+		if claims == nil {
+			claims = make(map[interface{}]types.PiecePriority)
+			b.claims[key] = claims
+		}
+		claims[owner] = priority
+	}
+
+	var effective types.PiecePriority
+	for _, claimed := range claims {
+		effective.Raise(claimed)
+	}
+	// 已完成的piece不再需要声明
+	complete := piece.State().Complete
+	if len(claims) == 0 || complete {
+		delete(b.claims, key)
+	}
+	b.mutex.Unlock()
+
+	// 没有声明时恢复为torrent的默认优先级，正常下载继续
+	if !complete {
+		piece.SetPriority(effective)
+	}
+}
+
+// 任务移除时清理该torrent的所有声明
+func (b *streamPriorityBoard) forget(t *torrent.Torrent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for key := range b.claims {
+		if key.t == t {
+			delete(b.claims, key)
+		}
+	}
+}
+
+// 单个播放请求的piece调度：按码率估算播放位置之后N秒的数据量，
+// 分段设置Now/Next/Readahead优先级，播放位置之前的piece撤销优先级
+type streamScheduler struct {
+	sts      *SimpleTorrentService
+	file     *torrent.File
+	bitrate  int64
+	seconds  int64
+	maxBytes int64
+	claimed  map[int]types.PiecePriority
+	// 多个播放请求同时进行且本请求缓冲领先时只保留Now/Next窗口
+	limited atomic.Bool
+
+	// 跳转目标关键帧的偏移，-1为没有
+	prefetchAt int64
+
+	// 上次调度时的位置，以及用于估计播放速度的读取记录
+	scheduledAt int64
+	rateStart   time.Time
+	rateBytes   int64
+	mutex       sync.Mutex
+}
+
+func (sts *SimpleTorrentService) newStreamScheduler(file *torrent.File) *streamScheduler {
+	// 码率（字节/秒）由文件大小和时长估算
+	bitrate := int64(defaultStreamBitrate / 8)
+	if media, err := sts.ProbeTorrentFile(file); err == nil && media.Bitrate > 0 {
+		bitrate = media.Bitrate / 8
+	}
+
+	var maxBytes int64
+	if sts.streamingOnly() {
+		maxBytes = sts.streamReadaheadLimit()
+	}
+
+	return &streamScheduler{
+		sts:         sts,
+		file:        file,
+		bitrate:     bitrate,
+		seconds:     int64(sts.config.Stream.ReadaheadSeconds),
+		maxBytes:    maxBytes,
+		claimed:     make(map[int]types.PiecePriority),
+		prefetchAt:  -1,
+		scheduledAt: -1,
+		rateStart:   time.Now(),
+	}
+}
+
+// 估计的消耗速度：码率和最近读取速度中的较大值，最多为码率的streamMaxRateFactor倍，
+// 播放器填充缓冲时的突发读取不会让预读窗口无限扩大
+func (s *streamScheduler) rate() int64 {
+	observed := s.observedRate()
+	if limit := s.bitrate * streamMaxRateFactor; observed > limit {
+		observed = limit
+	}
+	if observed > s.bitrate {
+		return observed
+	}
+	return s.bitrate
+}
+
+// 最近的读取速度（字节/秒）
+func (s *streamScheduler) observedRate() int64 {
+	if elapsed := time.Since(s.rateStart); elapsed >= time.Second {
+		return int64(float64(s.rateBytes) / elapsed.Seconds())
+	}
+	return 0
+}
+
+func (s *streamScheduler) throughput() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.observedRate()
+}
+
+// 读取时调用，移动超过一个piece或seek后重新调度
+func (s *streamScheduler) advance(pos int64, read int64, seeked bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if seeked {
+		s.rateStart = time.Now()
+		s.rateBytes = 0
+	} else {
+		s.rateBytes += read
+		if time.Since(s.rateStart) > streamRateWindow {
+			// 保留一半的记录，平滑速度变化
+			s.rateStart = time.Now().Add(-streamRateWindow / 2)
+			s.rateBytes /= 2
+		}
+	}
+
+	pieceLength := s.file.Torrent().Info().PieceLength
+	if !seeked && s.scheduledAt >= 0 && pos-s.scheduledAt < pieceLength {
+		return
+	}
+	s.schedule(pos)
+}
+
+type streamWindow struct {
+	bytes    int64
+	priority types.PiecePriority
+}
+
+func (s *streamScheduler) schedule(pos int64) {
+	s.scheduledAt = pos
+	rate := s.rate()
+	windows := []streamWindow{
+		{streamNowSeconds * rate, types.PiecePriorityNow},
+		{streamNextSeconds * rate, types.PiecePriorityNext},
+		{s.seconds * rate, types.PiecePriorityReadahead},
+	}
+	if s.limited.Load() {
+		windows = windows[:2]
+	}
+
+	desired := make(map[int]types.PiecePriority)
+	s.desireWindows(desired, pos, windows)
+	// 跳转目标的关键帧在播放器请求之前先下载，播放位置到达后按正常窗口调度
+	if s.prefetchAt > pos {
+		s.desireWindows(desired, s.prefetchAt, windows[:2])
+	} else {
+		s.prefetchAt = -1
+	}
+
+	t := s.file.Torrent()
+	board := s.sts.streamPriorities
+	for index := range s.claimed {
+		if _, exists := desired[index]; !exists {
+			board.set(s, streamPieceKey{t, index}, types.PiecePriorityNone)
+			delete(s.claimed, index)
+		}
+	}
+	for index, priority := range desired {
+		if s.claimed[index] == priority {
+			continue
+		}
+		if t.Piece(index).State().Complete {
+			continue
+		}
+		board.set(s, streamPieceKey{t, index}, priority)
+		s.claimed[index] = priority
+	}
+}
+
+// 将从pos开始的各窗口内的piece加入desired，已加入的piece保留更高的优先级
+func (s *streamScheduler) desireWindows(desired map[int]types.PiecePriority, pos int64, windows []streamWindow) {
+	t := s.file.Torrent()
+	pieceLength := t.Info().PieceLength
+	start := s.file.Offset() + pos
+	for _, window := range windows {
+		length := window.bytes
+		if s.maxBytes > 0 && length > s.maxBytes {
+			length = s.maxBytes
+		}
+		if remaining := s.file.Length() - pos; length > remaining {
+			length = remaining
+		}
+		if length <= 0 {
+			continue
+		}
+		for index := int(start / pieceLength); index <= int((start+length-1)/pieceLength) && index < t.NumPieces(); index++ {
+			if _, exists := desired[index]; !exists {
+				desired[index] = window.priority
+			}
+		}
+	}
+}
+
+// 播放请求指定了跳转时间时，预先下载目标关键帧之后的数据
+func (s *streamScheduler) prefetch(offset int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prefetchAt = offset
+}
+
+// 限制或恢复预读窗口，立即按当前位置重新调度
+func (s *streamScheduler) setLimited(limited bool) {
+	if s.limited.Swap(limited) == limited {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.scheduledAt >= 0 && s.claimed != nil {
+		s.schedule(s.scheduledAt)
+	}
+}
+
+// 播放位置之后连续已下载的数据可播放的秒数，最多统计到预读窗口
+func (s *streamScheduler) bufferedSeconds() float64 {
+	s.mutex.Lock()
+	pos := s.scheduledAt
+	rate := s.rate()
+	s.mutex.Unlock()
+	if pos < 0 || rate <= 0 {
+		return 0
+	}
+
+	t := s.file.Torrent()
+	pieceLength := t.Info().PieceLength
+	start := s.file.Offset() + pos
+	end := s.file.Offset() + s.file.Length()
+	if limit := start + int64(s.seconds)*rate; limit < end {
+		end = limit
+	}
+	buffered := start
+	for index := int(start / pieceLength); buffered < end && index < t.NumPieces(); index++ {
+		if !t.Piece(index).State().Complete {
+			break
+		}
+		buffered = int64(index+1) * pieceLength
+	}
+	if buffered > end {
+		buffered = end
+	}
+	return float64(buffered-start) / float64(rate)
+}
+
+// 请求结束时撤销所有优先级
+func (s *streamScheduler) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t := s.file.Torrent()
+	for index := range s.claimed {
+		s.sts.streamPriorities.set(s, streamPieceKey{t, index}, types.PiecePriorityNone)
+	}
+	s.claimed = nil
+}
+
+// 读取时通知播放会话当前位置
+type scheduledReader struct {
+	*torrentFileReader
+	session *streamSession
+}
+
+func (r scheduledReader) Read(b []byte) (int, error) {
+	// 读取位置的数据尚未下载时，等待时间计入卡顿
+	waiting := !isTorrentPositionPlayable(r.session.file, r.pos, 1)
+	r.session.beginRead(waiting)
+	start := time.Now()
+	n, err := r.torrentFileReader.Read(b)
+	r.session.read(r.pos, int64(n), waiting, time.Since(start))
+	return n, err
+}
+
+func (r scheduledReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.torrentFileReader.Seek(offset, whence)
+	if err == nil {
+		r.session.seek(pos)
+	}
+	return pos, err
+}
+
+// 提供torrent中的媒体文件，piece优先级随播放位置调整，请求期间登记为播放会话；
+// prefetchOffset不小于0时预先下载该位置的数据
+func serveScheduledTorrentFile(c *gin.Context, ts *SimpleTorrentService, torrentFile *torrent.File, contentType string, prefetchOffset int64) {
+	if c.Request.Method == http.MethodHead {
+		serveTorrentFile(c, torrentFile, contentType, ts.streamReadaheadLimit())
+		return
+	}
+
+	session, err := ts.streamSessions.open(c.ClientIP(), torrentFile)
+	if err != nil {
+		c.Header("Retry-After", "10")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer ts.streamSessions.close(session)
+	if prefetchOffset >= 0 {
+		session.scheduler.prefetch(prefetchOffset)
+	}
+
+	reader := newTorrentFileReader(c.Request.Context(), torrentFile, ts.streamReadaheadLimit())
+	defer reader.Close()
+	// 预读窗口受限时torrent读取器也只保留最小预读
+	readahead := adaptiveReadahead(ts.streamReadaheadLimit())
+	floor := readaheadFloor(ts.streamReadaheadLimit())
+	reader.reader.SetReadaheadFunc(func(rc torrent.ReadaheadContext) int64 {
+		if session.scheduler.limited.Load() {
+			return floor
+		}
+		return readahead(rc)
+	})
+
+	serveTorrentContent(c, torrentFile, scheduledReader{reader, session}, contentType)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/types"
+)
+
+func TestStreamSchedulerRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		readBytes int64
+		want      int64
+	}{
+		{"未读取按码率", 0, 1000},
+		{"倍速播放按读取速度", 6000, 3000},
+		{"突发读取不超过上限", 1 << 30, 1000 * streamMaxRateFactor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &streamScheduler{bitrate: 1000, rateStart: time.Now().Add(-2 * time.Second), rateBytes: tt.readBytes}
+			// 经过的时间略大于2秒，读取速度略低于估算值
+			if got := s.rate(); got > tt.want || got < tt.want*99/100 {
+				t.Fatalf("rate() = %d, 期望 %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamPriorityBoardKeepsMediaIndexClaim(t *testing.T) {
+	ts := newTestTorrentService(t)
+	_, tor := addTestTorrentStatus(t, ts, "movie.mp4", "")
+	board := ts.streamPriorities
+	key := streamPieceKey{tor, 0}
+	priority := func() types.PiecePriority {
+		return tor.Piece(0).State().Priority
+	}
+	// 等待添加后的校验结束，校验期间piece优先级为None
+	for deadline := time.Now().Add(5 * time.Second); tor.Piece(0).State().Checking; {
+		if time.Now().After(deadline) {
+			t.Fatal("等待校验超时")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 快速启动声明的优先级在播放请求撤销后保持
+	claim := newMediaIndexClaim(tor.Files()[0])
+	ts.prioritizeFileRange(claim, 0, 1)
+	s := &streamScheduler{}
+	board.set(s, key, types.PiecePriorityReadahead)
+	board.set(s, key, types.PiecePriorityNone)
+	if priority() != types.PiecePriorityNow {
+		t.Fatalf("优先级 %v, 期望Now", priority())
+	}
+
+	// 快速启动结束后撤销自己的声明，播放请求的声明仍然有效
+	board.set(s, key, types.PiecePriorityNext)
+	ts.releaseMediaIndexClaim(claim)
+	if priority() != types.PiecePriorityNext {
+		t.Fatalf("撤销快速启动声明后优先级 %v, 期望Next", priority())
+	}
+	board.set(s, key, types.PiecePriorityNone)
+	if priority() != types.PiecePriorityNone {
+		t.Fatalf("撤销所有声明后优先级 %v", priority())
+	}
+
+	// 移除任务时清理声明
+	board.set(s, key, types.PiecePriorityNext)
+	board.forget(tor)
+	if len(board.claims) != 0 {
+		t.Fatalf("声明未清理: %v", board.claims)
+	}
+}
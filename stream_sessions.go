@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
+)
+
+// 单次读取等待超过该时间计为一次卡顿
+const streamStallThreshold = 500 * time.Millisecond
+
+// 多个播放会话之间重新分配预读的间隔
+const streamBalanceInterval = time.Second
+
+// 正在进行的torrent流播放请求
+type streamSession struct {
+	id        string
+	clientIP  string
+	file      *torrent.File
+	startedAt time.Time
+	scheduler *streamScheduler
+
+	position   int64
+	bytesSent  int64
+	stalls     int
+	stallTime  time.Duration
+	lastReadAt time.Time
+	// 正在等待尚未下载的数据
+	waitingSince time.Time
+	mutex        sync.Mutex
+}
+
+// /streams 返回的会话信息
+type StreamSessionInfo struct {
+	ID       string `json:"id"`
+	ClientIP string `json:"client_ip"`
+	Hash     string `json:"hash"`
+	Torrent  string `json:"torrent"`
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	// 当前读取位置（字节），能解析出时长时换算为秒
+	Position        int64   `json:"position"`
+	PositionSeconds float64 `json:"position_seconds,omitempty"`
+	BytesSent       int64   `json:"bytes_sent"`
+	// 最近的发送速度（字节/秒）
+	Throughput int64 `json:"throughput"`
+	// 播放位置之后已下载的数据可播放的秒数
+	BufferedSeconds float64 `json:"buffered_seconds"`
+	Stalls          int     `json:"stalls"`
+	StallSeconds    float64 `json:"stall_seconds"`
+	// 当前正在等待数据
+	Stalled bool `json:"stalled"`
+	// 缓冲领先于其他会话，暂停预读
+	Limited    bool      `json:"limited"`
+	StartedAt  time.Time `json:"started_at"`
+	LastReadAt time.Time `json:"last_read_at"`
+}
+
+// 读取位置的数据尚未下载时记录开始等待的时间
+func (s *streamSession) beginRead(waiting bool) {
+	if waiting {
+		s.mutex.Lock()
+		s.waitingSince = time.Now()
+		s.mutex.Unlock()
+	}
+}
+
+func (s *streamSession) read(pos int64, n int64, waiting bool, elapsed time.Duration) {
+	s.mutex.Lock()
+	s.waitingSince = time.Time{}
+	s.position = pos
+	s.bytesSent += n
+	s.lastReadAt = time.Now()
+	if waiting && elapsed >= streamStallThreshold {
+		s.stalls++
+		s.stallTime += elapsed
+	}
+	s.mutex.Unlock()
+
+	s.scheduler.advance(pos, n, false)
+}
+
+func (s *streamSession) seek(pos int64) {
+	s.mutex.Lock()
+	s.position = pos
+	s.mutex.Unlock()
+
+	s.scheduler.advance(pos, 0, true)
+}
+
+func (s *streamSession) info(media *MediaInfo) StreamSessionInfo {
+	t := s.file.Torrent()
+	s.mutex.Lock()
+	info := StreamSessionInfo{
+		ID:           s.id,
+		ClientIP:     s.clientIP,
+		Hash:         t.InfoHash().HexString(),
+		Torrent:      t.Name(),
+		File:         s.file.Path(),
+		Size:         s.file.Length(),
+		Position:     s.position,
+		BytesSent:    s.bytesSent,
+		Stalls:       s.stalls,
+		StallSeconds: s.stallTime.Seconds(),
+		StartedAt:    s.startedAt,
+		LastReadAt:   s.lastReadAt,
+	}
+	if !s.waitingSince.IsZero() {
+		if waited := time.Since(s.waitingSince); waited >= streamStallThreshold {
+			info.Stalled = true
+			info.StallSeconds += waited.Seconds()
+		}
+	}
+	s.mutex.Unlock()
+
+	info.Throughput = s.scheduler.throughput()
+	info.BufferedSeconds = s.scheduler.bufferedSeconds()
+	info.Limited = s.scheduler.limited.Load()
+	if media != nil && media.Duration > 0 && info.Size > 0 {
+		info.PositionSeconds = float64(info.Position) / float64(info.Size) * media.Duration
+	}
+	return info
+}
+
+// 播放会话登记，限制同时播放的数量并在会话之间分配预读
+type streamSessionRegistry struct {
+	sts      *SimpleTorrentService
+	sessions map[string]*streamSession
+	nextID   uint64
+	mutex    sync.Mutex
+}
+
+func newStreamSessionRegistry(sts *SimpleTorrentService) *streamSessionRegistry {
+	return &streamSessionRegistry{
+		sts:      sts,
+		sessions: make(map[string]*streamSession),
+	}
+}
+
+// 同一客户端对同一文件的多个请求（浏览器跳转时常见）算作一个播放
+func (r *streamSessionRegistry) open(clientIP string, file *torrent.File) (*streamSession, error) {
+	// 估算码率需要解析媒体头部（读取torrent数据），在加锁之前完成；
+	// 调度器在开始读取前不设置优先级，未登记时直接丢弃即可
+	scheduler := r.sts.newStreamScheduler(file)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if limit := r.sts.config.Stream.MaxSessions; limit > 0 {
+		streams := make(map[string]bool)
+		for _, session := range r.sessions {
+			streams[session.clientIP+"/"+session.file.Torrent().InfoHash().HexString()+"/"+session.file.Path()] = true
+		}
+		key := clientIP + "/" + file.Torrent().InfoHash().HexString() + "/" + file.Path()
+		if !streams[key] && len(streams) >= limit {
+			return nil, fmt.Errorf("同时播放数量已达上限: %d", limit)
+		}
+	}
+
+	r.nextID++
+	session := &streamSession{
+		id:        strconv.FormatUint(r.nextID, 10),
+		clientIP:  clientIP,
+		file:      file,
+		startedAt: time.Now(),
+		scheduler: scheduler,
+	}
+	r.sessions[session.id] = session
+	return session, nil
+}
+
+// 会话结束时撤销其设置的piece优先级，恢复正常下载
+func (r *streamSessionRegistry) close(session *streamSession) {
+	r.mutex.Lock()
+	delete(r.sessions, session.id)
+	r.mutex.Unlock()
+
+	session.scheduler.Close()
+}
+
+func (r *streamSessionRegistry) list() []*streamSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sessions := make([]*streamSession, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].startedAt.Before(sessions[j].startedAt)
+	})
+	return sessions
+}
+
+// 多个会话同时播放时，缓冲比最少的会话多出streamNextSeconds以上的会话暂停预读，
+// 下载带宽优先给缓冲最少的会话；只有一个会话时不限制
+func (r *streamSessionRegistry) balance() {
+	sessions := r.list()
+	if len(sessions) <= 1 {
+		for _, session := range sessions {
+			session.scheduler.setLimited(false)
+		}
+		return
+	}
+
+	buffered := make([]float64, len(sessions))
+	least := -1.0
+	for i, session := range sessions {
+		buffered[i] = session.scheduler.bufferedSeconds()
+		if least < 0 || buffered[i] < least {
+			least = buffered[i]
+		}
+	}
+	for i, session := range sessions {
+		session.scheduler.setLimited(buffered[i] > least+streamNextSeconds)
+	}
+}
+
+func (sts *SimpleTorrentService) balanceStreams() {
+	ticker := time.NewTicker(streamBalanceInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sts.streamSessions.balance()
+	}
+}
+
+// 正在进行的播放会话
+func (sts *SimpleTorrentService) GetStreamSessions() []StreamSessionInfo {
+	sessions := sts.streamSessions.list()
+	infos := make([]StreamSessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		media, _ := sts.ProbeTorrentFile(session.file)
+		infos = append(infos, session.info(media))
+	}
+	return infos
+}
+
+func setupStreamRoutes(r *gin.Engine, ts *SimpleTorrentService) {
+	// 正在播放的torrent文件：客户端、位置、速度和卡顿次数
+	r.GET("/streams", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"streams":      ts.GetStreamSessions(),
+			"max_sessions": ts.config.Stream.MaxSessions,
+		})
+	})
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// 字幕轨道
+type SubtitleTrack struct {
+	// s{文件索引}: 外挂字幕文件, e{流索引}: 内嵌字幕
+	ID       string `json:"id"`
+	Source   string `json:"source"` // sidecar 或 embedded
+	Label    string `json:"label"`
+	Language string `json:"language,omitempty"`
+	// srt/ass/ssa/vtt，内嵌字幕为编码名称
+	Format string `json:"format"`
+	Path   string `json:"path,omitempty"`
+	// 图形字幕（PGS、VobSub）无法转换为WebVTT
+	Supported bool   `json:"supported"`
+	URL       string `json:"url,omitempty"`
+}
+
+// 外挂字幕最大读取大小
+const maxSubtitleSize = 20 * 1024 * 1024
+
+var subtitleExts = map[string]bool{".srt": true, ".ass": true, ".ssa": true, ".vtt": true}
+
+// ffmpeg可转换为WebVTT的文本字幕编码
+var textSubtitleCodecs = map[string]bool{
+	"subrip": true, "srt": true, "ass": true, "ssa": true,
+	"webvtt": true, "mov_text": true, "text": true,
+}
+
+// 字幕服务 - 列出视频的外挂和内嵌字幕并转换为WebVTT
+type SubtitleService struct {
+	ts *SimpleTorrentService
+	hm *HLSManager
+	// 已转换的WebVTT缓存，内嵌字幕需要读取整个文件才能提取
+	cache map[string]string
+	mutex sync.Mutex
+}
+
+func NewSubtitleService(ts *SimpleTorrentService, hm *HLSManager) *SubtitleService {
+	return &SubtitleService{
+		ts:    ts,
+		hm:    hm,
+		cache: make(map[string]string),
+	}
+}
+
+// 列出视频文件的字幕轨道
+func (ss *SubtitleService) Tracks(ctx context.Context, hash string, fileIndex int) ([]SubtitleTrack, error) {
+	files, err := ss.ts.GetTorrentFiles(hash)
+	if err != nil {
+		return nil, err
+	}
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return nil, fmt.Errorf("文件索引无效: %d", fileIndex)
+	}
+
+	video := files[fileIndex]
+	tracks := sidecarSubtitles(files, fileIndex)
+
+	if ss.hm.Available() {
+		embedded, err := ss.embeddedSubtitles(ctx, hash, fileIndex, video)
+		if err != nil {
+			log.Printf("读取内嵌字幕失败: %v", err)
+		}
+		tracks = append(tracks, embedded...)
+	}
+
+	for i := range tracks {
+		if tracks[i].Supported {
+			tracks[i].URL = fmt.Sprintf("/subtitles/%s/%d/%s", hash, fileIndex, tracks[i].ID)
+		}
+	}
+	return tracks, nil
+}
+
+// 按文件名匹配外挂字幕：字幕文件名以视频文件名（不含扩展名）开头，
+// 种子中只有一个视频时所有字幕文件都属于该视频
+func sidecarSubtitles(files []*torrent.File, videoIndex int) []SubtitleTrack {
+	videoCount := 0
+	for _, file := range files {
+		if isVideoFile(file.Path()) {
+			videoCount++
+		}
+	}
+
+	videoBase := strings.TrimSuffix(path.Base(files[videoIndex].Path()), path.Ext(files[videoIndex].Path()))
+	tracks := []SubtitleTrack{}
+
+	for i, file := range files {
+		ext := strings.ToLower(path.Ext(file.Path()))
+		if !subtitleExts[ext] {
+			continue
+		}
+
+		base := strings.TrimSuffix(path.Base(file.Path()), path.Ext(file.Path()))
+		suffix, matched := "", false
+		if strings.HasPrefix(strings.ToLower(base), strings.ToLower(videoBase)) {
+			suffix, matched = strings.Trim(base[len(videoBase):], ".-_ "), true
+		} else if videoCount == 1 {
+			suffix, matched = base, true
+		}
+		if !matched {
+			continue
+		}
+
+		language, label := guessSubtitleLanguage(suffix)
+		if label == "" {
+			label = path.Base(file.Path())
+		}
+		tracks = append(tracks, SubtitleTrack{
+			ID:        fmt.Sprintf("s%d", i),
+			Source:    "sidecar",
+			Label:     label,
+			Language:  language,
+			Format:    strings.TrimPrefix(ext, "."),
+			Path:      file.Path(),
+			Supported: true,
+		})
+	}
+	return tracks
+}
+
+var languageTokenPattern = regexp.MustCompile(`[a-z]+(-[a-z]+)?`)
+
+// 根据文件名后缀或轨道标签猜测字幕语言，英文代码按单词匹配，中日文按字符匹配
+func guessSubtitleLanguage(name string) (string, string) {
+	lower := strings.ToLower(name)
+	tokens := make(map[string]bool)
+	for _, token := range languageTokenPattern.FindAllString(lower, -1) {
+		tokens[token] = true
+	}
+	has := func(codes []string, chars ...string) bool {
+		for _, code := range codes {
+			if tokens[code] {
+				return true
+			}
+		}
+		for _, char := range chars {
+			if strings.Contains(lower, char) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has([]string{"chs", "sc", "gb", "zh-hans", "zh-cn", "zh-sg"}, "简"):
+		return "zh-Hans", "简体中文"
+	case has([]string{"cht", "tc", "big5", "zh-hant", "zh-tw", "zh-hk"}, "繁"):
+		return "zh-Hant", "繁體中文"
+	case has([]string{"zh", "chi", "chn", "zho", "chinese"}, "中"):
+		return "zh", "中文"
+	case has([]string{"en", "eng", "english"}):
+		return "en", "English"
+	case has([]string{"ja", "jp", "jpn", "japanese"}, "日"):
+		return "ja", "日本語"
+	}
+	return "", name
+}
+
+// ffprobe读取内嵌字幕流
+func (ss *SubtitleService) embeddedSubtitles(ctx context.Context, hash string, fileIndex int, video *torrent.File) ([]SubtitleTrack, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, ss.hm.ffprobe,
+		"-v", "error",
+		"-select_streams", "s",
+		"-show_entries", "stream=index,codec_name:stream_tags=language,title",
+		"-of", "json",
+		ss.hm.inputURL(hash, fileIndex, video),
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe失败: %v", err)
+	}
+
+	var probe struct {
+		Streams []struct {
+			Index     int               `json:"index"`
+			CodecName string            `json:"codec_name"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("解析ffprobe输出失败: %v", err)
+	}
+
+	tracks := []SubtitleTrack{}
+	for _, stream := range probe.Streams {
+		title := stream.Tags["title"]
+		language, label := guessSubtitleLanguage(title + " " + stream.Tags["language"])
+		if title != "" {
+			label = title
+		}
+		if strings.TrimSpace(label) == "" {
+			label = fmt.Sprintf("内嵌字幕 %d", stream.Index)
+		}
+
+		tracks = append(tracks, SubtitleTrack{
+			ID:        fmt.Sprintf("e%d", stream.Index),
+			Source:    "embedded",
+			Label:     strings.TrimSpace(label),
+			Language:  language,
+			Format:    stream.CodecName,
+			Supported: textSubtitleCodecs[stream.CodecName],
+		})
+	}
+	return tracks, nil
+}
+
+// 获取字幕轨道的WebVTT内容，charset可指定外挂字幕编码（utf-8、gbk、big5）
+func (ss *SubtitleService) WebVTT(ctx context.Context, hash string, fileIndex int, trackID string, charset string) (string, error) {
+	files, err := ss.ts.GetTorrentFiles(hash)
+	if err != nil {
+		return "", err
+	}
+	if fileIndex < 0 || fileIndex >= len(files) || len(trackID) < 2 {
+		return "", fmt.Errorf("字幕不存在")
+	}
+
+	key := fmt.Sprintf("%s/%d/%s/%s", hash, fileIndex, trackID, charset)
+	ss.mutex.Lock()
+	vtt, cached := ss.cache[key]
+	ss.mutex.Unlock()
+	if cached {
+		return vtt, nil
+	}
+
+	index, err := strconv.Atoi(trackID[1:])
+	if err != nil {
+		return "", fmt.Errorf("字幕不存在")
+	}
+
+	switch trackID[0] {
+	case 's':
+		if index < 0 || index >= len(files) || !subtitleExts[strings.ToLower(path.Ext(files[index].Path()))] {
+			return "", fmt.Errorf("字幕不存在")
+		}
+		vtt, err = ss.sidecarWebVTT(ctx, files[index], charset)
+	case 'e':
+		if !ss.hm.Available() {
+			return "", fmt.Errorf("未找到ffmpeg，无法提取内嵌字幕")
+		}
+		vtt, err = ss.embeddedWebVTT(ctx, hash, fileIndex, files[fileIndex], index)
+	default:
+		return "", fmt.Errorf("字幕不存在")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ss.mutex.Lock()
+	if len(ss.cache) >= 100 {
+		ss.cache = make(map[string]string)
+	}
+	ss.cache[key] = vtt
+	ss.mutex.Unlock()
+	return vtt, nil
+}
+
+// 通过torrent读取外挂字幕并转换为WebVTT
+func (ss *SubtitleService) sidecarWebVTT(ctx context.Context, file *torrent.File, charset string) (string, error) {
+	if file.Length() > maxSubtitleSize {
+		return "", fmt.Errorf("字幕文件过大: %d bytes", file.Length())
+	}
+
+	reader := newTorrentFileReader(ctx, file, ss.ts.streamReadaheadLimit())
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxSubtitleSize))
+	if err != nil {
+		return "", fmt.Errorf("读取字幕文件失败: %v", err)
+	}
+
+	text, err := decodeSubtitle(data, charset)
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.ToLower(path.Ext(file.Path())) {
+	case ".srt":
+		return srtToWebVTT(text), nil
+	case ".ass", ".ssa":
+		return assToWebVTT(text), nil
+	default:
+		return text, nil
+	}
+}
+
+// ffmpeg提取内嵌字幕流，需要读取整个视频文件
+func (ss *SubtitleService) embeddedWebVTT(ctx context.Context, hash string, fileIndex int, video *torrent.File, stream int) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ss.hm.ffmpeg,
+		"-v", "error", "-nostdin",
+		"-i", ss.hm.inputURL(hash, fileIndex, video),
+		"-map", fmt.Sprintf("0:%d", stream),
+		"-f", "webvtt", "pipe:1",
+	)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("提取内嵌字幕失败: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// 解码字幕文本：优先识别BOM和UTF-8，否则按GBK或Big5解码
+func decodeSubtitle(data []byte, charset string) (string, error) {
+	var enc encoding.Encoding
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:]), nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		enc = unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		enc = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+	default:
+		switch strings.ToLower(charset) {
+		case "utf-8", "utf8":
+			return string(data), nil
+		case "gbk", "gb2312", "gb18030":
+			enc = simplifiedchinese.GB18030
+		case "big5":
+			enc = traditionalchinese.Big5
+		case "":
+			if utf8.Valid(data) {
+				return string(data), nil
+			}
+			enc = guessChineseEncoding(data)
+		default:
+			return "", fmt.Errorf("不支持的字幕编码: %s", charset)
+		}
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", fmt.Errorf("字幕解码失败: %v", err)
+	}
+	return string(decoded), nil
+}
+
+// 猜测非UTF-8中文字幕的编码：GB2312汉字的第二字节都不小于0xA1，
+// 而Big5中相当一部分汉字的第二字节在0x40-0x7E之间
+func guessChineseEncoding(data []byte) encoding.Encoding {
+	pairs, lowTrail := 0, 0
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] < 0x81 {
+			continue
+		}
+		trail := data[i+1]
+		// 0x80-0xA0只在GBK中作为第二字节出现
+		if trail >= 0x80 && trail < 0xA1 {
+			return simplifiedchinese.GB18030
+		}
+		pairs++
+		if trail < 0x80 {
+			lowTrail++
+		}
+		i++
+	}
+
+	if pairs > 0 && lowTrail*10 > pairs {
+		return traditionalchinese.Big5
+	}
+	return simplifiedchinese.GB18030
+}
+
+var (
+	srtTimingPattern = regexp.MustCompile(`(\d{1,2}:\d{2}:\d{2})[,.](\d{1,3})`)
+	srtFontPattern   = regexp.MustCompile(`(?i)</?font[^>]*>`)
+	assTagPattern    = regexp.MustCompile(`\{[^}]*\}`)
+)
+
+// SRT转WebVTT：时间戳的逗号改为点，去掉WebVTT不支持的font标签
+func srtToWebVTT(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, line := range strings.Split(text, "\n") {
+		if strings.Contains(line, "-->") {
+			line = srtTimingPattern.ReplaceAllStringFunc(line, func(ts string) string {
+				m := srtTimingPattern.FindStringSubmatch(ts)
+				millis := (m[2] + "00")[:3]
+				return padTimestamp(m[1]) + "." + millis
+			})
+		} else {
+			line = srtFontPattern.ReplaceAllString(line, "")
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// 补齐小时位: 1:02:03 -> 01:02:03
+func padTimestamp(ts string) string {
+	if len(ts) == 7 {
+		return "0" + ts
+	}
+	return ts
+}
+
+type vttCue struct {
+	start, end time.Duration
+	text       string
+}
+
+// ASS/SSA转WebVTT：读取[Events]中的Dialogue，去掉样式标签
+func assToWebVTT(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	var cues []vttCue
+	inEvents := false
+	// 没有Format行时使用ASS的默认字段顺序
+	startField, endField, textField, fieldCount := 1, 2, 9, 10
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+
+		if strings.HasPrefix(line, "Format:") {
+			fields := strings.Split(strings.TrimPrefix(line, "Format:"), ",")
+			fieldCount = len(fields)
+			startField, endField, textField = -1, -1, -1
+			for i, field := range fields {
+				switch strings.ToLower(strings.TrimSpace(field)) {
+				case "start":
+					startField = i
+				case "end":
+					endField = i
+				case "text":
+					textField = i
+				}
+			}
+			// 缺少必需的字段时跳过该段
+			if startField < 0 || endField < 0 || textField < 0 {
+				inEvents = false
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(line, "Dialogue:") {
+			continue
+		}
+		// Text是最后一个字段，可能包含逗号
+		fields := strings.SplitN(strings.TrimPrefix(line, "Dialogue:"), ",", fieldCount)
+		if len(fields) != fieldCount || startField >= len(fields) || endField >= len(fields) || textField >= len(fields) {
+			continue
+		}
+
+		start, err1 := parseASSTime(fields[startField])
+		end, err2 := parseASSTime(fields[endField])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		cueText := assTagPattern.ReplaceAllString(fields[textField], "")
+		cueText = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(cueText)
+		cueText = strings.TrimSpace(cueText)
+		if cueText == "" {
+			continue
+		}
+		cues = append(cues, vttCue{start: start, end: end, text: vttTextEscaper.Replace(cueText)})
+	}
+
+	sort.SliceStable(cues, func(i, j int) bool {
+		return cues[i].start < cues[j].start
+	})
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n", formatVTTTime(cue.start), formatVTTTime(cue.end), cue.text)
+	}
+	return b.String()
+}
+
+// WebVTT的cue文本中"&"、"<"和">"需要转义（"-->"会被当作时间行）
+var vttTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// ASS时间格式: H:MM:SS.cc
+func parseASSTime(s string) (time.Duration, error) {
+	var h, m, sec, cs int
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d:%d.%d", &h, &m, &sec, &cs); err != nil {
+		return 0, err
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(sec)*time.Second + time.Duration(cs)*10*time.Millisecond, nil
+}
+
+func formatVTTTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// 设置字幕路由
+func setupSubtitleRoutes(r *gin.Engine, ss *SubtitleService) {
+	// 列出视频的字幕轨道: /subtitles/:hash/:file，file为文件索引（顺序同 /torrent/:hash/files）
+	r.GET("/subtitles/:hash/:file", func(c *gin.Context) {
+		fileIndex, err := strconv.Atoi(c.Param("file"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的文件索引"})
+			return
+		}
+
+		tracks, err := ss.Tracks(c.Request.Context(), c.Param("hash"), fileIndex)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"tracks":             tracks,
+			"embedded_supported": ss.hm.Available(),
+		})
+	})
+
+	// 获取WebVTT字幕，可用 ?charset=gbk|big5|utf-8 指定外挂字幕编码
+	r.GET("/subtitles/:hash/:file/:track", func(c *gin.Context) {
+		fileIndex, err := strconv.Atoi(c.Param("file"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的文件索引"})
+			return
+		}
+
+		trackID := strings.TrimSuffix(c.Param("track"), ".vtt")
+		vtt, err := ss.WebVTT(c.Request.Context(), c.Param("hash"), fileIndex, trackID, c.Query("charset"))
+		if err != nil {
+			if c.Request.Context().Err() == nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.Data(http.StatusOK, "text/vtt; charset=utf-8", []byte(vtt))
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestSRTToWebVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		srt  string
+		want string
+	}{
+		{
+			name: "时间戳和换行",
+			srt:  "1\r\n00:00:01,000 --> 00:00:02,500\r\nHello\r\n\r\n2\r\n1:02:03,5 --> 1:02:04,25\r\nWorld\r\n",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.500\nHello\n\n2\n01:02:03.500 --> 01:02:04.250\nWorld\n\n",
+		},
+		{
+			name: "去掉font标签，保留其他标签",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\n<font color=\"#fff\"><i>斜体</i></font>\n",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\n<i>斜体</i>\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := srtToWebVTT(tt.srt); got != tt.want {
+				t.Fatalf("结果:\n%q\n期望:\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestASSToWebVTT(t *testing.T) {
+	const header = "[Script Info]\nTitle: test\n\n[V4+ Styles]\nFormat: Name, Fontname\nStyle: Default,Arial\n\n"
+	tests := []struct {
+		name string
+		ass  string
+		want string
+	}{
+		{
+			name: "默认字段顺序，按开始时间排序",
+			ass: header + "[Events]\n" +
+				"Dialogue: 0,0:00:05.00,0:00:06.00,Default,,0,0,0,,Second\n" +
+				"Dialogue: 0,0:00:01.50,0:00:02.00,Default,,0,0,0,,{\\b1}First{\\b0}\\Nline, with comma\n",
+			want: "WEBVTT\n\n00:00:01.500 --> 00:00:02.000\nFirst\nline, with comma\n\n00:00:05.000 --> 00:00:06.000\nSecond\n\n",
+		},
+		{
+			name: "按Format行确定字段位置",
+			ass: header + "[Events]\nFormat: Layer, Style, Start, End, Text\n" +
+				"Dialogue: 0,Default,1:00:00.00,1:00:01.10,你好\\h世界\n" +
+				"Comment: 0,Default,0:00:00.00,0:00:01.00,注释\n",
+			want: "WEBVTT\n\n01:00:00.000 --> 01:00:01.100\n你好 世界\n\n",
+		},
+		{
+			name: "转义特殊字符",
+			ass:  header + "[Events]\nDialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,a < b & c --> d\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\na &lt; b &amp; c --&gt; d\n\n",
+		},
+		{
+			name: "Format缺少Text字段时跳过",
+			ass:  header + "[Events]\nFormat: Start, End\nDialogue: 0:00:01.00,0:00:02.00\n",
+			want: "WEBVTT\n\n",
+		},
+		{
+			name: "Format字段少于默认位置",
+			ass:  header + "[Events]\nFormat: Start, End, Text\nDialogue: 0:00:01.00,0:00:02.00,Short\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nShort\n\n",
+		},
+		{
+			name: "无效的时间和空文本",
+			ass: header + "[Events]\n" +
+				"Dialogue: 0,bad,0:00:02.00,Default,,0,0,0,,x\n" +
+				"Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,{\\pos(1,2)}\n",
+			want: "WEBVTT\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := assToWebVTT(tt.ass); got != tt.want {
+				t.Fatalf("结果:\n%q\n期望:\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func encodeTestText(t *testing.T, enc encoding.Encoding, text string) []byte {
+	data, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeSubtitle(t *testing.T) {
+	const simplified = "这是简体中文字幕，测试编码识别。"
+	const traditional = "這是繁體中文字幕，測試編碼識別。"
+	utf16 := func(order unicode.Endianness) []byte {
+		return encodeTestText(t, unicode.UTF16(order, unicode.UseBOM), simplified)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		charset string
+		want    string
+		err     string
+	}{
+		{"UTF-8", []byte(simplified), "", simplified, ""},
+		{"UTF-8 BOM", append([]byte{0xEF, 0xBB, 0xBF}, simplified...), "", simplified, ""},
+		{"UTF-16LE BOM", utf16(unicode.LittleEndian), "", simplified, ""},
+		{"UTF-16BE BOM", utf16(unicode.BigEndian), "", simplified, ""},
+		{"自动识别GBK", encodeTestText(t, simplifiedchinese.GBK, simplified), "", simplified, ""},
+		{"自动识别Big5", encodeTestText(t, traditionalchinese.Big5, traditional), "", traditional, ""},
+		{"指定GBK", encodeTestText(t, simplifiedchinese.GBK, simplified), "GB2312", simplified, ""},
+		{"指定Big5", encodeTestText(t, traditionalchinese.Big5, traditional), "big5", traditional, ""},
+		{"不支持的编码", []byte("x"), "latin1", "", "不支持的字幕编码"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSubtitle(tt.data, tt.charset)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("期望错误 %q, 实际 %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("结果 %q, 期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuessChineseEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want encoding.Encoding
+	}{
+		{"GB2312", encodeTestText(t, simplifiedchinese.GBK, "简体中文字幕"), simplifiedchinese.GB18030},
+		// 第二字节在0x80-0xA0之间只出现在GBK中
+		{"GBK扩展字符", encodeTestText(t, simplifiedchinese.GBK, "丂亐"), simplifiedchinese.GB18030},
+		{"Big5", encodeTestText(t, traditionalchinese.Big5, "這是繁體中文字幕，請測試"), traditionalchinese.Big5},
+		{"纯ASCII", []byte("hello"), simplifiedchinese.GB18030},
+	}
+	for _, tt := range tests {
+		if got := guessChineseEncoding(tt.data); got != tt.want {
+			t.Errorf("%s: 识别为 %v", tt.name, got)
+		}
+	}
+}
+
+func TestSidecarSubtitles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		video string
+		want  map[string]string // 字幕路径 -> 语言
+	}{
+		{
+			name: "多个视频时按文件名前缀匹配",
+			files: []string{
+				"Show.S01E01.mkv", "Show.S01E01.chs.srt", "Show.S01E01.en.ass",
+				"Show.S01E02.mkv", "Show.S01E02.srt", "notes.txt",
+			},
+			video: "Show.S01E01.mkv",
+			want:  map[string]string{"Show.S01E01.chs.srt": "zh-Hans", "Show.S01E01.en.ass": "en"},
+		},
+		{
+			name:  "只有一个视频时所有字幕都属于该视频",
+			files: []string{"Movie.mp4", "Subs/繁體.ssa", "Subs/english.vtt", "Subs/other.srt"},
+			video: "Movie.mp4",
+			want:  map[string]string{"Subs/繁體.ssa": "zh-Hant", "Subs/english.vtt": "en", "Subs/other.srt": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := make(map[string][]byte)
+			for _, name := range tt.files {
+				contents[filepath.FromSlash(name)] = []byte(name)
+			}
+			tor, err := newTestTorrentClient(t, t.TempDir()).AddTorrent(buildTestMultiFileTorrent(t, t.TempDir(), contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := tor.Files()
+			videoIndex := -1
+			for i, file := range files {
+				if strings.TrimPrefix(file.Path(), "multi/") == tt.video {
+					videoIndex = i
+				}
+			}
+			if videoIndex < 0 {
+				t.Fatalf("找不到视频文件: %s", tt.video)
+			}
+
+			tracks := sidecarSubtitles(files, videoIndex)
+			if len(tracks) != len(tt.want) {
+				t.Fatalf("字幕 %+v, 期望 %v", tracks, tt.want)
+			}
+			for _, track := range tracks {
+				language, ok := tt.want[strings.TrimPrefix(track.Path, "multi/")]
+				if !ok || track.Language != language || !track.Supported || track.Source != "sidecar" {
+					t.Fatalf("字幕 %+v, 期望 %v", track, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// 不连接DHT和tracker、不启动后台任务的torrent服务，状态文件保存在临时目录
+func newTestTorrentService(t *testing.T) *SimpleTorrentService {
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.NoDHT = true
+	cfg.DisableTrackers = true
+	cfg.ListenPort = 0
+	cfg.NoDefaultPortForwarding = true
+	sts, err := newSimpleTorrentService(t.TempDir(), t.TempDir(), &Config{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sts.client.Close() })
+	return sts
+}
+
+// 生成包含单个文件的torrent
+func testTorrentFile(t *testing.T, name string) []byte {
+	return buildTestTorrent(t, t.TempDir(), name, []byte("content of "+name))
+}
+
+// 在dir中写入文件并生成对应的torrent
+func buildTestTorrent(t *testing.T, dir string, name string, content []byte) []byte {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := metainfo.Info{PieceLength: 16 * 1024}
+	if err := info.BuildFromFilePath(path); err != nil {
+		t.Fatal(err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := (&metainfo.MetaInfo{InfoBytes: infoBytes}).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/gin-gonic/gin"
+)
+
+// 海报图宽度（像素）
+const posterWidth = 480
+
+var errThumbnailIncomplete = errors.New("文件尚未下载完成")
+
+// 缩略图服务 - 为下载完成的视频生成海报图和进度条预览图（雪碧图+WebVTT）
+type ThumbnailService struct {
+	ts       *SimpleTorrentService
+	hm       *HLSManager
+	config   ThumbnailConfig
+	cacheDir string
+	jobs     chan thumbnailJob
+	// 排队或生成中的缓存目录
+	pending map[string]bool
+	// 生成失败的原因，按缓存目录和文件标识记录，文件变化后重试
+	failed map[string]string
+	mutex  sync.Mutex
+}
+
+type thumbnailJob struct {
+	hash      string
+	fileIndex int
+	file      *torrent.File
+	key       string
+	stamp     string
+}
+
+// 生成结果，保存在缓存目录的meta.json中
+type ThumbnailMeta struct {
+	Hash string `json:"hash"`
+	Path string `json:"path"`
+	// 生成时源文件在磁盘上的路径，非文件存储时为空
+	Source string `json:"source,omitempty"`
+	// 源文件标识（本地文件的修改时间和大小），变化后重新生成
+	Stamp    string  `json:"stamp"`
+	Duration float64 `json:"duration"`
+	// 预览图中相邻缩略图的时间间隔（秒）
+	Interval    float64   `json:"interval"`
+	Tiles       int       `json:"tiles"`
+	Columns     int       `json:"columns"`
+	Rows        int       `json:"rows"`
+	TileWidth   int       `json:"tile_width"`
+	TileHeight  int       `json:"tile_height"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+func NewThumbnailService(ts *SimpleTorrentService, hm *HLSManager, config ThumbnailConfig) *ThumbnailService {
+	th := &ThumbnailService{
+		ts:       ts,
+		hm:       hm,
+		config:   config,
+		cacheDir: filepath.Join(ts.downloadDir, ".thumbnails"),
+		jobs:     make(chan thumbnailJob, 256),
+		pending:  make(map[string]bool),
+		failed:   make(map[string]string),
+	}
+	if !hm.Available() {
+		return th
+	}
+
+	workers := config.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go th.worker()
+	}
+	go th.scanCompleted()
+
+	log.Printf("缩略图生成已启用，并发数: %d", workers)
+	return th
+}
+
+func (th *ThumbnailService) intervalSeconds() float64 {
+	if th.config.IntervalSeconds > 0 {
+		return float64(th.config.IntervalSeconds)
+	}
+	return 10
+}
+
+func (th *ThumbnailService) maxTiles() int {
+	if th.config.MaxTiles > 0 {
+		return th.config.MaxTiles
+	}
+	return 100
+}
+
+func (th *ThumbnailService) tileWidth() int {
+	if th.config.TileWidth > 0 {
+		return th.config.TileWidth
+	}
+	return 160
+}
+
+// 缓存目录名由info-hash和文件路径确定
+func thumbnailKey(hash string, path string) string {
+	sum := sha1.Sum([]byte(hash + "/" + path))
+	return hex.EncodeToString(sum[:])
+}
+
+// 本地文件存在时使用修改时间和大小标识，否则使用文件长度（torrent内容由info-hash确定）
+func (th *ThumbnailService) fileStamp(hash string, file *torrent.File) string {
+	if localPath := th.localPath(hash, file); localPath != "" {
+		if info, err := os.Stat(localPath); err == nil {
+			return fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return strconv.FormatInt(file.Length(), 16)
+}
+
+// 文件存储下已下载文件在磁盘上的路径，其他存储返回空
+func (th *ThumbnailService) localPath(hash string, file *torrent.File) string {
+	if !th.ts.fileStorage() {
+		return ""
+	}
+	path := filepath.Join(th.ts.torrentDataDir(hash), file.Path())
+	if info, err := os.Stat(path); err != nil || info.Size() != file.Length() {
+		return ""
+	}
+	return path
+}
+
+// 查询缩略图状态：已生成时返回结果，否则加入生成队列
+// 返回值state为ready、generating或failed
+func (th *ThumbnailService) Status(hash string, fileIndex int) (*ThumbnailMeta, string, error) {
+	files, err := th.ts.GetTorrentFiles(hash)
+	if err != nil {
+		return nil, "", err
+	}
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return nil, "", fmt.Errorf("文件索引无效: %d", fileIndex)
+	}
+	file := files[fileIndex]
+	if !isVideoFile(file.Path()) {
+		return nil, "", fmt.Errorf("不是视频文件: %s", file.Path())
+	}
+	if file.BytesCompleted() < file.Length() {
+		return nil, "", errThumbnailIncomplete
+	}
+
+	job := thumbnailJob{
+		hash:      hash,
+		fileIndex: fileIndex,
+		file:      file,
+		key:       thumbnailKey(hash, file.Path()),
+		stamp:     th.fileStamp(hash, file),
+	}
+	if meta := th.readMeta(job.key); meta != nil && meta.Stamp == job.stamp {
+		return meta, "ready", nil
+	}
+
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	if reason, exists := th.failed[job.key+"@"+job.stamp]; exists {
+		return nil, "failed", fmt.Errorf("%s", reason)
+	}
+	th.enqueueLocked(job)
+	return nil, "generating", nil
+}
+
+// 加入队列，调用方需持有锁；队列已满时丢弃，下次查询或扫描时重新加入
+func (th *ThumbnailService) enqueueLocked(job thumbnailJob) {
+	if th.pending[job.key] {
+		return
+	}
+	select {
+	case th.jobs <- job:
+		th.pending[job.key] = true
+	default:
+	}
+}
+
+func (th *ThumbnailService) readMeta(key string) *ThumbnailMeta {
+	data, err := os.ReadFile(filepath.Join(th.cacheDir, key, "meta.json"))
+	if err != nil {
+		return nil
+	}
+	var meta ThumbnailMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+func (th *ThumbnailService) worker() {
+	for job := range th.jobs {
+		start := time.Now()
+		err := th.safeGenerate(job)
+
+		th.mutex.Lock()
+		delete(th.pending, job.key)
+		if err != nil {
+			// 同一文件只保留最新版本的失败原因
+			th.forgetFailedLocked(job.key)
+			th.failed[job.key+"@"+job.stamp] = err.Error()
+		}
+		th.mutex.Unlock()
+
+		if err != nil {
+			log.Printf("生成缩略图失败: %s, %v", job.file.Path(), err)
+		} else {
+			log.Printf("缩略图已生成: %s, 耗时: %v", job.file.Path(), time.Since(start).Round(time.Millisecond))
+		}
+	}
+}
+
+// 解析文件头时的异常只让该任务失败，不影响worker
+func (th *ThumbnailService) safeGenerate(job thumbnailJob) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("生成缩略图异常: %v", recovered)
+		}
+	}()
+	return th.generate(job)
+}
+
+// 清除某个缓存目录的失败记录，调用方需持有锁
+func (th *ThumbnailService) forgetFailedLocked(key string) {
+	for failedKey := range th.failed {
+		if strings.HasPrefix(failedKey, key+"@") {
+			delete(th.failed, failedKey)
+		}
+	}
+}
+
+// 生成海报图和预览图，先写入临时目录，完成后替换旧的缓存
+func (th *ThumbnailService) generate(job thumbnailJob) error {
+	source := th.localPath(job.hash, job.file)
+	input := source
+	if input == "" {
+		input = th.hm.inputURL(job.hash, job.fileIndex, job.file)
+	}
+
+	duration, err := th.duration(job.file, input)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(th.cacheDir, job.key)
+	tmpDir := dir + ".tmp"
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return fmt.Errorf("创建缩略图目录失败: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 间隔随时长增大，使缩略图数量不超过上限
+	interval := math.Max(th.intervalSeconds(), math.Ceil(duration/float64(th.maxTiles())))
+	tiles := int(math.Ceil(duration / interval))
+	if tiles < 1 {
+		tiles = 1
+	}
+	columns := 10
+	if tiles < columns {
+		columns = tiles
+	}
+	rows := (tiles + columns - 1) / columns
+
+	// 海报图取10%处的画面，跳过片头黑屏
+	if err := th.runFFmpeg(filepath.Join(tmpDir, "poster.jpg"),
+		"-ss", strconv.FormatFloat(duration/10, 'f', 3, 64),
+		"-i", input,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:-2", posterWidth),
+		"-q:v", "3",
+	); err != nil {
+		return fmt.Errorf("生成海报图失败: %v", err)
+	}
+
+	// 只解码关键帧，按间隔取帧后拼接为一张图
+	if err := th.runFFmpeg(filepath.Join(tmpDir, "sprite.jpg"),
+		"-skip_frame", "nokey",
+		"-i", input,
+		"-an", "-sn",
+		"-vf", fmt.Sprintf("fps=1/%s,scale=%d:-2,tile=%dx%d", strconv.FormatFloat(interval, 'f', -1, 64), th.tileWidth(), columns, rows),
+		"-frames:v", "1",
+		"-q:v", "5",
+	); err != nil {
+		return fmt.Errorf("生成预览图失败: %v", err)
+	}
+
+	// 缩略图高度由视频宽高比决定，从生成的图片尺寸计算
+	spriteFile, err := os.Open(filepath.Join(tmpDir, "sprite.jpg"))
+	if err != nil {
+		return fmt.Errorf("读取预览图失败: %v", err)
+	}
+	spriteConfig, err := jpeg.DecodeConfig(spriteFile)
+	spriteFile.Close()
+	if err != nil {
+		return fmt.Errorf("读取预览图失败: %v", err)
+	}
+
+	meta := ThumbnailMeta{
+		Hash:        job.hash,
+		Path:        job.file.Path(),
+		Source:      source,
+		Stamp:       job.stamp,
+		Duration:    duration,
+		Interval:    interval,
+		Tiles:       tiles,
+		Columns:     columns,
+		Rows:        rows,
+		TileWidth:   spriteConfig.Width / columns,
+		TileHeight:  spriteConfig.Height / rows,
+		GeneratedAt: time.Now(),
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "sprite.vtt"), []byte(spriteVTT(meta)), 0644); err != nil {
+		return fmt.Errorf("写入预览图索引失败: %v", err)
+	}
+	data, _ := json.MarshalIndent(meta, "", "  ")
+	if err := os.WriteFile(filepath.Join(tmpDir, "meta.json"), data, 0644); err != nil {
+		return fmt.Errorf("写入缩略图信息失败: %v", err)
+	}
+
+	os.RemoveAll(dir)
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return fmt.Errorf("保存缩略图失败: %v", err)
+	}
+	return nil
+}
+
+// 优先使用头部解析得到的时长，无法解析的容器使用ffprobe
+func (th *ThumbnailService) duration(file *torrent.File, input string) (float64, error) {
+	if media, err := th.ts.ProbeTorrentFile(file); err == nil && media.Duration > 0 {
+		return media.Duration, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, th.hm.ffprobe,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		input,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("获取视频时长失败: %v", err)
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("无法识别视频时长: %s", strings.TrimSpace(string(out)))
+	}
+	return duration, nil
+}
+
+// 单线程运行ffmpeg，并发由工作协程数量控制
+func (th *ThumbnailService) runFFmpeg(output string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	full := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-threads", "1", "-filter_threads", "1"}
+	full = append(full, args...)
+	full = append(full, "-threads", "1", "-y", output)
+
+	cmd := exec.CommandContext(ctx, th.hm.ffmpeg, full...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+	return nil
+}
+
+// 进度条预览的WebVTT，每条cue指向雪碧图中的一块区域
+func spriteVTT(meta ThumbnailMeta) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for i := 0; i < meta.Tiles; i++ {
+		start := float64(i) * meta.Interval
+		end := math.Min(start+meta.Interval, meta.Duration)
+		x := (i % meta.Columns) * meta.TileWidth
+		y := (i / meta.Columns) * meta.TileHeight
+		fmt.Fprintf(&b, "%s --> %s\nsprite.jpg#xywh=%d,%d,%d,%d\n\n",
+			formatVTTTime(secondsToDuration(start)), formatVTTTime(secondsToDuration(end)), x, y, meta.TileWidth, meta.TileHeight)
+	}
+	return b.String()
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// 缓存对应的源文件是否仍在磁盘上；重启后任务尚未加载时据此保留缓存
+func (th *ThumbnailService) sourceExists(key string) bool {
+	meta := th.readMeta(key)
+	if meta == nil {
+		return false
+	}
+	source := meta.Source
+	if source == "" {
+		source = filepath.Join(th.ts.downloadDir, filepath.FromSlash(meta.Path))
+	}
+	_, err := os.Stat(source)
+	return err == nil
+}
+
+// 定期为下载完成的视频生成缩略图，并清理源文件已删除的缓存
+func (th *ThumbnailService) scanCompleted() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		known := make(map[string]bool)
+		for _, task := range th.ts.GetDownloadStatus().Torrents {
+			files, err := th.ts.GetTorrentFiles(task.Hash)
+			if err != nil {
+				continue
+			}
+			for i, file := range files {
+				if !isVideoFile(file.Path()) {
+					continue
+				}
+				known[thumbnailKey(task.Hash, file.Path())] = true
+				if file.BytesCompleted() == file.Length() {
+					th.Status(task.Hash, i)
+				}
+			}
+		}
+
+		th.mutex.Lock()
+		for failedKey := range th.failed {
+			if key, _, _ := strings.Cut(failedKey, "@"); !known[key] {
+				delete(th.failed, failedKey)
+			}
+		}
+		th.mutex.Unlock()
+
+		entries, err := os.ReadDir(th.cacheDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			key := entry.Name()
+			if !entry.IsDir() || known[key] || strings.HasSuffix(key, ".tmp") || th.sourceExists(key) {
+				continue
+			}
+			th.mutex.Lock()
+			if !th.pending[key] {
+				os.RemoveAll(filepath.Join(th.cacheDir, key))
+				log.Printf("清理缩略图缓存: %s", key)
+			}
+			th.mutex.Unlock()
+		}
+	}
+}
+
+// 设置缩略图路由
+func setupThumbnailRoutes(r *gin.Engine, th *ThumbnailService) {
+	status := func(c *gin.Context) (*ThumbnailMeta, bool) {
+		if !th.hm.Available() {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "未找到ffmpeg，缩略图生成不可用"})
+			return nil, false
+		}
+		fileIndex, err := strconv.Atoi(c.Param("file"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的文件索引"})
+			return nil, false
+		}
+
+		meta, state, err := th.Status(c.Param("hash"), fileIndex)
+		switch {
+		case err == errThumbnailIncomplete:
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case state == "failed":
+			c.JSON(http.StatusInternalServerError, gin.H{"status": state, "error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case state == "generating":
+			c.Header("Retry-After", "5")
+			c.JSON(http.StatusAccepted, gin.H{"status": state})
+		default:
+			return meta, true
+		}
+		return nil, false
+	}
+
+	// 缩略图状态及地址，尚未生成时加入队列并返回202
+	r.GET("/thumbnails/:hash/:file", func(c *gin.Context) {
+		meta, ok := status(c)
+		if !ok {
+			return
+		}
+		base := fmt.Sprintf("/thumbnails/%s/%s", c.Param("hash"), c.Param("file"))
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ready",
+			"poster": base + "/poster.jpg",
+			"sprite": base + "/sprite.jpg",
+			"vtt":    base + "/sprite.vtt",
+			"meta":   meta,
+		})
+	})
+
+	// poster.jpg、sprite.jpg或sprite.vtt
+	r.GET("/thumbnails/:hash/:file/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		if name != "poster.jpg" && name != "sprite.jpg" && name != "sprite.vtt" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "文件不存在"})
+			return
+		}
+		meta, ok := status(c)
+		if !ok {
+			return
+		}
+		if name == "sprite.vtt" {
+			c.Header("Content-Type", "text/vtt; charset=utf-8")
+		}
+		c.File(filepath.Join(th.cacheDir, thumbnailKey(meta.Hash, meta.Path), name))
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestThumbnailSourceExists(t *testing.T) {
+	dir := t.TempDir()
+	th := &ThumbnailService{
+		ts:       &SimpleTorrentService{downloadDir: dir},
+		cacheDir: filepath.Join(dir, ".thumbnails"),
+	}
+	writeMeta := func(key string, meta ThumbnailMeta) {
+		os.MkdirAll(filepath.Join(th.cacheDir, key), 0755)
+		data, _ := json.Marshal(meta)
+		os.WriteFile(filepath.Join(th.cacheDir, key, "meta.json"), data, 0644)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "show"), 0755)
+	os.WriteFile(filepath.Join(dir, "show", "01.mkv"), []byte("x"), 0644)
+	custom := filepath.Join(t.TempDir(), "02.mkv")
+	os.WriteFile(custom, []byte("x"), 0644)
+
+	writeMeta("default", ThumbnailMeta{Path: "show/01.mkv"})
+	writeMeta("custom", ThumbnailMeta{Path: "02.mkv", Source: custom})
+	writeMeta("deleted", ThumbnailMeta{Path: "show/03.mkv"})
+	os.MkdirAll(filepath.Join(th.cacheDir, "broken"), 0755)
+
+	for key, want := range map[string]bool{"default": true, "custom": true, "deleted": false, "broken": false} {
+		if got := th.sourceExists(key); got != want {
+			t.Errorf("sourceExists(%s) = %v, 期望 %v", key, got, want)
+		}
+	}
+}
+
+func TestSpriteVTT(t *testing.T) {
+	vtt := spriteVTT(ThumbnailMeta{Duration: 25, Interval: 10, Tiles: 3, Columns: 2, Rows: 2, TileWidth: 160, TileHeight: 90})
+	for _, want := range []string{
+		"00:00:00.000 --> 00:00:10.000\nsprite.jpg#xywh=0,0,160,90",
+		"00:00:10.000 --> 00:00:20.000\nsprite.jpg#xywh=160,0,160,90",
+		"00:00:20.000 --> 00:00:25.000\nsprite.jpg#xywh=0,90,160,90",
+	} {
+		if !strings.Contains(vtt, want) {
+			t.Errorf("缺少cue: %q\n%s", want, vtt)
+		}
+	}
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -20,14 +19,8 @@ func handleTorrentStream(c *gin.Context, ts *SimpleTorrentService, requestPath s
 	}
 
 	hash := parts[1]
-	filename := strings.Join(parts[2:], "/") // 支持子目录
-
-	// URL解码文件名
-	decodedFilename, err := url.QueryUnescape(filename)
-	if err != nil {
-		log.Printf("URL解码失败: %v", err)
-		decodedFilename = filename
-	}
+	// 路由参数已经过一次URL解码，不能再次解码，否则文件名中的"+"和"%"会被改变
+	decodedFilename := strings.Join(parts[2:], "/") // 支持子目录
 
 	log.Printf("尝试流播放Torrent文件: hash=%s, filename=%s", hash, decodedFilename)
 
@@ -43,68 +36,37 @@ func handleTorrentStream(c *gin.Context, ts *SimpleTorrentService, requestPath s
 		return
 	}
 
-	// 检查是否为视频文件
-	if !isVideoFile(decodedFilename) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "不是视频文件"})
-		return
-	}
-
 	// 获取文件大小
 	fileSize := torrentFile.Length()
-	log.Printf("找到Torrent视频文件: %s, 大小: %d bytes", decodedFilename, fileSize)
+	log.Printf("找到Torrent文件: %s, 大小: %d bytes", decodedFilename, fileSize)
 
 	// 设置基本响应头
-	c.Header("Content-Type", getContentType(decodedFilename))
-	c.Header("Accept-Ranges", "bytes")
 	c.Header("Cache-Control", "no-cache")
 
-	// 预加载文件开头部分以确保可播放
-	preloadAroundPosition(torrentFile, 0, 5*1024*1024) // 预加载前5MB
-
-	// 处理Range请求（支持快进和断点续传）
-	rangeHeader := c.GetHeader("Range")
-	if rangeHeader != "" {
-		// 解析Range请求的位置，预加载该位置周围的数据
-		if strings.Contains(rangeHeader, "bytes=") {
-			ranges := strings.Split(strings.TrimPrefix(rangeHeader, "bytes="), "-")
-			if len(ranges) >= 1 && ranges[0] != "" {
-				if start, parseErr := parseRangeStart(ranges[0]); parseErr == nil {
-					preloadAroundPosition(torrentFile, start, 10*1024*1024) // 预加载10MB窗口
-				}
-			}
-		}
-		handleTorrentRangeRequest(c, torrentFile, rangeHeader)
-	} else {
-		// 普通请求，返回整个文件
-		c.Header("Content-Length", fmt.Sprintf("%d", fileSize))
-		c.Status(http.StatusOK)
-		streamTorrentFile(c, torrentFile)
-	}
-}
+	// 位于文件末尾的moov或MKV索引优先下载，避免播放器等待
+	ts.prioritizeMediaIndex(torrentFile)
 
-// 解析Range起始位置
-func parseRangeStart(rangeStart string) (int64, error) {
-	if rangeStart == "" {
-		return 0, nil
-	}
-	return parseInt64(rangeStart)
-}
-
-// 安全的int64解析
-func parseInt64(s string) (int64, error) {
-	var result int64
-	var err error
-	
-	// 简单的字符串到int64转换
-	for _, char := range s {
-		if char >= '0' && char <= '9' {
-			result = result*10 + int64(char-'0')
+	// 指定跳转时间（?t=秒）时通过关键帧索引找到目标位置，在播放器请求之前开始下载。
+	// 响应内容仍从文件开头（或Range指定的位置）开始，客户端按X-Seek-Offset自行发起Range请求
+	prefetchOffset := int64(-1)
+	if t := c.Query("t"); t != "" {
+		seconds, err := strconv.ParseFloat(t, 64)
+		if err != nil || seconds < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时间"})
+			return
+		}
+		if index, err := ts.SeekIndex(torrentFile); err == nil {
+			point := index.Locate(seconds)
+			prefetchOffset = point.Offset
+			c.Header("X-Seek-Time", strconv.FormatFloat(point.Time, 'f', 3, 64))
+			c.Header("X-Seek-Offset", strconv.FormatInt(point.Offset, 10))
 		} else {
-			return 0, fmt.Errorf("无效的数字: %s", s)
+			log.Printf("关键帧索引不可用: %s, %v", decodedFilename, err)
 		}
 	}
-	
-	return result, err
+
+	// 按码率保持播放位置之后的数据优先下载，请求结束后恢复
+	serveScheduledTorrentFile(c, ts, torrentFile, torrentContentType(c.Request.Context(), torrentFile), prefetchOffset)
 }
 
 // 设置获取正在下载视频文件的API路由
@@ -117,6 +79,69 @@ func setupTorrentRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 		})
 	})
 
+	// 获取任务详情，包含web seed等各来源接收的字节数
+	r.GET("/torrent/:hash", func(c *gin.Context) {
+		detail, err := ts.GetTorrentDetail(c.Param("hash"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, detail)
+	})
+
+	// 运行时添加HTTP镜像（web seed）
+	r.POST("/torrent/:hash/webseeds", func(c *gin.Context) {
+		var req struct {
+			URLs []string `json:"urls"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || len(req.URLs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请提供urls"})
+			return
+		}
+
+		hash := c.Param("hash")
+		if err := ts.AddWebSeeds(hash, req.URLs); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "web seed已添加", "hash": hash})
+	})
+
+	// 固定任务，不参与自动清理
+	r.POST("/torrent/:hash/pin", func(c *gin.Context) {
+		hash := c.Param("hash")
+		if err := ts.SetPinned(hash, true); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "任务已固定", "hash": hash})
+	})
+
+	// 取消固定
+	r.DELETE("/torrent/:hash/pin", func(c *gin.Context) {
+		hash := c.Param("hash")
+		if err := ts.SetPinned(hash, false); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "已取消固定", "hash": hash})
+	})
+
+	// 获取任务事件（完成、解压结果等）
+	r.GET("/torrent/:hash/events", func(c *gin.Context) {
+		hash := c.Param("hash")
+		events, err := ts.GetTaskEvents(hash)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"hash":   hash,
+			"events": events,
+		})
+	})
+
 	// 获取特定torrent的文件列表
 	r.GET("/torrent/:hash/files", func(c *gin.Context) {
 		hash := c.Param("hash")
@@ -135,14 +160,21 @@ func setupTorrentRoutes(r *gin.Engine, ts *SimpleTorrentService) {
 			}
 			playable := isTorrentPositionPlayable(file, 0, bufferSize)
 
-			fileInfos = append(fileInfos, gin.H{
+			fileInfo := gin.H{
 				"path":        file.Path(),
 				"size":        file.Length(),
 				"downloaded":  file.BytesCompleted(),
 				"progress":    float64(file.BytesCompleted()) / float64(file.Length()) * 100,
 				"is_video":    isVideoFile(file.Path()),
 				"playable":    playable,
-			})
+			}
+			// 媒体信息：时长、编码、分辨率及浏览器能否直接播放
+			if isVideoFile(file.Path()) {
+				if media, err := ts.ProbeTorrentFile(file); err == nil {
+					fileInfo["media"] = media
+				}
+			}
+			fileInfos = append(fileInfos, fileInfo)
 		}
 
 		c.JSON(http.StatusOK, gin.H{
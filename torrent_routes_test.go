@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamURL生成的地址经过路由解码后与原路径一致，不能再次解码
+func TestStreamURLRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/stream/*filepath", func(c *gin.Context) {
+		c.String(http.StatusOK, strings.TrimPrefix(c.Param("filepath"), "/"))
+	})
+
+	for _, streamPath := range []string{
+		"torrent/abc/a+b.mkv",
+		"torrent/abc/100% done.mkv",
+		"torrent/abc/%41%2B.mkv",
+		"torrent/abc/第一季/第 01 集 #1?.mp4",
+		"剧集/a+b c.mp4",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, streamURL("", streamPath), nil))
+		if w.Body.String() != streamPath {
+			t.Errorf("streamURL(%q) 解码后为 %q", streamPath, w.Body.String())
+		}
+	}
+}
+
+// 文件名包含"+"和"%"的torrent文件可以通过streamURL播放
+func TestHandleTorrentStreamSpecialCharacters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ts := newTestTorrentService(t)
+	name := "a+b %41.bin"
+	content := []byte("special characters in torrent file name")
+	torrentPath := filepath.Join(t.TempDir(), "special.torrent")
+	if err := os.WriteFile(torrentPath, buildTestTorrent(t, ts.downloadDir, name, content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.DownloadTorrentFile(torrentPath); err != nil {
+		t.Fatalf("添加torrent失败: %v", err)
+	}
+	var hash string
+	ts.mutex.RLock()
+	for h := range ts.torrents {
+		hash = h
+	}
+	ts.mutex.RUnlock()
+
+	r := gin.New()
+	r.GET("/stream/*filepath", func(c *gin.Context) {
+		handleTorrentStream(c, ts, strings.TrimPrefix(c.Param("filepath"), "/"))
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Get(streamURL(server.URL, "torrent/"+hash+"/"+name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != string(content) {
+		t.Fatalf("播放失败: %d %s", resp.StatusCode, body)
+	}
+}
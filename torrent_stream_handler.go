@@ -1,209 +1,94 @@
 package main
 
 import (
+	"context"
 	"io"
-	"log"
-	"time"
 
 	"github.com/anacrolix/torrent"
-	"github.com/gin-gonic/gin"
 )
 
-// 流式传输Torrent文件的指定范围 - 支持边下载边播放
-func streamTorrentRange(c *gin.Context, torrentFile *torrent.File, start int64, contentLength int64) {
-	buffer := make([]byte, 32768) // 32KB缓冲区
-	remaining := contentLength
-	currentPos := start
-
-	log.Printf("开始流式传输Torrent文件: %s, 起始位置: %d, 长度: %d", torrentFile.Path(), start, contentLength)
-
-	for remaining > 0 {
-		// 计算本次读取的大小
-		toRead := int64(len(buffer))
-		if remaining < toRead {
-			toRead = remaining
-		}
-
-		// 等待数据可用 - 智能缓冲策略
-		if !waitForDataAvailable(torrentFile, currentPos, toRead) {
-			log.Printf("等待数据超时，位置: %d", currentPos)
-			break
-		}
-
-		// 创建读取器从指定位置读取
-		reader := torrentFile.NewReader()
-		reader.Seek(currentPos, io.SeekStart)
-
-		// 读取数据
-		n, err := reader.Read(buffer[:toRead])
-		reader.Close()
-
-		if err != nil && err != io.EOF {
-			log.Printf("读取Torrent文件数据失败: %v", err)
-			break
-		}
-		if n == 0 {
-			break
-		}
-
-		// 写入响应并立即刷新
-		if _, writeErr := c.Writer.Write(buffer[:n]); writeErr != nil {
-			log.Printf("写入响应失败: %v", writeErr)
-			break
-		}
-		c.Writer.Flush()
-
-		remaining -= int64(n)
-		currentPos += int64(n)
-
-		// 检查客户端是否断开连接
-		select {
-		case <-c.Request.Context().Done():
-			log.Printf("客户端断开连接")
-			return
-		default:
-		}
-	}
+// 预读范围：刚开始读取或seek后只预读少量数据以尽快返回，连续读取时逐渐增大
+const (
+	minReadahead = 2 * 1024 * 1024
+	maxReadahead = 64 * 1024 * 1024
+)
 
-	log.Printf("Torrent文件流式传输完成")
+// Torrent文件读取器 - 每个请求使用一个长期存在的reader，读取阻塞直到数据可用或请求结束
+type torrentFileReader struct {
+	ctx    context.Context
+	reader torrent.Reader
+	length int64
+	pos    int64
 }
 
-// 等待数据可用 - 智能缓冲策略
-func waitForDataAvailable(torrentFile *torrent.File, position int64, length int64) bool {
-	maxWaitTime := 30 * time.Second
-	checkInterval := 500 * time.Millisecond
-	startTime := time.Now()
-
-	// 计算需要的piece范围
-	pieceLength := torrentFile.Torrent().Info().PieceLength
-	startPiece := int(position / pieceLength)
-	endPiece := int((position + length - 1) / pieceLength)
-
-	log.Printf("等待数据可用: 位置 %d-%d, piece %d-%d", position, position+length-1, startPiece, endPiece)
+func newTorrentFileReader(ctx context.Context, torrentFile *torrent.File, readaheadLimit int64) *torrentFileReader {
+	reader := torrentFile.NewReader()
+	// 数据块到达即可读取，不等待整个piece校验完成
+	reader.SetResponsive()
+	reader.SetReadaheadFunc(adaptiveReadahead(readaheadLimit))
 
-	for time.Since(startTime) < maxWaitTime {
-		allAvailable := true
+	return &torrentFileReader{ctx: ctx, reader: reader, length: torrentFile.Length()}
+}
 
-		// 检查所需的piece是否都已下载
-		for pieceIndex := startPiece; pieceIndex <= endPiece; pieceIndex++ {
-			if pieceIndex >= torrentFile.Torrent().NumPieces() {
-				break
-			}
-			
-			piece := torrentFile.Torrent().Piece(pieceIndex)
-			if !piece.State().Complete {
-				allAvailable = false
-				// 优先下载这个piece
-				piece.SetPriority(torrent.PiecePriorityHigh)
-				log.Printf("等待piece %d下载完成...", pieceIndex)
-				break
-			}
+// 预读大小为连续读取长度的一半，限制在[min(minReadahead, limit), limit]之间
+func adaptiveReadahead(limit int64) torrent.ReadaheadFunc {
+	if limit <= 0 || limit > maxReadahead {
+		limit = maxReadahead
+	}
+	floor := readaheadFloor(limit)
+	return func(rc torrent.ReadaheadContext) int64 {
+		readahead := (rc.CurrentPos - rc.ContiguousReadStartPos) / 2
+		if readahead > limit {
+			readahead = limit
 		}
-
-		if allAvailable {
-			log.Printf("所需数据已可用")
-			return true
+		if readahead < floor {
+			readahead = floor
 		}
-
-		time.Sleep(checkInterval)
+		return readahead
 	}
-
-	log.Printf("等待数据超时")
-	return false
 }
 
-// 流式传输整个Torrent文件 - 支持边下载边播放
-func streamTorrentFile(c *gin.Context, torrentFile *torrent.File) {
-	buffer := make([]byte, 32768) // 32KB缓冲区
-	fileSize := torrentFile.Length()
-	currentPos := int64(0)
-
-	log.Printf("开始流式传输整个Torrent文件: %s, 大小: %d", torrentFile.Path(), fileSize)
-
-	reader := torrentFile.NewReader()
-	defer reader.Close()
-
-	for currentPos < fileSize {
-		// 计算本次读取的大小
-		toRead := int64(len(buffer))
-		if fileSize-currentPos < toRead {
-			toRead = fileSize - currentPos
-		}
-
-		// 等待数据可用
-		if !waitForDataAvailable(torrentFile, currentPos, toRead) {
-			log.Printf("等待数据超时，位置: %d", currentPos)
-			break
-		}
-
-		// 读取数据
-		n, err := reader.Read(buffer[:toRead])
-		if err != nil && err != io.EOF {
-			log.Printf("读取Torrent文件数据失败: %v", err)
-			break
-		}
-		if n == 0 {
-			break
-		}
-
-		// 写入响应并立即刷新
-		if _, writeErr := c.Writer.Write(buffer[:n]); writeErr != nil {
-			log.Printf("写入响应失败: %v", writeErr)
-			break
-		}
-		c.Writer.Flush()
-
-		currentPos += int64(n)
-
-		// 检查客户端是否断开连接
-		select {
-		case <-c.Request.Context().Done():
-			log.Printf("客户端断开连接")
-			return
-		default:
-		}
+// 最小预读，有界缓存的预读上限小于minReadahead时不能超过上限
+func readaheadFloor(limit int64) int64 {
+	if limit > 0 && limit < minReadahead {
+		return limit
 	}
-
-	log.Printf("Torrent文件流式传输完成")
+	return minReadahead
 }
 
-// 预加载策略 - 为快进做准备
-func preloadAroundPosition(torrentFile *torrent.File, position int64, windowSize int64) {
-	pieceLength := torrentFile.Torrent().Info().PieceLength
-	
-	// 计算预加载窗口
-	startPos := position - windowSize/2
-	if startPos < 0 {
-		startPos = 0
+// 单次读取限制在文件剩余长度内，reader在多文件种子中可能读到下一个文件的数据
+func (r *torrentFileReader) Read(b []byte) (int, error) {
+	remaining := r.length - r.pos
+	if remaining <= 0 {
+		return 0, io.EOF
 	}
-	endPos := position + windowSize/2
-	if endPos > torrentFile.Length() {
-		endPos = torrentFile.Length()
+	if int64(len(b)) > remaining {
+		b = b[:remaining]
 	}
+	n, err := r.reader.ReadContext(r.ctx, b)
+	r.pos += int64(n)
+	return n, err
+}
 
-	startPiece := int(startPos / pieceLength)
-	endPiece := int((endPos - 1) / pieceLength)
-
-	log.Printf("预加载位置 %d 周围的数据, piece %d-%d", position, startPiece, endPiece)
-
-	// 设置piece优先级
-	for pieceIndex := startPiece; pieceIndex <= endPiece; pieceIndex++ {
-		if pieceIndex >= torrentFile.Torrent().NumPieces() {
-			break
-		}
-		
-		piece := torrentFile.Torrent().Piece(pieceIndex)
-		if !piece.State().Complete {
-			piece.SetPriority(torrent.PiecePriorityHigh)
-		}
+func (r *torrentFileReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.reader.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
 	}
+	return pos, err
+}
+
+func (r *torrentFileReader) Close() error {
+	return r.reader.Close()
 }
 
 // 检查Torrent文件中的特定位置是否可播放
 func isTorrentPositionPlayable(torrentFile *torrent.File, position int64, bufferSize int64) bool {
 	pieceLength := torrentFile.Torrent().Info().PieceLength
-	startPiece := int(position / pieceLength)
-	endPiece := int((position + bufferSize - 1) / pieceLength)
+	// position是文件内偏移，需加上文件在种子中的偏移
+	offset := torrentFile.Offset() + position
+	startPiece := int(offset / pieceLength)
+	endPiece := int((offset + bufferSize - 1) / pieceLength)
 
 	// 检查关键piece是否已下载
 	for pieceIndex := startPiece; pieceIndex <= endPiece && pieceIndex < torrentFile.Torrent().NumPieces(); pieceIndex++ {
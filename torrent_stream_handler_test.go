@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestAdaptiveReadahead(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      int64
+		contiguous int64
+		want       int64
+	}{
+		{"刚开始读取", maxReadahead, 0, minReadahead},
+		{"连续读取后增大", maxReadahead, 20 << 20, 10 << 20},
+		{"不超过最大预读", maxReadahead, 1 << 30, maxReadahead},
+		{"未设置上限", 0, 1 << 30, maxReadahead},
+		{"上限大于最小预读", 4 << 20, 1 << 30, 4 << 20},
+		{"上限小于最小预读时不超过上限", 1 << 20, 0, 1 << 20},
+		{"上限小于最小预读的连续读取", 1 << 20, 1 << 30, 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := torrent.ReadaheadContext{ContiguousReadStartPos: 100, CurrentPos: 100 + tt.contiguous}
+			if got := adaptiveReadahead(tt.limit)(rc); got != tt.want {
+				t.Fatalf("adaptiveReadahead(%d) = %d, 期望 %d", tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+// 多文件torrent的数据目录和torrent内容
+func buildTestMultiFileTorrent(tb testing.TB, dir string, files map[string][]byte) *metainfo.MetaInfo {
+	root := filepath.Join(dir, "multi")
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), content, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	info := metainfo.Info{PieceLength: 256 * 1024}
+	if err := info.BuildFromFilePath(root); err != nil {
+		tb.Fatal(err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &metainfo.MetaInfo{InfoBytes: infoBytes}
+}
+
+func newTestTorrentClient(tb testing.TB, dataDir string) *torrent.Client {
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.DataDir = dataDir
+	cfg.NoDHT = true
+	cfg.DisableTrackers = true
+	cfg.ListenPort = 0
+	cfg.NoDefaultPortForwarding = true
+	cfg.Seed = true
+	cfg.DisableAcceptRateLimiting = true
+	client, err := torrent.NewClient(cfg)
+	if err != nil {
+		tb.Fatalf("创建torrent客户端失败: %v", err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	return client
+}
+
+func randomTestData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// 读取到文件末尾时不会读到多文件torrent中下一个文件的数据
+func TestTorrentFileReaderStopsAtFileEnd(t *testing.T) {
+	dir := t.TempDir()
+	// 文件边界不与piece对齐
+	first, second := randomTestData(300*1024+17), randomTestData(200*1024)
+	mi := buildTestMultiFileTorrent(t, dir, map[string][]byte{"a.bin": first, "b.bin": second})
+
+	client := newTestTorrentClient(t, dir)
+	tor, err := client.AddTorrent(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tor.GotInfo()
+	tor.VerifyData()
+
+	for _, file := range tor.Files() {
+		want := first
+		if filepath.Base(file.Path()) == "b.bin" {
+			want = second
+		}
+		reader := newTorrentFileReader(context.Background(), file, maxReadahead)
+		// 一次读取超过文件长度的缓冲区
+		buf := make([]byte, 1<<20)
+		var got []byte
+		for {
+			n, err := reader.Read(buf)
+			got = append(got, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		reader.Close()
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: 读取 %d 字节, 期望 %d 字节", file.Path(), len(got), len(want))
+		}
+	}
+}
+
+// 做种客户端拥有完整数据，下载客户端通过本地连接边下边读
+type streamBenchmark struct {
+	b      *testing.B
+	mi     *metainfo.MetaInfo
+	seeder *torrent.Client
+	size   int64
+}
+
+func newStreamBenchmark(b *testing.B, size int) *streamBenchmark {
+	dir := b.TempDir()
+	mi := buildTestMultiFileTorrent(b, dir, map[string][]byte{
+		"video.mkv": randomTestData(size),
+		"extra.nfo": randomTestData(1024),
+	})
+	seeder := newTestTorrentClient(b, dir)
+	tor, err := seeder.AddTorrent(mi)
+	if err != nil {
+		b.Fatal(err)
+	}
+	<-tor.GotInfo()
+	tor.VerifyData()
+	if !tor.Complete.Bool() {
+		b.Fatal("做种数据不完整")
+	}
+	return &streamBenchmark{b: b, mi: mi, seeder: seeder, size: int64(size)}
+}
+
+// 新的下载客户端，返回视频文件
+func (sb *streamBenchmark) leech() *torrent.File {
+	leecher := newTestTorrentClient(sb.b, sb.b.TempDir())
+	tor, err := leecher.AddTorrent(sb.mi)
+	if err != nil {
+		sb.b.Fatal(err)
+	}
+	<-tor.GotInfo()
+	tor.AddClientPeer(sb.seeder)
+	for _, file := range tor.Files() {
+		if filepath.Base(file.Path()) == "video.mkv" {
+			return file
+		}
+	}
+	sb.b.Fatal("找不到视频文件")
+	return nil
+}
+
+// 从零开始边下边读整个文件的吞吐量
+func BenchmarkTorrentStreamThroughput(b *testing.B) {
+	sb := newStreamBenchmark(b, 32<<20)
+	b.SetBytes(sb.size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		file := sb.leech()
+		b.StartTimer()
+
+		reader := newTorrentFileReader(context.Background(), file, maxReadahead)
+		n, err := io.Copy(io.Discard, reader)
+		reader.Close()
+		if err != nil || n != sb.size {
+			b.Fatalf("读取 %d 字节, 错误: %v", n, err)
+		}
+	}
+}
+
+// 播放器请求到收到第一个字节的时间，包括从文件开头和从中间seek两种情况
+func BenchmarkTorrentStreamTimeToFirstByte(b *testing.B) {
+	sb := newStreamBenchmark(b, 32<<20)
+	for _, bench := range []struct {
+		name   string
+		offset int64
+	}{
+		{"开头", 0},
+		{"中间", 16 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var total time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				file := sb.leech()
+				b.StartTimer()
+
+				start := time.Now()
+				reader := newTorrentFileReader(context.Background(), file, maxReadahead)
+				if _, err := reader.Seek(bench.offset, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				buf := make([]byte, 32*1024)
+				if _, err := io.ReadAtLeast(reader, buf, 1); err != nil {
+					b.Fatal(err)
+				}
+				total += time.Since(start)
+				reader.Close()
+			}
+			b.ReportMetric(float64(total.Milliseconds())/float64(b.N), "ms-ttfb")
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/gin-gonic/gin"
+)
+
+// 搜索结果 - 各索引器结果归一化后的格式
+type SearchResult struct {
+	Title      string    `json:"title"`
+	Size       int64     `json:"size"`
+	Seeders    int       `json:"seeders"`
+	Peers      int       `json:"peers"`
+	Category   string    `json:"category"`
+	InfoHash   string    `json:"info_hash,omitempty"`
+	MagnetURL  string    `json:"magnet_url,omitempty"`
+	TorrentURL string    `json:"torrent_url,omitempty"`
+	Details    string    `json:"details,omitempty"`
+	Published  time.Time `json:"published"`
+	Indexers   []string  `json:"indexers"`
+	// 可直接作为 POST /download 的请求体
+	Download gin.H `json:"download"`
+}
+
+// 单个索引器的搜索错误
+type SearchError struct {
+	Indexer string `json:"indexer"`
+	Error   string `json:"error"`
+}
+
+// Torznab/Jackett兼容索引器搜索
+type TorznabSearcher struct {
+	indexers []IndexerConfig
+}
+
+func NewTorznabSearcher(indexers []IndexerConfig) *TorznabSearcher {
+	return &TorznabSearcher{indexers: indexers}
+}
+
+// 出错时根元素为 <error code="" description=""/>
+type torznabDocument struct {
+	XMLName     xml.Name
+	Code        string `xml:"code,attr"`
+	Description string `xml:"description,attr"`
+	Channel     struct {
+		Items []torznabItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type torznabItem struct {
+	Title     string `xml:"title"`
+	GUID      string `xml:"guid"`
+	Link      string `xml:"link"`
+	Comments  string `xml:"comments"`
+	PubDate   string `xml:"pubDate"`
+	Size      string `xml:"size"`
+	Enclosure struct {
+		URL    string `xml:"url,attr"`
+		Length string `xml:"length,attr"`
+	} `xml:"enclosure"`
+	Attrs []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"attr"`
+}
+
+// 索引器API地址，配置中可省略结尾的 /api
+func (idx IndexerConfig) apiURL(params url.Values) string {
+	base := strings.TrimRight(idx.URL, "/")
+	if !strings.HasSuffix(base, "/api") {
+		base += "/api"
+	}
+	if idx.APIKey != "" {
+		params.Set("apikey", idx.APIKey)
+	}
+	return base + "?" + params.Encode()
+}
+
+func (idx IndexerConfig) timeout() time.Duration {
+	if idx.TimeoutSeconds > 0 {
+		return time.Duration(idx.TimeoutSeconds) * time.Second
+	}
+	return 15 * time.Second
+}
+
+func (idx IndexerConfig) enabledFor(names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if strings.EqualFold(name, idx.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// 并行查询所有索引器，按info-hash去重后按做种数排序
+func (s *TorznabSearcher) Search(query string, category string, indexerNames []string) ([]SearchResult, []SearchError) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var all []SearchResult
+	searchErrors := []SearchError{}
+
+	for _, idx := range s.indexers {
+		if !idx.enabledFor(indexerNames) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(idx IndexerConfig) {
+			defer wg.Done()
+
+			params := url.Values{}
+			params.Set("t", "search")
+			params.Set("q", query)
+			if category == "" && len(idx.Categories) > 0 {
+				params.Set("cat", strings.Join(idx.Categories, ","))
+			} else if category != "" {
+				params.Set("cat", category)
+			}
+
+			results, err := s.query(idx, params)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				searchErrors = append(searchErrors, SearchError{Indexer: idx.Name, Error: err.Error()})
+				return
+			}
+			all = append(all, results...)
+		}(idx)
+	}
+	wg.Wait()
+
+	results := dedupeSearchResults(all)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Seeders > results[j].Seeders
+	})
+	return results, searchErrors
+}
+
+// 测试索引器是否可用（请求caps）
+func (s *TorznabSearcher) Test(name string) error {
+	for _, idx := range s.indexers {
+		if idx.Name != name {
+			continue
+		}
+
+		params := url.Values{}
+		params.Set("t", "caps")
+		_, err := s.fetch(idx, params)
+		return err
+	}
+	return fmt.Errorf("索引器不存在: %s", name)
+}
+
+func (s *TorznabSearcher) fetch(idx IndexerConfig, params url.Values) (*torznabDocument, error) {
+	client := &http.Client{Timeout: idx.timeout()}
+	resp, err := client.Get(idx.apiURL(params))
+	if err != nil {
+		return nil, fmt.Errorf("请求索引器失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("请求索引器失败，状态码: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 20*1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("读取索引器响应失败: %v", err)
+	}
+
+	var doc torznabDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("解析索引器响应失败: %v", err)
+	}
+	if doc.XMLName.Local == "error" {
+		return nil, fmt.Errorf("索引器错误 %s: %s", doc.Code, doc.Description)
+	}
+	return &doc, nil
+}
+
+func (s *TorznabSearcher) query(idx IndexerConfig, params url.Values) ([]SearchResult, error) {
+	doc, err := s.fetch(idx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	for _, item := range doc.Channel.Items {
+		results = append(results, normalizeTorznabItem(idx.Name, item))
+	}
+	return results, nil
+}
+
+func normalizeTorznabItem(indexer string, item torznabItem) SearchResult {
+	result := SearchResult{
+		Title:     strings.TrimSpace(item.Title),
+		Details:   item.Comments,
+		Published: parseFeedTime(item.PubDate),
+		Indexers:  []string{indexer},
+	}
+
+	attrs := make(map[string]string)
+	for _, attr := range item.Attrs {
+		// category可能出现多次，保留第一个
+		if _, exists := attrs[attr.Name]; !exists {
+			attrs[attr.Name] = attr.Value
+		}
+	}
+
+	for _, size := range []string{attrs["size"], item.Size, item.Enclosure.Length} {
+		if n, err := strconv.ParseInt(size, 10, 64); err == nil && n > 0 {
+			result.Size = n
+			break
+		}
+	}
+	result.Seeders, _ = strconv.Atoi(attrs["seeders"])
+	result.Peers, _ = strconv.Atoi(attrs["peers"])
+	result.Category = attrs["category"]
+
+	// 下载链接可能是magnet或torrent文件
+	for _, link := range []string{attrs["magneturl"], item.Link, item.Enclosure.URL} {
+		if link == "" {
+			continue
+		}
+		if strings.HasPrefix(link, "magnet:") {
+			if result.MagnetURL == "" {
+				result.MagnetURL = link
+			}
+		} else if result.TorrentURL == "" {
+			result.TorrentURL = link
+		}
+	}
+
+	result.InfoHash = strings.ToLower(attrs["infohash"])
+	if result.InfoHash == "" && result.MagnetURL != "" {
+		if m, err := metainfo.ParseMagnetUri(result.MagnetURL); err == nil {
+			result.InfoHash = m.InfoHash.HexString()
+		}
+	}
+
+	if result.MagnetURL != "" {
+		result.Download = gin.H{"magnet_url": result.MagnetURL}
+	} else {
+		result.Download = gin.H{"torrent_url": result.TorrentURL}
+	}
+	return result
+}
+
+// 按info-hash去重，保留做种数最多的结果并合并来源索引器
+func dedupeSearchResults(results []SearchResult) []SearchResult {
+	deduped := []SearchResult{}
+	byHash := make(map[string]int)
+
+	for _, result := range results {
+		if result.InfoHash == "" {
+			deduped = append(deduped, result)
+			continue
+		}
+
+		i, exists := byHash[result.InfoHash]
+		if !exists {
+			byHash[result.InfoHash] = len(deduped)
+			deduped = append(deduped, result)
+			continue
+		}
+
+		// 复制后追加，避免与原结果共用底层数组
+		indexers := make([]string, 0, len(deduped[i].Indexers)+len(result.Indexers))
+		indexers = append(indexers, deduped[i].Indexers...)
+		indexers = append(indexers, result.Indexers...)
+		if result.Seeders > deduped[i].Seeders {
+			deduped[i] = result
+		}
+		deduped[i].Indexers = indexers
+	}
+
+	return deduped
+}
+
+// 设置搜索路由
+func setupSearchRoutes(r *gin.Engine, searcher *TorznabSearcher) {
+	// 搜索所有索引器: /search?q=...&cat=5000&indexers=a,b
+	r.GET("/search", func(c *gin.Context) {
+		query := strings.TrimSpace(c.Query("q"))
+		if query == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "搜索关键词不能为空"})
+			return
+		}
+
+		var names []string
+		if value := c.Query("indexers"); value != "" {
+			names = strings.Split(value, ",")
+		}
+
+		results, searchErrors := searcher.Search(query, c.Query("cat"), names)
+		c.JSON(http.StatusOK, gin.H{
+			"query":   query,
+			"results": results,
+			"errors":  searchErrors,
+		})
+	})
+
+	// 索引器列表（不包含API key）
+	r.GET("/indexers", func(c *gin.Context) {
+		indexers := []gin.H{}
+		for _, idx := range searcher.indexers {
+			indexers = append(indexers, gin.H{
+				"name":       idx.Name,
+				"url":        idx.URL,
+				"categories": idx.Categories,
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"indexers": indexers})
+	})
+
+	// 测试索引器连接
+	r.POST("/indexers/:name/test", func(c *gin.Context) {
+		if err := searcher.Test(c.Param("name")); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "索引器可用"})
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMagnet = "magnet:?xt=urn:btih:17690e02bc8f7f0a1f9d39cd4bdde5d4e31f5395&dn=seek"
+
+// 解析单个Torznab条目
+func parseTorznabItem(t *testing.T, item string) torznabItem {
+	doc := `<rss xmlns:torznab="http://torznab.com/schemas/2015/feed"><channel>` + item + `</channel></rss>`
+	var parsed torznabDocument
+	if err := xml.Unmarshal([]byte(doc), &parsed); err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if len(parsed.Channel.Items) != 1 {
+		t.Fatalf("条目数 %d", len(parsed.Channel.Items))
+	}
+	return parsed.Channel.Items[0]
+}
+
+func TestNormalizeTorznabItem(t *testing.T) {
+	tests := []struct {
+		name string
+		item string
+		want SearchResult
+	}{
+		{
+			name: "Jackett: magnet属性和torrent链接",
+			item: `<item>
+  <title> Show S01E01 1080p </title>
+  <link>http://indexer/dl/1.torrent</link>
+  <comments>http://indexer/details/1</comments>
+  <pubDate>Mon, 02 Jan 2006 15:04:05 +0000</pubDate>
+  <size>1000</size>
+  <torznab:attr name="category" value="5040"/>
+  <torznab:attr name="category" value="5000"/>
+  <torznab:attr name="seeders" value="12"/>
+  <torznab:attr name="peers" value="20"/>
+  <torznab:attr name="magneturl" value="` + strings.ReplaceAll(testMagnet, "&", "&amp;") + `"/>
+</item>`,
+			want: SearchResult{
+				Title:      "Show S01E01 1080p",
+				Size:       1000,
+				Seeders:    12,
+				Peers:      20,
+				Category:   "5040",
+				InfoHash:   "17690e02bc8f7f0a1f9d39cd4bdde5d4e31f5395",
+				MagnetURL:  testMagnet,
+				TorrentURL: "http://indexer/dl/1.torrent",
+				Details:    "http://indexer/details/1",
+				Published:  time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+			},
+		},
+		{
+			name: "size属性优先，info-hash转为小写",
+			item: `<item>
+  <title>Movie</title>
+  <size>1</size>
+  <enclosure url="http://indexer/dl/2.torrent" length="2" type="application/x-bittorrent"/>
+  <torznab:attr name="size" value="3000"/>
+  <torznab:attr name="infohash" value="ABCDEF0123456789ABCDEF0123456789ABCDEF01"/>
+</item>`,
+			want: SearchResult{
+				Title:      "Movie",
+				Size:       3000,
+				InfoHash:   "abcdef0123456789abcdef0123456789abcdef01",
+				TorrentURL: "http://indexer/dl/2.torrent",
+			},
+		},
+		{
+			name: "只有enclosure时使用其大小和地址",
+			item: `<item>
+  <title>Album</title>
+  <size>0</size>
+  <enclosure url="http://indexer/dl/3.torrent" length="4000" type="application/x-bittorrent"/>
+</item>`,
+			want: SearchResult{
+				Title:      "Album",
+				Size:       4000,
+				TorrentURL: "http://indexer/dl/3.torrent",
+			},
+		},
+		{
+			name: "link为magnet",
+			item: `<item>
+  <title>Magnet only</title>
+  <link>` + strings.ReplaceAll(testMagnet, "&", "&amp;") + `</link>
+</item>`,
+			want: SearchResult{
+				Title:     "Magnet only",
+				InfoHash:  "17690e02bc8f7f0a1f9d39cd4bdde5d4e31f5395",
+				MagnetURL: testMagnet,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeTorznabItem("idx", parseTorznabItem(t, tt.item))
+			if got.Title != tt.want.Title || got.Size != tt.want.Size || got.Seeders != tt.want.Seeders ||
+				got.Peers != tt.want.Peers || got.Category != tt.want.Category || got.InfoHash != tt.want.InfoHash ||
+				got.MagnetURL != tt.want.MagnetURL || got.TorrentURL != tt.want.TorrentURL ||
+				got.Details != tt.want.Details || !got.Published.Equal(tt.want.Published) {
+				t.Fatalf("结果 %+v\n期望 %+v", got, tt.want)
+			}
+			if len(got.Indexers) != 1 || got.Indexers[0] != "idx" {
+				t.Fatalf("索引器 %v", got.Indexers)
+			}
+
+			// 有magnet时优先用magnet添加
+			wantDownload := map[string]interface{}{"torrent_url": tt.want.TorrentURL}
+			if tt.want.MagnetURL != "" {
+				wantDownload = map[string]interface{}{"magnet_url": tt.want.MagnetURL}
+			}
+			if fmt.Sprint(got.Download) != fmt.Sprint(wantDownload) {
+				t.Fatalf("download %v, 期望 %v", got.Download, wantDownload)
+			}
+		})
+	}
+}
+
+func TestIndexerAPIURL(t *testing.T) {
+	tests := []struct {
+		url    string
+		apiKey string
+		want   string
+	}{
+		{"http://jackett:9117/api/v2.0/indexers/all/results/torznab", "key", "http://jackett:9117/api/v2.0/indexers/all/results/torznab/api?apikey=key&t=search"},
+		{"http://indexer/api/", "", "http://indexer/api?t=search"},
+		{"http://indexer", "", "http://indexer/api?t=search"},
+	}
+	for _, tt := range tests {
+		got := IndexerConfig{URL: tt.url, APIKey: tt.apiKey}.apiURL(url.Values{"t": {"search"}})
+		if got != tt.want {
+			t.Errorf("apiURL(%q) = %q, 期望 %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+// 本地模拟的索引器：按路径返回不同的结果
+func newTorznabFixtureServer(t *testing.T) (*httptest.Server, chan url.Values) {
+	queries := make(chan url.Values, 10)
+	item := func(title string, hash string, seeders int) string {
+		return fmt.Sprintf(`<item><title>%s</title><link>http://indexer/%s.torrent</link>
+<torznab:attr name="infohash" value="%s"/><torznab:attr name="seeders" value="%d"/></item>`, title, hash, hash, seeders)
+	}
+	hashA := strings.Repeat("a", 40)
+	hashB := strings.Repeat("b", 40)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Header().Set("Content-Type", "application/rss+xml")
+		switch r.URL.Path {
+		case "/one/api":
+			fmt.Fprintf(w, `<rss xmlns:torznab="http://torznab.com/schemas/2015/feed"><channel>%s%s</channel></rss>`,
+				item("A from one", hashA, 5), item("B from one", hashB, 1))
+		case "/two/api":
+			fmt.Fprintf(w, `<rss xmlns:torznab="http://torznab.com/schemas/2015/feed"><channel>%s</channel></rss>`,
+				item("A from two", hashA, 9))
+		case "/bad/api":
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><error code="100" description="Invalid API Key"/>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, queries
+}
+
+func TestTorznabSearch(t *testing.T) {
+	server, queries := newTorznabFixtureServer(t)
+	searcher := NewTorznabSearcher([]IndexerConfig{
+		{Name: "one", URL: server.URL + "/one", APIKey: "k1", Categories: []string{"5000", "5040"}},
+		{Name: "two", URL: server.URL + "/two/api"},
+		{Name: "bad", URL: server.URL + "/bad"},
+		{Name: "missing", URL: server.URL + "/missing"},
+	})
+
+	results, errs := searcher.Search("show", "", []string{"one", "TWO", "bad"})
+	close(queries)
+
+	// 同一info-hash只保留做种数最多的结果并合并索引器，按做种数排序
+	if len(results) != 2 {
+		t.Fatalf("结果数 %d: %+v", len(results), results)
+	}
+	indexers := results[0].Indexers
+	if results[0].Title != "A from two" || results[0].Seeders != 9 || len(indexers) != 2 || indexers[0] == indexers[1] {
+		t.Fatalf("去重结果 %+v", results[0])
+	}
+	if results[1].Title != "B from one" {
+		t.Fatalf("排序错误 %+v", results[1])
+	}
+
+	// 索引器返回的错误文档作为该索引器的错误，未选择的索引器不查询
+	if len(errs) != 1 || errs[0].Indexer != "bad" || !strings.Contains(errs[0].Error, "Invalid API Key") {
+		t.Fatalf("错误 %+v", errs)
+	}
+
+	count := 0
+	for q := range queries {
+		count++
+		if q.Get("t") != "search" || q.Get("q") != "show" {
+			t.Errorf("查询参数 %v", q)
+		}
+		if q.Get("apikey") == "k1" && q.Get("cat") != "5000,5040" {
+			t.Errorf("应使用索引器的默认分类: %v", q)
+		}
+	}
+	if count != 3 {
+		t.Fatalf("查询了 %d 个索引器", count)
+	}
+}
+
+func TestTorznabTest(t *testing.T) {
+	server, _ := newTorznabFixtureServer(t)
+	searcher := NewTorznabSearcher([]IndexerConfig{
+		{Name: "one", URL: server.URL + "/one"},
+		{Name: "bad", URL: server.URL + "/bad"},
+		{Name: "missing", URL: server.URL + "/missing"},
+	})
+
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"one", ""},
+		{"bad", "Invalid API Key"},
+		{"missing", "404"},
+		{"unknown", "索引器不存在"},
+	}
+	for _, tt := range tests {
+		err := searcher.Test(tt.name)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("Test(%q) = %v, 期望包含 %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDedupeSearchResultsCopiesIndexers(t *testing.T) {
+	hash := strings.Repeat("c", 40)
+	// 第一个结果的索引器切片还有剩余容量
+	shared := make([]string, 1, 4)
+	shared[0] = "one"
+	results := dedupeSearchResults([]SearchResult{
+		{Title: "a", InfoHash: hash, Seeders: 1, Indexers: shared},
+		{Title: "b", InfoHash: hash, Seeders: 2, Indexers: []string{"two"}},
+	})
+	if len(results) != 1 || results[0].Title != "b" || fmt.Sprint(results[0].Indexers) != "[one two]" {
+		t.Fatalf("去重结果 %+v", results)
+	}
+	if shared[:2][1] != "" {
+		t.Fatalf("修改了原结果的底层数组: %v", shared[:2])
+	}
+}
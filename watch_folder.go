@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 监视目录中自动添加.torrent文件，处理后移动到added/或failed/子目录
+func (sts *SimpleTorrentService) watchFolders() {
+	if len(sts.config.WatchDirs) == 0 {
+		return
+	}
+
+	for _, dir := range sts.config.WatchDirs {
+		log.Printf("监视目录: %s (分类: %s, 保存路径: %s)", dir.Path, dir.Category, dir.SavePath)
+	}
+
+	interval := time.Duration(sts.config.WatchIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// 已处理但未能移走的文件，避免每次扫描重复添加
+	processed := make(map[string]time.Time)
+	for {
+		for _, dir := range sts.config.WatchDirs {
+			sts.scanWatchDir(dir, processed)
+		}
+		<-ticker.C
+	}
+}
+
+// 扫描单个监视目录，processed记录移动失败的文件及其修改时间，文件被替换后重新处理
+func (sts *SimpleTorrentService) scanWatchDir(dir WatchDirConfig, processed map[string]time.Time) {
+	entries, err := os.ReadDir(dir.Path)
+	if err != nil {
+		log.Printf("读取监视目录失败: %s, 错误: %v", dir.Path, err)
+		return
+	}
+
+	present := make(map[string]bool)
+	defer func() {
+		// 清理已被删除或移走的文件记录
+		for path := range processed {
+			if filepath.Dir(path) == filepath.Clean(dir.Path) && !present[path] {
+				delete(processed, path)
+			}
+		}
+	}()
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".torrent") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		// 跳过可能仍在写入的文件
+		if time.Since(info.ModTime()) < 2*time.Second {
+			continue
+		}
+
+		torrentPath := filepath.Join(dir.Path, entry.Name())
+		present[torrentPath] = true
+		if modTime, exists := processed[torrentPath]; exists && modTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		opts := AddOptions{
+			Category: dir.Category,
+			SavePath: dir.SavePath,
+		}
+
+		target := "added"
+		if err := sts.DownloadTorrentFileWithOptions(torrentPath, opts); errors.Is(err, errTorrentExists) {
+			log.Printf("监视目录中的torrent任务已存在，跳过: %s", torrentPath)
+		} else if err != nil {
+			log.Printf("监视目录添加torrent失败: %s, 错误: %v", torrentPath, err)
+			target = "failed"
+		} else {
+			log.Printf("监视目录添加torrent成功: %s", torrentPath)
+		}
+
+		if err := moveToSubdir(torrentPath, target); err != nil {
+			log.Printf("移动torrent文件失败: %s, 错误: %v", torrentPath, err)
+			processed[torrentPath] = info.ModTime()
+		} else {
+			delete(processed, torrentPath)
+		}
+	}
+}
+
+// 移动文件到所在目录的子目录，重名时追加时间戳
+func moveToSubdir(path string, subdir string) error {
+	dir := filepath.Join(filepath.Dir(path), subdir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	name := filepath.Base(path)
+	dst := filepath.Join(dir, name)
+	if _, err := os.Stat(dst); err == nil {
+		ext := filepath.Ext(name)
+		dst = filepath.Join(dir, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), time.Now().Unix(), ext))
+	}
+
+	return os.Rename(path, dst)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在监视目录中写入torrent文件，修改时间设为过去以免被当作正在写入
+func writeWatchTorrent(t *testing.T, dir string, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDownloadTorrentFileExisting(t *testing.T) {
+	ts := newTestTorrentService(t)
+	path := writeWatchTorrent(t, t.TempDir(), "a.torrent", testTorrentFile(t, "a.bin"))
+
+	if err := ts.DownloadTorrentFileWithOptions(path, AddOptions{SavePath: "tv"}); err != nil {
+		t.Fatal(err)
+	}
+	ts.mutex.RLock()
+	if len(ts.torrents) != 1 {
+		t.Fatalf("任务数 %d", len(ts.torrents))
+	}
+	var status *TorrentStatus
+	for _, s := range ts.torrents {
+		status = s
+	}
+	ts.mutex.RUnlock()
+
+	// 重复添加返回errTorrentExists，不覆盖状态和保存路径
+	err := ts.DownloadTorrentFileWithOptions(path, AddOptions{SavePath: "movies"})
+	if !errors.Is(err, errTorrentExists) {
+		t.Fatalf("期望errTorrentExists, 实际 %v", err)
+	}
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	for _, s := range ts.torrents {
+		if s != status || s.SavePath != filepath.Join(ts.downloadDir, "tv") {
+			t.Fatalf("状态被覆盖: %+v", s)
+		}
+	}
+}
+
+func TestScanWatchDir(t *testing.T) {
+	ts := newTestTorrentService(t)
+	dir := t.TempDir()
+	data := testTorrentFile(t, "a.bin")
+	processed := make(map[string]time.Time)
+	watch := WatchDirConfig{Path: dir, Category: "tv"}
+
+	path := writeWatchTorrent(t, dir, "a.torrent", data)
+	ts.scanWatchDir(watch, processed)
+	if _, err := os.Stat(filepath.Join(dir, "added", "a.torrent")); err != nil {
+		t.Fatalf("应移动到added/: %v", err)
+	}
+
+	// 已存在的任务视为已添加，文件同样移动到added/
+	writeWatchTorrent(t, dir, "a.torrent", data)
+	ts.scanWatchDir(watch, processed)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("重复的torrent应被移走: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "added"))
+	if len(entries) != 2 {
+		t.Fatalf("added/中文件数 %d", len(entries))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed")); !os.IsNotExist(err) {
+		t.Fatal("重复的torrent不应视为失败")
+	}
+}
+
+func TestScanWatchDirMoveFailure(t *testing.T) {
+	ts := newTestTorrentService(t)
+	dir := t.TempDir()
+	processed := make(map[string]time.Time)
+	watch := WatchDirConfig{Path: dir}
+
+	// added是普通文件时无法创建子目录，移动失败
+	if err := os.WriteFile(filepath.Join(dir, "added"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := writeWatchTorrent(t, dir, "a.torrent", testTorrentFile(t, "a.bin"))
+	ts.scanWatchDir(watch, processed)
+
+	taskCount := func() int {
+		ts.mutex.RLock()
+		defer ts.mutex.RUnlock()
+		return len(ts.torrents)
+	}
+	if taskCount() != 1 {
+		t.Fatalf("任务数 %d", taskCount())
+	}
+	if _, exists := processed[path]; !exists {
+		t.Fatal("移动失败的文件应被记录")
+	}
+
+	// 移除任务后再次扫描，未变化的文件不会重新添加
+	ts.mutex.RLock()
+	var hashes []string
+	for hash := range ts.torrents {
+		hashes = append(hashes, hash)
+	}
+	ts.mutex.RUnlock()
+	for _, hash := range hashes {
+		if err := ts.RemoveDownload(hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts.scanWatchDir(watch, processed)
+	if taskCount() != 0 {
+		t.Fatal("未变化的文件不应重复添加")
+	}
+
+	// 文件被替换后重新处理
+	newer := time.Now().Add(-30 * time.Second)
+	if err := os.Chtimes(path, newer, newer); err != nil {
+		t.Fatal(err)
+	}
+	ts.scanWatchDir(watch, processed)
+	if taskCount() != 1 {
+		t.Fatal("修改后的文件应重新添加")
+	}
+
+	// 文件删除后清理记录
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	ts.scanWatchDir(watch, processed)
+	if len(processed) != 0 {
+		t.Fatalf("删除的文件应清理记录: %v", processed)
+	}
+}
+
+func TestGetDownloadedFilesExternalSavePath(t *testing.T) {
+	ts := newTestTorrentService(t)
+	external := t.TempDir()
+	hash, _ := addTestTorrentStatus(t, ts, "movie.mp4", external)
+	if err := os.WriteFile(filepath.Join(external, "movie.mp4"), []byte("data of movie.mp4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 下载目录中的任务已由目录遍历列出，不重复
+	addTestTorrentStatus(t, ts, "local.bin", "")
+	if err := os.WriteFile(filepath.Join(ts.downloadDir, "local.bin"), []byte("data of local.bin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ts.GetDownloadedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	want := "local.bin,torrent/" + hash + "/movie.mp4"
+	if got := strings.Join(paths, ","); got != want {
+		t.Fatalf("文件列表 %q, 期望 %q", got, want)
+	}
+	if files[1].FileID != playbackFileID("torrent/"+hash+"/movie.mp4") {
+		t.Fatalf("FileID %q", files[1].FileID)
+	}
+}
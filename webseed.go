@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/webseed"
+)
+
+// Web seed (BEP 19) / HTTP镜像来源及其接收的字节数
+type WebSeedSource struct {
+	URL           string    `json:"url"`
+	Origin        string    `json:"origin"` // torrent: 种子或magnet中的ws参数, request: 添加任务时指定, runtime: 运行时添加
+	AddedTime     time.Time `json:"added_time"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// 内部记录，字节数由web seed读取时原子累加
+type webSeedSource struct {
+	url       string
+	origin    string
+	addedTime time.Time
+	bytes     atomic.Int64
+}
+
+// 统计从web seed读取的字节数
+type webSeedCountingReader struct {
+	r      io.Reader
+	source *webSeedSource
+}
+
+func (w *webSeedCountingReader) Read(b []byte) (int, error) {
+	n, err := w.r.Read(b)
+	w.source.bytes.Add(int64(n))
+	return n, err
+}
+
+func countWebSeedBytes(source *webSeedSource) torrent.AddWebSeedsOpt {
+	return func(c *webseed.Client) {
+		inner := c.ResponseBodyWrapper
+		c.ResponseBodyWrapper = func(r io.Reader) io.Reader {
+			if inner != nil {
+				r = inner(r)
+			}
+			return &webSeedCountingReader{r: r, source: source}
+		}
+	}
+}
+
+func validateWebSeedURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("无效的web seed地址: %s", raw)
+	}
+	return nil
+}
+
+// 为torrent添加web seed并统计字节数，调用方需持有锁
+func (sts *SimpleTorrentService) addWebSeedsLocked(t *torrent.Torrent, urls []string, origin string) {
+	hash := t.InfoHash().String()
+
+	for _, u := range urls {
+		if validateWebSeedURL(u) != nil {
+			log.Printf("忽略无效的web seed: %s", u)
+			continue
+		}
+
+		exists := false
+		for _, source := range sts.webSeeds[hash] {
+			if source.url == u {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+
+		source := &webSeedSource{url: u, origin: origin, addedTime: time.Now()}
+		sts.webSeeds[hash] = append(sts.webSeeds[hash], source)
+		t.AddWebSeeds([]string{u}, countWebSeedBytes(source))
+		log.Printf("添加web seed: %s (%s)", u, hash[:8])
+	}
+}
+
+// 运行时为任务添加HTTP镜像
+func (sts *SimpleTorrentService) AddWebSeeds(hash string, urls []string) error {
+	for _, u := range urls {
+		if err := validateWebSeedURL(u); err != nil {
+			return err
+		}
+	}
+
+	sts.mutex.Lock()
+	status, exists := sts.torrents[hash]
+	if !exists {
+		sts.mutex.Unlock()
+		return fmt.Errorf("下载任务不存在")
+	}
+	sts.addWebSeedsLocked(status.Torrent, urls, "runtime")
+	sts.mutex.Unlock()
+
+	sts.addEvent(hash, "webseed", fmt.Sprintf("添加 %d 个web seed", len(urls)))
+	return nil
+}
+
+// 获取任务的web seed来源，调用方需持有锁
+func (sts *SimpleTorrentService) webSeedSourcesLocked(hash string) []WebSeedSource {
+	sources := []WebSeedSource{}
+	for _, source := range sts.webSeeds[hash] {
+		sources = append(sources, WebSeedSource{
+			URL:           source.url,
+			Origin:        source.origin,
+			AddedTime:     source.addedTime,
+			BytesReceived: source.bytes.Load(),
+		})
+	}
+	return sources
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestValidateWebSeedURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"http://mirror.example.com/files/", true},
+		{"https://mirror.example.com/file.mkv", true},
+		{"ftp://mirror.example.com/", false},
+		{"mirror.example.com/files/", false},
+		{"http:///files/", false},
+		{"http://[::1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := validateWebSeedURL(tt.url); (err == nil) != tt.valid {
+			t.Errorf("validateWebSeedURL(%q) = %v, 期望有效: %v", tt.url, err, tt.valid)
+		}
+	}
+}
+
+func webSeedOrigins(t *testing.T, ts *SimpleTorrentService, hash string) map[string]string {
+	detail, err := ts.GetTorrentDetail(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := make(map[string]string)
+	for _, source := range detail.WebSeeds {
+		origins[source.URL] = source.Origin
+	}
+	return origins
+}
+
+// magnet中的ws参数、添加任务时指定和运行时添加的镜像，跳过无效和重复的地址
+func TestWebSeedSources(t *testing.T) {
+	ts := newTestTorrentService(t)
+	hash := strings.Repeat("ab", 20)
+	magnet := "magnet:?xt=urn:btih:" + hash +
+		"&ws=" + "http%3A%2F%2Fa.example.com%2Ffile.mkv" +
+		"&ws=" + "ftp%3A%2F%2Fbad.example.com%2F" +
+		"&ws=" + "http%3A%2F%2Fa.example.com%2Ffile.mkv"
+	opts := AddOptions{WebSeeds: []string{"http://b.example.com/", "http://a.example.com/file.mkv", "not a url"}}
+	if err := ts.DownloadMagnetWithOptions(magnet, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"http://a.example.com/file.mkv": "torrent",
+		"http://b.example.com/":         "request",
+	}
+	if got := webSeedOrigins(t, ts, hash); !reflect.DeepEqual(got, want) {
+		t.Fatalf("web seed %v, 期望 %v", got, want)
+	}
+
+	if err := ts.AddWebSeeds(hash, []string{"https://c.example.com/", "http://b.example.com/"}); err != nil {
+		t.Fatal(err)
+	}
+	want["https://c.example.com/"] = "runtime"
+	if got := webSeedOrigins(t, ts, hash); !reflect.DeepEqual(got, want) {
+		t.Fatalf("web seed %v, 期望 %v", got, want)
+	}
+
+	// 有一个无效地址时不添加任何地址
+	if err := ts.AddWebSeeds(hash, []string{"https://d.example.com/", "ftp://bad/"}); err == nil {
+		t.Fatal("无效的地址应返回错误")
+	}
+	if got := webSeedOrigins(t, ts, hash); len(got) != len(want) {
+		t.Fatalf("web seed %v, 期望 %v", got, want)
+	}
+	if err := ts.AddWebSeeds(strings.Repeat("cd", 20), []string{"https://d.example.com/"}); err == nil {
+		t.Fatal("任务不存在应返回错误")
+	}
+
+	// 移除任务后清除记录
+	if err := ts.RemoveDownload(hash); err != nil {
+		t.Fatal(err)
+	}
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	if _, exists := ts.webSeeds[hash]; exists {
+		t.Fatal("移除任务后应清除web seed记录")
+	}
+}
+
+// 只有web seed一个来源时，数据全部从HTTP镜像下载并计入该镜像的字节数
+func TestWebSeedDownload(t *testing.T) {
+	ts := newTestTorrentService(t)
+	content := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	seedDir := t.TempDir()
+	torrentData := buildTestTorrent(t, seedDir, "mirror.bin", content)
+	torrentPath := filepath.Join(t.TempDir(), "mirror.torrent")
+	if err := os.WriteFile(torrentPath, torrentData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests atomic.Int64
+	fileServer := http.FileServer(http.Dir(seedDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// 单文件torrent的镜像地址以/结尾时，在后面加上文件名
+	if err := ts.DownloadTorrentFileWithOptions(torrentPath, AddOptions{WebSeeds: []string{server.URL + "/"}}); err != nil {
+		t.Fatal(err)
+	}
+	mi, err := metainfo.Load(bytes.NewReader(torrentData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := mi.HashInfoBytes().HexString()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		files, err := ts.GetTorrentFiles(hash)
+		if err == nil && len(files) == 1 && files[0].BytesCompleted() == int64(len(content)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("从web seed下载超时")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	data, err := os.ReadFile(filepath.Join(ts.downloadDir, "mirror.bin"))
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("下载的内容不一致: %v", err)
+	}
+	detail, err := ts.GetTorrentDetail(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.WebSeeds) != 1 || detail.WebSeeds[0].Origin != "request" || detail.WebSeeds[0].BytesReceived < int64(len(content)) {
+		t.Fatalf("web seed %+v, 期望至少 %d 字节", detail.WebSeeds, len(content))
+	}
+	if requests.Load() == 0 {
+		t.Fatal("没有请求web seed")
+	}
+}